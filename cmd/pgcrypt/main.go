@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/pgsdf/pgmount/config"
+	"github.com/pgsdf/pgmount/device"
+	"github.com/pgsdf/pgmount/prompt"
+)
+
+// Size of generated keyfiles, as in the geli(8) examples
+const keyFileSize = 64
+
+// keyFileList collects the keyfiles given with -k, in order
+type keyFileList []string
+
+func (k *keyFileList) String() string { return strings.Join(*k, ",") }
+
+func (k *keyFileList) Set(path string) error {
+	*k = append(*k, path)
+	return nil
+}
+
+var (
+	cryptType    = flag.String("t", defaultCryptType(), "Encryption type: geli or luks")
+	generateKeys = flag.Bool("generate-keys", false, "Create the keyfiles given with -k from random data")
+	noPassphrase = flag.Bool("P", false, "Use the keyfiles only, without a passphrase")
+	fsType       = flag.String("fs", defaultFilesystem(), "Filesystem to create on the encrypted device, or \"none\"")
+	label        = flag.String("L", "", "Label of the filesystem (and of the LUKS container)")
+	configFile   = flag.String("config", "", "Path to configuration file")
+	noConfig     = flag.Bool("no-config", false, "Don't register the keyfiles in a config file")
+	assumeYes    = flag.Bool("y", false, "Don't ask for confirmation")
+	verbose      = flag.Bool("v", false, "Verbose output")
+	keyFiles     keyFileList
+)
+
+func init() {
+	flag.Var(&keyFiles, "k", "Keyfile, repeated for several GELI keyfiles")
+}
+
+func main() {
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: pgcrypt [-t geli|luks] [-k keyfile]... [--generate-keys] [-P] [-fs fstype] [-L label] [-y] <device|UUID=|LABEL=|...>\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	if *cryptType != "geli" && *cryptType != "luks" {
+		log.Fatalf("Unknown encryption type %q, use geli or luks", *cryptType)
+	}
+	if *noPassphrase && len(keyFiles) == 0 {
+		log.Fatal("-P needs a keyfile, given with -k")
+	}
+	if *cryptType == "luks" && len(keyFiles) > 1 {
+		log.Fatal("LUKS takes a single keyfile")
+	}
+
+	// Initialize device manager
+	mgr := device.NewManager()
+	if _, err := mgr.Scan(); err != nil {
+		log.Fatalf("Failed to scan devices: %v", err)
+	}
+
+	dev, err := mgr.Resolve(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := checkDevice(mgr, &dev); err != nil {
+		log.Fatalf("Refusing to encrypt %s: %v", dev.Path, err)
+	}
+	// GELI providers are registered by what the disk keeps, not their UUID
+	if *cryptType == "geli" && !*noConfig && len(keyFiles) > 0 {
+		if _, err := geliEntry(&dev); err != nil {
+			log.Fatalf("Refusing to encrypt %s: %v, use -no-config", dev.Path, err)
+		}
+	}
+
+	fmt.Println(describe(&dev))
+	if !*assumeYes {
+		tty := &prompt.TTY{In: os.Stdin, Out: os.Stdout}
+		ok, err := tty.Confirm(prompt.Request{
+			Description: fmt.Sprintf("All data on %s will be destroyed. Encrypt it with %s?", dev.Path, *cryptType),
+		})
+		if err != nil || !ok {
+			fmt.Println("Nothing was changed")
+			os.Exit(1)
+		}
+	}
+
+	if *generateKeys {
+		for _, path := range keyFiles {
+			if err := generateKeyFile(path); err != nil {
+				log.Fatalf("Failed to create keyfile: %v", err)
+			}
+			fmt.Printf("Created keyfile %s\n", path)
+		}
+	}
+
+	key := device.Key{KeyFiles: keyFiles}
+	if !*noPassphrase {
+		key.Passphrase, err = newPassphrase()
+		if err != nil {
+			log.Fatalf("Failed to read the passphrase: %v", err)
+		}
+		defer clear(key.Passphrase)
+	}
+
+	if *verbose {
+		log.Printf("Encrypting %s with %s", dev.Path, *cryptType)
+	}
+	if err := device.Encrypt(&dev, *cryptType, key, *label); err != nil {
+		log.Fatalf("Failed to encrypt device: %v", err)
+	}
+	fmt.Printf("Encrypted %s with %s\n", dev.Path, *cryptType)
+
+	// Read the new header, which holds the UUID of a LUKS container
+	encrypted, err := mgr.Probe(dev.Path)
+	if err != nil {
+		log.Fatalf("Failed to probe %s: %v", dev.Path, err)
+	}
+
+	if *fsType != "none" {
+		if err := createFilesystem(mgr, &encrypted, key); err != nil {
+			log.Fatalf("Failed to create filesystem: %v", err)
+		}
+		fmt.Printf("Created %s filesystem on %s\n", *fsType, dev.Path)
+	}
+
+	if !*noConfig && len(keyFiles) > 0 {
+		path, err := register(&encrypted, key)
+		if err != nil {
+			log.Fatalf("Failed to register keyfiles: %v", err)
+		}
+		fmt.Printf("Registered the keyfiles of %s in %s\n", dev.Path, path)
+	}
+}
+
+// defaultCryptType returns the encryption the system has tools for
+func defaultCryptType() string {
+	if runtime.GOOS == "freebsd" {
+		return "geli"
+	}
+	return "luks"
+}
+
+// defaultFilesystem returns the native filesystem of the system
+func defaultFilesystem() string {
+	if runtime.GOOS == "freebsd" {
+		return "ufs"
+	}
+	return "ext4"
+}
+
+// checkDevice refuses devices that are not removable, and devices that
+// are in use themselves or through a device stacked on them
+func checkDevice(mgr *device.Manager, dev *device.Device) error {
+	if !dev.IsRemovable {
+		return fmt.Errorf("it is not a removable device")
+	}
+	if dev.IsOptical {
+		return fmt.Errorf("it is an optical drive")
+	}
+	return checkUnused(mgr, dev)
+}
+
+// checkUnused fails if dev or any device stacked on it is in use
+func checkUnused(mgr *device.Manager, dev *device.Device) error {
+	switch {
+	case dev.IsMounted:
+		return fmt.Errorf("%s is mounted at %s", dev.Path, dev.MountPoint)
+	case dev.Pool != "":
+		return fmt.Errorf("%s belongs to the imported pool %s", dev.Path, dev.Pool)
+	case dev.IsEncrypted && dev.IsUnlocked:
+		return fmt.Errorf("%s is unlocked", dev.Path)
+	}
+	for _, path := range dev.Children {
+		if child, ok := mgr.GetDevice(path); ok {
+			if err := checkUnused(mgr, &child); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// describe sums up the device for the confirmation
+func describe(dev *device.Device) string {
+	parts := []string{}
+	if name := strings.TrimSpace(dev.Vendor + " " + dev.Model); name != "" {
+		parts = append(parts, name)
+	}
+	if dev.Label != "" {
+		parts = append(parts, "label "+dev.Label)
+	}
+	if dev.FSType != "" {
+		parts = append(parts, dev.FSType)
+	}
+	parts = append(parts, formatSize(dev.Size))
+	return fmt.Sprintf("%s: %s", dev.Path, strings.Join(parts, ", "))
+}
+
+// generateKeyFile writes a keyfile of random data that only its owner can
+// read. An existing file is never overwritten.
+func generateKeyFile(path string) error {
+	key := make([]byte, keyFileSize)
+	defer clear(key)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0400)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(key); err != nil {
+		file.Close()
+		os.Remove(path)
+		return err
+	}
+	return file.Close()
+}
+
+// newPassphrase asks for the new passphrase twice on the terminal
+func newPassphrase() ([]byte, error) {
+	if !prompt.IsTerminal(os.Stdin) {
+		return nil, fmt.Errorf("not attached to a terminal")
+	}
+	tty := &prompt.TTY{In: os.Stdin, Out: os.Stderr}
+
+	retry := ""
+	for {
+		passphrase, err := tty.GetPassphrase(prompt.Request{Prompt: "New passphrase:", Error: retry})
+		if err != nil {
+			return nil, err
+		}
+		if len(passphrase) == 0 {
+			retry = "The passphrase cannot be empty"
+			continue
+		}
+		again, err := tty.GetPassphrase(prompt.Request{Prompt: "Repeat passphrase:"})
+		if err != nil {
+			clear(passphrase)
+			return nil, err
+		}
+		match := bytes.Equal(passphrase, again)
+		clear(again)
+		if match {
+			return passphrase, nil
+		}
+		clear(passphrase)
+		retry = "The passphrases do not match, please try again"
+	}
+}
+
+// createFilesystem unlocks the new container, creates the filesystem on
+// its cleartext device and locks it again
+func createFilesystem(mgr *device.Manager, dev *device.Device, key device.Key) error {
+	key.NoPassphrase = key.Passphrase == nil
+	cleartext, err := mgr.Unlock(dev.Path, key, device.UnlockOptions{})
+	if err != nil {
+		return err
+	}
+
+	if *verbose {
+		log.Printf("Creating %s filesystem on %s", *fsType, cleartext.Path)
+	}
+	err = device.MakeFilesystem(&cleartext, *fsType, *label)
+	if lockErr := mgr.Lock(dev.Path); lockErr != nil && err == nil {
+		err = lockErr
+	}
+	return err
+}
+
+// geliEntry returns a device_config entry that matches the GELI provider
+// on dev wherever it is plugged in: by partition GUID or, for a whole disk,
+// by serial number. A partition without a GUID shares its serial number
+// with the other partitions of its disk, so it has no entry.
+func geliEntry(dev *device.Device) (config.DeviceConfig, error) {
+	switch {
+	case dev.PartUUID != "":
+		return config.DeviceConfig{IDPartUUID: dev.PartUUID}, nil
+	case dev.Serial != "" && !dev.IsPartition:
+		return config.DeviceConfig{IDSerial: dev.Serial}, nil
+	}
+	return config.DeviceConfig{}, fmt.Errorf("%s has no partition GUID or serial number to be found by", dev.Path)
+}
+
+// register adds the keyfiles of the new device to the configuration and
+// returns its path. The keyfile of a LUKS container goes in the keyfiles of
+// the encryption section, by UUID. GELI providers have no UUID and get a
+// geli entry in device_config instead, see geliEntry.
+func register(dev *device.Device, key device.Key) (string, error) {
+	path := *configFile
+	if path == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("failed to get home directory: %w", err)
+		}
+		path = homeDir + "/.config/pgmount/config.yml"
+	}
+
+	cfg := config.Default()
+	if _, err := os.Stat(path); err == nil {
+		if cfg, err = config.Load(path); err != nil {
+			return "", err
+		}
+	}
+
+	if dev.UUID != "" {
+		if cfg.Encryption.KeyFiles == nil {
+			cfg.Encryption.KeyFiles = make(map[string]string)
+		}
+		cfg.Encryption.KeyFiles[dev.UUID] = key.KeyFiles[0]
+	} else {
+		entry, err := geliEntry(dev)
+		if err != nil {
+			return "", err
+		}
+		entry.GELI = &config.GELIProviderConfig{KeyFiles: key.KeyFiles, Passphrase: key.Passphrase != nil}
+		found := false
+		for i := range cfg.Devices {
+			existing := &cfg.Devices[i]
+			if existing.IDPartUUID == entry.IDPartUUID && existing.IDSerial == entry.IDSerial {
+				existing.GELI = entry.GELI
+				found = true
+			}
+		}
+		if !found {
+			cfg.Devices = append(cfg.Devices, entry)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", fmt.Errorf("failed to create config directory: %w", err)
+	}
+	return path, cfg.Save(path)
+}
+
+func formatSize(bytes uint64) string {
+	const (
+		KB = 1024
+		MB = KB * 1024
+		GB = MB * 1024
+		TB = GB * 1024
+	)
+
+	switch {
+	case bytes >= TB:
+		return fmt.Sprintf("%.2f TB", float64(bytes)/float64(TB))
+	case bytes >= GB:
+		return fmt.Sprintf("%.2f GB", float64(bytes)/float64(GB))
+	case bytes >= MB:
+		return fmt.Sprintf("%.2f MB", float64(bytes)/float64(MB))
+	case bytes >= KB:
+		return fmt.Sprintf("%.2f KB", float64(bytes)/float64(KB))
+	default:
+		return fmt.Sprintf("%d B", bytes)
+	}
+}
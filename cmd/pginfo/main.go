@@ -27,6 +27,18 @@ func main() {
 		log.Fatalf("Failed to scan devices: %v", err)
 	}
 
+	// Only show the devices given on the command line, if any
+	if flag.NArg() > 0 {
+		devices = devices[:0]
+		for _, spec := range flag.Args() {
+			dev, err := mgr.Resolve(spec)
+			if err != nil {
+				log.Fatal(err)
+			}
+			devices = append(devices, dev)
+		}
+	}
+
 	if len(devices) == 0 {
 		fmt.Println("No removable devices found")
 		return
@@ -36,21 +48,21 @@ func main() {
 	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
 
 	if *verbose {
-		fmt.Fprintln(w, "DEVICE\tLABEL\tUUID\tFSTYPE\tSIZE\tMOUNTED\tMOUNT POINT\tENCRYPTED")
-		fmt.Fprintln(w, "------\t-----\t----\t------\t----\t-------\t-----------\t---------")
+		fmt.Fprintln(w, "DEVICE\tLABEL\tUUID\tFSTYPE\tSIZE\tMOUNTED\tMOUNT POINT\tUSED\tFREE\tTOTAL\tINODES\tENCRYPTED\tPART TYPE\tBUS\tVENDOR\tMODEL\tSERIAL\tWWN\tUSB ID\tPORT")
+		fmt.Fprintln(w, "------\t-----\t----\t------\t----\t-------\t-----------\t----\t----\t-----\t------\t---------\t---------\t---\t------\t-----\t------\t---\t------\t----")
 	} else {
-		fmt.Fprintln(w, "DEVICE\tLABEL\tMOUNTED\tMOUNT POINT")
-		fmt.Fprintln(w, "------\t-----\t-------\t-----------")
+		fmt.Fprintln(w, "DEVICE\tLABEL\tMOUNTED\tMOUNT POINT\tFREE")
+		fmt.Fprintln(w, "------\t-----\t-------\t-----------\t----")
 	}
 
 	for _, dev := range devices {
 		// Skip non-partitions unless showing all
-		if !dev.IsPartition && !*showAll {
+		if !dev.IsMountable() && !*showAll && flag.NArg() == 0 {
 			continue
 		}
 
 		if *verbose {
-			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%v\t%s\t%v\n",
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%v\t%s\t%s\t%s\t%s\t%s\t%v\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
 				dev.Path,
 				dev.Label,
 				truncateString(dev.UUID, 8),
@@ -58,7 +70,19 @@ func main() {
 				formatSize(dev.Size),
 				dev.IsMounted,
 				dev.MountPoint,
+				usageSize(dev, dev.Used),
+				usageSize(dev, dev.Free),
+				usageSize(dev, dev.Total),
+				inodes(dev),
 				dev.IsEncrypted,
+				partitionType(dev),
+				dev.Bus,
+				dev.Vendor,
+				dev.Model,
+				dev.Serial,
+				dev.WWN,
+				dev.USBID(),
+				dev.PortPath,
 			)
 		} else {
 			mounted := "No"
@@ -70,12 +94,21 @@ func main() {
 			if label == "" {
 				label = dev.Name
 			}
+			if !dev.MediaPresent {
+				label = "(no media)"
+			}
+
+			free := ""
+			if dev.Total > 0 {
+				free = fmt.Sprintf("%s (%.0f%%)", formatSize(dev.Free), dev.FreePercent())
+			}
 
-			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n",
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
 				dev.Path,
 				label,
 				mounted,
 				dev.MountPoint,
+				free,
 			)
 		}
 	}
@@ -83,6 +116,32 @@ func main() {
 	w.Flush()
 }
 
+// partitionType returns the friendly name of a partition's type, or the
+// raw type id if the type is not known
+func partitionType(dev device.Device) string {
+	if dev.PartitionTypeName != "" {
+		return dev.PartitionTypeName
+	}
+	return dev.PartitionType
+}
+
+// usageSize formats a space statistic, which is only known while the
+// device is mounted
+func usageSize(dev device.Device, bytes uint64) string {
+	if dev.Total == 0 {
+		return ""
+	}
+	return formatSize(bytes)
+}
+
+// inodes formats the used and total number of inodes
+func inodes(dev device.Device) string {
+	if dev.Inodes == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d/%d", dev.Inodes-dev.InodesFree, dev.Inodes)
+}
+
 func truncateString(s string, maxLen int) string {
 	if len(s) <= maxLen {
 		return s
@@ -7,6 +7,7 @@ import (
 	"os"
 	"os/exec"
 	"strings"
+	"time"
 
 	"github.com/pgsdf/pgmount/config"
 	"github.com/pgsdf/pgmount/device"
@@ -19,6 +20,7 @@ var (
 	noConfig   = flag.Bool("no-config", false, "Don't use any config file")
 	fsType     = flag.String("t", "", "Filesystem type")
 	options    = flag.String("o", "", "Mount options (comma-separated)")
+	image      = flag.String("image", "", "Attach a disk image or ISO file and mount its filesystems")
 )
 
 func main() {
@@ -42,8 +44,8 @@ func main() {
 
 		mounted := 0
 		for _, dev := range devices {
-			if dev.IsPartition && !dev.IsMounted {
-				if err := mountDevice(cfg, dev); err != nil {
+			if dev.IsMountable() && !dev.IsMounted {
+				if err := mountDevice(cfg, &dev); err != nil {
 					fmt.Fprintf(os.Stderr, "Failed to mount %s: %v\n", dev.Path, err)
 				} else {
 					mounted++
@@ -56,9 +58,17 @@ func main() {
 		return
 	}
 
+	if *image != "" {
+		if err := mountImage(cfg, mgr, *image); err != nil {
+			log.Fatalf("Failed to mount image: %v", err)
+		}
+		return
+	}
+
 	// Mount specific device
 	if flag.NArg() < 1 {
-		fmt.Fprintf(os.Stderr, "Usage: pgmount [-a] [-t fstype] [-o options] <device>\n")
+		fmt.Fprintf(os.Stderr, "Usage: pgmount [-a] [-t fstype] [-o options] <device|UUID=|LABEL=|...>\n")
+		fmt.Fprintf(os.Stderr, "       pgmount [-t fstype] [-o options] --image <file>\n")
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
@@ -66,23 +76,15 @@ func main() {
 	devicePath := flag.Arg(0)
 
 	// Scan for the device
-	devices, err := mgr.Scan()
-	if err != nil {
+	if _, err := mgr.Scan(); err != nil {
 		log.Fatalf("Failed to scan devices: %v", err)
 	}
 
-	var targetDev *device.Device
-	for _, dev := range devices {
-		if dev.Path == devicePath || dev.Name == devicePath ||
-			"/dev/"+dev.Name == devicePath {
-			targetDev = dev
-			break
-		}
-	}
-
-	if targetDev == nil {
-		log.Fatalf("Device not found: %s", devicePath)
+	dev, err := mgr.Resolve(devicePath)
+	if err != nil {
+		log.Fatal(err)
 	}
+	targetDev := &dev
 
 	if targetDev.IsMounted {
 		log.Fatalf("Device already mounted at %s", targetDev.MountPoint)
@@ -95,6 +97,71 @@ func main() {
 	fmt.Printf("Mounted %s at %s\n", targetDev.Path, targetDev.MountPoint)
 }
 
+// mountImage attaches an image file and mounts every filesystem in it. The
+// image is detached again if none of them could be mounted.
+func mountImage(cfg *config.Config, mgr *device.Manager, path string) error {
+	devPath, err := device.AttachImage(path)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Attached %s as %s\n", path, devPath)
+
+	mounted := 0
+	for _, dev := range waitForImage(mgr, devPath) {
+		if dev.IsMounted {
+			// e.g. automounted by pgmountd in the meantime
+			mounted++
+			continue
+		}
+		if cfg.ShouldIgnore(dev.Identity()) {
+			continue
+		}
+		if err := mountDevice(cfg, &dev); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to mount %s: %v\n", dev.Path, err)
+			continue
+		}
+		mounted++
+		fmt.Printf("Mounted %s at %s\n", dev.Path, dev.MountPoint)
+	}
+
+	if mounted == 0 {
+		if err := device.DetachImage(devPath); err != nil {
+			log.Printf("Failed to detach %s: %v", devPath, err)
+		}
+		return fmt.Errorf("no filesystem found in %s", path)
+	}
+	return nil
+}
+
+// waitForImage returns the filesystems of a newly attached image,
+// giving the kernel a moment to find its partitions
+func waitForImage(mgr *device.Manager, devPath string) []device.Device {
+	var found []device.Device
+	for attempt := 0; attempt < 20; attempt++ {
+		devices, err := mgr.Scan()
+		if err != nil {
+			log.Fatalf("Failed to scan devices: %v", err)
+		}
+
+		found = found[:0]
+		inImage := map[string]bool{devPath: true}
+		for _, dev := range devices {
+			// Parents are listed before their partitions
+			if inImage[dev.Parent] {
+				inImage[dev.Path] = true
+			}
+			if inImage[dev.Path] && dev.IsMountable() && dev.FSType != "" {
+				found = append(found, dev)
+			}
+		}
+		if len(found) > 0 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return found
+}
+
 func loadConfig() (*config.Config, error) {
 	if *noConfig {
 		return config.Default(), nil
@@ -117,6 +184,10 @@ func loadConfig() (*config.Config, error) {
 }
 
 func mountDevice(cfg *config.Config, dev *device.Device) error {
+	if dev.IsPoolMember() {
+		return importPool(cfg, dev)
+	}
+
 	// Determine mount point
 	mountPoint := dev.GetMountDirectory(cfg.MountBase)
 
@@ -126,7 +197,7 @@ func mountDevice(cfg *config.Config, dev *device.Device) error {
 	}
 
 	// Get mount options
-	opts := cfg.GetMountOptions(dev.FSType, dev.Label, dev.UUID, dev.Path)
+	opts := cfg.MountOptionsFor(dev.FSType, dev.Identity())
 
 	// Override with command-line options
 	if *options != "" {
@@ -134,7 +205,7 @@ func mountDevice(cfg *config.Config, dev *device.Device) error {
 	}
 
 	// Override filesystem type
-	fs := dev.FSType
+	fs := dev.MountType()
 	if *fsType != "" {
 		fs = *fsType
 	}
@@ -164,3 +235,45 @@ func mountDevice(cfg *config.Config, dev *device.Device) error {
 
 	return nil
 }
+
+// importPool imports the ZFS pool of a device instead of mounting it
+func importPool(cfg *config.Config, dev *device.Device) error {
+	if !cfg.ZFS.Enabled {
+		return fmt.Errorf("ZFS support is disabled")
+	}
+
+	opts := device.PoolImportOptions{
+		MountBase: cfg.MountBase,
+		ReadOnly:  cfg.ZFS.ReadOnly,
+		NoMount:   cfg.ZFS.NoMount,
+		Rename:    cfg.ZFS.OnConflict != "refuse",
+	}
+
+	mountOpts := cfg.MountOptionsFor(dev.FSType, dev.Identity())
+	if *options != "" {
+		mountOpts = strings.Split(*options, ",")
+	}
+	for _, opt := range mountOpts {
+		if opt == "ro" || opt == "readonly" {
+			opts.ReadOnly = true
+		}
+	}
+
+	if *verbose {
+		log.Printf("Importing pool %s (%s)", dev.Label, dev.UUID)
+	}
+
+	pool, mountPoint, err := device.ImportPool(dev, opts)
+	if err != nil {
+		return err
+	}
+	if pool != dev.Label {
+		fmt.Printf("Pool %s is imported as %s, the name is already in use\n", dev.Label, pool)
+	}
+
+	dev.Pool = pool
+	dev.MountPoint = mountPoint
+	dev.IsMounted = true
+
+	return nil
+}
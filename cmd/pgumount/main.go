@@ -1,11 +1,15 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
 
 	"github.com/pgsdf/pgmount/device"
 )
@@ -13,6 +17,8 @@ import (
 var (
 	unmountAll = flag.Bool("a", false, "Unmount all mounted devices")
 	detach     = flag.Bool("detach", false, "Also detach/eject the device after unmounting")
+	lock       = flag.Bool("lock", false, "Also lock the encrypted device after unmounting")
+	forget     = flag.Bool("forget-passwords", false, "Make pgmountd forget cached passwords")
 	force      = flag.Bool("f", false, "Force unmount")
 	verbose    = flag.Bool("v", false, "Verbose output")
 )
@@ -20,6 +26,16 @@ var (
 func main() {
 	flag.Parse()
 
+	if *forget {
+		if err := forgetPasswords(); err != nil {
+			log.Fatalf("Failed to forget passwords: %v", err)
+		}
+		fmt.Println("Cached passwords forgotten")
+		if !*unmountAll && flag.NArg() == 0 {
+			return
+		}
+	}
+
 	// Initialize device manager
 	mgr := device.NewManager()
 
@@ -33,15 +49,16 @@ func main() {
 		unmounted := 0
 		for _, dev := range devices {
 			if dev.IsMounted {
-				if err := unmountDevice(dev); err != nil {
+				if err := unmountDevice(&dev); err != nil {
 					fmt.Fprintf(os.Stderr, "Failed to unmount %s: %v\n", dev.Path, err)
 				} else {
 					unmounted++
 					fmt.Printf("Unmounted %s\n", dev.Path)
+					released := releaseDevice(mgr, &dev)
 
 					if *detach {
-						if err := detachDevice(dev); err != nil {
-							fmt.Fprintf(os.Stderr, "Failed to detach %s: %v\n", dev.Path, err)
+						if err := detachDevice(mgr, released); err != nil {
+							fmt.Fprintf(os.Stderr, "Failed to detach %s: %v\n", released.Path, err)
 						}
 					}
 				}
@@ -54,7 +71,7 @@ func main() {
 
 	// Unmount specific device or mount point
 	if flag.NArg() < 1 {
-		fmt.Fprintf(os.Stderr, "Usage: pgumount [-a] [--detach] [-f] <device|mountpoint>\n")
+		fmt.Fprintf(os.Stderr, "Usage: pgumount [-a] [--detach] [--lock] [--forget-passwords] [-f] <device|mountpoint|UUID=|LABEL=|...>\n")
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
@@ -62,59 +79,98 @@ func main() {
 	target := flag.Arg(0)
 
 	// Scan for the device
-	devices, err := mgr.Scan()
-	if err != nil {
+	if _, err := mgr.Scan(); err != nil {
 		log.Fatalf("Failed to scan devices: %v", err)
 	}
 
-	var targetDev *device.Device
-	for _, dev := range devices {
-		if dev.Path == target || dev.Name == target ||
-			"/dev/"+dev.Name == target || dev.MountPoint == target {
-			targetDev = dev
-			break
-		}
+	dev, err := mgr.Resolve(target)
+	if err != nil {
+		log.Fatal(err)
 	}
+	targetDev := &dev
 
-	if targetDev == nil {
-		log.Fatalf("Device not found: %s", target)
+	// An unlocked encrypted device is unmounted through its cleartext device
+	if targetDev.IsEncrypted && targetDev.IsUnlocked && len(targetDev.Children) > 0 {
+		if cleartext, ok := mgr.GetDevice(targetDev.Children[0]); ok && cleartext.IsMounted {
+			targetDev = &cleartext
+		}
 	}
 
-	if !targetDev.IsMounted {
+	// Ejecting needs no mount, e.g. a disc that was never mounted
+	if targetDev.IsMounted {
+		if err := unmountDevice(targetDev); err != nil {
+			log.Fatalf("Failed to unmount device: %v", err)
+		}
+		fmt.Printf("Unmounted %s\n", targetDev.Path)
+		targetDev = releaseDevice(mgr, targetDev)
+	} else if targetDev.IsEncrypted && targetDev.IsUnlocked && (*lock || *detach) {
+		// Unlocked but not mounted
+		if err := lockDevice(mgr, targetDev); err != nil {
+			log.Fatalf("Failed to lock device: %v", err)
+		}
+	} else if !*detach {
 		log.Fatalf("Device not mounted: %s", targetDev.Path)
 	}
 
-	if err := unmountDevice(targetDev); err != nil {
-		log.Fatalf("Failed to unmount device: %v", err)
-	}
-
-	fmt.Printf("Unmounted %s\n", targetDev.Path)
-
 	if *detach {
-		if err := detachDevice(targetDev); err != nil {
+		if err := detachDevice(mgr, targetDev); err != nil {
 			log.Fatalf("Failed to detach device: %v", err)
 		}
 		fmt.Printf("Detached %s\n", targetDev.Path)
 	}
 }
 
+// forgetPasswords asks the running pgmountd to drop its cached passwords
+func forgetPasswords() error {
+	output, err := exec.Command("pkill", "-USR1", "-x", "pgmountd").CombinedOutput()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+			return fmt.Errorf("pgmountd is not running")
+		}
+		return fmt.Errorf("pkill failed: %w (output: %s)", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// unmountDevice unmounts every mount of a device, newest first so that
+// bind mounts go before the mount they were made from
 func unmountDevice(dev *device.Device) error {
-	args := []string{}
+	// Exporting a pool unmounts all of its datasets
+	if dev.Pool != "" {
+		if *verbose {
+			log.Printf("Running: zpool export %s", dev.Pool)
+		}
+		return device.ExportPool(dev.Pool)
+	}
 
-	if *force {
-		args = append(args, "-f")
+	mountPoints := []string{}
+	for _, entry := range dev.Mounts {
+		mountPoints = append(mountPoints, entry.MountPoint)
+	}
+	if len(mountPoints) == 0 {
+		mountPoints = append(mountPoints, dev.MountPoint)
 	}
 
-	args = append(args, dev.MountPoint)
+	for i := len(mountPoints) - 1; i >= 0; i-- {
+		args := []string{}
 
-	if *verbose {
-		log.Printf("Running: umount %v", args)
-	}
+		if *force {
+			args = append(args, "-f")
+		}
+
+		args = append(args, mountPoints[i])
+
+		if *verbose {
+			log.Printf("Running: umount %v", args)
+		}
+
+		cmd := exec.Command("umount", args...)
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("unmount failed: %w (output: %s)", err, string(output))
+		}
 
-	cmd := exec.Command("umount", args...)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("unmount failed: %w (output: %s)", err, string(output))
 	}
 
 	// Remove mount point directory if empty
@@ -123,19 +179,63 @@ func unmountDevice(dev *device.Device) error {
 	return nil
 }
 
-func detachDevice(dev *device.Device) error {
+// releaseDevice runs once dev is unmounted. With --lock or --detach it
+// locks the encrypted device that dev is the cleartext device of. It then
+// detaches the loop or md device of an image once its last filesystem is
+// unmounted. It returns the device left behind for --detach, which is the
+// encrypted device once that is locked.
+func releaseDevice(mgr *device.Manager, dev *device.Device) *device.Device {
+	mgr.SetMounted(dev.Path, "")
+
+	released := dev
+	if *lock || *detach {
+		if parent, ok := mgr.GetDevice(dev.Parent); ok && parent.IsEncrypted && parent.IsUnlocked {
+			if err := lockDevice(mgr, &parent); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to lock %s: %v\n", parent.Path, err)
+			} else {
+				released = &parent
+			}
+		}
+	}
+
+	if err := mgr.DetachIdleImage(released.Path); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to detach image of %s: %v\n", released.Path, err)
+	}
+	return released
+}
+
+// lockDevice locks an unlocked encrypted device
+func lockDevice(mgr *device.Manager, dev *device.Device) error {
+	if *verbose {
+		log.Printf("Locking %s", dev.Path)
+	}
+	if err := mgr.Lock(dev.Path); err != nil {
+		return err
+	}
+	fmt.Printf("Locked %s\n", dev.Path)
+	return nil
+}
+
+func detachDevice(mgr *device.Manager, dev *device.Device) error {
 	// For USB devices, we can use camcontrol to eject/detach
 	if *verbose {
 		log.Printf("Detaching device %s", dev.Name)
 	}
 
-	// Get the disk name (strip partition number)
+	if dev.IsOptical {
+		return ejectDisc(dev)
+	}
+
+	// Get the disk name; filesystems on the whole disk are the disk itself
 	diskName := dev.Name
-	// Simple heuristic: if name ends with a digit preceded by 'p', strip it
-	if len(diskName) > 2 {
-		if diskName[len(diskName)-2] == 'p' {
-			diskName = diskName[:len(diskName)-2]
-		}
+	if dev.Parent != "" {
+		diskName = filepath.Base(dev.Parent)
+	}
+
+	// Images are detached from their loop or md device instead, unless
+	// that already happened when their last filesystem was unmounted
+	if strings.HasPrefix(diskName, "loop") || strings.HasPrefix(diskName, "md") {
+		return mgr.DetachIdleImage(dev.Path)
 	}
 
 	// Try to eject using camcontrol
@@ -152,3 +252,17 @@ func detachDevice(dev *device.Device) error {
 
 	return nil
 }
+
+// ejectDisc opens the tray of an optical drive
+func ejectDisc(dev *device.Device) error {
+	cmd := exec.Command("eject", dev.Path)
+	if runtime.GOOS == "freebsd" {
+		cmd = exec.Command("cdcontrol", "-f", dev.Path, "eject")
+	}
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("eject failed: %w (output: %s)", err, string(output))
+	}
+	return nil
+}
@@ -3,6 +3,7 @@ package config
 import (
 	"fmt"
 	"os"
+	"strings"
 
 	"gopkg.in/yaml.v3"
 )
@@ -19,7 +20,12 @@ type Config struct {
 	Devices       []DeviceConfig      `yaml:"device_config"`
 	EventHooks    map[string]string   `yaml:"event_hooks"`
 	MountOptions  MountOptionsConfig  `yaml:"mount_options"`
-	GELI          GELIConfig          `yaml:"geli"`
+	Encryption    EncryptionConfig    `yaml:"encryption"`
+	ZFS           ZFSConfig           `yaml:"zfs"`
+
+	// Percentage of free space below which a mounted device is reported
+	// as low on space; 0 disables the check
+	LowSpaceThreshold float64 `yaml:"low_space_threshold"`
 }
 
 // NotificationConfig contains notification settings
@@ -33,6 +39,7 @@ type NotificationConfig struct {
 	DeviceUnlocked   float64 `yaml:"device_unlocked"`
 	DeviceLocked     float64 `yaml:"device_locked"`
 	JobFailed        float64 `yaml:"job_failed"`
+	SpaceLow         float64 `yaml:"space_low"`
 }
 
 // TrayConfig contains tray icon settings
@@ -42,14 +49,40 @@ type TrayConfig struct {
 	IconName string `yaml:"icon_name"`
 }
 
-// DeviceConfig contains per-device configuration
+// DeviceConfig contains per-device configuration. An entry applies when its
+// label, UUID, GPT partition GUID or path matches, or when all of the hardware and partition
+// type keys it sets (vendor, model, serial, WWN, bus, USB ID, port,
+// partition type) match.
 type DeviceConfig struct {
 	IDLabel    string   `yaml:"id_label"`
 	IDUUID     string   `yaml:"id_uuid"`
 	DevicePath string   `yaml:"device_path"`
+	IDPartUUID string   `yaml:"id_part_uuid,omitempty"` // GPT partition GUID, for GELI providers
+	IDVendor   string   `yaml:"id_vendor,omitempty"`
+	IDModel    string   `yaml:"id_model,omitempty"`
+	IDSerial   string   `yaml:"id_serial,omitempty"`
+	IDWWN      string   `yaml:"id_wwn,omitempty"`
+	IDBus      string   `yaml:"id_bus,omitempty"`
+	IDUSB      string   `yaml:"id_usb,omitempty"`       // "vendor:product", e.g. "0951:1666"
+	IDPort     string   `yaml:"id_port,omitempty"`      // Physical port path, e.g. "1-2.3"
+	IDPartType string   `yaml:"id_part_type,omitempty"` // Type GUID, MBR id or name, e.g. "efi"
 	Ignore     bool     `yaml:"ignore"`
 	Automount  *bool    `yaml:"automount,omitempty"`
+	AutoLock   *bool    `yaml:"auto_lock,omitempty"` // Lock the encrypted device once it is unmounted
 	Options    []string `yaml:"options"`
+	// VeraCrypt personal iterations multiplier, if the volume uses one
+	VeraCryptPIM int `yaml:"veracrypt_pim,omitempty"`
+	// How to attach a GELI provider with several keyfiles, a passphrase
+	// and keyfiles, or metadata kept apart
+	GELI *GELIProviderConfig `yaml:"geli,omitempty"`
+}
+
+// GELIProviderConfig describes how a GELI provider is attached. Without a
+// passphrase it is attached with geli attach -p.
+type GELIProviderConfig struct {
+	KeyFiles       []string `yaml:"keyfiles"`        // In the order they were given to geli init, may be on a key device
+	Passphrase     bool     `yaml:"passphrase"`      // The passphrase is needed along with the keyfiles
+	MetadataBackup string   `yaml:"metadata_backup"` // geli backup file, restored when the provider has no metadata
 }
 
 // MountOptionsConfig contains default mount options
@@ -57,12 +90,28 @@ type MountOptionsConfig struct {
 	Default map[string][]string `yaml:"default"`
 }
 
-// GELIConfig contains GELI encryption settings
-type GELIConfig struct {
-	Enabled      bool              `yaml:"enabled"`
-	PasswordCmd  string            `yaml:"password_cmd"`
-	CacheTimeout int               `yaml:"cache_timeout"`
-	KeyFiles     map[string]string `yaml:"keyfiles"`
+// EncryptionConfig contains settings for unlocking GELI and LUKS devices
+type EncryptionConfig struct {
+	Enabled          bool              `yaml:"enabled"`
+	PasswordCmd      string            `yaml:"password_cmd"`
+	Pinentry         string            `yaml:"pinentry"` // Prompt program, by default gpg-agent's or "pinentry"
+	CacheTimeout     int               `yaml:"cache_timeout"`
+	Keyring          bool              `yaml:"keyring"`            // Look up and remember passwords with the Secret Service
+	KeyFiles         map[string]string `yaml:"keyfiles"`           // By UUID or path of the encrypted device
+	KeyDeviceTimeout int               `yaml:"key_device_timeout"` // Seconds to wait for a key device to be plugged in
+	AutoLock         bool              `yaml:"auto_lock"`          // Lock devices once their filesystem is unmounted
+}
+
+// GELIConfig is the encryption section of configurations written before
+// LUKS support, which is still read from the "geli" key
+type GELIConfig = EncryptionConfig
+
+// ZFSConfig contains settings for ZFS pools on removable disks
+type ZFSConfig struct {
+	Enabled    bool   `yaml:"enabled"`
+	ReadOnly   bool   `yaml:"readonly"`    // Import pools read-only
+	NoMount    bool   `yaml:"no_mount"`    // Import without mounting datasets (zpool import -N)
+	OnConflict string `yaml:"on_conflict"` // "rename" or "refuse" a pool named like an imported one
 }
 
 // Default returns a default configuration
@@ -83,6 +132,7 @@ func Default() *Config {
 			DeviceUnlocked:  -1.0,
 			DeviceLocked:    -1.0,
 			JobFailed:       -1.0,
+			SpaceLow:        5.0,
 		},
 		Tray: TrayConfig{
 			Enabled:  false,
@@ -101,14 +151,24 @@ func Default() *Config {
 				"ufs":   {},
 				"zfs":   {},
 				"msdos": {"locale=en_US.UTF-8", "longnames"},
+				// Discs are read-only media
+				"iso9660": {"ro"},
+				"udf":     {"ro"},
 			},
 		},
-		GELI: GELIConfig{
-			Enabled:      true,
-			PasswordCmd:  "",
-			CacheTimeout: 0,
-			KeyFiles:     make(map[string]string),
+		Encryption: EncryptionConfig{
+			Enabled:          true,
+			PasswordCmd:      "",
+			CacheTimeout:     0,
+			KeyFiles:         make(map[string]string),
+			KeyDeviceTimeout: 30,
+			AutoLock:         true,
+		},
+		ZFS: ZFSConfig{
+			Enabled:    true,
+			OnConflict: "rename",
 		},
+		LowSpaceThreshold: 10,
 	}
 }
 
@@ -123,10 +183,44 @@ func Load(path string) (*Config, error) {
 	if err := yaml.Unmarshal(data, cfg); err != nil {
 		return nil, fmt.Errorf("failed to parse config file: %w", err)
 	}
+	if err := loadLegacyGELI(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
 
 	return cfg, nil
 }
 
+// loadLegacyGELI applies a "geli" section from before LUKS support. It
+// stands in for a missing "encryption" section; otherwise only its keyfiles
+// are added to those of the encryption section.
+func loadLegacyGELI(data []byte, cfg *Config) error {
+	var sections struct {
+		GELI       yaml.Node `yaml:"geli"`
+		Encryption yaml.Node `yaml:"encryption"`
+	}
+	if err := yaml.Unmarshal(data, &sections); err != nil || sections.GELI.IsZero() {
+		return err
+	}
+
+	if sections.Encryption.IsZero() {
+		return sections.GELI.Decode(&cfg.Encryption)
+	}
+
+	var legacy GELIConfig
+	if err := sections.GELI.Decode(&legacy); err != nil {
+		return err
+	}
+	if cfg.Encryption.KeyFiles == nil {
+		cfg.Encryption.KeyFiles = make(map[string]string)
+	}
+	for id, keyfile := range legacy.KeyFiles {
+		if _, ok := cfg.Encryption.KeyFiles[id]; !ok {
+			cfg.Encryption.KeyFiles[id] = keyfile
+		}
+	}
+	return nil
+}
+
 // Save writes the configuration to a file
 func (c *Config) Save(path string) error {
 	data, err := yaml.Marshal(c)
@@ -143,45 +237,135 @@ func (c *Config) Save(path string) error {
 	return nil
 }
 
+// DeviceIdentity holds the properties a device is matched on
+type DeviceIdentity struct {
+	Label    string
+	UUID     string
+	PartUUID string // GPT unique partition GUID
+	Path     string
+	Vendor   string
+	Model    string
+	Serial   string
+	WWN      string
+	Bus      string
+	USBID    string
+	PortPath string
+
+	PartitionType     string // Type GUID or MBR id
+	PartitionTypeName string // e.g. "efi"
+	SystemPartition   bool   // EFI, swap, recovery or reserved partition
+}
+
 // GetDeviceConfig returns the configuration for a specific device
 func (c *Config) GetDeviceConfig(label, uuid, path string) *DeviceConfig {
+	return c.DeviceConfigFor(DeviceIdentity{Label: label, UUID: uuid, Path: path})
+}
+
+// DeviceConfigFor returns the first configuration entry matching a device
+func (c *Config) DeviceConfigFor(id DeviceIdentity) *DeviceConfig {
 	for i := range c.Devices {
 		dev := &c.Devices[i]
-		if dev.IDLabel != "" && dev.IDLabel == label {
+		if dev.IDLabel != "" && dev.IDLabel == id.Label {
 			return dev
 		}
-		if dev.IDUUID != "" && dev.IDUUID == uuid {
+		if dev.IDUUID != "" && dev.IDUUID == id.UUID {
 			return dev
 		}
-		if dev.DevicePath != "" && dev.DevicePath == path {
+		if dev.IDPartUUID != "" && strings.EqualFold(dev.IDPartUUID, id.PartUUID) {
+			return dev
+		}
+		if dev.DevicePath != "" && dev.DevicePath == id.Path {
+			return dev
+		}
+		if dev.matchesHardware(id) {
 			return dev
 		}
 	}
 	return nil
 }
 
+// matchesHardware reports whether all hardware and partition type keys set
+// on the entry match
+func (d *DeviceConfig) matchesHardware(id DeviceIdentity) bool {
+	matched := false
+	if d.IDPartType != "" {
+		if !strings.EqualFold(d.IDPartType, id.PartitionType) &&
+			!strings.EqualFold(d.IDPartType, id.PartitionTypeName) {
+			return false
+		}
+		matched = true
+	}
+
+	keys := []struct{ want, got string }{
+		{d.IDVendor, id.Vendor},
+		{d.IDModel, id.Model},
+		{d.IDSerial, id.Serial},
+		{d.IDWWN, id.WWN},
+		{d.IDBus, id.Bus},
+		{d.IDUSB, id.USBID},
+		{d.IDPort, id.PortPath},
+	}
+
+	for _, key := range keys {
+		if key.want == "" {
+			continue
+		}
+		if !strings.EqualFold(key.want, key.got) {
+			return false
+		}
+		matched = true
+	}
+	return matched
+}
+
 // ShouldIgnoreDevice checks if a device should be ignored
 func (c *Config) ShouldIgnoreDevice(label, uuid, path string) bool {
-	devCfg := c.GetDeviceConfig(label, uuid, path)
+	return c.ShouldIgnore(DeviceIdentity{Label: label, UUID: uuid, Path: path})
+}
+
+// ShouldIgnore checks if a device should be ignored. System partitions
+// (EFI, swap, recovery, reserved) are ignored unless an entry matches them.
+func (c *Config) ShouldIgnore(id DeviceIdentity) bool {
+	devCfg := c.DeviceConfigFor(id)
 	if devCfg != nil {
 		return devCfg.Ignore
 	}
-	return false
+	return id.SystemPartition
 }
 
 // ShouldAutomountDevice checks if a device should be automounted
 func (c *Config) ShouldAutomountDevice(label, uuid, path string) bool {
-	devCfg := c.GetDeviceConfig(label, uuid, path)
+	return c.ShouldAutomount(DeviceIdentity{Label: label, UUID: uuid, Path: path})
+}
+
+// ShouldAutomount checks if a device should be automounted
+func (c *Config) ShouldAutomount(id DeviceIdentity) bool {
+	devCfg := c.DeviceConfigFor(id)
 	if devCfg != nil && devCfg.Automount != nil {
 		return *devCfg.Automount
 	}
 	return c.Automount
 }
 
+// ShouldAutoLock returns whether an encrypted device is locked once its
+// filesystem is unmounted
+func (c *Config) ShouldAutoLock(id DeviceIdentity) bool {
+	devCfg := c.DeviceConfigFor(id)
+	if devCfg != nil && devCfg.AutoLock != nil {
+		return *devCfg.AutoLock
+	}
+	return c.Encryption.AutoLock
+}
+
 // GetMountOptions returns mount options for a device
 func (c *Config) GetMountOptions(fstype string, label, uuid, path string) []string {
+	return c.MountOptionsFor(fstype, DeviceIdentity{Label: label, UUID: uuid, Path: path})
+}
+
+// MountOptionsFor returns mount options for a device
+func (c *Config) MountOptionsFor(fstype string, id DeviceIdentity) []string {
 	// Check device-specific options first
-	devCfg := c.GetDeviceConfig(label, uuid, path)
+	devCfg := c.DeviceConfigFor(id)
 	if devCfg != nil && len(devCfg.Options) > 0 {
 		return devCfg.Options
 	}
@@ -193,3 +377,15 @@ func (c *Config) GetMountOptions(fstype string, label, uuid, path string) []stri
 
 	return []string{}
 }
+
+// KeyFileFor returns the keyfile configured for an encrypted device, looked
+// up by UUID and then by path, since GELI providers have no UUID
+func (e *EncryptionConfig) KeyFileFor(id DeviceIdentity) (string, bool) {
+	if id.UUID != "" {
+		if keyfile, ok := e.KeyFiles[id.UUID]; ok {
+			return keyfile, true
+		}
+	}
+	keyfile, ok := e.KeyFiles[id.Path]
+	return keyfile, ok
+}
@@ -113,6 +113,13 @@ func TestGetDeviceConfig(t *testing.T) {
 		t.Error("Should find device by UUID")
 	}
 
+	// Test finding by partition GUID, which GELI providers are matched by
+	cfg.Devices = append(cfg.Devices, DeviceConfig{IDPartUUID: "5E2A91B0-6C1D-4F2E-9A3B-7C8D9E0F1A2B"})
+	devCfg = cfg.DeviceConfigFor(DeviceIdentity{PartUUID: "5e2a91b0-6c1d-4f2e-9a3b-7c8d9e0f1a2b", Path: "/dev/da0p1"})
+	if devCfg == nil || devCfg.IDPartUUID == "" {
+		t.Error("Should find device by partition GUID")
+	}
+
 	// Test not finding device
 	devCfg = cfg.GetDeviceConfig("NONEXISTENT", "", "")
 	if devCfg != nil {
@@ -120,6 +127,60 @@ func TestGetDeviceConfig(t *testing.T) {
 	}
 }
 
+func TestDeviceConfigForHardware(t *testing.T) {
+	cfg := Default()
+	cfg.Devices = []DeviceConfig{
+		{
+			IDVendor: "Kingston",
+			IDSerial: "60A44C413A7CF3B1",
+			Options:  []string{"ro"},
+		},
+		{
+			IDUSB:  "0781:5581",
+			Ignore: true,
+		},
+	}
+
+	kingston := DeviceIdentity{Vendor: "Kingston", Model: "DataTraveler 3.0", Serial: "60A44C413A7CF3B1", Bus: "usb"}
+	devCfg := cfg.DeviceConfigFor(kingston)
+	if devCfg == nil || devCfg.Options[0] != "ro" {
+		t.Error("Should find device by vendor and serial")
+	}
+
+	// An identical stick with a different serial must not match
+	kingston.Serial = "60A44C413A7CF3B2"
+	if cfg.DeviceConfigFor(kingston) != nil {
+		t.Error("All hardware keys of an entry should have to match")
+	}
+
+	if !cfg.ShouldIgnore(DeviceIdentity{USBID: "0781:5581"}) {
+		t.Error("Should ignore device by USB ID")
+	}
+	if cfg.ShouldIgnore(DeviceIdentity{}) {
+		t.Error("Entries without hardware keys should not match everything")
+	}
+}
+
+func TestShouldIgnoreSystemPartition(t *testing.T) {
+	cfg := Default()
+	efi := DeviceIdentity{Path: "/dev/da0p1", PartitionType: "c12a7328-f81f-11d2-ba4b-00a0c93ec93b",
+		PartitionTypeName: "efi", SystemPartition: true}
+	if !cfg.ShouldIgnore(efi) {
+		t.Error("Should ignore system partitions by default")
+	}
+
+	cfg.Devices = []DeviceConfig{{IDPartType: "EFI", Options: []string{"ro"}}}
+	if cfg.ShouldIgnore(efi) {
+		t.Error("An id_part_type entry should override the system partition policy")
+	}
+	if cfg.ShouldIgnore(DeviceIdentity{PartitionTypeName: "ms-basic-data"}) {
+		t.Error("Should not ignore data partitions")
+	}
+	if cfg.DeviceConfigFor(DeviceIdentity{PartitionType: "0c", PartitionTypeName: "fat32lba"}) != nil {
+		t.Error("id_part_type should only match its own type")
+	}
+}
+
 func TestShouldIgnoreDevice(t *testing.T) {
 	cfg := Default()
 	cfg.Devices = []DeviceConfig{
@@ -205,3 +266,117 @@ func TestGetMountOptions(t *testing.T) {
 		t.Error("Should return empty options for unknown filesystem")
 	}
 }
+
+func TestLoadLegacyGELIConfig(t *testing.T) {
+	dir := t.TempDir()
+
+	legacy := dir + "/legacy.yml"
+	content := `
+geli:
+  password_cmd: "pass show usb"
+  keyfiles:
+    "/dev/da0p1": /root/keys/da0p1.key
+`
+	if err := os.WriteFile(legacy, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := Load(legacy)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if !cfg.Encryption.Enabled {
+		t.Error("Encryption should stay enabled by default")
+	}
+	if cfg.Encryption.PasswordCmd != "pass show usb" {
+		t.Errorf("Password command should come from the geli section, got %q", cfg.Encryption.PasswordCmd)
+	}
+	if keyfile, ok := cfg.Encryption.KeyFileFor(DeviceIdentity{Path: "/dev/da0p1"}); !ok || keyfile != "/root/keys/da0p1.key" {
+		t.Errorf("Expected the keyfile of /dev/da0p1, got %q", keyfile)
+	}
+
+	both := dir + "/both.yml"
+	content = `
+encryption:
+  password_cmd: "pass show disk"
+  keyfiles:
+    "1111": /root/keys/new.key
+geli:
+  password_cmd: "pass show usb"
+  keyfiles:
+    "1111": /root/keys/old.key
+    "2222": /root/keys/other.key
+`
+	if err := os.WriteFile(both, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err = Load(both)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if cfg.Encryption.PasswordCmd != "pass show disk" {
+		t.Errorf("The encryption section should win, got %q", cfg.Encryption.PasswordCmd)
+	}
+	if cfg.Encryption.KeyFiles["1111"] != "/root/keys/new.key" || cfg.Encryption.KeyFiles["2222"] != "/root/keys/other.key" {
+		t.Errorf("Unexpected keyfiles: %v", cfg.Encryption.KeyFiles)
+	}
+}
+
+func TestLoadGELIProviderConfig(t *testing.T) {
+	path := t.TempDir() + "/config.yml"
+	content := `
+device_config:
+  - device_path: /dev/da0p1
+    geli:
+      keyfiles:
+        - /root/keys/da0p1.0.key
+        - uuid:1234-ABCD:/da0p1.1.key
+      passphrase: true
+      metadata_backup: /var/backups/da0p1.eli
+geli:
+  keyfiles:
+    "/dev/da1p1": /root/keys/da1p1.key
+`
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	devCfg := cfg.DeviceConfigFor(DeviceIdentity{Path: "/dev/da0p1"})
+	if devCfg == nil || devCfg.GELI == nil {
+		t.Fatal("Expected a geli entry for /dev/da0p1")
+	}
+	geli := devCfg.GELI
+	if len(geli.KeyFiles) != 2 || geli.KeyFiles[1] != "uuid:1234-ABCD:/da0p1.1.key" || !geli.Passphrase ||
+		geli.MetadataBackup != "/var/backups/da0p1.eli" {
+		t.Errorf("Unexpected geli entry %+v", geli)
+	}
+	// The geli section of old configurations is read as before
+	if _, ok := cfg.Encryption.KeyFileFor(DeviceIdentity{Path: "/dev/da1p1"}); !ok {
+		t.Error("Expected the keyfile of /dev/da1p1")
+	}
+}
+
+func TestShouldAutoLock(t *testing.T) {
+	cfg := Default()
+	keepOpen := false
+	cfg.Devices = []DeviceConfig{
+		{IDUUID: "1111", AutoLock: &keepOpen},
+	}
+
+	if !cfg.ShouldAutoLock(DeviceIdentity{UUID: "2222"}) {
+		t.Error("Encrypted devices should be locked after unmounting by default")
+	}
+	if cfg.ShouldAutoLock(DeviceIdentity{UUID: "1111"}) {
+		t.Error("auto_lock: false should keep the device unlocked")
+	}
+
+	cfg.Encryption.AutoLock = false
+	if cfg.ShouldAutoLock(DeviceIdentity{UUID: "2222"}) {
+		t.Error("The encryption section should turn auto-locking off")
+	}
+}
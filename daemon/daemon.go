@@ -1,12 +1,13 @@
 package daemon
 
 import (
-	"bufio"
+	"bytes"
 	"fmt"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -15,6 +16,7 @@ import (
 	"github.com/pgsdf/pgmount/config"
 	"github.com/pgsdf/pgmount/device"
 	"github.com/pgsdf/pgmount/notify"
+	"github.com/pgsdf/pgmount/prompt"
 )
 
 // Daemon handles automounting and device events
@@ -26,17 +28,51 @@ type Daemon struct {
 	stopChan          chan struct{}
 	wg                sync.WaitGroup
 	mu                sync.Mutex
-	mounted           map[string]*device.Device
+	mounted           map[string]device.Device
+	ownMounts         map[string]ownMount // Mount points the daemon set or cleared, until the next whole scan
 	onDeviceChangedFn func() // Callback for device changes
+	pollInterval      time.Duration
+	lowSpace          map[string]bool // Devices reported as low on space, owned by pollDevices
+	passwords         *passwordCache  // Passphrases of encrypted devices by stable ID
+	prompter          prompt.Prompter // Asks for passwords, chosen when needed if nil
+	keyring           Keyring         // Stored passwords, nil unless encryption.keyring is set
 }
 
+// ownMount is a mount point the daemon set or cleared on a device
+type ownMount struct {
+	mountPoint string
+	scanned    bool // A whole scan ran since it was recorded
+}
+
+// Keyring stores passwords of encrypted devices by device.Device.StableID,
+// see keyring.SecretService
+type Keyring interface {
+	// Lookup returns the password stored for id, or nil if there is none
+	Lookup(id string) ([]byte, error)
+	// Store saves the password for id under a label shown to the user
+	Store(id, label string, password []byte) error
+}
+
+// Number of times a wrong password is prompted for again
+const passwordAttempts = 3
+
 // New creates a new daemon instance
 func New(cfg *config.Config) (*Daemon, error) {
+	return NewWithManager(cfg, device.NewManager())
+}
+
+// NewWithManager creates a new daemon instance using the given device
+// manager, e.g. one backed by a device.FakeBackend in tests
+func NewWithManager(cfg *config.Config, mgr *device.Manager) (*Daemon, error) {
 	return &Daemon{
-		config:    cfg,
-		deviceMgr: device.NewManager(),
-		stopChan:  make(chan struct{}),
-		mounted:   make(map[string]*device.Device),
+		config:       cfg,
+		deviceMgr:    mgr,
+		stopChan:     make(chan struct{}),
+		mounted:      make(map[string]device.Device),
+		ownMounts:    make(map[string]ownMount),
+		pollInterval: 2 * time.Second,
+		lowSpace:     make(map[string]bool),
+		passwords:    newPasswordCache(time.Duration(cfg.Encryption.CacheTimeout) * time.Second),
 	}, nil
 }
 
@@ -64,6 +100,15 @@ func (d *Daemon) Stop() {
 	log.Println("Stopping daemon...")
 	close(d.stopChan)
 	d.wg.Wait()
+	d.passwords.Flush()
+}
+
+// ForgetPasswords drops every cached passphrase, e.g. when the user steps
+// away or the system goes to sleep
+func (d *Daemon) ForgetPasswords() {
+	if n := d.passwords.Flush(); n > 0 {
+		log.Printf("Forgot %d cached password(s)", n)
+	}
 }
 
 // MountAll mounts all available devices
@@ -74,8 +119,8 @@ func (d *Daemon) MountAll() error {
 	}
 
 	for _, dev := range devices {
-		if dev.IsPartition && !dev.IsMounted {
-			if err := d.mountDevice(dev); err != nil {
+		if dev.IsMountable() && !dev.IsMounted {
+			if err := d.mountDevice(&dev); err != nil {
 				log.Printf("Failed to mount %s: %v", dev.Path, err)
 			}
 		}
@@ -98,52 +143,63 @@ func (d *Daemon) monitorDevd() {
 
 // pollDevices periodically checks for device changes
 func (d *Daemon) pollDevices() {
-	ticker := time.NewTicker(2 * time.Second)
+	ticker := time.NewTicker(d.pollInterval)
 	defer ticker.Stop()
 
-	knownDevices := make(map[string]bool)
+	// Start from an empty snapshot so devices present at startup are
+	// reported as added and automounted
+	last := device.NewSnapshot(nil)
+	lastTick := time.Now()
 
 	for {
 		select {
 		case <-d.stopChan:
 			return
-		case <-ticker.C:
-			devices, err := d.deviceMgr.Scan()
+		case now := <-ticker.C:
+			if resumedFromSleep(lastTick, now) {
+				log.Println("System resumed from sleep")
+				d.ForgetPasswords()
+			}
+			lastTick = now
+
+			snap, err := d.deviceMgr.Snapshot()
 			if err != nil {
 				log.Printf("Failed to scan devices: %v", err)
 				continue
 			}
 
-			currentDevices := make(map[string]bool)
-
-			// Check for new devices
-			for _, dev := range devices {
-				currentDevices[dev.Path] = true
-
-				if !knownDevices[dev.Path] {
-					// New device detected
-					d.onDeviceAdded(dev)
-					knownDevices[dev.Path] = true
-				}
-			}
-
-			// Check for removed devices
-			for path := range knownDevices {
-				if !currentDevices[path] {
-					d.onDeviceRemoved(path)
-					delete(knownDevices, path)
+			for _, ev := range device.Diff(last, snap) {
+				dev := ev.Device
+				switch ev.Type {
+				case device.EventAdded:
+					d.onDeviceAdded(&dev)
+				case device.EventRemoved:
+					d.onDeviceRemoved(dev.Path)
+				case device.EventChanged:
+					d.onDeviceChanged(&dev, ev.Changes)
 				}
 			}
+			d.expireOwnMounts()
+			d.checkSpace(snap.Devices())
+			last = snap
 		}
 	}
 }
 
+// resumedFromSleep reports whether the system was suspended between two
+// ticks. The monotonic clock stops while the system sleeps but the wall
+// clock does not, so they drift apart by the time spent asleep.
+func resumedFromSleep(prev, now time.Time) bool {
+	wall := now.Round(0).Sub(prev.Round(0))
+	return wall-now.Sub(prev) > 10*time.Second
+}
+
 // onDeviceAdded handles device addition
 func (d *Daemon) onDeviceAdded(dev *device.Device) {
 	log.Printf("Device added: %s (%s)", dev.Path, dev.GetDisplayName())
 
 	// Check if device should be ignored
-	if d.config.ShouldIgnoreDevice(dev.Label, dev.UUID, dev.Path) {
+	if d.config.ShouldIgnore(dev.Identity()) {
 		log.Printf("Ignoring device %s", dev.Path)
 		return
 	}
@@ -157,21 +213,127 @@ func (d *Daemon) onDeviceAdded(dev *device.Device) {
 	// Execute event hook
 	d.executeEventHook("device_added", dev)
 
-	// Auto-mount if enabled
-	if dev.IsPartition && d.config.ShouldAutomountDevice(dev.Label, dev.UUID, dev.Path) {
-		if err := d.mountDevice(dev); err != nil {
-			log.Printf("Failed to automount %s: %v", dev.Path, err)
+	d.automount(dev)
+
+	// Notify tray of device changes
+	d.notifyDeviceChanged()
+}
+
+// onDeviceChanged handles a device whose media, filesystem or mount state
+// changed, e.g. a reformatted stick or a card swapped in a reader slot
+func (d *Daemon) onDeviceChanged(dev *device.Device, changes []device.Change) {
+	fields := make([]string, 0, len(changes))
+	for _, c := range changes {
+		fields = append(fields, fmt.Sprintf("%s %q -> %q", c.Field, c.Old, c.New))
+	}
+	log.Printf("Device changed: %s (%s)", dev.Path, strings.Join(fields, ", "))
 
-			if d.config.Notifications.Enabled && d.config.Notifications.JobFailed > 0 {
-				notify.Send("Mount Failed", fmt.Sprintf("Failed to mount %s: %v", dev.GetDisplayName(), err),
-					int(d.config.Notifications.JobFailed*1000))
+	// Forget mounts that were undone outside pgmount
+	if !dev.IsMounted {
+		d.mu.Lock()
+		delete(d.mounted, dev.Path)
+		d.mu.Unlock()
+	}
+
+	// A disc or card taken out while mounted leaves a stale mount behind
+	if !dev.MediaPresent {
+		d.mu.Lock()
+		mounted, ok := d.mounted[dev.Path]
+		d.mu.Unlock()
+
+		if ok {
+			if err := d.unmountDevice(&mounted); err != nil {
+				log.Printf("Failed to unmount %s: %v", dev.Path, err)
 			}
 		}
 	}
 
+	// Mounts and unmounts made here were announced when they were made
+	if changes = d.withoutOwnMountChange(dev.Path, changes); len(changes) == 0 {
+		return
+	}
+
+	if d.config.ShouldIgnore(dev.Identity()) {
+		log.Printf("Ignoring device %s", dev.Path)
+		return
+	}
+
+	// Execute event hook
+	d.executeEventHook("device_changed", dev, changes...)
+
+	// New media or a new filesystem is treated like a fresh insertion
+	for _, c := range changes {
+		if c.Field == "uuid" || c.Field == "fstype" || c.Field == "media" {
+			d.automount(dev)
+			break
+		}
+	}
+
 	// Notify tray of device changes
-	if d.onDeviceChangedFn != nil {
-		d.onDeviceChangedFn()
+	d.notifyDeviceChanged()
+}
+
+// automount mounts a device if it holds a filesystem and the configuration
+// allows it
+func (d *Daemon) automount(dev *device.Device) {
+	if !dev.IsMountable() || dev.IsMounted || dev.FSType == "" {
+		return
+	}
+	// The cleartext device of an unlocked device is mounted on its own
+	if dev.IsEncrypted && dev.IsUnlocked {
+		return
+	}
+	if !d.config.ShouldAutomount(dev.Identity()) {
+		return
+	}
+
+	if err := d.mountDevice(dev); err != nil {
+		log.Printf("Failed to automount %s: %v", dev.Path, err)
+
+		if d.config.Notifications.Enabled && d.config.Notifications.JobFailed > 0 {
+			notify.Send("Mount Failed", fmt.Sprintf("Failed to mount %s: %v", dev.GetDisplayName(), err),
+				int(d.config.Notifications.JobFailed*1000))
+		}
+	}
+}
+
+// withoutOwnMountChange drops the mount_point change from changes if the
+// daemon made it
+func (d *Daemon) withoutOwnMountChange(path string, changes []device.Change) []device.Change {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	own, ok := d.ownMounts[path]
+	if !ok {
+		return changes
+	}
+	kept := make([]device.Change, 0, len(changes))
+	for _, c := range changes {
+		if c.Field == "mount_point" && c.New == own.mountPoint {
+			delete(d.ownMounts, path)
+			continue
+		}
+		kept = append(kept, c)
+	}
+	return kept
+}
+
+// expireOwnMounts forgets the mount points the daemon set or cleared once a
+// whole scan ran since. That scan showed the change if there was one, but a
+// mount undone again before the next poll shows none, and a later change
+// from outside must not be taken for the daemon's own.
+func (d *Daemon) expireOwnMounts() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for path, own := range d.ownMounts {
+		if own.scanned {
+			delete(d.ownMounts, path)
+			continue
+		}
+		// The scan may have started before it was recorded
+		own.scanned = true
+		d.ownMounts[path] = own
 	}
 }
 
@@ -185,15 +347,18 @@ func (d *Daemon) onDeviceRemoved(path string) {
 
 	if ok {
 		// Device was mounted, unmount it
-		if err := d.unmountDevice(dev); err != nil {
+		if err := d.unmountDevice(&dev); err != nil {
 			log.Printf("Failed to unmount %s: %v", path, err)
 		}
 	}
+	d.mu.Lock()
+	delete(d.ownMounts, path)
+	d.mu.Unlock()
 
 	// Send notification
 	if d.config.Notifications.Enabled && d.config.Notifications.DeviceRemoved > 0 {
 		displayName := path
-		if dev != nil {
+		if ok {
 			displayName = dev.GetDisplayName()
 		}
 		notify.Send("Device Removed", fmt.Sprintf("%s disconnected", displayName),
@@ -201,9 +366,40 @@ func (d *Daemon) onDeviceRemoved(path string) {
 	}
 
 	// Notify tray of device changes
-	if d.onDeviceChangedFn != nil {
-		d.onDeviceChangedFn()
+	d.notifyDeviceChanged()
+}
+
+// checkSpace reports mounted devices whose free space dropped below the
+// configured threshold. Each device is reported once until it has enough
+// free space again or is unmounted.
+func (d *Daemon) checkSpace(devices []device.Device) {
+	threshold := d.config.LowSpaceThreshold
+	if threshold <= 0 {
+		return
 	}
+
+	low := make(map[string]bool)
+	for _, dev := range devices {
+		free := dev.FreePercent()
+		if !dev.IsMounted || free < 0 || free >= threshold {
+			continue
+		}
+		low[dev.Path] = true
+		if d.lowSpace[dev.Path] || d.config.ShouldIgnore(dev.Identity()) {
+			continue
+		}
+
+		log.Printf("Device %s is low on space: %.1f%% free", dev.Path, free)
+
+		if d.config.Notifications.Enabled && d.config.Notifications.SpaceLow > 0 {
+			notify.SendWithIcon("Low Disk Space",
+				fmt.Sprintf("%s has only %.0f%% free space left", dev.GetDisplayName(), free),
+				"drive-harddisk", int(d.config.Notifications.SpaceLow*1000))
+		}
+
+		d.executeEventHook("space_low", &dev)
+	}
+	d.lowSpace = low
 }
 
 // mountDevice mounts a device
@@ -212,11 +408,31 @@ func (d *Daemon) mountDevice(dev *device.Device) error {
 		return fmt.Errorf("device already mounted at %s", dev.MountPoint)
 	}
 
-	// Handle encrypted devices
-	if dev.IsEncrypted && !dev.IsUnlocked {
-		if err := d.unlockDevice(dev); err != nil {
+	// The filesystem of an encrypted device is on the cleartext device
+	// stacked on it, which is mounted in its place
+	if dev.IsEncrypted {
+		cleartext, err := d.unlockDevice(dev)
+		if err != nil {
 			return fmt.Errorf("failed to unlock device: %w", err)
 		}
+		if cleartext.IsMounted {
+			return fmt.Errorf("device already mounted at %s", cleartext.MountPoint)
+		}
+		if err := d.mountDevice(&cleartext); err != nil {
+			return err
+		}
+		dev.MountPoint = cleartext.MountPoint
+		return nil
+	}
+
+	// ZFS pools are imported rather than mounted
+	if dev.IsPoolMember() {
+		mountPoint, err := d.importPool(dev)
+		if err != nil {
+			return err
+		}
+		d.onMounted(dev, mountPoint)
+		return nil
 	}
 
 	// Determine mount point
@@ -228,7 +444,7 @@ func (d *Daemon) mountDevice(dev *device.Device) error {
 	}
 
 	// Get mount options
-	opts := d.config.GetMountOptions(dev.FSType, dev.Label, dev.UUID, dev.Path)
+	opts := d.mountOptions(dev)
 
 	// Build mount command
 	args := []string{}
@@ -236,7 +452,7 @@ func (d *Daemon) mountDevice(dev *device.Device) error {
 		args = append(args, "-o", strings.Join(opts, ","))
 	}
 	if dev.FSType != "" && dev.FSType != "auto" {
-		args = append(args, "-t", dev.FSType)
+		args = append(args, "-t", dev.MountType())
 	}
 	args = append(args, dev.Path, mountPoint)
 
@@ -248,11 +464,19 @@ func (d *Daemon) mountDevice(dev *device.Device) error {
 		return fmt.Errorf("mount failed: %w (output: %s)", err, string(output))
 	}
 
+	d.onMounted(dev, mountPoint)
+	return nil
+}
+
+// onMounted records a device as mounted and announces it
+func (d *Daemon) onMounted(dev *device.Device, mountPoint string) {
 	dev.MountPoint = mountPoint
 	dev.IsMounted = true
+	d.deviceMgr.SetMounted(dev.Path, mountPoint)
 
 	d.mu.Lock()
-	d.mounted[dev.Path] = dev
+	d.mounted[dev.Path] = *dev
+	d.ownMounts[dev.Path] = ownMount{mountPoint: mountPoint}
 	d.mu.Unlock()
 
 	log.Printf("Successfully mounted %s at %s", dev.Path, mountPoint)
@@ -272,11 +496,7 @@ func (d *Daemon) mountDevice(dev *device.Device) error {
 	}
 
 	// Notify tray of device changes
-	if d.onDeviceChangedFn != nil {
-		d.onDeviceChangedFn()
-	}
-
-	return nil
+	d.notifyDeviceChanged()
 }
 
 // unmountDevice unmounts a device
@@ -285,20 +505,48 @@ func (d *Daemon) unmountDevice(dev *device.Device) error {
 		return fmt.Errorf("device not mounted")
 	}
 
-	log.Printf("Unmounting %s from %s", dev.Path, dev.MountPoint)
+	if dev.Pool != "" {
+		// Exporting a pool unmounts all of its datasets
+		log.Printf("Exporting pool %s of %s", dev.Pool, dev.Path)
+		if err := device.ExportPool(dev.Pool); err != nil {
+			return err
+		}
+	} else {
+		// Bind mounts of the device are undone too, newest first, as
+		// pgumount does. dev may have been recorded before the bind mounts
+		// were made, so take its mounts from the latest scan.
+		mounts := dev.Mounts
+		if current, ok := d.deviceMgr.GetDevice(dev.Path); ok && len(current.Mounts) > 0 {
+			mounts = current.Mounts
+		}
+		mountPoints := []string{}
+		for _, entry := range mounts {
+			mountPoints = append(mountPoints, entry.MountPoint)
+		}
+		if len(mountPoints) == 0 {
+			mountPoints = append(mountPoints, dev.MountPoint)
+		}
 
-	cmd := exec.Command("umount", dev.MountPoint)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("unmount failed: %w (output: %s)", err, string(output))
+		for i := len(mountPoints) - 1; i >= 0; i-- {
+			log.Printf("Unmounting %s from %s", dev.Path, mountPoints[i])
+
+			cmd := exec.Command("umount", mountPoints[i])
+			output, err := cmd.CombinedOutput()
+			if err != nil {
+				return fmt.Errorf("unmount failed: %w (output: %s)", err, string(output))
+			}
+		}
 	}
 
 	mountPoint := dev.MountPoint
 	dev.MountPoint = ""
 	dev.IsMounted = false
+	dev.Pool = ""
+	d.deviceMgr.SetMounted(dev.Path, "")
 
 	d.mu.Lock()
 	delete(d.mounted, dev.Path)
+	d.ownMounts[dev.Path] = ownMount{}
 	d.mu.Unlock()
 
 	// Remove mount point directory if empty
@@ -315,48 +563,282 @@ func (d *Daemon) unmountDevice(dev *device.Device) error {
 	// Execute event hook
 	d.executeEventHook("device_unmounted", dev)
 
+	// Lock the encrypted device the filesystem was on
+	idle := dev.Path
+	if parent, ok := d.deviceMgr.GetDevice(dev.Parent); ok && parent.IsEncrypted && parent.IsUnlocked &&
+		d.config.ShouldAutoLock(parent.Identity()) {
+		if err := d.lockDevice(&parent); err != nil {
+			log.Printf("Failed to lock %s: %v", parent.Path, err)
+		} else {
+			idle = parent.Path
+		}
+	}
+
+	// Images are detached once their last filesystem is unmounted
+	if err := d.deviceMgr.DetachIdleImage(idle); err != nil {
+		log.Printf("Failed to detach image of %s: %v", dev.Path, err)
+	}
+
 	// Notify tray of device changes
-	if d.onDeviceChangedFn != nil {
-		d.onDeviceChangedFn()
+	d.notifyDeviceChanged()
+
+	return nil
+}
+
+// lockDevice locks an unlocked encrypted device whose filesystem is not
+// mounted
+func (d *Daemon) lockDevice(dev *device.Device) error {
+	log.Printf("Locking %s", dev.Path)
+
+	if err := d.deviceMgr.Lock(dev.Path); err != nil {
+		return err
 	}
+	dev.IsUnlocked = false
+
+	log.Printf("Successfully locked %s", dev.Path)
+
+	// Send notification
+	if d.config.Notifications.Enabled && d.config.Notifications.DeviceLocked > 0 {
+		notify.Send("Device Locked", fmt.Sprintf("%s locked", dev.GetDisplayName()),
+			int(d.config.Notifications.DeviceLocked*1000))
+	}
+
+	// Execute event hook
+	d.executeEventHook("device_locked", dev)
+
+	// Notify tray of device changes
+	d.notifyDeviceChanged()
 
 	return nil
 }
 
-// unlockDevice unlocks a GELI encrypted device
-func (d *Daemon) unlockDevice(dev *device.Device) error {
-	if !d.config.GELI.Enabled {
-		return fmt.Errorf("GELI support is disabled")
+// importPool imports the ZFS pool of a device under the mount base and
+// returns where its root dataset is mounted
+func (d *Daemon) importPool(dev *device.Device) (string, error) {
+	if !d.config.ZFS.Enabled {
+		return "", fmt.Errorf("ZFS support is disabled")
+	}
+
+	opts := device.PoolImportOptions{
+		MountBase: d.config.MountBase,
+		ReadOnly:  d.config.ZFS.ReadOnly,
+		NoMount:   d.config.ZFS.NoMount,
+		Rename:    d.config.ZFS.OnConflict != "refuse",
+	}
+	for _, opt := range d.config.MountOptionsFor(dev.FSType, dev.Identity()) {
+		if opt == "ro" || opt == "readonly" {
+			opts.ReadOnly = true
+		}
+	}
+
+	log.Printf("Importing pool %s from %s", dev.Label, dev.Path)
+
+	pool, mountPoint, err := device.ImportPool(dev, opts)
+	if err != nil {
+		return "", err
+	}
+	if pool != dev.Label {
+		log.Printf("Imported pool %s as %s, the name is already in use", dev.Label, pool)
+	}
+	dev.Pool = pool
+
+	return mountPoint, nil
+}
+
+// mountOptions returns the mount options for a device. The cleartext
+// device of an encrypted device takes the options configured for the
+// encrypted device, whose UUID and label are the ones users know.
+func (d *Daemon) mountOptions(dev *device.Device) []string {
+	if parent, ok := d.deviceMgr.GetDevice(dev.Parent); ok && parent.IsEncrypted {
+		if devCfg := d.config.DeviceConfigFor(parent.Identity()); devCfg != nil && len(devCfg.Options) > 0 {
+			return devCfg.Options
+		}
+	}
+	return d.config.MountOptionsFor(dev.FSType, dev.Identity())
+}
+
+// hasOption reports whether opts contains the mount option opt
+func hasOption(opts []string, opt string) bool {
+	for _, o := range opts {
+		if o == opt {
+			return true
+		}
+	}
+	return false
+}
+
+// unlockDevice unlocks a GELI, LUKS, BitLocker or VeraCrypt device and returns the
+// cleartext device stacked on it
+func (d *Daemon) unlockDevice(dev *device.Device) (device.Device, error) {
+	if dev.IsUnlocked {
+		return d.deviceMgr.CleartextDevice(dev.Path)
+	}
+	if !d.config.Encryption.Enabled {
+		return device.Device{}, fmt.Errorf("encryption support is disabled")
 	}
 
 	log.Printf("Unlocking encrypted device %s", dev.Path)
 
-	// Check for keyfile
-	keyfile, hasKeyfile := d.config.GELI.KeyFiles[dev.UUID]
-	
-	var cmd *exec.Cmd
-	if hasKeyfile {
-		// Use keyfile
-		cmd = exec.Command("geli", "attach", "-k", keyfile, dev.Path)
-	} else {
-		// Prompt for password
-		password, err := d.getPassword(dev)
+	// Open the device read-only if it is to be mounted read-only
+	opts := device.UnlockOptions{ReadOnly: hasOption(d.mountOptions(dev), "ro")}
+	if devCfg := d.config.DeviceConfigFor(dev.Identity()); devCfg != nil {
+		opts.PIM = devCfg.VeraCryptPIM
+	}
+
+	// Keyfiles come from the geli entry of the device, which can ask for
+	// the passphrase as well, or from the keyfiles section
+	var keyfiles []string
+	geli := d.geliConfig(dev)
+	if geli != nil {
+		keyfiles = geli.KeyFiles
+	} else if keyfile, ok := d.config.Encryption.KeyFileFor(dev.Identity()); ok {
+		keyfiles = []string{keyfile}
+	}
+	key, err := d.keyFiles(dev, keyfiles)
+	if err != nil {
+		return device.Device{}, err
+	}
+	defer clear(key.KeyData)
+
+	unlock := func(passphrase []byte) (device.Device, error) {
+		withPassphrase := key
+		withPassphrase.Passphrase = passphrase
+		return d.deviceMgr.Unlock(dev.Path, withPassphrase, opts)
+	}
+
+	// Unless the geli entry asks for the passphrase, keyfiles are enough
+	if len(keyfiles) > 0 && (geli == nil || !geli.Passphrase) {
+		key.NoPassphrase = geli != nil
+		cleartext, err := unlock(nil)
 		if err != nil {
-			return fmt.Errorf("failed to get password: %w", err)
+			return device.Device{}, err
 		}
+		return d.onUnlocked(dev, cleartext), nil
+	}
 
-		cmd = exec.Command("geli", "attach", dev.Path)
-		cmd.Stdin = strings.NewReader(password + "\n")
+	if cached, ok := d.passwords.Get(dev.StableID()); ok {
+		cleartext, err := unlock(cached)
+		clear(cached)
+		if err == nil {
+			return d.onUnlocked(dev, cleartext), nil
+		}
+		// The passphrase may have been changed since it was cached
+		log.Printf("Cached password for %s failed: %v", dev.Path, err)
+		d.passwords.Forget(dev.StableID())
 	}
 
-	output, err := cmd.CombinedOutput()
+	if d.keyring != nil && dev.StableID() != "" {
+		stored, err := d.keyring.Lookup(dev.StableID())
+		if err != nil {
+			log.Printf("Failed to look up the password of %s in the keyring: %v", dev.Path, err)
+		} else if stored != nil {
+			cleartext, err := unlock(stored)
+			clear(stored)
+			if err == nil {
+				return d.onUnlocked(dev, cleartext), nil
+			}
+			log.Printf("Password from the keyring for %s failed: %v", dev.Path, err)
+		}
+	}
+
+	// Prompt for the password, again while it is wrong
+	retry := ""
+	for attempt := 1; ; attempt++ {
+		password, err := d.getPassword(dev, retry)
+		if err != nil {
+			return device.Device{}, fmt.Errorf("failed to get password: %w", err)
+		}
+
+		cleartext, err := unlock(password)
+		if err == nil {
+			d.passwords.Put(dev.StableID(), password)
+			d.rememberPassword(dev, password)
+			clear(password)
+			return d.onUnlocked(dev, cleartext), nil
+		}
+		clear(password)
+
+		if attempt == passwordAttempts {
+			return device.Device{}, err
+		}
+		log.Printf("Failed to unlock %s: %v", dev.Path, err)
+		retry = fmt.Sprintf("Failed to unlock %s, please try again", dev.GetDisplayName())
+	}
+}
+
+// geliConfig returns the geli entry of the device configuration for dev, or
+// nil if it has none
+func (d *Daemon) geliConfig(dev *device.Device) *config.GELIProviderConfig {
+	if devCfg := d.config.DeviceConfigFor(dev.Identity()); devCfg != nil {
+		return devCfg.GELI
+	}
+	return nil
+}
+
+// keyFiles checks that the keyfiles configured for dev can be read and
+// returns them as a key. A keyfile on a key device is read into the key,
+// and only one can be, since it is passed on a descriptor of its own.
+func (d *Daemon) keyFiles(dev *device.Device, keyfiles []string) (device.Key, error) {
+	var key device.Key
+	var keyDevUUID, keyDevPath string
+	for _, keyfile := range keyfiles {
+		if uuid, path, ok := device.ParseKeyDeviceRef(keyfile); ok {
+			if keyDevUUID != "" {
+				return device.Key{}, fmt.Errorf("%s has more than one keyfile on a key device", dev.Path)
+			}
+			keyDevUUID, keyDevPath = uuid, path
+			key.KeyFiles = append(key.KeyFiles, "-")
+			continue
+		}
+
+		file, err := os.Open(keyfile)
+		if err != nil {
+			return device.Key{}, fmt.Errorf("keyfile of %s cannot be read: %w", dev.Path, err)
+		}
+		file.Close()
+		key.KeyFiles = append(key.KeyFiles, keyfile)
+	}
+
+	if keyDevUUID != "" {
+		data, err := d.readKeyDeviceFile(dev, keyDevUUID, keyDevPath)
+		if err != nil {
+			return device.Key{}, err
+		}
+		key.KeyData = data
+	}
+	return key, nil
+}
+
+// readKeyDeviceFile reads the keyfile of dev from the key device with the
+// given UUID, waiting for it to be plugged in if it is not
+func (d *Daemon) readKeyDeviceFile(dev *device.Device, uuid, path string) ([]byte, error) {
+	spec := "UUID=" + uuid
+	keyDev, err := d.deviceMgr.Resolve(spec)
 	if err != nil {
-		return fmt.Errorf("geli attach failed: %w (output: %s)", err, string(output))
+		timeout := time.Duration(d.config.Encryption.KeyDeviceTimeout) * time.Second
+		log.Printf("Waiting %v for key device %s to unlock %s", timeout, uuid, dev.Path)
+		if d.config.Notifications.Enabled {
+			notify.Send("Key Device Needed", fmt.Sprintf("Insert the key device to unlock %s", dev.GetDisplayName()),
+				int(timeout/time.Millisecond))
+		}
+		if keyDev, err = d.deviceMgr.WaitForDevice(spec, timeout); err != nil {
+			return nil, fmt.Errorf("key device %s for %s not found: %w", uuid, dev.Path, err)
+		}
 	}
 
+	log.Printf("Reading keyfile %s from %s", path, keyDev.Path)
+	key, err := device.ReadKeyFile(&keyDev, path)
+	if err != nil {
+		return nil, fmt.Errorf("keyfile of %s cannot be read from key device %s: %w", dev.Path, uuid, err)
+	}
+	return key, nil
+}
+
+// onUnlocked records that dev was unlocked as cleartext and tells the user
+func (d *Daemon) onUnlocked(dev *device.Device, cleartext device.Device) device.Device {
 	dev.IsUnlocked = true
 
-	log.Printf("Successfully unlocked %s", dev.Path)
+	log.Printf("Successfully unlocked %s as %s", dev.Path, cleartext.Path)
 
 	// Send notification
 	if d.config.Notifications.Enabled && d.config.Notifications.DeviceUnlocked > 0 {
@@ -364,20 +846,21 @@ func (d *Daemon) unlockDevice(dev *device.Device) error {
 			int(d.config.Notifications.DeviceUnlocked*1000))
 	}
 
-	return nil
+	return cleartext
 }
 
-// getPassword prompts for a password
-func (d *Daemon) getPassword(dev *device.Device) (string, error) {
-	if d.config.GELI.PasswordCmd != "" {
+// getPassword asks for the password of dev with the password command or a
+// pinentry prompt. retry explains why the previous password was rejected.
+func (d *Daemon) getPassword(dev *device.Device, retry string) ([]byte, error) {
+	if d.config.Encryption.PasswordCmd != "" {
 		// Parse and validate the password command to prevent command injection
 		// Split the command into program and arguments
-		parts, err := shellquote.Split(d.config.GELI.PasswordCmd)
+		parts, err := shellquote.Split(d.config.Encryption.PasswordCmd)
 		if err != nil {
-			return "", fmt.Errorf("invalid password command: %w", err)
+			return nil, fmt.Errorf("invalid password command: %w", err)
 		}
 		if len(parts) == 0 {
-			return "", fmt.Errorf("empty password command")
+			return nil, fmt.Errorf("empty password command")
 		}
 
 		// Execute command directly without shell to prevent injection
@@ -389,36 +872,111 @@ func (d *Daemon) getPassword(dev *device.Device) (string, error) {
 		}
 
 		output, err := cmd.Output()
+		defer clear(output)
 		if err != nil {
-			return "", fmt.Errorf("password command failed: %w", err)
+			return nil, fmt.Errorf("password command failed: %w", err)
 		}
-		return strings.TrimSpace(string(output)), nil
+		return append([]byte(nil), bytes.TrimSpace(output)...), nil
 	}
 
-	// Use built-in password prompt
-	fmt.Printf("Enter password for %s: ", dev.GetDisplayName())
-	reader := bufio.NewReader(os.Stdin)
-	password, err := reader.ReadString('\n')
+	prompter, err := d.getPrompter()
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	return prompter.GetPassphrase(prompt.Request{
+		Title:       "Unlock Encrypted Device",
+		Description: fmt.Sprintf("Enter the password for %s (%s, %s)", dev.GetDisplayName(), dev.Path, formatSize(dev.Size)),
+		Prompt:      "Password:",
+		Error:       retry,
+	})
+}
+
+// getPrompter returns the prompter for passwords and questions
+func (d *Daemon) getPrompter() (prompt.Prompter, error) {
+	if d.prompter != nil {
+		return d.prompter, nil
+	}
+	return prompt.New(d.config.Encryption.Pinentry)
+}
+
+// rememberPassword offers to store a password the user typed in the keyring
+func (d *Daemon) rememberPassword(dev *device.Device, password []byte) {
+	if d.keyring == nil || dev.StableID() == "" || d.config.Encryption.PasswordCmd != "" {
+		return
+	}
+
+	prompter, err := d.getPrompter()
+	if err != nil {
+		log.Printf("Failed to ask about remembering the password: %v", err)
+		return
+	}
+	remember, err := prompter.Confirm(prompt.Request{
+		Title:       "Remember Password",
+		Description: fmt.Sprintf("Remember the password of %s in the keyring?", dev.GetDisplayName()),
+		OK:          "Remember",
+		Cancel:      "Not Now",
+	})
+	if err != nil {
+		log.Printf("Failed to ask about remembering the password: %v", err)
+		return
+	}
+	if !remember {
+		return
+	}
+
+	label := fmt.Sprintf("Encryption passphrase for %s", dev.GetDisplayName())
+	if err := d.keyring.Store(dev.StableID(), label, password); err != nil {
+		log.Printf("Failed to store the password of %s in the keyring: %v", dev.Path, err)
 	}
-	return strings.TrimSpace(password), nil
 }
 
-// executeEventHook executes an event hook if configured
-func (d *Daemon) executeEventHook(event string, dev *device.Device) {
+// formatSize formats a size in bytes for prompts
+func formatSize(size uint64) string {
+	const (
+		KB = 1024
+		MB = KB * 1024
+		GB = MB * 1024
+		TB = GB * 1024
+	)
+
+	switch {
+	case size >= TB:
+		return fmt.Sprintf("%.2f TB", float64(size)/float64(TB))
+	case size >= GB:
+		return fmt.Sprintf("%.2f GB", float64(size)/float64(GB))
+	case size >= MB:
+		return fmt.Sprintf("%.2f MB", float64(size)/float64(MB))
+	case size >= KB:
+		return fmt.Sprintf("%.2f KB", float64(size)/float64(KB))
+	default:
+		return fmt.Sprintf("%d B", size)
+	}
+}
+
+// executeEventHook executes an event hook if configured. For device_changed
+// the {changes} placeholder expands to the changed field names, and {free}
+// expands to the free space of a mounted device in bytes.
+func (d *Daemon) executeEventHook(event string, dev *device.Device, changes ...device.Change) {
 	if hookCmd, ok := d.config.EventHooks[event]; ok {
 		// Properly escape all device values to prevent command injection
 		escapedDevice := shellquote.Join(dev.Path)
 		escapedLabel := shellquote.Join(dev.Label)
 		escapedUUID := shellquote.Join(dev.UUID)
 		escapedMountPoint := shellquote.Join(dev.MountPoint)
+		fields := make([]string, 0, len(changes))
+		for _, c := range changes {
+			fields = append(fields, c.Field)
+		}
+		escapedChanges := shellquote.Join(strings.Join(fields, ","))
+		free := strconv.FormatUint(dev.Free, 10)
 
 		// Replace placeholders with escaped values
 		cmd := strings.ReplaceAll(hookCmd, "{device}", escapedDevice)
 		cmd = strings.ReplaceAll(cmd, "{label}", escapedLabel)
 		cmd = strings.ReplaceAll(cmd, "{uuid}", escapedUUID)
 		cmd = strings.ReplaceAll(cmd, "{mount_point}", escapedMountPoint)
+		cmd = strings.ReplaceAll(cmd, "{changes}", escapedChanges)
+		cmd = strings.ReplaceAll(cmd, "{free}", free)
 
 		log.Printf("Executing event hook for %s: %s", event, cmd)
 
@@ -431,6 +989,11 @@ func (d *Daemon) executeEventHook(event string, dev *device.Device) {
 	}
 }
 
+// SetKeyring sets the keyring passwords are looked up in before prompting
+func (d *Daemon) SetKeyring(k Keyring) {
+	d.keyring = k
+}
+
 // GetDeviceManager returns the device manager
 func (d *Daemon) GetDeviceManager() *device.Manager {
 	return d.deviceMgr
@@ -438,17 +1001,74 @@ func (d *Daemon) GetDeviceManager() *device.Manager {
 
 // SetDeviceChangedCallback sets the callback for device changes
 func (d *Daemon) SetDeviceChangedCallback(fn func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	d.onDeviceChangedFn = fn
 }
 
+// notifyDeviceChanged calls the device changed callback if one is set
+func (d *Daemon) notifyDeviceChanged() {
+	d.mu.Lock()
+	fn := d.onDeviceChangedFn
+	d.mu.Unlock()
+
+	if fn != nil {
+		fn()
+	}
+}
+
 // MountDevice mounts a specific device (public method for tray integration)
-func (d *Daemon) MountDevice(dev *device.Device) error {
-	return d.mountDevice(dev)
+func (d *Daemon) MountDevice(dev device.Device) error {
+	if err := d.restoreGELIMetadata(&dev); err != nil {
+		return err
+	}
+	return d.mountDevice(&dev)
+}
+
+// restoreGELIMetadata restores the metadata of a GELI provider that has
+// none from the metadata_backup of its geli entry. Only devices the user
+// mounts get here: the entry may match another disk by path, and a restore
+// overwrites the last sector.
+func (d *Daemon) restoreGELIMetadata(dev *device.Device) error {
+	geli := d.geliConfig(dev)
+	if geli == nil || geli.MetadataBackup == "" || dev.FSType != "" {
+		return nil
+	}
+
+	log.Printf("Restoring GELI metadata of %s from %s", dev.Path, geli.MetadataBackup)
+	restored, err := d.deviceMgr.RestoreGELIMetadata(dev.Path, geli.MetadataBackup)
+	if err != nil {
+		return fmt.Errorf("failed to restore the metadata of %s: %w", dev.Path, err)
+	}
+	*dev = restored
+	return nil
 }
 
 // UnmountDevice unmounts a specific device (public method for tray integration)
-func (d *Daemon) UnmountDevice(dev *device.Device) error {
-	return d.unmountDevice(dev)
+func (d *Daemon) UnmountDevice(dev device.Device) error {
+	return d.unmountDevice(&dev)
+}
+
+// LockDevice unmounts the filesystem of an unlocked encrypted device and
+// locks it (public method for tray integration)
+func (d *Daemon) LockDevice(dev device.Device) error {
+	if !dev.IsEncrypted || !dev.IsUnlocked {
+		return fmt.Errorf("%s is not unlocked", dev.Path)
+	}
+
+	for _, path := range dev.Children {
+		if child, ok := d.deviceMgr.GetDevice(path); ok && child.IsMounted {
+			if err := d.unmountDevice(&child); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Unmounting locks the device already unless auto_lock is off
+	if current, ok := d.deviceMgr.GetDevice(dev.Path); ok && !current.IsUnlocked {
+		return nil
+	}
+	return d.lockDevice(&dev)
 }
 
 // openInFileManager opens a path in the configured file manager
@@ -0,0 +1,599 @@
+package daemon
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pgsdf/pgmount/config"
+	"github.com/pgsdf/pgmount/device"
+	"github.com/pgsdf/pgmount/prompt"
+)
+
+// waitFor polls cond until it returns true or the timeout expires
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDaemonHotplug(t *testing.T) {
+	hookLog := filepath.Join(t.TempDir(), "hooks.log")
+
+	cfg := config.Default()
+	cfg.Automount = false
+	cfg.Notifications.Enabled = false
+	cfg.EventHooks["device_added"] = "echo {device} >> " + hookLog
+	cfg.EventHooks["device_changed"] = "echo changed {device} {changes} >> " + hookLog
+	cfg.Devices = []config.DeviceConfig{{IDLabel: "IGNORED", Ignore: true}}
+
+	backend := device.NewFakeBackend()
+	d, err := NewWithManager(cfg, device.NewManagerWithBackend(backend))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.pollInterval = 10 * time.Millisecond
+
+	var changes atomic.Int32
+	d.SetDeviceChangedCallback(func() { changes.Add(1) })
+
+	if err := d.Start(); err != nil {
+		t.Fatalf("Failed to start daemon: %v", err)
+	}
+	defer d.Stop()
+
+	backend.Insert(device.Device{Name: "da0", Path: "/dev/da0", IsRemovable: true})
+	backend.Insert(device.Device{Name: "da0p1", Path: "/dev/da0p1", Parent: "/dev/da0",
+		FSType: "vfat", Label: "STICK", IsPartition: true, IsRemovable: true})
+	backend.Insert(device.Device{Name: "da1p1", Path: "/dev/da1p1",
+		FSType: "vfat", Label: "IGNORED", IsPartition: true, IsRemovable: true})
+
+	readLog := func() string {
+		data, _ := os.ReadFile(hookLog)
+		return string(data)
+	}
+	waitFor(t, "device_added hooks", func() bool {
+		log := readLog()
+		return strings.Contains(log, "/dev/da0\n") && strings.Contains(log, "/dev/da0p1\n")
+	})
+
+	// Give the ignored device a few poll cycles to (not) show up
+	time.Sleep(50 * time.Millisecond)
+	if strings.Contains(readLog(), "/dev/da1p1") {
+		t.Error("Ignored device should not run the device_added hook")
+	}
+
+	// A reformat is reported as a change rather than a new device
+	backend.Update("/dev/da0p1", func(dev *device.Device) {
+		dev.FSType = "exfat"
+		dev.Label = "BACKUP"
+	})
+	waitFor(t, "device_changed hook", func() bool {
+		return strings.Contains(readLog(), "changed /dev/da0p1 fstype,label\n")
+	})
+
+	backend.Remove("/dev/da0")
+	waitFor(t, "removal", func() bool {
+		// da0 and da0p1 added, da0p1 changed, both removed
+		return changes.Load() == 5
+	})
+}
+
+func TestDaemonLowSpace(t *testing.T) {
+	hookLog := filepath.Join(t.TempDir(), "hooks.log")
+
+	cfg := config.Default()
+	cfg.Automount = false
+	cfg.Notifications.Enabled = false
+	cfg.LowSpaceThreshold = 10
+	cfg.EventHooks["space_low"] = "echo {device} {free} >> " + hookLog
+
+	stick := device.Device{Name: "da0p1", Path: "/dev/da0p1", FSType: "vfat",
+		IsPartition: true, IsRemovable: true}
+	backend := device.NewFakeBackend(stick)
+	backend.SetMounted(stick.Path, "/media/STICK")
+	backend.SetUsage(stick.Path, device.Usage{Total: 1000, Free: 500, Used: 500})
+
+	d, err := NewWithManager(cfg, device.NewManagerWithBackend(backend))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.pollInterval = 10 * time.Millisecond
+
+	if err := d.Start(); err != nil {
+		t.Fatalf("Failed to start daemon: %v", err)
+	}
+	defer d.Stop()
+
+	readLog := func() string {
+		data, _ := os.ReadFile(hookLog)
+		return string(data)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if readLog() != "" {
+		t.Fatalf("Should not report a half empty device, got %q", readLog())
+	}
+
+	backend.SetUsage(stick.Path, device.Usage{Total: 1000, Free: 50, Used: 950})
+	waitFor(t, "space_low hook", func() bool {
+		return readLog() == "/dev/da0p1 50\n"
+	})
+
+	// Still low on the next polls, so no repeated reports
+	time.Sleep(50 * time.Millisecond)
+	if got := readLog(); got != "/dev/da0p1 50\n" {
+		t.Errorf("Should report low space once, got %q", got)
+	}
+}
+
+func TestDaemonMediaChange(t *testing.T) {
+	hookLog := filepath.Join(t.TempDir(), "hooks.log")
+
+	cfg := config.Default()
+	cfg.Automount = false
+	cfg.Notifications.Enabled = false
+	cfg.EventHooks["device_added"] = "echo added {device} >> " + hookLog
+	cfg.EventHooks["device_changed"] = "echo changed {device} {changes} >> " + hookLog
+
+	backend := device.NewFakeBackend(device.Device{Name: "cd0", Path: "/dev/cd0",
+		IsRemovable: true, IsOptical: true})
+	d, err := NewWithManager(cfg, device.NewManagerWithBackend(backend))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.pollInterval = 10 * time.Millisecond
+
+	if err := d.Start(); err != nil {
+		t.Fatalf("Failed to start daemon: %v", err)
+	}
+	defer d.Stop()
+
+	readLog := func() string {
+		data, _ := os.ReadFile(hookLog)
+		return string(data)
+	}
+
+	waitFor(t, "empty drive", func() bool {
+		return readLog() == "added /dev/cd0\n"
+	})
+
+	// The drive stays at the same path, so a disc shows up as a change
+	backend.Update("/dev/cd0", func(dev *device.Device) {
+		dev.MediaPresent = true
+		dev.FSType = "iso9660"
+		dev.Label = "FREEBSD_INSTALL"
+		dev.Size = 4697620480
+	})
+	waitFor(t, "media insertion", func() bool {
+		return readLog() == "added /dev/cd0\nchanged /dev/cd0 fstype,label,size,media\n"
+	})
+
+	backend.Update("/dev/cd0", func(dev *device.Device) {
+		*dev = device.Device{Name: "cd0", Path: "/dev/cd0", IsRemovable: true, IsOptical: true}
+	})
+	waitFor(t, "media removal", func() bool {
+		return strings.HasSuffix(readLog(), "changed /dev/cd0 fstype,label,size,media\n"+
+			"changed /dev/cd0 fstype,label,size,media\n")
+	})
+}
+
+func TestDaemonOwnMountChange(t *testing.T) {
+	hookLog := filepath.Join(t.TempDir(), "hooks.log")
+
+	cfg := config.Default()
+	cfg.Automount = false
+	cfg.Notifications.Enabled = false
+	cfg.FileManager = ""
+	cfg.EventHooks["device_mounted"] = "echo mounted {device} >> " + hookLog
+	cfg.EventHooks["device_changed"] = "echo changed {device} {changes} >> " + hookLog
+
+	stick := device.Device{Name: "da0p1", Path: "/dev/da0p1", FSType: "vfat",
+		IsPartition: true, IsRemovable: true}
+	backend := device.NewFakeBackend(stick)
+	d, err := NewWithManager(cfg, device.NewManagerWithBackend(backend))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.pollInterval = 10 * time.Millisecond
+
+	if err := d.Start(); err != nil {
+		t.Fatalf("Failed to start daemon: %v", err)
+	}
+	defer d.Stop()
+
+	readLog := func() string {
+		data, _ := os.ReadFile(hookLog)
+		return string(data)
+	}
+
+	// Let the poller see the stick unmounted first
+	time.Sleep(50 * time.Millisecond)
+
+	// A mount made by the daemon is announced as device_mounted only
+	backend.SetMounted(stick.Path, "/media/STICK")
+	d.onMounted(&stick, "/media/STICK")
+	time.Sleep(50 * time.Millisecond)
+	if got := readLog(); got != "mounted /dev/da0p1\n" {
+		t.Errorf("Own mount should not run the device_changed hook, got %q", got)
+	}
+
+	// An unmount from outside is a change
+	backend.SetMounted(stick.Path, "")
+	waitFor(t, "device_changed hook", func() bool {
+		return readLog() == "mounted /dev/da0p1\nchanged /dev/da0p1 mount_point\n"
+	})
+
+	// A mount undone again before the poller saw it is never shown by a
+	// scan, and is forgotten so changes from outside are still announced
+	d.onMounted(&stick, "/media/STICK")
+	d.mu.Lock()
+	delete(d.mounted, stick.Path)
+	d.ownMounts[stick.Path] = ownMount{} // as unmountDevice records it
+	d.mu.Unlock()
+	time.Sleep(50 * time.Millisecond)
+	backend.SetMounted(stick.Path, "/media/STICK")
+	time.Sleep(50 * time.Millisecond)
+	backend.SetMounted(stick.Path, "")
+	waitFor(t, "device_changed hooks", func() bool {
+		return readLog() == "mounted /dev/da0p1\nchanged /dev/da0p1 mount_point\n"+
+			"mounted /dev/da0p1\nchanged /dev/da0p1 mount_point\nchanged /dev/da0p1 mount_point\n"
+	})
+}
+
+// scriptedPrompter answers prompts with the given passwords in turn, and
+// questions with remember
+type scriptedPrompter struct {
+	answers   []string
+	remember  bool
+	requests  []prompt.Request
+	questions []prompt.Request
+}
+
+func (p *scriptedPrompter) GetPassphrase(req prompt.Request) ([]byte, error) {
+	p.requests = append(p.requests, req)
+	if len(p.requests) > len(p.answers) {
+		return nil, prompt.ErrCanceled
+	}
+	return []byte(p.answers[len(p.requests)-1]), nil
+}
+
+func (p *scriptedPrompter) Confirm(req prompt.Request) (bool, error) {
+	p.questions = append(p.questions, req)
+	return p.remember, nil
+}
+
+// mapKeyring is a Keyring in memory
+type mapKeyring map[string]string
+
+func (k mapKeyring) Lookup(uuid string) ([]byte, error) {
+	if password, ok := k[uuid]; ok {
+		return []byte(password), nil
+	}
+	return nil, nil
+}
+
+func (k mapKeyring) Store(uuid, label string, password []byte) error {
+	k[uuid] = string(password)
+	return nil
+}
+
+// passwordCrypto unlocks devices of a FakeBackend given the right password,
+// creating a LUKS mapping or, for GELI, a .eli provider
+type passwordCrypto struct {
+	backend  *device.FakeBackend
+	password string
+}
+
+func (c *passwordCrypto) Unlock(dev *device.Device, key device.Key, opts device.UnlockOptions) error {
+	if string(key.Passphrase) != c.password {
+		return errors.New("no key available with this passphrase")
+	}
+	path := "/dev/mapper/luks-" + dev.UUID
+	if dev.FSType == "geli" {
+		path = dev.Path + ".eli"
+	}
+	c.backend.Update(dev.Path, func(d *device.Device) { d.IsUnlocked = true })
+	c.backend.Insert(device.Device{Name: filepath.Base(path), Path: path,
+		Parent: dev.Path, IsPartition: true, IsRemovable: true, FSType: "ext4"})
+	return nil
+}
+
+func (c *passwordCrypto) Lock(dev, cleartext *device.Device) error {
+	c.backend.Remove(cleartext.Path)
+	c.backend.Update(dev.Path, func(d *device.Device) { d.IsUnlocked = false })
+	return nil
+}
+
+func TestDaemonUnlockPrompt(t *testing.T) {
+	cfg := config.Default()
+	cfg.Notifications.Enabled = false
+	cfg.Encryption.CacheTimeout = 3600
+
+	backend := device.NewFakeBackend(device.Device{Name: "sdb1", Path: "/dev/sdb1", IsPartition: true,
+		IsRemovable: true, FSType: "crypto_LUKS", UUID: "0a1b2c3d", Label: "BACKUP", Size: 16 << 30, IsEncrypted: true})
+	device.RegisterCryptoBackend("crypto_LUKS", &passwordCrypto{backend: backend, password: "secret"})
+	defer device.RegisterCryptoBackend("crypto_LUKS", device.LUKSBackend{})
+
+	mgr := device.NewManagerWithBackend(backend)
+	if _, err := mgr.Scan(); err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewWithManager(cfg, mgr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prompter := &scriptedPrompter{answers: []string{"wrong", "secret"}}
+	d.prompter = prompter
+
+	dev, _ := mgr.GetDevice("/dev/sdb1")
+	cleartext, err := d.unlockDevice(&dev)
+	if err != nil {
+		t.Fatalf("Unlock failed: %v", err)
+	}
+	if cleartext.Path != "/dev/mapper/luks-0a1b2c3d" {
+		t.Errorf("Unexpected cleartext device %s", cleartext.Path)
+	}
+
+	if len(prompter.requests) != 2 {
+		t.Fatalf("Expected 2 prompts, got %d", len(prompter.requests))
+	}
+	first, second := prompter.requests[0], prompter.requests[1]
+	if first.Error != "" || second.Error == "" {
+		t.Errorf("Only the retry should show an error, got %q and %q", first.Error, second.Error)
+	}
+	if want := "Enter the password for BACKUP (/dev/sdb1, 16.00 GB)"; first.Description != want {
+		t.Errorf("Description = %q, want %q", first.Description, want)
+	}
+
+	// Plugged in again, the cached password unlocks without a prompt
+	if err := mgr.Lock("/dev/sdb1"); err != nil {
+		t.Fatal(err)
+	}
+	dev, _ = mgr.GetDevice("/dev/sdb1")
+	if _, err := d.unlockDevice(&dev); err != nil {
+		t.Fatalf("Unlock with cached password failed: %v", err)
+	}
+	if len(prompter.requests) != 2 {
+		t.Errorf("Cached password should not prompt, got %d prompts", len(prompter.requests))
+	}
+
+	// A canceled prompt gives up
+	d.ForgetPasswords()
+	if err := mgr.Lock("/dev/sdb1"); err != nil {
+		t.Fatal(err)
+	}
+	dev, _ = mgr.GetDevice("/dev/sdb1")
+	if _, err := d.unlockDevice(&dev); !errors.Is(err, prompt.ErrCanceled) {
+		t.Errorf("Expected ErrCanceled, got %v", err)
+	}
+}
+
+func TestDaemonCacheGELIPassword(t *testing.T) {
+	cfg := config.Default()
+	cfg.Notifications.Enabled = false
+	cfg.Encryption.CacheTimeout = 3600
+
+	// GELI providers have no UUID, the partition GUID stands in for it
+	backend := device.NewFakeBackend(device.Device{Name: "da0p1", Path: "/dev/da0p1", IsPartition: true,
+		IsRemovable: true, FSType: "geli", PartUUID: "5e2a91b0-1c3d-4e5f-8a9b-0c1d2e3f4a5b", IsEncrypted: true})
+	device.RegisterCryptoBackend("geli", &passwordCrypto{backend: backend, password: "secret"})
+	defer device.RegisterCryptoBackend("geli", device.GELIBackend{})
+
+	mgr := device.NewManagerWithBackend(backend)
+	if _, err := mgr.Scan(); err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewWithManager(cfg, mgr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prompter := &scriptedPrompter{answers: []string{"secret"}}
+	d.prompter = prompter
+
+	dev, _ := mgr.GetDevice("/dev/da0p1")
+	if _, err := d.unlockDevice(&dev); err != nil {
+		t.Fatalf("Unlock failed: %v", err)
+	}
+	if err := mgr.Lock("/dev/da0p1"); err != nil {
+		t.Fatal(err)
+	}
+	dev, _ = mgr.GetDevice("/dev/da0p1")
+	if _, err := d.unlockDevice(&dev); err != nil {
+		t.Fatalf("Unlock with cached password failed: %v", err)
+	}
+	if len(prompter.requests) != 1 {
+		t.Errorf("The cached password should unlock the provider, got %d prompts", len(prompter.requests))
+	}
+}
+
+func TestDaemonUnlockKeyring(t *testing.T) {
+	cfg := config.Default()
+	cfg.Notifications.Enabled = false
+
+	backend := device.NewFakeBackend(device.Device{Name: "sdb1", Path: "/dev/sdb1", IsPartition: true,
+		IsRemovable: true, FSType: "crypto_LUKS", UUID: "0a1b2c3d", Label: "BACKUP", IsEncrypted: true})
+	device.RegisterCryptoBackend("crypto_LUKS", &passwordCrypto{backend: backend, password: "secret"})
+	defer device.RegisterCryptoBackend("crypto_LUKS", device.LUKSBackend{})
+
+	mgr := device.NewManagerWithBackend(backend)
+	if _, err := mgr.Scan(); err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewWithManager(cfg, mgr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prompter := &scriptedPrompter{answers: []string{"secret"}, remember: true}
+	d.prompter = prompter
+	keyring := mapKeyring{"0a1b2c3d": "outdated"}
+	d.SetKeyring(keyring)
+
+	// A password in the keyring that no longer works falls back to the
+	// prompt, which offers to remember the new one
+	dev, _ := mgr.GetDevice("/dev/sdb1")
+	if _, err := d.unlockDevice(&dev); err != nil {
+		t.Fatalf("Unlock failed: %v", err)
+	}
+	if len(prompter.requests) != 1 || len(prompter.questions) != 1 {
+		t.Fatalf("Expected one prompt and one question, got %d and %d", len(prompter.requests), len(prompter.questions))
+	}
+	if keyring["0a1b2c3d"] != "secret" {
+		t.Errorf("Keyring has %q, want the new password", keyring["0a1b2c3d"])
+	}
+
+	// Next time the keyring unlocks the device without asking
+	if err := mgr.Lock("/dev/sdb1"); err != nil {
+		t.Fatal(err)
+	}
+	dev, _ = mgr.GetDevice("/dev/sdb1")
+	if _, err := d.unlockDevice(&dev); err != nil {
+		t.Fatalf("Unlock from the keyring failed: %v", err)
+	}
+	if len(prompter.requests) != 1 || len(prompter.questions) != 1 {
+		t.Errorf("The keyring should unlock without prompts, got %d and %d", len(prompter.requests), len(prompter.questions))
+	}
+}
+
+func TestDaemonKeyringGELI(t *testing.T) {
+	cfg := config.Default()
+	cfg.Notifications.Enabled = false
+
+	backend := device.NewFakeBackend(device.Device{Name: "da0p1", Path: "/dev/da0p1", IsPartition: true,
+		IsRemovable: true, FSType: "geli", PartUUID: "5e2a91b0", IsEncrypted: true})
+	device.RegisterCryptoBackend("geli", &passwordCrypto{backend: backend, password: "secret"})
+	defer device.RegisterCryptoBackend("geli", device.GELIBackend{})
+
+	mgr := device.NewManagerWithBackend(backend)
+	if _, err := mgr.Scan(); err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewWithManager(cfg, mgr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prompter := &scriptedPrompter{answers: []string{"secret"}, remember: true}
+	d.prompter = prompter
+	keyring := mapKeyring{}
+	d.SetKeyring(keyring)
+
+	// GELI providers have no UUID, and are remembered by partition GUID
+	dev, _ := mgr.GetDevice("/dev/da0p1")
+	if _, err := d.unlockDevice(&dev); err != nil {
+		t.Fatalf("Unlock failed: %v", err)
+	}
+	if keyring["partuuid:5e2a91b0"] != "secret" {
+		t.Fatalf("Keyring has %v, want the password by partition GUID", keyring)
+	}
+
+	if err := mgr.Lock("/dev/da0p1"); err != nil {
+		t.Fatal(err)
+	}
+	dev, _ = mgr.GetDevice("/dev/da0p1")
+	if _, err := d.unlockDevice(&dev); err != nil {
+		t.Fatalf("Unlock from the keyring failed: %v", err)
+	}
+	if len(prompter.requests) != 1 {
+		t.Errorf("The keyring should unlock without a prompt, got %d prompts", len(prompter.requests))
+	}
+}
+
+// keyfileCrypto attaches GELI providers of a FakeBackend with whatever key
+// it is given, and records the keys
+type keyfileCrypto struct {
+	backend *device.FakeBackend
+	keys    []device.Key
+}
+
+func (c *keyfileCrypto) Unlock(dev *device.Device, key device.Key, opts device.UnlockOptions) error {
+	key.Passphrase = append([]byte(nil), key.Passphrase...)
+	c.keys = append(c.keys, key)
+	c.backend.Update(dev.Path, func(d *device.Device) { d.IsUnlocked = true })
+	c.backend.Insert(device.Device{Name: dev.Name + ".eli", Path: dev.Path + ".eli",
+		Parent: dev.Path, IsPartition: true, IsRemovable: true, FSType: "ufs"})
+	return nil
+}
+
+func (c *keyfileCrypto) Lock(dev, cleartext *device.Device) error {
+	c.backend.Remove(cleartext.Path)
+	c.backend.Update(dev.Path, func(d *device.Device) { d.IsUnlocked = false })
+	return nil
+}
+
+func TestDaemonUnlockGELIKeyFiles(t *testing.T) {
+	dir := t.TempDir()
+	first, second := filepath.Join(dir, "first.key"), filepath.Join(dir, "second.key")
+	for _, keyfile := range []string{first, second} {
+		if err := os.WriteFile(keyfile, []byte("key"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	geli := &config.GELIProviderConfig{KeyFiles: []string{second, first}, Passphrase: true}
+	cfg := config.Default()
+	cfg.Notifications.Enabled = false
+	cfg.Devices = []config.DeviceConfig{{DevicePath: "/dev/da0p1", GELI: geli}}
+
+	backend := device.NewFakeBackend(device.Device{Name: "da0p1", Path: "/dev/da0p1", IsPartition: true,
+		IsRemovable: true, FSType: "geli", IsEncrypted: true})
+	crypto := &keyfileCrypto{backend: backend}
+	device.RegisterCryptoBackend("geli", crypto)
+	defer device.RegisterCryptoBackend("geli", device.GELIBackend{})
+
+	mgr := device.NewManagerWithBackend(backend)
+	if _, err := mgr.Scan(); err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewWithManager(cfg, mgr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prompter := &scriptedPrompter{answers: []string{"secret"}}
+	d.prompter = prompter
+
+	// Keyfiles in the configured order, along with the passphrase
+	dev, _ := mgr.GetDevice("/dev/da0p1")
+	if _, err := d.unlockDevice(&dev); err != nil {
+		t.Fatalf("Unlock failed: %v", err)
+	}
+	key := crypto.keys[0]
+	if strings.Join(key.KeyFiles, " ") != second+" "+first || string(key.Passphrase) != "secret" || key.NoPassphrase {
+		t.Errorf("Unexpected key %+v", key)
+	}
+
+	// Keyfiles only, without a prompt
+	geli.Passphrase = false
+	if err := mgr.Lock("/dev/da0p1"); err != nil {
+		t.Fatal(err)
+	}
+	dev, _ = mgr.GetDevice("/dev/da0p1")
+	if _, err := d.unlockDevice(&dev); err != nil {
+		t.Fatalf("Unlock failed: %v", err)
+	}
+	if key := crypto.keys[1]; key.Passphrase != nil || !key.NoPassphrase || len(prompter.requests) != 1 {
+		t.Errorf("Unexpected key %+v after %d prompts", key, len(prompter.requests))
+	}
+
+	// A missing keyfile is reported with the device it is for
+	geli.KeyFiles = []string{first, filepath.Join(dir, "missing.key")}
+	if err := mgr.Lock("/dev/da0p1"); err != nil {
+		t.Fatal(err)
+	}
+	dev, _ = mgr.GetDevice("/dev/da0p1")
+	_, err = d.unlockDevice(&dev)
+	if err == nil || !strings.Contains(err.Error(), "/dev/da0p1") || !strings.Contains(err.Error(), "missing.key") {
+		t.Errorf("Expected an error naming the device and keyfile, got %v", err)
+	}
+	if len(crypto.keys) != 2 {
+		t.Errorf("Nothing should be unlocked with a missing keyfile")
+	}
+}
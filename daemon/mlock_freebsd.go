@@ -0,0 +1,27 @@
+package daemon
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// mlock keeps the pages of b in memory. The syscall package has no wrapper
+// for mlock(2) on FreeBSD.
+func mlock(b []byte) error {
+	return memoryLockCall(syscall.SYS_MLOCK, b)
+}
+
+// munlock allows the pages of b to be swapped out again
+func munlock(b []byte) error {
+	return memoryLockCall(syscall.SYS_MUNLOCK, b)
+}
+
+func memoryLockCall(trap uintptr, b []byte) error {
+	if len(b) == 0 {
+		return nil
+	}
+	if _, _, errno := syscall.Syscall(trap, uintptr(unsafe.Pointer(&b[0])), uintptr(len(b)), 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+package daemon
+
+import "syscall"
+
+// mlock keeps the pages of b in memory
+func mlock(b []byte) error {
+	return syscall.Mlock(b)
+}
+
+// munlock allows the pages of b to be swapped out again
+func munlock(b []byte) error {
+	return syscall.Munlock(b)
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !freebsd
+
+package daemon
+
+// mlock is a no-op where memory cannot be locked
+func mlock(b []byte) error {
+	return nil
+}
+
+// munlock is a no-op where memory cannot be locked
+func munlock(b []byte) error {
+	return nil
+}
@@ -0,0 +1,132 @@
+package daemon
+
+import (
+	"log"
+	"os"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// passwordCache keeps the passphrases of encrypted devices by their
+// device.Device.StableID for a while, so a device is not prompted for again when it is plugged back in.
+// Passphrases live in memory that is locked out of swap and are zeroed
+// when they expire or the cache is flushed.
+type passwordCache struct {
+	mu      sync.Mutex
+	timeout time.Duration
+	entries map[string]*cachedPassword
+}
+
+// cachedPassword is a passphrase in locked memory and the timer that
+// expires it
+type cachedPassword struct {
+	secret []byte
+	timer  *time.Timer
+}
+
+// newPasswordCache creates a cache that keeps passphrases for timeout, or
+// none if timeout is zero
+func newPasswordCache(timeout time.Duration) *passwordCache {
+	return &passwordCache{
+		timeout: timeout,
+		entries: make(map[string]*cachedPassword),
+	}
+}
+
+// Get returns a copy of the passphrase cached for id, which the caller
+// should zero once it is done with it
+func (c *passwordCache) Get(id string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[id]
+	if !ok {
+		return nil, false
+	}
+	return append([]byte(nil), entry.secret...), true
+}
+
+// Put caches a copy of passphrase for id. Devices without a stable ID are
+// not cached, since their path may belong to another device next time.
+func (c *passwordCache) Put(id string, passphrase []byte) {
+	if c.timeout <= 0 || id == "" {
+		return
+	}
+
+	entry := &cachedPassword{secret: lockedBuffer(len(passphrase))}
+	copy(entry.secret, passphrase)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.remove(id)
+	entry.timer = time.AfterFunc(c.timeout, func() { c.expire(id, entry) })
+	c.entries[id] = entry
+}
+
+// Forget drops the passphrase cached for id, e.g. one that no longer
+// unlocks the device
+func (c *passwordCache) Forget(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.remove(id)
+}
+
+// Flush drops every cached passphrase and returns how many there were
+func (c *passwordCache) Flush() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := len(c.entries)
+	for id := range c.entries {
+		c.remove(id)
+	}
+	return n
+}
+
+// expire drops entry once its timeout has passed, unless it has been
+// replaced in the meantime
+func (c *passwordCache) expire(id string, entry *cachedPassword) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries[id] == entry {
+		c.remove(id)
+	}
+}
+
+// remove zeroes and drops the entry for id. The caller holds c.mu.
+func (c *passwordCache) remove(id string) {
+	entry, ok := c.entries[id]
+	if !ok {
+		return
+	}
+	entry.timer.Stop()
+	wipeBuffer(entry.secret)
+	delete(c.entries, id)
+}
+
+// lockedBuffer returns a buffer of n bytes on pages of its own, locked into
+// memory so that it is never written to swap. The Go heap does not move
+// objects, so the pages stay put until the buffer is wiped.
+func lockedBuffer(n int) []byte {
+	page := os.Getpagesize()
+	size := (n/page + 1) * page
+	raw := make([]byte, size+page)
+	offset := (page - int(uintptr(unsafe.Pointer(&raw[0]))%uintptr(page))) % page
+	buf := raw[offset : offset+n : offset+size]
+
+	if err := mlock(buf[:size]); err != nil {
+		log.Printf("Failed to lock passphrase memory: %v", err)
+	}
+	return buf
+}
+
+// wipeBuffer zeroes a buffer from lockedBuffer and unlocks its pages
+func wipeBuffer(buf []byte) {
+	clear(buf[:cap(buf)])
+	if err := munlock(buf[:cap(buf)]); err != nil {
+		log.Printf("Failed to unlock passphrase memory: %v", err)
+	}
+}
@@ -0,0 +1,106 @@
+package daemon
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pgsdf/pgmount/config"
+	"github.com/pgsdf/pgmount/device"
+)
+
+// isZero reports whether every byte of a cached secret, including the rest
+// of its pages, is zero
+func isZero(secret []byte) bool {
+	for _, b := range secret[:cap(secret)] {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestPasswordCacheExpiry(t *testing.T) {
+	c := newPasswordCache(20 * time.Millisecond)
+
+	c.Put("0a1b2c3d", []byte("secret"))
+	secret := c.entries["0a1b2c3d"].secret
+
+	got, ok := c.Get("0a1b2c3d")
+	if !ok || string(got) != "secret" {
+		t.Fatalf("Get() = %q, %v", got, ok)
+	}
+	// Callers zero their copy, which must leave the cache intact
+	clear(got)
+	if got, _ := c.Get("0a1b2c3d"); string(got) != "secret" {
+		t.Errorf("Cached password changed to %q", got)
+	}
+
+	waitFor(t, "expiry", func() bool {
+		_, ok := c.Get("0a1b2c3d")
+		return !ok
+	})
+	if !isZero(secret) {
+		t.Errorf("Expired password was not zeroed: %q", secret)
+	}
+}
+
+func TestPasswordCacheFlush(t *testing.T) {
+	c := newPasswordCache(time.Hour)
+
+	c.Put("0a1b2c3d", []byte("old"))
+	old := c.entries["0a1b2c3d"].secret
+	c.Put("0a1b2c3d", []byte("secret"))
+	if !isZero(old) {
+		t.Errorf("Replaced password was not zeroed: %q", old)
+	}
+	c.Put("4e5f6071", []byte("other"))
+	secrets := [][]byte{c.entries["0a1b2c3d"].secret, c.entries["4e5f6071"].secret}
+
+	c.Forget("4e5f6071")
+	if _, ok := c.Get("4e5f6071"); ok || !isZero(secrets[1]) {
+		t.Error("Forgotten password should be gone and zeroed")
+	}
+
+	if n := c.Flush(); n != 1 {
+		t.Errorf("Flush() = %d, want 1", n)
+	}
+	if _, ok := c.Get("0a1b2c3d"); ok || !isZero(secrets[0]) {
+		t.Error("Flushed password should be gone and zeroed")
+	}
+}
+
+func TestPasswordCacheDisabled(t *testing.T) {
+	c := newPasswordCache(0)
+	c.Put("0a1b2c3d", []byte("secret"))
+	if _, ok := c.Get("0a1b2c3d"); ok {
+		t.Error("A zero timeout should disable the cache")
+	}
+
+	c = newPasswordCache(time.Hour)
+	c.Put("", []byte("secret"))
+	if len(c.entries) != 0 {
+		t.Error("Devices without a UUID should not be cached")
+	}
+}
+
+func TestDaemonStopForgetsPasswords(t *testing.T) {
+	cfg := config.Default()
+	cfg.Encryption.CacheTimeout = 3600
+
+	d, err := NewWithManager(cfg, device.NewManagerWithBackend(device.NewFakeBackend()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.pollInterval = 10 * time.Millisecond
+	if err := d.Start(); err != nil {
+		t.Fatalf("Failed to start daemon: %v", err)
+	}
+
+	d.passwords.Put("0a1b2c3d", []byte("secret"))
+	secret := d.passwords.entries["0a1b2c3d"].secret
+	d.Stop()
+
+	if _, ok := d.passwords.Get("0a1b2c3d"); ok || !isZero(secret) {
+		t.Error("Stopping the daemon should zero cached passwords")
+	}
+}
@@ -0,0 +1,139 @@
+package device
+
+import (
+	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/pgsdf/pgmount/device/parttable"
+	"github.com/pgsdf/pgmount/device/probe"
+)
+
+// Backend discovers devices and their state on a particular platform
+type Backend interface {
+	// Scan returns the removable devices and everything stacked on them
+	Scan() ([]*Device, error)
+
+	// Probe fills in the filesystem type, label and UUID of a device
+	Probe(dev *Device) error
+
+	// MountTable returns the currently mounted filesystems
+	MountTable() ([]MountEntry, error)
+
+	// Usage returns the space statistics of the filesystem mounted at
+	// mountPoint
+	Usage(mountPoint string) (Usage, error)
+}
+
+// DefaultBackend returns the backend for the running operating system,
+// or nil if the platform is not supported
+func DefaultBackend() Backend {
+	switch runtime.GOOS {
+	case "freebsd":
+		return &GeomBackend{}
+	case "linux":
+		return &SysfsBackend{Fallback: &LsblkBackend{}}
+	}
+	return nil
+}
+
+// setPartitionTypeNames fills in the friendly name of each partition type
+func setPartitionTypeNames(devices []*Device) {
+	for _, dev := range devices {
+		if dev.PartitionTypeName == "" {
+			dev.PartitionTypeName = parttable.TypeName(dev.PartitionScheme, dev.PartitionType)
+		}
+	}
+}
+
+// setPartitionEntry records the partition table entry of a partition as
+// reported by udev or lsblk, which call MBR tables "dos" and write MBR
+// types as "0xc"
+func setPartitionEntry(dev *Device, scheme, typ, label, uuid string) {
+	dev.PartitionScheme = partitionScheme(scheme)
+	if hexType, ok := strings.CutPrefix(strings.ToLower(typ), "0x"); ok {
+		if id, err := strconv.ParseUint(hexType, 16, 8); err == nil {
+			typ = fmt.Sprintf("%02x", id)
+		}
+	}
+	dev.PartitionType = strings.ToLower(typ)
+	dev.PartitionLabel = label
+	dev.PartUUID = strings.ToLower(uuid)
+}
+
+// partitionScheme returns the name of a partition table as udev, lsblk or
+// GEOM report it, e.g. "dos" or "GPT", in the form PartitionScheme uses
+func partitionScheme(scheme string) string {
+	scheme = strings.ToLower(scheme)
+	if scheme == "dos" {
+		return "mbr"
+	}
+	return scheme
+}
+
+// applyPartitionTables reads the partition table of every disk whose
+// partitions were found without their table entries, e.g. when udev has
+// not recorded them, and fills the entries in by partition number
+func applyPartitionTables(devices []*Device) {
+	byParent := make(map[string][]*Device)
+	for _, dev := range devices {
+		if dev.IsPartition && dev.PartitionNum > 0 && dev.PartitionType == "" {
+			byParent[dev.Parent] = append(byParent[dev.Parent], dev)
+		}
+	}
+
+	for disk, parts := range byParent {
+		table, err := parttable.ReadFile(disk)
+		if err != nil {
+			continue
+		}
+		for _, dev := range parts {
+			entry, ok := table.Find(dev.PartitionNum)
+			if !ok {
+				continue
+			}
+			dev.PartitionScheme = entry.Scheme
+			dev.PartitionType = entry.Type
+			dev.PartitionLabel = entry.Label
+			dev.PartUUID = entry.UUID
+		}
+	}
+}
+
+// probeWholeDisks probes disks that have neither partitions nor a known
+// filesystem, to find filesystems written to the whole disk, and discs that
+// the scanner did not probe
+func probeWholeDisks(backend Backend, devices []*Device) {
+	for _, dev := range devices {
+		if dev.IsPartition || !dev.MediaPresent || dev.FSType != "" ||
+			dev.PartitionTable != "" || len(dev.Children) > 0 {
+			continue
+		}
+		backend.Probe(dev)
+	}
+}
+
+// probeDevice reads the superblock of a device to detect its filesystem
+func probeDevice(dev *Device) error {
+	res, err := probe.ProbeFile(dev.Path)
+	if err == probe.ErrUnknown && dev.PartitionTable == "" {
+		// VeraCrypt volumes have no signature, only a random-looking header
+		dev.MaybeVeraCrypt = probe.IsVeraCryptCandidateFile(dev.Path)
+		dev.IsEncrypted = dev.MaybeVeraCrypt
+	}
+	if err != nil {
+		return err
+	}
+
+	dev.FSType = res.Type
+	if res.Label != "" {
+		dev.Label = res.Label
+	}
+	if res.UUID != "" {
+		dev.UUID = res.UUID
+	}
+	dev.IsEncrypted = isEncryptedType(res.Type)
+
+	return nil
+}
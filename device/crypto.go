@@ -0,0 +1,351 @@
+package device
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CryptoBackend unlocks one kind of encrypted container. Once unlocked, the
+// scanners find the cleartext device (a GELI ".eli" provider or a
+// device-mapper node) as a child of the encrypted device, and it is probed
+// and mounted like any partition.
+type CryptoBackend interface {
+	// Unlock opens dev with key and creates its cleartext device
+	Unlock(dev *Device, key Key, opts UnlockOptions) error
+	// Lock removes the cleartext device of dev
+	Lock(dev, cleartext *Device) error
+}
+
+// Key holds what unlocks an encrypted device: a passphrase, keyfiles or,
+// for GELI and VeraCrypt, both
+type Key struct {
+	Passphrase []byte
+	// Keyfiles in the order their contents are combined, "-" for KeyData,
+	// which is passed on a descriptor of its own. GELI and VeraCrypt take
+	// several, LUKS and BitLocker one.
+	KeyFiles     []string
+	KeyData      []byte // Keyfile contents read from a key device
+	NoPassphrase bool   // The GELI provider has keyfiles only (geli attach -p)
+}
+
+// UnlockOptions controls how an encrypted device is opened
+type UnlockOptions struct {
+	ReadOnly bool // Create a read-only cleartext device
+	PIM      int  // VeraCrypt personal iterations multiplier, 0 for the default
+}
+
+// cryptoBackends holds the backend for each encrypted container type, by
+// the FSType the probe reports for it
+var cryptoBackends = map[string]CryptoBackend{
+	"geli":        GELIBackend{},
+	"crypto_LUKS": LUKSBackend{},
+	"BitLocker":   BitLockerBackend{},
+	// VeraCrypt volumes have no signature, see Device.MaybeVeraCrypt
+	"tcrypt": VeraCryptBackend{},
+}
+
+// keyDataPath is where geli(8) and cryptsetup(8) read KeyData from, so
+// standard input stays free for the passphrase. On FreeBSD this needs
+// fdescfs(5) mounted on /dev/fd.
+const keyDataPath = "/dev/fd/3"
+
+// fdDir lists the open file descriptors of a process. This is a variable so
+// tests can point it elsewhere.
+var fdDir = "/dev/fd"
+
+// cryptCommand runs geli(8) or cryptsetup(8) with stdin as its input and
+// keyData, if any, readable at keyDataPath. This is a variable so tests can
+// stand in for them.
+var cryptCommand = func(stdin, keyData []byte, name string, args ...string) ([]byte, error) {
+	cmd := exec.Command(name, args...)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	if keyData != nil {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		// Without fdescfs, FreeBSD's /dev/fd only has standard input, output
+		// and error, and the command would fail on a missing keyfile
+		if _, err := os.Stat(filepath.Join(fdDir, strconv.Itoa(int(r.Fd())))); err != nil {
+			w.Close()
+			return nil, fmt.Errorf("cannot pass the key to %s: %s does not list open files, mount fdescfs(5) on it", name, fdDir)
+		}
+		go func() {
+			w.Write(keyData)
+			w.Close()
+		}()
+		cmd.ExtraFiles = []*os.File{r}
+	}
+	return cmd.CombinedOutput()
+}
+
+// keyFileArg returns the path a keyfile is read from, keyDataPath for "-"
+func keyFileArg(keyfile string) string {
+	if keyfile == "-" {
+		return keyDataPath
+	}
+	return keyfile
+}
+
+// Time between scans while waiting for a cleartext device to appear
+var cleartextScanInterval = 100 * time.Millisecond
+
+// RegisterCryptoBackend sets the backend that unlocks devices of the given
+// FSType, e.g. to support another container format
+func RegisterCryptoBackend(fstype string, backend CryptoBackend) {
+	cryptoBackends[fstype] = backend
+}
+
+// isEncryptedType reports whether fstype is an encrypted container
+func isEncryptedType(fstype string) bool {
+	_, ok := cryptoBackends[fstype]
+	return ok
+}
+
+// cryptoBackendFor returns the backend that unlocks dev
+func cryptoBackendFor(dev *Device) (CryptoBackend, bool) {
+	if backend, ok := cryptoBackends[dev.FSType]; ok {
+		return backend, true
+	}
+	if dev.MaybeVeraCrypt {
+		backend, ok := cryptoBackends["tcrypt"]
+		return backend, ok
+	}
+	return nil, false
+}
+
+// GELIBackend unlocks FreeBSD GELI providers with geli(8)
+type GELIBackend struct{}
+
+// Unlock attaches the provider, creating <provider>.eli
+func (GELIBackend) Unlock(dev *Device, key Key, opts UnlockOptions) error {
+	args := []string{"attach"}
+	if opts.ReadOnly {
+		args = append(args, "-r")
+	}
+	if key.NoPassphrase {
+		args = append(args, "-p")
+	}
+	for _, keyfile := range key.KeyFiles {
+		args = append(args, "-k", keyFileArg(keyfile))
+	}
+	var stdin []byte
+	if key.Passphrase != nil {
+		// Read the passphrase from standard input rather than the terminal
+		args = append(args, "-j", "-")
+		stdin = append(append(stdin, key.Passphrase...), '\n')
+		defer clear(stdin)
+	}
+	args = append(args, dev.Path)
+
+	if output, err := cryptCommand(stdin, key.KeyData, "geli", args...); err != nil {
+		return fmt.Errorf("geli attach failed: %w (output: %s)", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// Lock detaches the .eli provider
+func (GELIBackend) Lock(dev, cleartext *Device) error {
+	if output, err := cryptCommand(nil, nil, "geli", "detach", filepath.Base(cleartext.Path)); err != nil {
+		return fmt.Errorf("geli detach failed: %w (output: %s)", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// LUKSBackend unlocks LUKS1 and LUKS2 containers with cryptsetup(8)
+type LUKSBackend struct{}
+
+// Unlock opens the container as /dev/mapper/luks-<uuid>
+func (LUKSBackend) Unlock(dev *Device, key Key, opts UnlockOptions) error {
+	return cryptsetupOpen(dev, "luks", key, opts)
+}
+
+// Lock closes the device-mapper node
+func (LUKSBackend) Lock(dev, cleartext *Device) error {
+	return cryptsetupClose(cleartext)
+}
+
+// BitLockerBackend unlocks BitLocker and BitLocker To Go volumes with
+// cryptsetup(8). A recovery key works in place of the passphrase.
+type BitLockerBackend struct{}
+
+// Unlock opens the volume as /dev/mapper/bitlk-<uuid>
+func (BitLockerBackend) Unlock(dev *Device, key Key, opts UnlockOptions) error {
+	return cryptsetupOpen(dev, "bitlk", key, opts)
+}
+
+// Lock closes the device-mapper node
+func (BitLockerBackend) Lock(dev, cleartext *Device) error {
+	return cryptsetupClose(cleartext)
+}
+
+// VeraCryptBackend unlocks VeraCrypt and TrueCrypt volumes with
+// cryptsetup(8)
+type VeraCryptBackend struct{}
+
+// Unlock opens the volume as /dev/mapper/tcrypt-<name>
+func (VeraCryptBackend) Unlock(dev *Device, key Key, opts UnlockOptions) error {
+	return cryptsetupOpen(dev, "tcrypt", key, opts)
+}
+
+// Lock closes the device-mapper node
+func (VeraCryptBackend) Lock(dev, cleartext *Device) error {
+	return cryptsetupClose(cleartext)
+}
+
+// cryptsetupOpen opens dev as /dev/mapper/<type>-<uuid>
+func cryptsetupOpen(dev *Device, cryptType string, key Key, opts UnlockOptions) error {
+	args := []string{"open", "--type", cryptType}
+	if opts.ReadOnly {
+		args = append(args, "--readonly")
+	}
+	if cryptType == "tcrypt" {
+		args = append(args, "--veracrypt")
+		if opts.PIM > 0 {
+			args = append(args, "--veracrypt-pim", strconv.Itoa(opts.PIM))
+		}
+	}
+
+	if len(key.KeyFiles) > 1 && cryptType != "tcrypt" {
+		return fmt.Errorf("%s takes a single keyfile", cryptType)
+	}
+	for _, keyfile := range key.KeyFiles {
+		args = append(args, "--key-file", keyFileArg(keyfile))
+	}
+	var stdin []byte
+	// Without --key-file cryptsetup reads one line from standard input.
+	// TrueCrypt keyfiles are combined with the passphrase instead of
+	// replacing it.
+	if len(key.KeyFiles) == 0 || cryptType == "tcrypt" {
+		stdin = append(append(stdin, key.Passphrase...), '\n')
+		defer clear(stdin)
+	}
+	args = append(args, dev.Path, mapperName(cryptType, dev))
+
+	if output, err := cryptCommand(stdin, key.KeyData, "cryptsetup", args...); err != nil {
+		return fmt.Errorf("cryptsetup open failed: %w (output: %s)", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// cryptsetupClose removes the device-mapper node of a cleartext device
+func cryptsetupClose(cleartext *Device) error {
+	if output, err := cryptCommand(nil, nil, "cryptsetup", "close", filepath.Base(cleartext.Path)); err != nil {
+		return fmt.Errorf("cryptsetup close failed: %w (output: %s)", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// mapperName returns the device-mapper name for an unlocked container,
+// following the "luks-<uuid>" convention of udisks
+func mapperName(cryptType string, dev *Device) string {
+	if dev.UUID != "" {
+		return cryptType + "-" + dev.UUID
+	}
+	return cryptType + "-" + dev.Name
+}
+
+// Unlock opens the encrypted device at path with key and returns the
+// cleartext device stacked on it
+func (m *Manager) Unlock(path string, key Key, opts UnlockOptions) (Device, error) {
+	dev, ok := m.GetDevice(path)
+	if !ok {
+		return Device{}, fmt.Errorf("device not found: %s", path)
+	}
+	backend, ok := cryptoBackendFor(&dev)
+	if !ok {
+		return Device{}, fmt.Errorf("%s is not an encrypted device", path)
+	}
+
+	if err := backend.Unlock(&dev, key, opts); err != nil {
+		return Device{}, err
+	}
+	m.SetUnlocked(path, true)
+
+	return m.CleartextDevice(path)
+}
+
+// RestoreGELIMetadata writes the metadata of a GELI provider back from a
+// backup made by geli init or geli backup, for providers whose metadata is
+// kept apart, and returns the provider as it is now. This overwrites the
+// last sector of the device, so it is only done when the user asks.
+func (m *Manager) RestoreGELIMetadata(path, backup string) (Device, error) {
+	if output, err := cryptCommand(nil, nil, "geli", "restore", backup, path); err != nil {
+		return Device{}, fmt.Errorf("geli restore failed: %w (output: %s)", err, strings.TrimSpace(string(output)))
+	}
+	return m.Probe(path)
+}
+
+// Lock removes the cleartext device of an unlocked encrypted device. It
+// fails while the cleartext filesystem is mounted.
+func (m *Manager) Lock(path string) error {
+	m.mu.RLock()
+	dev := m.devices[path]
+	if dev == nil {
+		m.mu.RUnlock()
+		return fmt.Errorf("device not found: %s", path)
+	}
+	if !dev.IsEncrypted || len(dev.Children) == 0 || m.devices[dev.Children[0]] == nil {
+		m.mu.RUnlock()
+		return fmt.Errorf("%s is not unlocked", path)
+	}
+	if m.inUse(dev) {
+		m.mu.RUnlock()
+		return fmt.Errorf("%s is still mounted", path)
+	}
+	locked := dev.clone()
+	cleartext := m.devices[dev.Children[0]].clone()
+	m.mu.RUnlock()
+
+	backend, ok := cryptoBackendFor(&locked)
+	if !ok {
+		return fmt.Errorf("%s is not an encrypted device", path)
+	}
+	if err := backend.Lock(&locked, &cleartext); err != nil {
+		return err
+	}
+
+	m.forget(cleartext.Path)
+	m.SetUnlocked(path, false)
+	return nil
+}
+
+// CleartextDevice returns the device stacked on an unlocked encrypted
+// device. It scans again for a moment while the kernel creates the device
+// and udev probes it.
+func (m *Manager) CleartextDevice(path string) (Device, error) {
+	var found *Device
+	for attempt := 0; attempt < 20; attempt++ {
+		if attempt > 0 {
+			time.Sleep(cleartextScanInterval)
+		}
+		if _, err := m.Scan(); err != nil {
+			return Device{}, err
+		}
+
+		dev, ok := m.GetDevice(path)
+		if !ok || len(dev.Children) == 0 {
+			continue
+		}
+		if child, ok := m.GetDevice(dev.Children[0]); ok {
+			found = &child
+			if child.FSType != "" {
+				break
+			}
+		}
+	}
+
+	if found == nil {
+		return Device{}, fmt.Errorf("no cleartext device found for %s", path)
+	}
+	return *found, nil
+}
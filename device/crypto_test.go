@@ -0,0 +1,264 @@
+package device
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// stubCrypt stands in for geli and cryptsetup, recording each command and
+// the input it was given
+func stubCrypt(t *testing.T) *[]string {
+	runs := []string{}
+	old := cryptCommand
+	cryptCommand = func(stdin, keyData []byte, name string, args ...string) ([]byte, error) {
+		run := name + " " + strings.Join(args, " ")
+		if keyData != nil {
+			run += " 3<" + string(keyData)
+		}
+		runs = append(runs, run+" <"+string(stdin))
+		return nil, nil
+	}
+	t.Cleanup(func() { cryptCommand = old })
+	return &runs
+}
+
+func TestCryptoBackendUnlock(t *testing.T) {
+	runs := stubCrypt(t)
+
+	geli := &Device{Name: "da0p1", Path: "/dev/da0p1", FSType: "geli"}
+	luks := &Device{Name: "sdb1", Path: "/dev/sdb1", FSType: "crypto_LUKS", UUID: "0a1b2c3d-4e5f-6071-8293-a4b5c6d7e8f9"}
+	bitlk := &Device{Name: "sdc1", Path: "/dev/sdc1", FSType: "BitLocker", UUID: "12345678-1234-5678-9abc-def012345678"}
+	vera := &Device{Name: "sdd1", Path: "/dev/sdd1", MaybeVeraCrypt: true}
+
+	tests := []struct {
+		backend CryptoBackend
+		dev     *Device
+		key     Key
+		opts    UnlockOptions
+		want    string
+	}{
+		{GELIBackend{}, geli, Key{Passphrase: []byte("secret")}, UnlockOptions{}, "geli attach -j - /dev/da0p1 <secret\n"},
+		{GELIBackend{}, geli, Key{KeyFiles: []string{"/root/da0p1.key"}}, UnlockOptions{ReadOnly: true},
+			"geli attach -r -k /root/da0p1.key /dev/da0p1 <"},
+		{LUKSBackend{}, luks, Key{Passphrase: []byte("secret")}, UnlockOptions{},
+			"cryptsetup open --type luks /dev/sdb1 luks-0a1b2c3d-4e5f-6071-8293-a4b5c6d7e8f9 <secret\n"},
+		{LUKSBackend{}, luks, Key{KeyFiles: []string{"/root/sdb1.key"}}, UnlockOptions{},
+			"cryptsetup open --type luks --key-file /root/sdb1.key /dev/sdb1 luks-0a1b2c3d-4e5f-6071-8293-a4b5c6d7e8f9 <"},
+		{BitLockerBackend{}, bitlk, Key{Passphrase: []byte("123456-123456")}, UnlockOptions{ReadOnly: true},
+			"cryptsetup open --type bitlk --readonly /dev/sdc1 bitlk-12345678-1234-5678-9abc-def012345678 <123456-123456\n"},
+		{GELIBackend{}, geli, Key{KeyFiles: []string{"-"}, KeyData: []byte("key")}, UnlockOptions{},
+			"geli attach -k /dev/fd/3 /dev/da0p1 3<key <"},
+		{GELIBackend{}, geli, Key{KeyFiles: []string{"/root/a.key", "-", "/root/c.key"}, KeyData: []byte("key"), NoPassphrase: true},
+			UnlockOptions{}, "geli attach -p -k /root/a.key -k /dev/fd/3 -k /root/c.key /dev/da0p1 3<key <"},
+		{GELIBackend{}, geli, Key{Passphrase: []byte("secret"), KeyFiles: []string{"/root/a.key", "-"}, KeyData: []byte("key")},
+			UnlockOptions{}, "geli attach -k /root/a.key -k /dev/fd/3 -j - /dev/da0p1 3<key <secret\n"},
+		{GELIBackend{}, geli, Key{Passphrase: []byte("secret"), KeyFiles: []string{"/root/a.key", "/root/b.key"}}, UnlockOptions{},
+			"geli attach -k /root/a.key -k /root/b.key -j - /dev/da0p1 <secret\n"},
+		{LUKSBackend{}, luks, Key{KeyFiles: []string{"-"}, KeyData: []byte("key")}, UnlockOptions{},
+			"cryptsetup open --type luks --key-file /dev/fd/3 /dev/sdb1 luks-0a1b2c3d-4e5f-6071-8293-a4b5c6d7e8f9 3<key <"},
+		{VeraCryptBackend{}, vera, Key{Passphrase: []byte("secret"), KeyFiles: []string{"/root/tc.key"}}, UnlockOptions{PIM: 485},
+			"cryptsetup open --type tcrypt --veracrypt --veracrypt-pim 485 --key-file /root/tc.key /dev/sdd1 tcrypt-sdd1 <secret\n"},
+		{VeraCryptBackend{}, vera, Key{Passphrase: []byte("secret"), KeyFiles: []string{"-"}, KeyData: []byte("key")}, UnlockOptions{},
+			"cryptsetup open --type tcrypt --veracrypt --key-file /dev/fd/3 /dev/sdd1 tcrypt-sdd1 3<key <secret\n"},
+	}
+
+	for _, tt := range tests {
+		*runs = nil
+		if err := tt.backend.Unlock(tt.dev, tt.key, tt.opts); err != nil {
+			t.Fatalf("Unlock failed: %v", err)
+		}
+		if len(*runs) != 1 || (*runs)[0] != tt.want {
+			t.Errorf("Ran %q, want %q", *runs, tt.want)
+		}
+	}
+}
+
+func TestCryptCommandKeyData(t *testing.T) {
+	if _, err := os.Stat("/dev/fd"); err != nil {
+		t.Skipf("/dev/fd is not available: %v", err)
+	}
+	output, err := cryptCommand([]byte("secret"), []byte("key"), "sh", "-c", "cat "+keyDataPath+"; cat")
+	if err != nil || string(output) != "keysecret" {
+		t.Errorf("cryptCommand() = %q, %v", output, err)
+	}
+}
+
+func TestCryptCommandWithoutFdescfs(t *testing.T) {
+	old := fdDir
+	fdDir = t.TempDir()
+	defer func() { fdDir = old }()
+
+	_, err := cryptCommand(nil, []byte("key"), "cat", keyDataPath)
+	if err == nil || !strings.Contains(err.Error(), "fdescfs") {
+		t.Errorf("Expected an error about fdescfs, got %v", err)
+	}
+}
+
+func TestCryptoBackendSingleKeyFile(t *testing.T) {
+	stubCrypt(t)
+
+	luks := &Device{Name: "sdb1", Path: "/dev/sdb1", FSType: "crypto_LUKS"}
+	if err := (LUKSBackend{}).Unlock(luks, Key{KeyFiles: []string{"/root/a.key", "/root/b.key"}}, UnlockOptions{}); err == nil {
+		t.Error("LUKS cannot take several keyfiles")
+	}
+}
+
+func TestRestoreGELIMetadata(t *testing.T) {
+	// A provider whose metadata was wiped looks like random data
+	backend := NewFakeBackend(Device{Name: "da0p1", Path: "/dev/da0p1", IsPartition: true,
+		IsRemovable: true, MaybeVeraCrypt: true, IsEncrypted: true})
+	m := NewManagerWithBackend(backend)
+	if _, err := m.Scan(); err != nil {
+		t.Fatal(err)
+	}
+
+	runs := stubCrypt(t)
+	old := cryptCommand
+	cryptCommand = func(stdin, keyData []byte, name string, args ...string) ([]byte, error) {
+		backend.Update("/dev/da0p1", func(dev *Device) { dev.FSType = "geli" })
+		return old(stdin, keyData, name, args...)
+	}
+
+	dev, err := m.RestoreGELIMetadata("/dev/da0p1", "/var/backups/da0p1.eli")
+	if err != nil {
+		t.Fatalf("RestoreGELIMetadata failed: %v", err)
+	}
+	if want := "geli restore /var/backups/da0p1.eli /dev/da0p1 <"; len(*runs) != 1 || (*runs)[0] != want {
+		t.Errorf("Ran %q, want %q", *runs, want)
+	}
+	if dev.FSType != "geli" || !dev.IsEncrypted {
+		t.Errorf("Expected the provider to be probed again, got %+v", dev)
+	}
+}
+
+func TestCryptoBackendLock(t *testing.T) {
+	runs := stubCrypt(t)
+
+	tests := []struct {
+		backend   CryptoBackend
+		cleartext *Device
+		want      string
+	}{
+		{GELIBackend{}, &Device{Path: "/dev/da0p1.eli"}, "geli detach da0p1.eli <"},
+		{LUKSBackend{}, &Device{Path: "/dev/mapper/luks-0a1b2c3d"}, "cryptsetup close luks-0a1b2c3d <"},
+		{VeraCryptBackend{}, &Device{Path: "/dev/mapper/tcrypt-sdd1"}, "cryptsetup close tcrypt-sdd1 <"},
+	}
+
+	for _, tt := range tests {
+		*runs = nil
+		if err := tt.backend.Lock(&Device{}, tt.cleartext); err != nil {
+			t.Fatalf("Lock failed: %v", err)
+		}
+		if len(*runs) != 1 || (*runs)[0] != tt.want {
+			t.Errorf("Ran %q, want %q", *runs, tt.want)
+		}
+	}
+}
+
+// fakeCrypto unlocks devices of a FakeBackend by inserting a cleartext
+// device on top of them
+type fakeCrypto struct {
+	backend *FakeBackend
+	keys    []Key
+}
+
+func (f *fakeCrypto) Unlock(dev *Device, key Key, opts UnlockOptions) error {
+	f.keys = append(f.keys, key)
+	f.backend.Update(dev.Path, func(d *Device) { d.IsUnlocked = true })
+	f.backend.Insert(Device{
+		Name:        "luks-" + dev.UUID,
+		Path:        "/dev/mapper/luks-" + dev.UUID,
+		Parent:      dev.Path,
+		IsPartition: true,
+		IsRemovable: true,
+		FSType:      "ext4",
+		Label:       "BACKUP",
+	})
+	return nil
+}
+
+func (f *fakeCrypto) Lock(dev, cleartext *Device) error {
+	f.backend.Remove(cleartext.Path)
+	f.backend.Update(dev.Path, func(d *Device) { d.IsUnlocked = false })
+	return nil
+}
+
+func TestManagerUnlock(t *testing.T) {
+	backend := NewFakeBackend(
+		Device{Name: "sdb", Path: "/dev/sdb", IsRemovable: true, MediaPresent: true},
+		Device{Name: "sdb1", Path: "/dev/sdb1", Parent: "/dev/sdb", IsPartition: true, IsRemovable: true,
+			FSType: "crypto_LUKS", UUID: "0a1b2c3d", IsEncrypted: true},
+		Device{Name: "sdb2", Path: "/dev/sdb2", Parent: "/dev/sdb", IsPartition: true, IsRemovable: true, FSType: "vfat"},
+	)
+	crypto := &fakeCrypto{backend: backend}
+	old := cryptoBackends["crypto_LUKS"]
+	RegisterCryptoBackend("crypto_LUKS", crypto)
+	defer RegisterCryptoBackend("crypto_LUKS", old)
+
+	m := NewManagerWithBackend(backend)
+	if _, err := m.Scan(); err != nil {
+		t.Fatalf("Failed to scan: %v", err)
+	}
+
+	if _, err := m.Unlock("/dev/sdb2", Key{Passphrase: []byte("secret")}, UnlockOptions{}); err == nil {
+		t.Error("Unlocking a plain filesystem should fail")
+	}
+
+	cleartext, err := m.Unlock("/dev/sdb1", Key{Passphrase: []byte("secret")}, UnlockOptions{})
+	if err != nil {
+		t.Fatalf("Unlock failed: %v", err)
+	}
+	if cleartext.Path != "/dev/mapper/luks-0a1b2c3d" || cleartext.FSType != "ext4" || cleartext.Parent != "/dev/sdb1" {
+		t.Errorf("Unexpected cleartext device: %+v", cleartext)
+	}
+	if len(crypto.keys) != 1 || string(crypto.keys[0].Passphrase) != "secret" {
+		t.Errorf("Backend got keys %v", crypto.keys)
+	}
+
+	dev, _ := m.GetDevice("/dev/sdb1")
+	if !dev.IsUnlocked || len(dev.Children) != 1 {
+		t.Errorf("sdb1 should be unlocked with one child, got %+v", dev)
+	}
+
+	again, err := m.CleartextDevice("/dev/sdb1")
+	if err != nil || again.Path != cleartext.Path {
+		t.Errorf("CleartextDevice() = %s, %v", again.Path, err)
+	}
+
+	// Locking waits for the cleartext filesystem to be unmounted
+	m.SetMounted(cleartext.Path, "/media/BACKUP")
+	if err := m.Lock("/dev/sdb1"); err == nil {
+		t.Error("Locking a device whose filesystem is mounted should fail")
+	}
+	m.SetMounted(cleartext.Path, "")
+	if err := m.Lock("/dev/sdb1"); err != nil {
+		t.Fatalf("Lock failed: %v", err)
+	}
+
+	dev, _ = m.GetDevice("/dev/sdb1")
+	if dev.IsUnlocked || len(dev.Children) != 0 {
+		t.Errorf("sdb1 should be locked without children, got %+v", dev)
+	}
+	if _, ok := m.GetDevice(cleartext.Path); ok {
+		t.Error("The cleartext device should be gone")
+	}
+	if err := m.Lock("/dev/sdb1"); err == nil {
+		t.Error("Locking a locked device should fail")
+	}
+}
+
+func TestIsEncryptedType(t *testing.T) {
+	for fstype, want := range map[string]bool{"geli": true, "crypto_LUKS": true, "BitLocker": true, "ext4": false, "": false} {
+		if got := isEncryptedType(fstype); got != want {
+			t.Errorf("isEncryptedType(%q) = %v, want %v", fstype, got, want)
+		}
+	}
+
+	if _, ok := cryptoBackendFor(&Device{MaybeVeraCrypt: true}); !ok {
+		t.Error("VeraCrypt candidates should be unlocked with the tcrypt backend")
+	}
+	if _, ok := cryptoBackendFor(&Device{}); ok {
+		t.Error("A device without a filesystem is not encrypted")
+	}
+}
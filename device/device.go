@@ -1,685 +1,334 @@
 package device
 
 import (
-	"bufio"
 	"fmt"
-	"os"
-	"os/exec"
 	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+
+	"github.com/pgsdf/pgmount/config"
+	"github.com/pgsdf/pgmount/device/parttable"
 )
 
 // Device represents a removable storage device
 type Device struct {
-	Name         string // e.g., "da0", "da0p1"
-	Path         string // e.g., "/dev/da0p1"
-	Label        string
-	UUID         string
-	FSType       string
-	Size         uint64
-	MountPoint   string
-	IsMounted    bool
-	IsEncrypted  bool
-	IsUnlocked   bool
-	IsPartition  bool
-	IsRemovable  bool
-	PartitionNum int
-}
-
-// Manager handles device detection and management
-type Manager struct {
-	devices map[string]*Device
+	Name              string   // e.g., "da0", "da0p1"
+	Path              string   // e.g., "/dev/da0p1"
+	DevNum            string   // "major:minor" on Linux, e.g. "8:17"
+	Aliases           []string // Other nodes for the device, e.g. "/dev/gpt/backup" or "/dev/disk/by-uuid/..."
+	Label             string
+	UUID              string
+	FSType            string
+	Size              uint64
+	MountPoint        string       // Main mount point, see Mounts for all of them
+	Mounts            []MountEntry // Every mount of the device, including bind mounts
+	IsMounted         bool
+	IsEncrypted       bool
+	IsUnlocked        bool
+	MaybeVeraCrypt    bool // No known signature but a random-looking header, as VeraCrypt volumes have
+	IsPartition       bool
+	IsRemovable       bool
+	IsOptical         bool   // CD, DVD or Blu-ray drive, whose disc holds the filesystem directly
+	MediaPresent      bool   // A disc or card is inserted; readers and drives without one report no size
+	BackingFile       string // Image file behind a loop (Linux) or md (FreeBSD) device
+	Pool              string // Name of the imported ZFS pool the device belongs to
+	PartitionTable    string // Table on the device itself: "gpt", "mbr" or "bsd", or "" if there is none
+	PartitionNum      int
+	PartitionScheme   string   // Table the partition is in: "gpt", "mbr" or "bsd"
+	PartitionType     string   // Type GUID (gpt) or two-digit hex type id (mbr, bsd), e.g. "0c"
+	PartitionTypeName string   // Friendly name of PartitionType, e.g. "efi" or "ms-basic-data"
+	PartitionLabel    string   // GPT partition name
+	PartUUID          string   // GPT unique partition GUID
+	Parent            string   // Path of the parent device, e.g. "/dev/da0" for "/dev/da0p1"
+	Children          []string // Paths of partitions and crypt/LVM volumes stacked on this device
+	Hardware                   // Identity of the physical device, shared by its partitions
+	Usage                      // Space statistics of the filesystem, while it is mounted
 }
 
-// NewManager creates a new device manager
-func NewManager() *Manager {
-	return &Manager{
-		devices: make(map[string]*Device),
-	}
+// Hardware identifies the physical device behind a disk
+type Hardware struct {
+	Vendor    string // e.g., "Kingston"
+	Model     string // e.g., "DataTraveler 3.0"
+	Serial    string
+	WWN       string // World Wide Name, e.g., "0x5002538e40a1b2c3"
+	Bus       string // "usb", "mmc", "sata", "nvme" or "thunderbolt"
+	VendorID  string // USB vendor ID, e.g., "0951"
+	ProductID string // USB product ID, e.g., "1666"
+	PortPath  string // Physical port the device is plugged into, e.g., "1-2.3"
 }
 
-// Scan scans for all available devices
-func (m *Manager) Scan() ([]*Device, error) {
-	var devices []*Device
-	var err error
-
-	// Detect OS and use appropriate scanning method
-	switch runtime.GOOS {
-	case "freebsd":
-		devices, err = m.scanFreeBSD()
-	case "linux":
-		devices, err = m.scanLinux()
-	default:
-		return nil, fmt.Errorf("unsupported operating system: %s", runtime.GOOS)
-	}
-
-	if err != nil {
-		return nil, err
-	}
-
-	// Update internal device map
-	for _, dev := range devices {
-		m.devices[dev.Path] = dev
+// USBID returns the USB "vendor:product" ID, or "" for non-USB devices
+func (h Hardware) USBID() string {
+	if h.VendorID == "" {
+		return ""
 	}
-
-	return devices, nil
+	return h.VendorID + ":" + h.ProductID
 }
 
-// scanFreeBSD scans for devices on FreeBSD
-func (m *Manager) scanFreeBSD() ([]*Device, error) {
-	devices := []*Device{}
-
-	// Get list of devices from geom
-	cmd := exec.Command("geom", "disk", "list")
-	output, err := cmd.Output()
-	if err != nil {
-		return nil, fmt.Errorf("failed to list disks: %w", err)
-	}
-
-	// Parse geom output
-	diskDevices := m.parseGeomDiskList(string(output))
-
-	// For each disk, check partitions
-	for _, disk := range diskDevices {
-		// Check if removable
-		isRemovable := m.isRemovableDevice(disk.Name)
-		disk.IsRemovable = isRemovable
-
-		if isRemovable {
-			devices = append(devices, disk)
-
-			// Get partitions
-			partitions, err := m.getPartitions(disk.Name)
-			if err == nil {
-				devices = append(devices, partitions...)
-			}
+// mergeHardware fills in the fields of hw that are empty from other
+func mergeHardware(hw *Hardware, other Hardware) {
+	fill := func(field *string, value string) {
+		if *field == "" {
+			*field = value
 		}
 	}
 
-	return devices, nil
+	fill(&hw.Vendor, other.Vendor)
+	fill(&hw.Model, other.Model)
+	fill(&hw.Serial, other.Serial)
+	fill(&hw.WWN, other.WWN)
+	fill(&hw.Bus, other.Bus)
+	fill(&hw.VendorID, other.VendorID)
+	fill(&hw.ProductID, other.ProductID)
+	fill(&hw.PortPath, other.PortPath)
 }
 
-// scanLinux scans for devices on Linux
-func (m *Manager) scanLinux() ([]*Device, error) {
-	devices := []*Device{}
-
-	// Use lsblk to list block devices
-	cmd := exec.Command("lsblk", "-J", "-o", "NAME,SIZE,TYPE,MOUNTPOINT,FSTYPE,LABEL,UUID,RM,HOTPLUG")
-	output, err := cmd.Output()
-	if err != nil {
-		// Fallback to simpler method if lsblk JSON fails
-		return m.scanLinuxFallback()
-	}
-
-	// Parse lsblk JSON output
-	linuxDevices := m.parseLsblkJSON(string(output))
-
-	// Filter for removable devices and their partitions
-	for _, dev := range linuxDevices {
-		if dev.IsRemovable {
-			devices = append(devices, dev)
-		}
-	}
+// Manager handles device detection and management. It is safe for
+// concurrent use: it owns the device state and only hands out copies, so
+// all changes go through its methods.
+type Manager struct {
+	backend Backend
 
-	return devices, nil
+	mu      sync.RWMutex
+	order   []string
+	devices map[string]*Device
 }
 
-// scanLinuxFallback uses simple lsblk without JSON
-func (m *Manager) scanLinuxFallback() ([]*Device, error) {
-	devices := []*Device{}
-
-	// Read from /sys/block to find removable devices
-	blockDevices, err := os.ReadDir("/sys/block")
-	if err != nil {
-		return nil, fmt.Errorf("failed to read /sys/block: %w", err)
-	}
-
-	for _, entry := range blockDevices {
-		deviceName := entry.Name()
-
-		// Check if removable
-		removablePath := filepath.Join("/sys/block", deviceName, "removable")
-		removableData, err := os.ReadFile(removablePath)
-		if err != nil {
-			continue
-		}
-
-		isRemovable := strings.TrimSpace(string(removableData)) == "1"
-		if !isRemovable {
-			continue
-		}
-
-		// Create device entry
-		dev := &Device{
-			Name:        deviceName,
-			Path:        "/dev/" + deviceName,
-			IsRemovable: true,
-			IsPartition: false,
-		}
-
-		// Get size
-		sizePath := filepath.Join("/sys/block", deviceName, "size")
-		if sizeData, err := os.ReadFile(sizePath); err == nil {
-			if sectors, err := strconv.ParseUint(strings.TrimSpace(string(sizeData)), 10, 64); err == nil {
-				dev.Size = sectors * 512 // Convert sectors to bytes
-			}
-		}
-
-		devices = append(devices, dev)
+// NewManager creates a new device manager using the backend for the
+// running operating system
+func NewManager() *Manager {
+	return NewManagerWithBackend(DefaultBackend())
+}
 
-		// Find partitions
-		partitions := m.findLinuxPartitions(deviceName)
-		devices = append(devices, partitions...)
+// NewManagerWithBackend creates a new device manager using the given backend
+func NewManagerWithBackend(backend Backend) *Manager {
+	return &Manager{
+		backend: backend,
+		devices: make(map[string]*Device),
 	}
-
-	return devices, nil
 }
 
-// findLinuxPartitions finds partitions for a Linux block device
-func (m *Manager) findLinuxPartitions(deviceName string) []*Device {
-	partitions := []*Device{}
+// Scan scans for all available devices and returns copies of them
+func (m *Manager) Scan() ([]Device, error) {
+	if m.backend == nil {
+		return nil, fmt.Errorf("unsupported operating system: %s", runtime.GOOS)
+	}
 
-	deviceDir := filepath.Join("/sys/block", deviceName)
-	entries, err := os.ReadDir(deviceDir)
+	devices, err := m.backend.Scan()
 	if err != nil {
-		return partitions
+		return nil, err
 	}
 
-	for _, entry := range entries {
-		partName := entry.Name()
+	// Mount state comes from the mount table rather than the scanner
+	if mounts, err := m.backend.MountTable(); err == nil {
+		applyMountTable(devices, mounts)
+		applyPools(devices, mounts)
+	}
+	probeWholeDisks(m.backend, devices)
+	applyUsage(m.backend, devices)
+	setPartitionTypeNames(devices)
 
-		// Partitions are subdirectories that start with the device name
-		if !strings.HasPrefix(partName, deviceName) {
-			continue
-		}
+	// Update internal device map
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-		// Skip if it's the device itself
-		if partName == deviceName {
+	m.order = make([]string, 0, len(devices))
+	m.devices = make(map[string]*Device, len(devices))
+	for _, dev := range devices {
+		if _, ok := m.devices[dev.Path]; ok {
 			continue
 		}
-
-		// Create partition device
-		part := &Device{
-			Name:        partName,
-			Path:        "/dev/" + partName,
-			IsPartition: true,
-			IsRemovable: true,
-		}
-
-		// Get size
-		sizePath := filepath.Join(deviceDir, partName, "size")
-		if sizeData, err := os.ReadFile(sizePath); err == nil {
-			if sectors, err := strconv.ParseUint(strings.TrimSpace(string(sizeData)), 10, 64); err == nil {
-				part.Size = sectors * 512
-			}
-		}
-
-		// Detect filesystem
-		m.detectFilesystemLinux(part)
-
-		// Check mount status
-		m.checkMountStatus(part)
-
-		partitions = append(partitions, part)
+		m.order = append(m.order, dev.Path)
+		m.devices[dev.Path] = dev
 	}
 
-	return partitions
+	return m.copyDevices(func(*Device) bool { return true }), nil
 }
 
-// detectFilesystemLinux detects filesystem on Linux
-func (m *Manager) detectFilesystemLinux(dev *Device) {
-	// Try blkid to get filesystem info
-	cmd := exec.Command("blkid", "-o", "export", dev.Path)
-	output, err := cmd.Output()
-	if err == nil {
-		scanner := bufio.NewScanner(strings.NewReader(string(output)))
-		for scanner.Scan() {
-			line := scanner.Text()
-			if strings.HasPrefix(line, "TYPE=") {
-				dev.FSType = strings.TrimPrefix(line, "TYPE=")
-			} else if strings.HasPrefix(line, "LABEL=") {
-				dev.Label = strings.TrimPrefix(line, "LABEL=")
-			} else if strings.HasPrefix(line, "UUID=") {
-				dev.UUID = strings.TrimPrefix(line, "UUID=")
-			}
-		}
+// Snapshot scans for devices and returns an immutable snapshot of them
+func (m *Manager) Snapshot() (*Snapshot, error) {
+	if _, err := m.Scan(); err != nil {
+		return nil, err
 	}
 
-	// Fallback to file command
-	if dev.FSType == "" {
-		m.detectFilesystem(dev)
-	}
-}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 
-// parseLsblkJSON parses lsblk JSON output
-func (m *Manager) parseLsblkJSON(output string) []*Device {
-	devices := []*Device{}
-
-	// Simple JSON parsing for lsblk output
-	// Format: {"blockdevices": [{"name": "sda", "size": "...", ...}, ...]}
-	lines := strings.Split(output, "\n")
-	var currentDevice *Device
-
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-
-		if strings.Contains(line, `"name"`) {
-			if idx := strings.Index(line, `"name"`); idx >= 0 {
-				rest := line[idx+6:]
-				if idx2 := strings.Index(rest, `"`); idx2 >= 0 {
-					rest = rest[idx2+1:]
-					if idx3 := strings.Index(rest, `"`); idx3 >= 0 {
-						name := rest[:idx3]
-						currentDevice = &Device{
-							Name: name,
-							Path: "/dev/" + name,
-						}
-					}
-				}
-			}
-		}
-
-		if currentDevice != nil {
-			if strings.Contains(line, `"type"`) && strings.Contains(line, `"disk"`) {
-				currentDevice.IsPartition = false
-			} else if strings.Contains(line, `"type"`) && strings.Contains(line, `"part"`) {
-				currentDevice.IsPartition = true
-			}
-
-			if strings.Contains(line, `"rm"`) && strings.Contains(line, `"1"`) {
-				currentDevice.IsRemovable = true
-			}
-
-			if strings.Contains(line, `"hotplug"`) && strings.Contains(line, `"1"`) {
-				currentDevice.IsRemovable = true
-			}
-
-			if strings.Contains(line, `"mountpoint"`) {
-				if idx := strings.Index(line, `"mountpoint"`); idx >= 0 {
-					rest := line[idx+13:]
-					if idx2 := strings.Index(rest, `"`); idx2 >= 0 {
-						rest = rest[idx2+1:]
-						if idx3 := strings.Index(rest, `"`); idx3 >= 0 {
-							mp := rest[:idx3]
-							if mp != "" && mp != "null" {
-								currentDevice.MountPoint = mp
-								currentDevice.IsMounted = true
-							}
-						}
-					}
-				}
-			}
-
-			if strings.Contains(line, `"fstype"`) {
-				if idx := strings.Index(line, `"fstype"`); idx >= 0 {
-					rest := line[idx+9:]
-					if idx2 := strings.Index(rest, `"`); idx2 >= 0 {
-						rest = rest[idx2+1:]
-						if idx3 := strings.Index(rest, `"`); idx3 >= 0 {
-							fstype := rest[:idx3]
-							if fstype != "" && fstype != "null" {
-								currentDevice.FSType = fstype
-							}
-						}
-					}
-				}
-			}
-
-			if strings.Contains(line, `"label"`) {
-				if idx := strings.Index(line, `"label"`); idx >= 0 {
-					rest := line[idx+8:]
-					if idx2 := strings.Index(rest, `"`); idx2 >= 0 {
-						rest = rest[idx2+1:]
-						if idx3 := strings.Index(rest, `"`); idx3 >= 0 {
-							label := rest[:idx3]
-							if label != "" && label != "null" {
-								currentDevice.Label = label
-							}
-						}
-					}
-				}
-			}
-
-			if strings.Contains(line, `"uuid"`) {
-				if idx := strings.Index(line, `"uuid"`); idx >= 0 {
-					rest := line[idx+7:]
-					if idx2 := strings.Index(rest, `"`); idx2 >= 0 {
-						rest = rest[idx2+1:]
-						if idx3 := strings.Index(rest, `"`); idx3 >= 0 {
-							uuid := rest[:idx3]
-							if uuid != "" && uuid != "null" {
-								currentDevice.UUID = uuid
-							}
-						}
-					}
-				}
-			}
-
-			if strings.Contains(line, `"size"`) {
-				if idx := strings.Index(line, `"size"`); idx >= 0 {
-					rest := line[idx+7:]
-					if idx2 := strings.Index(rest, `"`); idx2 >= 0 {
-						rest = rest[idx2+1:]
-						if idx3 := strings.Index(rest, `"`); idx3 >= 0 {
-							sizeStr := rest[:idx3]
-							if size, err := m.parseLinuxSize(sizeStr); err == nil {
-								currentDevice.Size = size
-							}
-						}
-					}
-				}
-			}
-
-			// Check if we're at the end of a device object
-			if strings.Contains(line, "}") && !strings.Contains(line, "},") {
-				if currentDevice.Name != "" {
-					devices = append(devices, currentDevice)
-				}
-				currentDevice = nil
-			}
-		}
+	devices := make([]*Device, 0, len(m.order))
+	for _, path := range m.order {
+		devices = append(devices, m.devices[path])
 	}
-
-	return devices
+	return NewSnapshot(devices), nil
 }
 
-// parseLinuxSize parses Linux size strings like "8G", "128M", etc.
-func (m *Manager) parseLinuxSize(sizeStr string) (uint64, error) {
-	sizeStr = strings.TrimSpace(sizeStr)
-	if sizeStr == "" || sizeStr == "null" {
-		return 0, fmt.Errorf("empty size")
-	}
-
-	// Handle numeric-only sizes (in bytes)
-	if val, err := strconv.ParseUint(sizeStr, 10, 64); err == nil {
-		return val, nil
+// Probe re-reads the filesystem type, label and UUID of a device and
+// records them
+func (m *Manager) Probe(path string) (Device, error) {
+	if m.backend == nil {
+		return Device{}, fmt.Errorf("unsupported operating system: %s", runtime.GOOS)
 	}
 
-	// Handle sizes with units (K, M, G, T)
-	multiplier := uint64(1)
-	numStr := sizeStr
-
-	if len(sizeStr) > 0 {
-		lastChar := sizeStr[len(sizeStr)-1]
-		switch lastChar {
-		case 'K', 'k':
-			multiplier = 1024
-			numStr = sizeStr[:len(sizeStr)-1]
-		case 'M', 'm':
-			multiplier = 1024 * 1024
-			numStr = sizeStr[:len(sizeStr)-1]
-		case 'G', 'g':
-			multiplier = 1024 * 1024 * 1024
-			numStr = sizeStr[:len(sizeStr)-1]
-		case 'T', 't':
-			multiplier = 1024 * 1024 * 1024 * 1024
-			numStr = sizeStr[:len(sizeStr)-1]
-		}
+	dev, ok := m.GetDevice(path)
+	if !ok {
+		dev = Device{Name: filepath.Base(path), Path: path}
 	}
-
-	if val, err := strconv.ParseFloat(numStr, 64); err == nil {
-		return uint64(val * float64(multiplier)), nil
+	if err := m.backend.Probe(&dev); err != nil {
+		return Device{}, err
 	}
 
-	return 0, fmt.Errorf("failed to parse size: %s", sizeStr)
+	m.update(path, func(known *Device) {
+		known.FSType = dev.FSType
+		known.Label = dev.Label
+		known.UUID = dev.UUID
+		known.IsEncrypted = dev.IsEncrypted
+	})
+	return dev, nil
 }
 
-// GetDevice returns a device by path
-func (m *Manager) GetDevice(path string) (*Device, bool) {
-	dev, ok := m.devices[path]
-	return dev, ok
-}
+// GetDevice returns a copy of the device with the given path
+func (m *Manager) GetDevice(path string) (Device, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 
-// GetMountedDevices returns all mounted devices
-func (m *Manager) GetMountedDevices() []*Device {
-	mounted := []*Device{}
-	for _, dev := range m.devices {
-		if dev.IsMounted {
-			mounted = append(mounted, dev)
-		}
+	dev, ok := m.devices[path]
+	if !ok {
+		return Device{}, false
 	}
-	return mounted
+	return dev.clone(), true
 }
 
-// parseGeomDiskList parses the output of 'geom disk list'
-func (m *Manager) parseGeomDiskList(output string) []*Device {
-	devices := []*Device{}
-	var current *Device
-
-	scanner := bufio.NewScanner(strings.NewReader(output))
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-
-		if strings.HasPrefix(line, "Geom name:") {
-			if current != nil {
-				devices = append(devices, current)
-			}
-			name := strings.TrimSpace(strings.TrimPrefix(line, "Geom name:"))
-			current = &Device{
-				Name: name,
-				Path: "/dev/" + name,
-			}
-		} else if current != nil {
-			if strings.HasPrefix(line, "Mediasize:") {
-				parts := strings.Fields(line)
-				if len(parts) >= 2 {
-					fmt.Sscanf(parts[1], "%d", &current.Size)
-				}
-			}
-		}
-	}
-
-	if current != nil {
-		devices = append(devices, current)
-	}
+// GetMountedDevices returns copies of all mounted devices
+func (m *Manager) GetMountedDevices() []Device {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 
-	return devices
+	return m.copyDevices(func(dev *Device) bool { return dev.IsMounted })
 }
 
-// getPartitions returns partitions for a disk
-func (m *Manager) getPartitions(diskName string) ([]*Device, error) {
-	partitions := []*Device{}
-
-	// Use gpart to list partitions
-	cmd := exec.Command("gpart", "show", "-p", diskName)
-	output, err := cmd.Output()
-	if err != nil {
-		// Disk might not have partitions
-		return partitions, nil
-	}
-
-	scanner := bufio.NewScanner(strings.NewReader(string(output)))
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		fields := strings.Fields(line)
-
-		// Look for partition entries
-		if len(fields) >= 4 && !strings.HasPrefix(line, "=>") {
-			// Field format: start size index type [label]
-			if len(fields[0]) > 0 && fields[0][0] >= '0' && fields[0][0] <= '9' {
-				partName := ""
-				for i := 3; i < len(fields); i++ {
-					if strings.HasPrefix(fields[i], diskName) {
-						partName = fields[i]
-						break
-					}
-				}
-
-				if partName != "" {
-					part := &Device{
-						Name:        partName,
-						Path:        "/dev/" + partName,
-						IsPartition: true,
-						IsRemovable: true,
-					}
-
-					// Get filesystem info
-					m.detectFilesystem(part)
-
-					// Check if mounted
-					m.checkMountStatus(part)
-
-					partitions = append(partitions, part)
-				}
-			}
+// SetMounted records a device as mounted at mountPoint, or as unmounted if
+// mountPoint is empty
+func (m *Manager) SetMounted(path, mountPoint string) {
+	m.update(path, func(dev *Device) {
+		if mountPoint == "" {
+			dev.setMounts(nil)
+			dev.Usage = Usage{}
+			return
 		}
-	}
-
-	return partitions, nil
+		if !hasMountPoint(dev.Mounts, mountPoint) {
+			dev.setMounts(append(dev.Mounts, MountEntry{
+				Device:     dev.Path,
+				MountPoint: mountPoint,
+				FSType:     dev.MountType(),
+				Root:       "/",
+			}))
+		}
+	})
 }
 
-// detectFilesystem detects the filesystem type and metadata
-func (m *Manager) detectFilesystem(dev *Device) {
-	// Try file -s to detect filesystem
-	cmd := exec.Command("file", "-s", dev.Path)
-	output, err := cmd.Output()
-	if err == nil {
-		fsInfo := string(output)
-
-		// Parse filesystem type
-		if strings.Contains(fsInfo, "ext2") || strings.Contains(fsInfo, "ext3") || strings.Contains(fsInfo, "ext4") {
-			if strings.Contains(fsInfo, "ext4") {
-				dev.FSType = "ext4"
-			} else if strings.Contains(fsInfo, "ext3") {
-				dev.FSType = "ext3"
-			} else {
-				dev.FSType = "ext2"
-			}
-		} else if strings.Contains(fsInfo, "FAT") {
-			dev.FSType = "msdosfs"
-		} else if strings.Contains(fsInfo, "NTFS") {
-			dev.FSType = "ntfs"
-		} else if strings.Contains(fsInfo, "UFS") {
-			dev.FSType = "ufs"
-		} else if strings.Contains(fsInfo, "ZFS") {
-			dev.FSType = "zfs"
-		}
+// SetUnlocked records whether an encrypted device is attached
+func (m *Manager) SetUnlocked(path string, unlocked bool) {
+	m.update(path, func(dev *Device) {
+		dev.IsUnlocked = unlocked
+	})
+}
 
-		// Check for GELI encryption
-		if strings.Contains(fsInfo, "GELI") {
-			dev.IsEncrypted = true
-		}
+// update applies fn to a known device under the lock
+func (m *Manager) update(path string, fn func(dev *Device)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-		// Extract UUID and label if available
-		m.extractMetadata(dev)
+	if dev, ok := m.devices[path]; ok {
+		fn(dev)
 	}
 }
 
-// extractMetadata extracts UUID and label
-func (m *Manager) extractMetadata(dev *Device) {
-	// Try to get label using glabel
-	cmd := exec.Command("glabel", "status")
-	output, err := cmd.Output()
-	if err == nil {
-		scanner := bufio.NewScanner(strings.NewReader(string(output)))
-		for scanner.Scan() {
-			line := scanner.Text()
-			if strings.Contains(line, dev.Name) {
-				fields := strings.Fields(line)
-				if len(fields) >= 1 {
-					dev.Label = fields[0]
-				}
-			}
+// copyDevices returns copies of the devices matching keep in scan order.
+// The caller must hold m.mu.
+func (m *Manager) copyDevices(keep func(dev *Device) bool) []Device {
+	devices := []Device{}
+	for _, path := range m.order {
+		if dev := m.devices[path]; keep(dev) {
+			devices = append(devices, dev.clone())
 		}
 	}
+	return devices
+}
 
-	// For ext filesystems, try dumpe2fs
-	if strings.HasPrefix(dev.FSType, "ext") {
-		cmd := exec.Command("dumpe2fs", "-h", dev.Path)
-		output, err := cmd.Output()
-		if err == nil {
-			scanner := bufio.NewScanner(strings.NewReader(string(output)))
-			for scanner.Scan() {
-				line := scanner.Text()
-				if strings.HasPrefix(line, "Filesystem UUID:") {
-					dev.UUID = strings.TrimSpace(strings.TrimPrefix(line, "Filesystem UUID:"))
-				} else if strings.HasPrefix(line, "Filesystem volume name:") {
-					label := strings.TrimSpace(strings.TrimPrefix(line, "Filesystem volume name:"))
-					if label != "<none>" && label != "" {
-						dev.Label = label
-					}
-				}
-			}
-		}
-	}
+// clone returns a copy of the device that shares no memory with it
+func (d *Device) clone() Device {
+	copied := *d
+	copied.Children = append([]string(nil), d.Children...)
+	copied.Aliases = append([]string(nil), d.Aliases...)
+	copied.Mounts = nil
+	for _, entry := range d.Mounts {
+		entry.Options = append([]string(nil), entry.Options...)
+		copied.Mounts = append(copied.Mounts, entry)
+	}
+	return copied
 }
 
-// checkMountStatus checks if a device is mounted
-func (m *Manager) checkMountStatus(dev *Device) {
-	file, err := os.Open("/etc/mtab")
-	if err != nil {
-		// Try /proc/mounts on some systems, or use mount command
-		cmd := exec.Command("mount")
-		output, err := cmd.Output()
-		if err != nil {
-			return
-		}
-		m.parseMountOutput(dev, string(output))
-		return
-	}
-	defer file.Close()
-
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.HasPrefix(line, dev.Path+" ") {
-			fields := strings.Fields(line)
-			if len(fields) >= 2 {
-				dev.MountPoint = fields[1]
-				dev.IsMounted = true
-			}
-		}
+// Identity returns the properties device_config entries match on
+func (d *Device) Identity() config.DeviceIdentity {
+	return config.DeviceIdentity{
+		Label:    d.Label,
+		UUID:     d.UUID,
+		PartUUID: d.PartUUID,
+		Path:     d.Path,
+		Vendor:   d.Vendor,
+		Model:    d.Model,
+		Serial:   d.Serial,
+		WWN:      d.WWN,
+		Bus:      d.Bus,
+		USBID:    d.USBID(),
+		PortPath: d.PortPath,
+
+		PartitionType:     d.PartitionType,
+		PartitionTypeName: d.PartitionTypeName,
+		SystemPartition:   d.IsSystemPartition(),
 	}
 }
 
-// parseMountOutput parses mount command output
-func (m *Manager) parseMountOutput(dev *Device, output string) {
-	scanner := bufio.NewScanner(strings.NewReader(output))
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.Contains(line, dev.Path) {
-			// Format: /dev/da0p1 on /media/USB (ufs, local)
-			parts := strings.Split(line, " on ")
-			if len(parts) >= 2 {
-				mountInfo := strings.Split(parts[1], " (")
-				if len(mountInfo) >= 1 {
-					dev.MountPoint = strings.TrimSpace(mountInfo[0])
-					dev.IsMounted = true
-				}
-			}
-		}
-	}
+// StableID returns an identity that stays with the device when it is
+// plugged in again or renumbered: its UUID, or else its GPT partition GUID,
+// or else the serial number of its disk and its partition number, since
+// GELI providers have no UUID of their own. It is "" if there is none.
+func (d *Device) StableID() string {
+	switch {
+	case d.UUID != "":
+		return d.UUID
+	case d.PartUUID != "":
+		return "partuuid:" + d.PartUUID
+	case d.Serial != "":
+		return fmt.Sprintf("serial:%s:%d", d.Serial, d.PartitionNum)
+	}
+	return ""
 }
 
-// isRemovableDevice checks if a device is removable
-func (m *Manager) isRemovableDevice(name string) bool {
-	// Check if it's a USB device (da*, umass*)
-	if strings.HasPrefix(name, "da") || strings.HasPrefix(name, "umass") {
+// IsMountable reports whether the device itself can carry a filesystem to
+// mount: a partition or volume, the disc in an optical drive, or a
+// "superfloppy" disk with a filesystem (or what may be a VeraCrypt volume)
+// and no partition table, as cameras and many USB sticks use
+func (d *Device) IsMountable() bool {
+	if d.IsPartition {
 		return true
 	}
-
-	// Check CAM device info
-	cmd := exec.Command("camcontrol", "devlist")
-	output, err := cmd.Output()
-	if err != nil {
+	if !d.MediaPresent {
 		return false
 	}
+	return d.IsOptical || ((d.FSType != "" || d.MaybeVeraCrypt) && d.PartitionTable == "" && len(d.Children) == 0)
+}
 
-	// Look for USB mass storage in device list
-	scanner := bufio.NewScanner(strings.NewReader(string(output)))
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.Contains(line, name) {
-			if strings.Contains(strings.ToLower(line), "usb") ||
-				strings.Contains(strings.ToLower(line), "mass storage") {
-				return true
-			}
-		}
-	}
+// IsSystemPartition reports whether the partition type marks firmware,
+// swap, recovery or reserved space, e.g. an EFI system partition
+func (d *Device) IsSystemPartition() bool {
+	return d.IsPartition && parttable.IsSystem(d.PartitionScheme, d.PartitionType)
+}
 
-	return false
+// IsMountedAt reports whether any mount of the device is at mountPoint
+func (d *Device) IsMountedAt(mountPoint string) bool {
+	return hasMountPoint(d.Mounts, mountPoint)
 }
 
 // GetDisplayName returns a user-friendly display name
@@ -687,12 +336,31 @@ func (d *Device) GetDisplayName() string {
 	if d.Label != "" {
 		return d.Label
 	}
-	if d.UUID != "" {
+	if len(d.UUID) > 8 {
 		return d.UUID[:8] + "..."
 	}
+	if d.UUID != "" {
+		return d.UUID
+	}
 	return d.Name
 }
 
+// MountType returns the filesystem type to pass to mount(8). FSType uses
+// the blkid names on every platform, which FreeBSD spells differently.
+func (d *Device) MountType() string {
+	if runtime.GOOS == "freebsd" {
+		switch d.FSType {
+		case "vfat":
+			return "msdosfs"
+		case "ext2", "ext3", "ext4":
+			return "ext2fs"
+		case "iso9660":
+			return "cd9660"
+		}
+	}
+	return d.FSType
+}
+
 // GetMountDirectory returns the preferred mount directory name
 func (d *Device) GetMountDirectory(base string) string {
 	name := d.GetDisplayName()
@@ -724,3 +392,17 @@ func (d *Device) GetMountDirectory(base string) string {
 
 	return filepath.Join(base, sanitized)
 }
+
+// partitionNumber extracts the trailing partition index from a device name
+// such as "sdb2", "mmcblk0p1" or "da0p3", returning 0 if there is none
+func partitionNumber(name string) int {
+	i := len(name)
+	for i > 0 && name[i-1] >= '0' && name[i-1] <= '9' {
+		i--
+	}
+	num, err := strconv.Atoi(name[i:])
+	if err != nil {
+		return 0
+	}
+	return num
+}
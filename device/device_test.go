@@ -0,0 +1,231 @@
+package device
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestManagerReturnsCopies(t *testing.T) {
+	backend := NewFakeBackend(
+		Device{Name: "da0", Path: "/dev/da0", IsRemovable: true},
+		Device{Name: "da0p1", Path: "/dev/da0p1", Parent: "/dev/da0", FSType: "vfat", IsPartition: true},
+	)
+	m := NewManagerWithBackend(backend)
+
+	devices, err := m.Scan()
+	if err != nil {
+		t.Fatalf("Failed to scan: %v", err)
+	}
+	devices[1].IsMounted = true
+	devices[1].MountPoint = "/media/STICK"
+	devices[0].Children[0] = "/dev/bogus"
+
+	part, _ := m.GetDevice("/dev/da0p1")
+	if part.IsMounted {
+		t.Error("Changing a scanned device should not change the manager")
+	}
+	disk, _ := m.GetDevice("/dev/da0")
+	if disk.Children[0] != "/dev/da0p1" {
+		t.Errorf("Children should not be shared, got %v", disk.Children)
+	}
+
+	m.SetMounted("/dev/da0p1", "/media/STICK")
+	if part, _ := m.GetDevice("/dev/da0p1"); !part.IsMounted || part.MountPoint != "/media/STICK" {
+		t.Errorf("SetMounted should record the mount point, got %+v", part)
+	}
+	if mounted := m.GetMountedDevices(); len(mounted) != 1 || mounted[0].Path != "/dev/da0p1" {
+		t.Errorf("Should have one mounted device, got %+v", mounted)
+	}
+
+	m.SetMounted("/dev/da0p1", "")
+	if part, _ := m.GetDevice("/dev/da0p1"); part.IsMounted || part.MountPoint != "" {
+		t.Errorf("SetMounted with an empty mount point should unmount, got %+v", part)
+	}
+
+	m.SetUnlocked("/dev/da0p1", true)
+	if part, _ := m.GetDevice("/dev/da0p1"); !part.IsUnlocked {
+		t.Error("SetUnlocked should record the unlocked state")
+	}
+}
+
+// TestManagerConcurrency runs the daemon poll loop, mounts and tray refreshes
+// against one manager at the same time. Run with -race.
+func TestManagerConcurrency(t *testing.T) {
+	backend := NewFakeBackend()
+	for i := 0; i < 4; i++ {
+		disk := fmt.Sprintf("/dev/da%d", i)
+		backend.Insert(Device{Name: disk[5:], Path: disk, IsRemovable: true})
+		backend.Insert(Device{Name: disk[5:] + "p1", Path: disk + "p1", Parent: disk,
+			FSType: "vfat", IsPartition: true, IsRemovable: true})
+	}
+	m := NewManagerWithBackend(backend)
+
+	var wg sync.WaitGroup
+	run := func(fn func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				fn(i)
+			}
+		}()
+	}
+
+	// Daemon poll loop
+	run(func(i int) {
+		last := NewSnapshot(nil)
+		snap, err := m.Snapshot()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		Diff(last, snap)
+	})
+
+	// Mounting and unmounting from the daemon and the CLI tools
+	run(func(i int) {
+		path := fmt.Sprintf("/dev/da%dp1", i%4)
+		if i%2 == 0 {
+			m.SetMounted(path, "/media/"+path[5:])
+		} else {
+			m.SetMounted(path, "")
+		}
+		m.SetUnlocked(path, i%2 == 0)
+	})
+
+	// Tray refresh and Mount All
+	run(func(i int) {
+		devices, err := m.Scan()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		for j := range devices {
+			devices[j].IsMounted = !devices[j].IsMounted
+			devices[j].Children = append(devices[j].Children, "/dev/extra")
+		}
+		m.GetMountedDevices()
+	})
+
+	// Hotplug
+	run(func(i int) {
+		backend.Update("/dev/da0p1", func(dev *Device) {
+			dev.Label = fmt.Sprintf("L%d", i)
+		})
+		if dev, ok := m.GetDevice("/dev/da0"); ok {
+			_ = dev.GetDisplayName()
+		}
+	})
+
+	wg.Wait()
+
+	devices, err := m.Scan()
+	if err != nil {
+		t.Fatalf("Failed to scan: %v", err)
+	}
+	if len(devices) != 8 {
+		t.Errorf("Should have 8 devices, got %d", len(devices))
+	}
+	for _, dev := range devices {
+		if len(dev.Children) > 1 {
+			t.Errorf("%s children should not include changes made to copies: %v", dev.Path, dev.Children)
+		}
+	}
+}
+
+func TestIsMountable(t *testing.T) {
+	tests := []struct {
+		name string
+		dev  Device
+		want bool
+	}{
+		{"partition", Device{IsPartition: true, FSType: "vfat", MediaPresent: true}, true},
+		{"superfloppy", Device{FSType: "vfat", MediaPresent: true}, true},
+		{"partitioned disk", Device{PartitionTable: "gpt", MediaPresent: true, Children: []string{"/dev/da0p1"}}, false},
+		{"hybrid image", Device{FSType: "iso9660", PartitionTable: "mbr", MediaPresent: true}, false},
+		{"blank disk", Device{MediaPresent: true}, false},
+		{"disc", Device{IsOptical: true, FSType: "udf", MediaPresent: true}, true},
+		{"empty reader", Device{FSType: "vfat"}, false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.dev.IsMountable(); got != tt.want {
+			t.Errorf("%s: IsMountable() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestStableID(t *testing.T) {
+	tests := []struct {
+		name string
+		dev  Device
+		want string
+	}{
+		{"LUKS", Device{UUID: "0a1b2c3d", PartUUID: "5e2a91b0"}, "0a1b2c3d"},
+		{"GELI on GPT", Device{FSType: "geli", PartUUID: "5e2a91b0", Hardware: Hardware{Serial: "AA00"}}, "partuuid:5e2a91b0"},
+		{"GELI on MBR", Device{FSType: "geli", PartitionNum: 2, Hardware: Hardware{Serial: "AA00"}}, "serial:AA00:2"},
+		{"unknown", Device{Path: "/dev/da0"}, ""},
+	}
+
+	for _, tt := range tests {
+		if got := tt.dev.StableID(); got != tt.want {
+			t.Errorf("%s: StableID() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestGetDisplayName(t *testing.T) {
+	tests := []struct {
+		dev  Device
+		want string
+	}{
+		{Device{Name: "sdc1", Label: "STICK", UUID: "1234-ABCD"}, "STICK"},
+		{Device{Name: "sdc1", UUID: "0a1b2c3d-4e5f-6071-8293-a4b5c6d7e8f9"}, "0a1b2c3d..."},
+		// FAT serials and ZFS GUIDs can be shorter than the prefix
+		{Device{Name: "sdc1", UUID: "1234"}, "1234"},
+		{Device{Name: "da0p1"}, "da0p1"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.dev.GetDisplayName(); got != tt.want {
+			t.Errorf("GetDisplayName() = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestProbeWholeDisks(t *testing.T) {
+	// A FAT16 filesystem written straight to the disk, as cameras do
+	bs := make([]byte, 4096)
+	copy(bs, []byte{0xEB, 0x3C, 0x90})
+	copy(bs[3:], "MSDOS5.0")
+	binary.LittleEndian.PutUint16(bs[11:], 512)
+	bs[13] = 4
+	binary.LittleEndian.PutUint16(bs[14:], 1)
+	bs[16] = 2
+	binary.LittleEndian.PutUint16(bs[17:], 512)
+	binary.LittleEndian.PutUint16(bs[22:], 40)
+	binary.LittleEndian.PutUint32(bs[32:], 40000)
+	bs[38] = 0x29
+	copy(bs[43:], "CAMERA     FAT16   ")
+	binary.LittleEndian.PutUint16(bs[510:], 0xAA55)
+
+	path := filepath.Join(t.TempDir(), "da0")
+	if err := os.WriteFile(path, bs, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	disk := &Device{Name: "da0", Path: path, MediaPresent: true, IsRemovable: true}
+	partitioned := &Device{Name: "da1", Path: path, MediaPresent: true, PartitionTable: "gpt"}
+	probeWholeDisks(&LsblkBackend{}, []*Device{disk, partitioned})
+
+	if disk.FSType != "vfat" || disk.Label != "CAMERA" || !disk.IsMountable() {
+		t.Errorf("Should find the filesystem on the whole disk, got %q %q", disk.FSType, disk.Label)
+	}
+	if partitioned.FSType != "" {
+		t.Error("Disks with a partition table should not be probed")
+	}
+}
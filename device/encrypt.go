@@ -0,0 +1,150 @@
+package device
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// formatCommand runs newfs(8), mkfs(8) and their relatives. This is a
+// variable so tests can stand in for them.
+var formatCommand = func(name string, args ...string) ([]byte, error) {
+	return exec.Command(name, args...).CombinedOutput()
+}
+
+// Encrypt creates an encrypted container of the given type, "geli" or
+// "luks", on dev with key, destroying what dev held. A key without a
+// passphrase creates a keyfile-only container.
+func Encrypt(dev *Device, cryptType string, key Key, label string) error {
+	if key.Passphrase == nil && len(key.KeyFiles) == 0 {
+		return fmt.Errorf("a passphrase or keyfile is needed to encrypt %s", dev.Path)
+	}
+	if cryptType != "geli" && cryptType != "luks" {
+		return fmt.Errorf("unknown encryption type %q", cryptType)
+	}
+	if err := wipe(dev); err != nil {
+		return err
+	}
+	switch cryptType {
+	case "geli":
+		return initGELI(dev, key)
+	case "luks":
+		return formatLUKS(dev, key, label)
+	}
+	return nil
+}
+
+// wipe removes the partition table and signatures dev holds, so that
+// neither the old partitions nor the old filesystem turn up again next to
+// the new container
+func wipe(dev *Device) error {
+	var name string
+	var args []string
+	switch {
+	case runtime.GOOS == "freebsd" && dev.PartitionTable != "":
+		name, args = "gpart", []string{"destroy", "-F", dev.Name}
+	case runtime.GOOS == "freebsd":
+		return nil
+	default:
+		name, args = "wipefs", []string{"-a", dev.Path}
+	}
+
+	if output, err := formatCommand(name, args...); err != nil {
+		return fmt.Errorf("%s failed: %w (output: %s)", name, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// initGELI initializes a GELI provider with 4 KiB sectors. geli init keeps
+// a backup of the metadata in /var/backups.
+func initGELI(dev *Device, key Key) error {
+	args := []string{"init", "-s", "4096"}
+	var stdin []byte
+	if key.Passphrase == nil {
+		args = append(args, "-P")
+	} else {
+		args = append(args, "-J", "-")
+		stdin = append(append(stdin, key.Passphrase...), '\n')
+		defer clear(stdin)
+	}
+	for _, keyfile := range key.KeyFiles {
+		args = append(args, "-K", keyfile)
+	}
+	args = append(args, dev.Path)
+
+	if output, err := cryptCommand(stdin, nil, "geli", args...); err != nil {
+		return fmt.Errorf("geli init failed: %w (output: %s)", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// formatLUKS creates a LUKS2 container. The passphrase and keyfile go in
+// key slots of their own, so either unlocks it.
+func formatLUKS(dev *Device, key Key, label string) error {
+	if len(key.KeyFiles) > 1 {
+		return fmt.Errorf("luks takes a single keyfile")
+	}
+
+	args := []string{"luksFormat", "--type", "luks2", "--batch-mode"}
+	if label != "" {
+		args = append(args, "--label", label)
+	}
+	var stdin []byte
+	if key.Passphrase != nil {
+		stdin = append(append(stdin, key.Passphrase...), '\n')
+		defer clear(stdin)
+	} else {
+		args = append(args, "--key-file", key.KeyFiles[0])
+	}
+	args = append(args, dev.Path)
+
+	if output, err := cryptCommand(stdin, nil, "cryptsetup", args...); err != nil {
+		return fmt.Errorf("cryptsetup luksFormat failed: %w (output: %s)", err, strings.TrimSpace(string(output)))
+	}
+
+	// The passphrase unlocks the container to add the keyfile
+	if key.Passphrase != nil && len(key.KeyFiles) > 0 {
+		if output, err := cryptCommand(stdin, nil, "cryptsetup", "luksAddKey", dev.Path, key.KeyFiles[0]); err != nil {
+			return fmt.Errorf("cryptsetup luksAddKey failed: %w (output: %s)", err, strings.TrimSpace(string(output)))
+		}
+	}
+	return nil
+}
+
+// MakeFilesystem creates a filesystem of the given type (a blkid name such
+// as "ufs", "vfat" or "ext4") on dev
+func MakeFilesystem(dev *Device, fstype, label string) error {
+	var name string
+	var args []string
+	switch {
+	case fstype == "ufs":
+		name, args = "newfs", []string{"-U"}
+		if label != "" {
+			args = append(args, "-L", label)
+		}
+	case fstype == "vfat" && runtime.GOOS == "freebsd":
+		name, args = "newfs_msdos", []string{"-F", "32"}
+		if label != "" {
+			args = append(args, "-L", label)
+		}
+	case fstype == "vfat" || fstype == "exfat":
+		name = "mkfs." + fstype
+		if label != "" {
+			args = append(args, "-n", label)
+		}
+	case fstype == "ext2" || fstype == "ext3" || fstype == "ext4":
+		name, args = "mkfs."+fstype, []string{"-q"}
+		if label != "" {
+			args = append(args, "-L", label)
+		}
+	default:
+		return fmt.Errorf("cannot create %s filesystems", fstype)
+	}
+	args = append(args, dev.Path)
+
+	if output, err := formatCommand(name, args...); err != nil {
+		return fmt.Errorf("%s failed: %w (output: %s)", name, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package device
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// stubFormat stands in for newfs, mkfs and the tools that wipe a device,
+// recording each command
+func stubFormat(t *testing.T) *[]string {
+	runs := []string{}
+	old := formatCommand
+	formatCommand = func(name string, args ...string) ([]byte, error) {
+		runs = append(runs, name+" "+strings.Join(args, " "))
+		return nil, nil
+	}
+	t.Cleanup(func() { formatCommand = old })
+	return &runs
+}
+
+func TestEncrypt(t *testing.T) {
+	runs := stubCrypt(t)
+	wipes := stubFormat(t)
+	stick := &Device{Name: "da0", Path: "/dev/da0", PartitionTable: "gpt"}
+	wipe := "wipefs -a /dev/da0"
+	if runtime.GOOS == "freebsd" {
+		wipe = "gpart destroy -F da0"
+	}
+
+	tests := []struct {
+		cryptType string
+		key       Key
+		want      []string
+	}{
+		{"geli", Key{Passphrase: []byte("secret")}, []string{"geli init -s 4096 -J - /dev/da0 <secret\n"}},
+		{"geli", Key{KeyFiles: []string{"/root/a.key", "/root/b.key"}},
+			[]string{"geli init -s 4096 -P -K /root/a.key -K /root/b.key /dev/da0 <"}},
+		{"luks", Key{Passphrase: []byte("secret")},
+			[]string{"cryptsetup luksFormat --type luks2 --batch-mode --label BACKUP /dev/da0 <secret\n"}},
+		{"luks", Key{KeyFiles: []string{"/root/a.key"}},
+			[]string{"cryptsetup luksFormat --type luks2 --batch-mode --label BACKUP --key-file /root/a.key /dev/da0 <"}},
+		{"luks", Key{Passphrase: []byte("secret"), KeyFiles: []string{"/root/a.key"}}, []string{
+			"cryptsetup luksFormat --type luks2 --batch-mode --label BACKUP /dev/da0 <secret\n",
+			"cryptsetup luksAddKey /dev/da0 /root/a.key <secret\n",
+		}},
+	}
+
+	for _, tt := range tests {
+		*runs, *wipes = nil, nil
+		if err := Encrypt(stick, tt.cryptType, tt.key, "BACKUP"); err != nil {
+			t.Fatalf("Encrypt failed: %v", err)
+		}
+		if strings.Join(*runs, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("Ran %q, want %q", *runs, tt.want)
+		}
+		// The old partition table goes first
+		if len(*wipes) != 1 || (*wipes)[0] != wipe {
+			t.Errorf("Wiped with %q, want %q", *wipes, wipe)
+		}
+	}
+
+	if err := Encrypt(stick, "geli", Key{}, ""); err == nil {
+		t.Error("Encrypting without a passphrase or keyfile should fail")
+	}
+	if err := Encrypt(stick, "luks", Key{KeyFiles: []string{"/root/a.key", "/root/b.key"}}, ""); err == nil {
+		t.Error("LUKS cannot take several keyfiles")
+	}
+}
+
+func TestMakeFilesystem(t *testing.T) {
+	runs := stubFormat(t)
+	cleartext := &Device{Name: "da0.eli", Path: "/dev/da0.eli"}
+	vfat := "mkfs.vfat -n BACKUP /dev/da0.eli"
+	if runtime.GOOS == "freebsd" {
+		vfat = "newfs_msdos -F 32 -L BACKUP /dev/da0.eli"
+	}
+	tests := []struct {
+		fstype string
+		want   string
+	}{
+		{"ufs", "newfs -U -L BACKUP /dev/da0.eli"},
+		{"vfat", vfat},
+		{"ext4", "mkfs.ext4 -q -L BACKUP /dev/da0.eli"},
+	}
+	for _, tt := range tests {
+		*runs = nil
+		if err := MakeFilesystem(cleartext, tt.fstype, "BACKUP"); err != nil {
+			t.Fatalf("MakeFilesystem failed: %v", err)
+		}
+		if len(*runs) != 1 || (*runs)[0] != tt.want {
+			t.Errorf("Ran %q, want %q", *runs, tt.want)
+		}
+	}
+
+	if err := MakeFilesystem(cleartext, "iso9660", ""); err == nil {
+		t.Error("Creating an iso9660 filesystem should fail")
+	}
+}
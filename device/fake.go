@@ -0,0 +1,296 @@
+package device
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FakeBackend is an in-memory backend for tests and CI. Devices are loaded
+// from a fixture and can be inserted, removed and changed at runtime to
+// simulate hotplug events without real hardware.
+type FakeBackend struct {
+	mu      sync.Mutex
+	devices []*Device
+	mounts  map[string]string
+	usage   map[string]Usage
+}
+
+// fakeFixture is the on-disk format of a device fixture
+type fakeFixture struct {
+	Devices []fakeDevice `yaml:"devices"`
+}
+
+// fakeDevice describes a disk or partition in a fixture
+type fakeDevice struct {
+	Name       string       `yaml:"name"`
+	Label      string       `yaml:"label"`
+	UUID       string       `yaml:"uuid"`
+	FSType     string       `yaml:"fstype"`
+	Size       uint64       `yaml:"size"`
+	MountPoint string       `yaml:"mount_point"`
+	Encrypted  bool         `yaml:"encrypted"`
+	Removable  *bool        `yaml:"removable,omitempty"`
+	Optical    bool         `yaml:"optical"`
+	Media      *bool        `yaml:"media,omitempty"` // false for an empty drive
+	Vendor     string       `yaml:"vendor"`
+	Model      string       `yaml:"model"`
+	Serial     string       `yaml:"serial"`
+	WWN        string       `yaml:"wwn"`
+	Bus        string       `yaml:"bus"`
+	USBID      string       `yaml:"usb_id"` // "vendor:product"
+	Port       string       `yaml:"port"`
+	PartScheme string       `yaml:"part_scheme"` // "gpt", "mbr" or "bsd"
+	PartType   string       `yaml:"part_type"`   // Type GUID or MBR id
+	PartLabel  string       `yaml:"part_label"`
+	Partitions []fakeDevice `yaml:"partitions"`
+}
+
+// NewFakeBackend creates a fake backend holding the given devices
+func NewFakeBackend(devices ...Device) *FakeBackend {
+	f := &FakeBackend{
+		mounts: make(map[string]string),
+		usage:  make(map[string]Usage),
+	}
+	for _, dev := range devices {
+		f.Insert(dev)
+	}
+	return f
+}
+
+// LoadFakeBackend creates a fake backend from a YAML or JSON fixture:
+//
+//	devices:
+//	  - name: da0
+//	    size: 15518924800
+//	    partitions:
+//	      - name: da0p1
+//	        fstype: vfat
+//	        label: STICK
+func LoadFakeBackend(path string) (*FakeBackend, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fixture: %w", err)
+	}
+
+	// JSON is a subset of YAML, so one decoder handles both formats
+	var fixture fakeFixture
+	if err := yaml.Unmarshal(data, &fixture); err != nil {
+		return nil, fmt.Errorf("failed to parse fixture: %w", err)
+	}
+
+	f := NewFakeBackend()
+	for _, disk := range fixture.Devices {
+		f.insertFixture(disk, nil)
+	}
+	return f, nil
+}
+
+// insertFixture adds a fixture device and its partitions
+func (f *FakeBackend) insertFixture(fd fakeDevice, parent *Device) {
+	dev := Device{
+		Name:        fd.Name,
+		Path:        "/dev/" + fd.Name,
+		Label:       fd.Label,
+		UUID:        fd.UUID,
+		FSType:      fd.FSType,
+		Size:        fd.Size,
+		IsEncrypted: fd.Encrypted,
+		IsPartition: parent != nil,
+		IsRemovable: fd.Removable == nil || *fd.Removable,
+		IsOptical:   fd.Optical,
+		// Media is present unless the fixture says the drive is empty
+		MediaPresent: fd.Media == nil || *fd.Media,
+	}
+	dev.Hardware = Hardware{
+		Vendor:   fd.Vendor,
+		Model:    fd.Model,
+		Serial:   fd.Serial,
+		WWN:      fd.WWN,
+		Bus:      fd.Bus,
+		PortPath: fd.Port,
+	}
+	dev.VendorID, dev.ProductID, _ = strings.Cut(fd.USBID, ":")
+	if parent != nil {
+		mergeHardware(&dev.Hardware, parent.Hardware)
+		dev.Parent = parent.Path
+		dev.PartitionNum = partitionNumber(fd.Name)
+		dev.PartitionScheme = fd.PartScheme
+		dev.PartitionType = fd.PartType
+		dev.PartitionLabel = fd.PartLabel
+		// Partitions are as removable as their disk unless stated otherwise
+		if fd.Removable == nil {
+			dev.IsRemovable = parent.IsRemovable
+		}
+	}
+
+	f.Insert(dev)
+	if fd.MountPoint != "" {
+		f.SetMounted(dev.Path, fd.MountPoint)
+	}
+	for _, part := range fd.Partitions {
+		f.insertFixture(part, &dev)
+	}
+}
+
+// Insert adds a device, linking it to its parent if Parent is set
+func (f *FakeBackend) Insert(dev Device) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	dev.Children = nil
+	for _, existing := range f.devices {
+		if existing.Path == dev.Parent {
+			existing.Children = append(existing.Children, dev.Path)
+		}
+	}
+	f.devices = append(f.devices, &dev)
+}
+
+// Remove removes a device and everything stacked on it
+func (f *FakeBackend) Remove(path string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	removed := map[string]bool{path: true}
+	kept := []*Device{}
+	for _, dev := range f.devices {
+		if removed[dev.Path] || removed[dev.Parent] {
+			removed[dev.Path] = true
+			delete(f.mounts, dev.Path)
+			continue
+		}
+		kept = append(kept, dev)
+	}
+
+	for _, dev := range kept {
+		children := []string{}
+		for _, child := range dev.Children {
+			if !removed[child] {
+				children = append(children, child)
+			}
+		}
+		dev.Children = children
+	}
+	f.devices = kept
+}
+
+// Update changes a device in place, e.g. to simulate a reformat
+func (f *FakeBackend) Update(path string, fn func(dev *Device)) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, dev := range f.devices {
+		if dev.Path == path {
+			fn(dev)
+			return nil
+		}
+	}
+	return fmt.Errorf("device not found: %s", path)
+}
+
+// SetMounted records a device as mounted at mountPoint, or unmounted if
+// mountPoint is empty
+func (f *FakeBackend) SetMounted(path, mountPoint string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if mountPoint == "" {
+		delete(f.mounts, path)
+	} else {
+		f.mounts[path] = mountPoint
+	}
+}
+
+// SetUsage sets the space statistics reported for the filesystem of a
+// device while it is mounted
+func (f *FakeBackend) SetUsage(path string, usage Usage) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.usage[path] = usage
+}
+
+// Scan returns copies of the removable devices and everything stacked on
+// them, leaving out fixed disks like the real backends do
+func (f *FakeBackend) Scan() ([]*Device, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	byPath := make(map[string]*Device, len(f.devices))
+	for _, dev := range f.devices {
+		byPath[dev.Path] = dev
+	}
+	removable := func(dev *Device) bool {
+		// Bounded by the number of devices in case of a cycle
+		for i := 0; dev != nil && i <= len(f.devices); i++ {
+			if dev.IsRemovable {
+				return true
+			}
+			dev = byPath[dev.Parent]
+		}
+		return false
+	}
+
+	devices := make([]*Device, 0, len(f.devices))
+	for _, dev := range f.devices {
+		if !removable(dev) {
+			continue
+		}
+		copied := dev.clone()
+		copied.IsRemovable = true
+		devices = append(devices, &copied)
+	}
+	return devices, nil
+}
+
+// Probe fills in the filesystem metadata recorded for a device
+func (f *FakeBackend) Probe(dev *Device) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, known := range f.devices {
+		if known.Path == dev.Path {
+			dev.FSType = known.FSType
+			dev.Label = known.Label
+			dev.UUID = known.UUID
+			dev.IsEncrypted = known.IsEncrypted
+			return nil
+		}
+	}
+	return fmt.Errorf("device not found: %s", dev.Path)
+}
+
+// MountTable returns the simulated mount table
+func (f *FakeBackend) MountTable() ([]MountEntry, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	mounts := []MountEntry{}
+	for _, dev := range f.devices {
+		if mountPoint, ok := f.mounts[dev.Path]; ok {
+			mounts = append(mounts, MountEntry{
+				Device:     dev.Path,
+				MountPoint: mountPoint,
+				FSType:     dev.FSType,
+			})
+		}
+	}
+	return mounts, nil
+}
+
+// Usage returns the simulated space statistics of a mounted filesystem
+func (f *FakeBackend) Usage(mountPoint string) (Usage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for path, mounted := range f.mounts {
+		if mounted == mountPoint {
+			return f.usage[path], nil
+		}
+	}
+	return Usage{}, fmt.Errorf("not mounted: %s", mountPoint)
+}
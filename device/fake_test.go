@@ -0,0 +1,106 @@
+package device
+
+import (
+	"testing"
+)
+
+func TestFakeBackend(t *testing.T) {
+	backend, err := LoadFakeBackend("testdata/usb-stick.yml")
+	if err != nil {
+		t.Fatalf("Failed to load fixture: %v", err)
+	}
+
+	m := NewManagerWithBackend(backend)
+	devices, err := m.Scan()
+	if err != nil {
+		t.Fatalf("Failed to scan: %v", err)
+	}
+	if len(devices) != 2 {
+		t.Fatalf("Should have 2 devices, got %d", len(devices))
+	}
+
+	stick, ok := m.GetDevice("/dev/da0p1")
+	if !ok {
+		t.Fatal("Should find da0p1")
+	}
+	if stick.Label != "STICK" || stick.Parent != "/dev/da0" || !stick.IsRemovable {
+		t.Errorf("Unexpected partition: %+v", stick)
+	}
+	if stick.Serial != "60A44C413A7CF3B1" || stick.USBID() != "0951:1666" || stick.Bus != "usb" {
+		t.Errorf("da0p1 should inherit the hardware of da0, got %+v", stick.Hardware)
+	}
+	if stick.PartitionTypeName != "ms-basic-data" || stick.IsSystemPartition() {
+		t.Errorf("da0p1 should be a basic data partition, got %q", stick.PartitionTypeName)
+	}
+	if !stick.IsMounted || stick.MountPoint != "/media/STICK" {
+		t.Errorf("da0p1 should be mounted from the fixture, got %q", stick.MountPoint)
+	}
+	// The fixed disk is left out, as the real backends do
+	if _, ok := m.GetDevice("/dev/ada0p2"); ok {
+		t.Error("ada0p2 is not removable and should not be scanned")
+	}
+
+	// Simulate a reformat followed by removal of the stick
+	backend.Update("/dev/da0p1", func(dev *Device) { dev.Label = "BACKUP" })
+	m.Scan()
+	if stick, _ := m.GetDevice("/dev/da0p1"); stick.Label != "BACKUP" {
+		t.Errorf("Label should change to BACKUP, got %s", stick.Label)
+	}
+
+	backend.Remove("/dev/da0")
+	devices, _ = m.Scan()
+	if len(devices) != 0 {
+		t.Errorf("Should have no devices after removal, got %d", len(devices))
+	}
+	if _, ok := m.GetDevice("/dev/da0p1"); ok {
+		t.Error("da0p1 should be gone after removing da0")
+	}
+}
+
+func TestFakeBackendMedia(t *testing.T) {
+	backend, err := LoadFakeBackend("testdata/empty-drives.yml")
+	if err != nil {
+		t.Fatalf("Failed to load fixture: %v", err)
+	}
+
+	m := NewManagerWithBackend(backend)
+	old, err := m.Snapshot()
+	if err != nil {
+		t.Fatalf("Failed to scan: %v", err)
+	}
+
+	for _, path := range []string{"/dev/cd0", "/dev/da1"} {
+		dev, ok := m.GetDevice(path)
+		if !ok {
+			t.Fatalf("Should find %s", path)
+		}
+		if dev.MediaPresent || dev.IsMountable() {
+			t.Errorf("%s should be empty", path)
+		}
+	}
+
+	// Insert a disc, which changes the drive itself rather than adding a device
+	backend.Update("/dev/cd0", func(dev *Device) {
+		dev.MediaPresent = true
+		dev.FSType = "iso9660"
+		dev.Label = "FREEBSD_INSTALL"
+		dev.Size = 4697620480
+	})
+	next, err := m.Snapshot()
+	if err != nil {
+		t.Fatalf("Failed to scan: %v", err)
+	}
+
+	disc, _ := m.GetDevice("/dev/cd0")
+	if !disc.IsOptical || !disc.IsMountable() {
+		t.Errorf("cd0 should be mountable with a disc in it: %+v", disc)
+	}
+
+	events := Diff(old, next)
+	if len(events) != 1 || events[0].Type != EventChanged || !events[0].HasChange("media") {
+		t.Fatalf("Should report a media change of cd0, got %+v", events)
+	}
+	if !events[0].HasChange("fstype") {
+		t.Error("Should report the filesystem of the disc")
+	}
+}
@@ -0,0 +1,197 @@
+package device
+
+import (
+	"bufio"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// GeomBackend discovers devices on FreeBSD through GEOM
+type GeomBackend struct{}
+
+// Scan scans for devices on FreeBSD
+func (b *GeomBackend) Scan() ([]*Device, error) {
+	// The whole GEOM tree in one go instead of geom/gpart/glabel per disk
+	output, err := exec.Command("sysctl", "-n", "kern.geom.confxml").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read GEOM configuration: %w", err)
+	}
+
+	all, err := parseGeomXML(output)
+	if err != nil {
+		return nil, err
+	}
+
+	// Map disks to the CAM controller they hang off to tell the bus
+	sims := map[string]string{}
+	if output, err := exec.Command("camcontrol", "devlist", "-v").Output(); err == nil {
+		sims = parseCamDevlist(string(output))
+	}
+
+	devices := []*Device{}
+	byPath := make(map[string]*Device, len(all))
+	for _, dev := range all {
+		byPath[dev.Path] = dev
+
+		if parent := byPath[dev.Parent]; parent != nil {
+			// Parents come first, so their hardware and removability are known
+			dev.Hardware = parent.Hardware
+			dev.IsRemovable = parent.IsRemovable
+		} else {
+			b.readHardware(dev, sims[dev.Name])
+			dev.IsRemovable = isRemovableDisk(dev) || isAttachedImage(dev.Path, dev.BackingFile)
+			dev.IsOptical = strings.HasPrefix(dev.Name, "cd")
+		}
+		// Empty card readers and optical drives have a media size of zero
+		dev.MediaPresent = dev.Size > 0
+
+		if !dev.IsRemovable {
+			continue
+		}
+		if dev.IsPartition {
+			// Get filesystem info, whole disks are probed by the Manager
+			b.Probe(dev)
+		}
+		devices = append(devices, dev)
+	}
+
+	return devices, nil
+}
+
+// setGeomDiskIdent records a GEOM disk identity attribute on a disk
+func setGeomDiskIdent(dev *Device, key, value string) {
+	if value == "" || value == "(null)" {
+		return
+	}
+
+	switch key {
+	case "descr":
+		// e.g. "Kingston DataTraveler 3.0" or "Samsung SSD 860 EVO 500GB"
+		dev.Vendor, dev.Model, _ = strings.Cut(value, " ")
+	case "ident":
+		dev.Serial = value
+	case "lunid":
+		dev.WWN = "0x" + strings.ToLower(value)
+	}
+}
+
+// readHardware fills in the bus of a disk and, for USB disks, the USB IDs
+// and port from the umass(4) sysctls
+func (b *GeomBackend) readHardware(disk *Device, sim string) {
+	disk.Bus = geomBus(disk.Name, sim)
+
+	unit, ok := strings.CutPrefix(sim, "umass-sim")
+	if !ok {
+		return
+	}
+	pnp, err := exec.Command("sysctl", "-n", "dev.umass."+unit+".%pnpinfo").Output()
+	if err != nil {
+		return
+	}
+	location, _ := exec.Command("sysctl", "-n", "dev.umass."+unit+".%location").Output()
+	setUSBIdent(disk, parseSysctlPairs(string(pnp)), parseSysctlPairs(string(location)))
+}
+
+// setUSBIdent records the USB IDs and port of a disk from the umass(4)
+// %pnpinfo and %location sysctls
+func setUSBIdent(disk *Device, pnp, location map[string]string) {
+	disk.VendorID = strings.TrimPrefix(pnp["vendor"], "0x")
+	disk.ProductID = strings.TrimPrefix(pnp["product"], "0x")
+	if disk.Serial == "" {
+		disk.Serial = pnp["sernum"]
+	}
+	if location["bus"] != "" && location["port"] != "" {
+		// usbus<bus>.<hub address>.<port>, stable across replugs unlike ugen names
+		disk.PortPath = fmt.Sprintf("usbus%s.%s.%s", location["bus"], location["hubaddr"], location["port"])
+	}
+}
+
+// geomBus returns the bus of a disk from its name and CAM controller
+func geomBus(name, sim string) string {
+	switch {
+	case strings.HasPrefix(sim, "umass-sim"):
+		return "usb"
+	case strings.HasPrefix(sim, "ahcich"), strings.HasPrefix(sim, "ata"),
+		strings.HasPrefix(sim, "mvsch"), strings.HasPrefix(sim, "siisch"):
+		return "sata"
+	case strings.HasPrefix(sim, "nvme"), strings.HasPrefix(name, "nvd"):
+		return "nvme"
+	case strings.HasPrefix(sim, "sdhci"), strings.HasPrefix(sim, "mmc"),
+		strings.HasPrefix(name, "mmcsd"):
+		return "mmc"
+	}
+	return ""
+}
+
+// parseCamDevlist maps each peripheral in `camcontrol devlist -v` output
+// to the controller (SIM) of its bus, e.g. "da0" to "umass-sim0":
+//
+//	scbus6 on umass-sim0 bus 0:
+//	<Kingston DataTraveler 3.0 PMAP>   at scbus6 target 0 lun 0 (da0,pass3)
+func parseCamDevlist(output string) map[string]string {
+	sims := make(map[string]string)
+	sim := ""
+
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if strings.HasPrefix(line, "scbus") {
+			if fields := strings.Fields(line); len(fields) >= 3 && fields[1] == "on" {
+				sim = fields[2]
+			}
+			continue
+		}
+
+		start := strings.LastIndex(line, "(")
+		end := strings.LastIndex(line, ")")
+		if start < 0 || end < start {
+			continue
+		}
+		for _, periph := range strings.Split(line[start+1:end], ",") {
+			if !strings.HasPrefix(periph, "pass") {
+				sims[periph] = sim
+			}
+		}
+	}
+
+	return sims
+}
+
+// parseSysctlPairs parses the key=value pairs of a %pnpinfo or %location
+// sysctl, e.g. `vendor=0x0951 product=0x1666 sernum="60A44C413A7CF3B1"`
+func parseSysctlPairs(s string) map[string]string {
+	pairs := make(map[string]string)
+	for _, field := range strings.Fields(s) {
+		if key, value, ok := strings.Cut(field, "="); ok {
+			pairs[key] = strings.Trim(value, `"`)
+		}
+	}
+	return pairs
+}
+
+// isRemovableDisk checks if a disk is removable
+func isRemovableDisk(disk *Device) bool {
+	// USB mass storage (da*, umass*), optical drives (cd*) and memory cards
+	if strings.HasPrefix(disk.Name, "da") || strings.HasPrefix(disk.Name, "umass") ||
+		strings.HasPrefix(disk.Name, "cd") {
+		return true
+	}
+	return disk.Bus == "usb" || disk.Bus == "mmc"
+}
+
+// Probe reads the filesystem metadata of a device
+func (b *GeomBackend) Probe(dev *Device) error {
+	return probeDevice(dev)
+}
+
+// MountTable returns the currently mounted filesystems
+func (b *GeomBackend) MountTable() ([]MountEntry, error) {
+	return readFsstat()
+}
+
+// Usage returns the space statistics of a mounted filesystem
+func (b *GeomBackend) Usage(mountPoint string) (Usage, error) {
+	return statfsUsage(mountPoint)
+}
@@ -0,0 +1,136 @@
+package device
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseGeomXML(t *testing.T) {
+	data, err := os.ReadFile("testdata/confxml.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	devices, err := parseGeomXML(data)
+	if err != nil {
+		t.Fatalf("Failed to parse GEOM XML: %v", err)
+	}
+
+	paths := []string{}
+	byPath := make(map[string]*Device)
+	for _, dev := range devices {
+		paths = append(paths, dev.Path)
+		byPath[dev.Path] = dev
+	}
+	want := []string{"/dev/ada0", "/dev/ada0p1", "/dev/da0", "/dev/da0p1", "/dev/da0p2",
+		"/dev/da0p2.eli", "/dev/da1", "/dev/da1s1", "/dev/da1s1a", "/dev/md0", "/dev/md1"}
+	if strings.Join(paths, " ") != strings.Join(want, " ") {
+		t.Fatalf("Unexpected devices:\n got %v\nwant %v", paths, want)
+	}
+
+	da0 := byPath["/dev/da0"]
+	if da0.Size != 15518924800 || da0.IsPartition || da0.PartitionTable != "gpt" {
+		t.Errorf("Unexpected disk: %+v", da0)
+	}
+	if da0.Vendor != "Kingston" || da0.Model != "DataTraveler 3.0" || da0.Serial != "60A44C413A7CF3B1" {
+		t.Errorf("Unexpected disk identity: %+v", da0.Hardware)
+	}
+	if da0.WWN != "" || byPath["/dev/ada0"].WWN != "0x5002538e40a1b2c3" {
+		t.Errorf("Unexpected WWNs: %q %q", da0.WWN, byPath["/dev/ada0"].WWN)
+	}
+	if strings.Join(da0.Children, " ") != "/dev/da0p1 /dev/da0p2" {
+		t.Errorf("Unexpected da0 children: %v", da0.Children)
+	}
+
+	// Vnode-backed md devices know their image, swap-backed ones do not
+	if md0 := byPath["/dev/md0"]; md0.BackingFile != "/home/user/FreeBSD-14.1-RELEASE-amd64-disc1.iso" ||
+		md0.Size != 1296414720 {
+		t.Errorf("Unexpected md0: %+v", md0)
+	}
+	if md1 := byPath["/dev/md1"]; md1.BackingFile != "" {
+		t.Errorf("md1 should have no backing file, got %q", md1.BackingFile)
+	}
+
+	// A GPT label mentioning another partition must not confuse the tree
+	p1 := byPath["/dev/da0p1"]
+	if p1.Parent != "/dev/da0" || p1.PartitionNum != 1 || p1.PartitionScheme != "gpt" {
+		t.Errorf("Unexpected partition: %+v", p1)
+	}
+	if p1.PartitionType != "ebd0a0a2-b9e5-4433-87c0-68b6b72699c7" || p1.PartitionLabel != "da0p2 backup" ||
+		p1.PartUUID != "0e7f4a52-2a8c-11ee-8a3c-0800279a1b2c" {
+		t.Errorf("Unexpected partition entry: %s %q %s", p1.PartitionType, p1.PartitionLabel, p1.PartUUID)
+	}
+	if p1.Label != "STICK" || p1.FSType != "vfat" {
+		t.Errorf("Label provider should give label and type, got %q %q", p1.Label, p1.FSType)
+	}
+	if strings.Join(p1.Aliases, " ") != "/dev/msdosfs/STICK" {
+		t.Errorf("Label provider should be an alias, got %v", p1.Aliases)
+	}
+	if p1.Serial != "60A44C413A7CF3B1" {
+		t.Error("Partitions should inherit the disk hardware")
+	}
+
+	p2 := byPath["/dev/da0p2"]
+	if !p2.IsEncrypted || !p2.IsUnlocked || len(p2.Children) != 1 {
+		t.Errorf("da0p2 should be an attached GELI provider: %+v", p2)
+	}
+	if eli := byPath["/dev/da0p2.eli"]; eli.Parent != "/dev/da0p2" || !eli.IsPartition || eli.Size != 6928986112 {
+		t.Errorf("Unexpected ELI device: %+v", eli)
+	}
+
+	// BSD label nested in an MBR slice
+	s1 := byPath["/dev/da1s1"]
+	if s1.PartitionScheme != "mbr" || s1.PartitionType != "a5" {
+		t.Errorf("Unexpected slice entry: %s %s", s1.PartitionScheme, s1.PartitionType)
+	}
+	s1a := byPath["/dev/da1s1a"]
+	if s1a.Parent != "/dev/da1s1" || s1a.PartitionScheme != "bsd" || s1a.PartitionType != "07" {
+		t.Errorf("Unexpected BSD partition: %+v", s1a)
+	}
+	if s1a.Label != "da1 rescue" || s1a.FSType != "ufs" {
+		t.Errorf("Unexpected BSD partition label: %q %q", s1a.Label, s1a.FSType)
+	}
+}
+
+func TestParseCamDevlist(t *testing.T) {
+	output := `scbus0 on ahcich0 bus 0:
+<Samsung SSD 860 EVO 250GB RVT04B6Q>  at scbus0 target 0 lun 0 (ada0,pass0)
+<>                                 at scbus0 target -1 lun ffffffff ()
+scbus6 on umass-sim0 bus 0:
+<Kingston DataTraveler 3.0 PMAP>   at scbus6 target 0 lun 0 (pass3,da0)
+scbus7 on nvme0 bus 0:
+<Samsung SSD 970 EVO Plus 1TB 2B2QEXM7>  at scbus7 target 0 lun 1 (pass4,nda0)
+`
+
+	sims := parseCamDevlist(output)
+	tests := map[string]string{"ada0": "sata", "da0": "usb", "nda0": "nvme"}
+	for name, bus := range tests {
+		if got := geomBus(name, sims[name]); got != bus {
+			t.Errorf("%s should be on %s, got %q (sim %q)", name, bus, got, sims[name])
+		}
+	}
+	if _, ok := sims["pass3"]; ok {
+		t.Error("Pass-through devices should be skipped")
+	}
+	if geomBus("mmcsd0", "") != "mmc" || geomBus("nvd0", "") != "nvme" {
+		t.Error("Disks outside CAM should be recognised by name")
+	}
+}
+
+func TestSetUSBIdent(t *testing.T) {
+	disk := &Device{Name: "da0"}
+	pnp := parseSysctlPairs(`vendor=0x0951 product=0x1666 devclass=0x00 devsubclass=0x00 devproto=0x00 sernum="60A44C413A7CF3B1" release=0x0110 mode=host intclass=0x08 intsubclass=0x06 intprotocol=0x50`)
+	location := parseSysctlPairs(`bus=0 hubaddr=1 port=3 devaddr=2 interface=0 ugen=ugen0.2`)
+	setUSBIdent(disk, pnp, location)
+
+	if disk.USBID() != "0951:1666" {
+		t.Errorf("Unexpected USB ID: %s", disk.USBID())
+	}
+	if disk.Serial != "60A44C413A7CF3B1" {
+		t.Errorf("Unexpected serial: %s", disk.Serial)
+	}
+	if disk.PortPath != "usbus0.1.3" {
+		t.Errorf("Unexpected port path: %s", disk.PortPath)
+	}
+}
@@ -0,0 +1,246 @@
+package device
+
+import (
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// geomMesh is the root of the kern.geom.confxml tree
+type geomMesh struct {
+	Classes []geomClass `xml:"class"`
+}
+
+// geomClass is a GEOM class such as DISK, PART, ELI or LABEL
+type geomClass struct {
+	Name  string     `xml:"name"`
+	Geoms []geomGeom `xml:"geom"`
+}
+
+// geomGeom is an instance of a class, consuming lower providers and
+// offering new ones
+type geomGeom struct {
+	Name      string         `xml:"name"`
+	Rank      int            `xml:"rank"`
+	Config    geomConfig     `xml:"config"`
+	Consumers []geomConsumer `xml:"consumer"`
+	Providers []geomProvider `xml:"provider"`
+}
+
+// geomConsumer attaches a geom to the provider below it
+type geomConsumer struct {
+	Provider struct {
+		Ref string `xml:"ref,attr"`
+	} `xml:"provider"`
+}
+
+// geomProvider is a device node offered by a geom, e.g. /dev/da0p1
+type geomProvider struct {
+	ID        string     `xml:"id,attr"`
+	Name      string     `xml:"name"`
+	Mediasize uint64     `xml:"mediasize"`
+	Config    geomConfig `xml:"config"`
+}
+
+// geomConfig holds the class-specific key/value configuration of a geom
+// or provider
+type geomConfig struct {
+	Entries []struct {
+		XMLName xml.Name
+		Value   string `xml:",chardata"`
+	} `xml:",any"`
+}
+
+// get returns the value of a configuration key, or "" if it is not set
+func (c geomConfig) get(key string) string {
+	for _, entry := range c.Entries {
+		if entry.XMLName.Local == key {
+			return strings.TrimSpace(entry.Value)
+		}
+	}
+	return ""
+}
+
+// geomLabelFSTypes maps glabel(8) filesystem label namespaces to FSType
+var geomLabelFSTypes = map[string]string{
+	"msdosfs": "vfat",
+	"ufs":     "ufs",
+	"iso9660": "iso9660",
+	"ntfs":    "ntfs",
+	"ext2fs":  "", // Could be ext2, ext3 or ext4
+}
+
+// parseGeomXML turns a kern.geom.confxml dump into a flat device list in a
+// single pass: disks, the partitions of every (nested) partition table and
+// ELI layers, with Parent/Children links between them. Label providers are
+// folded into the devices they label rather than listed separately.
+func parseGeomXML(data []byte) ([]*Device, error) {
+	var mesh geomMesh
+	if err := xml.Unmarshal(data, &mesh); err != nil {
+		return nil, fmt.Errorf("failed to decode GEOM XML: %w", err)
+	}
+
+	type layer struct {
+		class string
+		geom  *geomGeom
+	}
+
+	byProvider := make(map[string]*Device)
+	disks := []*Device{}
+	layers := []layer{}
+	labels := []*geomGeom{}
+
+	for ci := range mesh.Classes {
+		class := &mesh.Classes[ci]
+		for gi := range class.Geoms {
+			geom := &class.Geoms[gi]
+			switch class.Name {
+			case "DISK", "MD":
+				for _, prov := range geom.Providers {
+					disk := &Device{
+						Name:        prov.Name,
+						Path:        "/dev/" + prov.Name,
+						Size:        prov.Mediasize,
+						BackingFile: prov.Config.get("file"), // vnode-backed md(4) devices
+					}
+					for _, key := range []string{"descr", "ident", "lunid"} {
+						setGeomDiskIdent(disk, key, prov.Config.get(key))
+					}
+					byProvider[prov.ID] = disk
+					disks = append(disks, disk)
+				}
+			case "PART", "ELI":
+				layers = append(layers, layer{class.Name, geom})
+			case "LABEL":
+				labels = append(labels, geom)
+			}
+		}
+	}
+
+	// Lower ranks sit closer to the disk, so parents are always known by the
+	// time their children are reached, e.g. a BSD label inside an MBR slice
+	sort.SliceStable(layers, func(i, j int) bool {
+		return layers[i].geom.Rank < layers[j].geom.Rank
+	})
+
+	for _, l := range layers {
+		if len(l.geom.Consumers) == 0 {
+			continue
+		}
+		parent := byProvider[l.geom.Consumers[0].Provider.Ref]
+		if parent == nil {
+			continue
+		}
+
+		if l.class == "PART" {
+			parent.PartitionTable = strings.ToLower(l.geom.Config.get("scheme"))
+		}
+		for _, prov := range l.geom.Providers {
+			dev := &Device{
+				Name:        prov.Name,
+				Path:        "/dev/" + prov.Name,
+				Size:        prov.Mediasize,
+				IsPartition: true,
+				Parent:      parent.Path,
+				Hardware:    parent.Hardware,
+			}
+			if l.class == "PART" {
+				setGeomPartition(dev, l.geom.Config.get("scheme"), prov.Config)
+			} else {
+				parent.IsEncrypted = true
+				parent.IsUnlocked = true
+			}
+			parent.Children = append(parent.Children, dev.Path)
+			byProvider[prov.ID] = dev
+		}
+	}
+
+	for _, geom := range labels {
+		if len(geom.Consumers) == 0 {
+			continue
+		}
+		if dev := byProvider[geom.Consumers[0].Provider.Ref]; dev != nil {
+			for _, prov := range geom.Providers {
+				applyGeomLabel(dev, prov.Name)
+				dev.Aliases = append(dev.Aliases, "/dev/"+prov.Name)
+			}
+		}
+	}
+
+	// Flatten depth first so a disk always comes before its partitions
+	byPath := make(map[string]*Device, len(byProvider))
+	for _, dev := range byProvider {
+		byPath[dev.Path] = dev
+	}
+	devices := []*Device{}
+	var visit func(dev *Device)
+	visit = func(dev *Device) {
+		devices = append(devices, dev)
+		for _, child := range dev.Children {
+			visit(byPath[child])
+		}
+	}
+	for _, disk := range disks {
+		visit(disk)
+	}
+
+	return devices, nil
+}
+
+// setGeomPartition records the partition table entry of a PART provider
+func setGeomPartition(dev *Device, scheme string, config geomConfig) {
+	dev.PartitionNum, _ = strconv.Atoi(config.get("index"))
+	dev.PartitionScheme = strings.ToLower(scheme)
+	if dev.PartitionScheme == "ebr" {
+		// Logical partitions in an extended partition use MBR types
+		dev.PartitionScheme = "mbr"
+	}
+	dev.PartitionLabel = config.get("label")
+	dev.PartUUID = config.get("rawuuid")
+
+	rawtype := config.get("rawtype")
+	if id, err := strconv.ParseUint(rawtype, 10, 8); err == nil {
+		// MBR and BSD types are reported in decimal
+		dev.PartitionType = fmt.Sprintf("%02x", id)
+	} else {
+		dev.PartitionType = strings.ToLower(rawtype)
+	}
+}
+
+// applyGeomLabel fills in metadata from a glabel(8) provider name such as
+// "msdosfs/STICK", "gpt/backup" or "gptid/<uuid>", for devices that could
+// not be probed directly
+func applyGeomLabel(dev *Device, name string) {
+	namespace, value, ok := strings.Cut(name, "/")
+	if !ok || value == "" {
+		return
+	}
+
+	switch namespace {
+	case "gpt":
+		if dev.PartitionLabel == "" {
+			dev.PartitionLabel = value
+		}
+	case "gptid":
+		if dev.PartUUID == "" {
+			dev.PartUUID = value
+		}
+	case "diskid":
+		if dev.Serial == "" {
+			dev.Serial = strings.TrimPrefix(value, "DISK-")
+		}
+	default:
+		fstype, ok := geomLabelFSTypes[namespace]
+		if !ok {
+			return
+		}
+		if dev.Label == "" {
+			dev.Label = value
+		}
+		if dev.FSType == "" {
+			dev.FSType = fstype
+		}
+	}
+}
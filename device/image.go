@@ -0,0 +1,222 @@
+package device
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Location of the list of images pgmount attached, one "<device> <image>"
+// line each. Loop and md devices set up by other programs, e.g. for snap
+// packages, are not removable media and stay hidden. This is a variable so
+// tests can point it elsewhere.
+var imageRegistry = "/var/run/pgmount/images"
+
+// attachImageDevice and detachImageDevice are variables so tests can stub
+// out losetup and mdconfig
+var (
+	attachImageDevice = attachImage
+	detachImageDevice = detachImage
+)
+
+// AttachImage attaches a disk image or ISO file to a loop device (Linux) or
+// md device (FreeBSD) and returns the path of the new device, e.g.
+// "/dev/loop0" or "/dev/md0". Partitions inside the image show up as
+// partitions of that device. ISO images and files that are not writable are
+// attached read-only.
+func AttachImage(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err == nil {
+		// The kernel reports the backing file with symlinks resolved
+		abs, err = filepath.EvalSymlinks(abs)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %w", path, err)
+	}
+	// The registry holds one image per line
+	if strings.Contains(abs, "\n") {
+		return "", fmt.Errorf("image path contains a newline: %q", abs)
+	}
+	info, err := os.Stat(abs)
+	if err != nil {
+		return "", fmt.Errorf("failed to read image: %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("not a regular file: %s", abs)
+	}
+
+	devPath, err := attachImageDevice(abs, imageReadOnly(abs))
+	if err != nil {
+		return "", err
+	}
+	if err := registerImage(devPath, abs); err != nil {
+		detachImageDevice(devPath)
+		return "", err
+	}
+	return devPath, nil
+}
+
+// DetachImage detaches the loop or md device of an attached image
+func DetachImage(devPath string) error {
+	if err := detachImageDevice(devPath); err != nil {
+		return err
+	}
+	return unregisterImage(devPath)
+}
+
+// DetachIdleImage detaches the loop or md device that path belongs to once
+// none of the filesystems in its image are mounted. It does nothing for
+// devices that are not backed by an image.
+func (m *Manager) DetachIdleImage(path string) error {
+	m.mu.RLock()
+	disk := m.devices[path]
+	for disk != nil && m.devices[disk.Parent] != nil {
+		disk = m.devices[disk.Parent]
+	}
+	if disk == nil || disk.BackingFile == "" || m.inUse(disk) {
+		m.mu.RUnlock()
+		return nil
+	}
+	diskPath := disk.Path
+	m.mu.RUnlock()
+
+	if err := DetachImage(diskPath); err != nil {
+		return err
+	}
+	m.forget(diskPath)
+	return nil
+}
+
+// forget drops a device and everything stacked on it until the next Scan
+func (m *Manager) forget(path string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	removed := map[string]bool{path: true}
+	order := []string{}
+	for _, p := range m.order {
+		// Parents are listed before their children
+		if removed[p] || removed[m.devices[p].Parent] {
+			removed[p] = true
+			delete(m.devices, p)
+			continue
+		}
+		order = append(order, p)
+	}
+	m.order = order
+
+	// e.g. the encrypted device below a cleartext device that is gone
+	for _, p := range order {
+		dev := m.devices[p]
+		children := []string{}
+		for _, child := range dev.Children {
+			if !removed[child] {
+				children = append(children, child)
+			}
+		}
+		dev.Children = children
+	}
+}
+
+// inUse reports whether a device or anything stacked on it is mounted. The
+// caller must hold m.mu.
+func (m *Manager) inUse(dev *Device) bool {
+	if dev.IsMounted {
+		return true
+	}
+	for _, child := range dev.Children {
+		if c := m.devices[child]; c != nil && m.inUse(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// imageReadOnly reports whether an image should be attached read-only
+func imageReadOnly(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".iso", ".cdr", ".udf":
+		return true
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return true
+	}
+	file.Close()
+	return false
+}
+
+// isAttachedImage reports whether pgmount attached file to devPath
+func isAttachedImage(devPath, file string) bool {
+	if file == "" {
+		return false
+	}
+	images, _ := readImageRegistry()
+	return images[devPath] == file
+}
+
+// readImageRegistry returns the images pgmount attached by device path
+func readImageRegistry() (map[string]string, error) {
+	images := make(map[string]string)
+
+	file, err := os.Open(imageRegistry)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return images, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if devPath, image, ok := strings.Cut(scanner.Text(), " "); ok {
+			images[devPath] = image
+		}
+	}
+	return images, scanner.Err()
+}
+
+// writeImageRegistry replaces the list of attached images
+func writeImageRegistry(images map[string]string) error {
+	if err := os.MkdirAll(filepath.Dir(imageRegistry), 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Dir(imageRegistry), err)
+	}
+
+	var b strings.Builder
+	for devPath, image := range images {
+		fmt.Fprintf(&b, "%s %s\n", devPath, image)
+	}
+
+	// Write a new file and rename it so readers never see a partial list
+	tmp := imageRegistry + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0644); err != nil {
+		return fmt.Errorf("failed to record attached image: %w", err)
+	}
+	return os.Rename(tmp, imageRegistry)
+}
+
+// registerImage records that pgmount attached image to devPath
+func registerImage(devPath, image string) error {
+	images, err := readImageRegistry()
+	if err != nil {
+		return err
+	}
+	images[devPath] = image
+	return writeImageRegistry(images)
+}
+
+// unregisterImage forgets the image attached to devPath
+func unregisterImage(devPath string) error {
+	images, err := readImageRegistry()
+	if err != nil {
+		return err
+	}
+	if _, ok := images[devPath]; !ok {
+		return nil
+	}
+	delete(images, devPath)
+	return writeImageRegistry(images)
+}
@@ -0,0 +1,33 @@
+package device
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// attachImage attaches a file to a new vnode-backed md(4) device. GEOM
+// tastes it like any other disk, so partitions appear on their own.
+func attachImage(path string, readOnly bool) (string, error) {
+	args := []string{"-a", "-t", "vnode", "-f", path}
+	if readOnly {
+		args = append(args, "-o", "readonly")
+	}
+
+	output, err := exec.Command("mdconfig", args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("mdconfig failed: %w (output: %s)", err, strings.TrimSpace(string(output)))
+	}
+	return "/dev/" + strings.TrimSpace(string(output)), nil
+}
+
+// detachImage destroys an md device
+func detachImage(devPath string) error {
+	unit := strings.TrimPrefix(filepath.Base(devPath), "md")
+	output, err := exec.Command("mdconfig", "-d", "-u", unit).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("mdconfig failed: %w (output: %s)", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package device
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// attachImage attaches a file to the next free loop device and has the
+// kernel scan it for partitions
+func attachImage(path string, readOnly bool) (string, error) {
+	args := []string{"--find", "--show", "--partscan"}
+	if readOnly {
+		args = append(args, "--read-only")
+	}
+	args = append(args, path)
+
+	output, err := exec.Command("losetup", args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("losetup failed: %w (output: %s)", err, strings.TrimSpace(string(output)))
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// detachImage detaches a loop device
+func detachImage(devPath string) error {
+	output, err := exec.Command("losetup", "--detach", devPath).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("losetup failed: %w (output: %s)", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux && !freebsd
+
+package device
+
+import "errors"
+
+// attachImage is only available on Linux and FreeBSD
+func attachImage(path string, readOnly bool) (string, error) {
+	return "", errors.New("attaching images is not supported on this platform")
+}
+
+// detachImage is only available on Linux and FreeBSD
+func detachImage(devPath string) error {
+	return errors.New("detaching images is not supported on this platform")
+}
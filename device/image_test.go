@@ -0,0 +1,148 @@
+package device
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestImageRegistry(t *testing.T) {
+	oldRegistry := imageRegistry
+	imageRegistry = filepath.Join(t.TempDir(), "run", "images")
+	defer func() { imageRegistry = oldRegistry }()
+
+	if isAttachedImage("/dev/loop0", "/home/user/disc.iso") {
+		t.Error("Nothing should be attached without a registry")
+	}
+
+	if err := registerImage("/dev/loop0", "/home/user/disc.iso"); err != nil {
+		t.Fatalf("Failed to register image: %v", err)
+	}
+	if err := registerImage("/dev/loop1", "/home/user/firmware.img"); err != nil {
+		t.Fatalf("Failed to register image: %v", err)
+	}
+	if !isAttachedImage("/dev/loop0", "/home/user/disc.iso") {
+		t.Error("loop0 should be a pgmount image")
+	}
+	if isAttachedImage("/dev/loop1", "/var/lib/snapd/snaps/core_1.snap") {
+		t.Error("A loop device reused for another file should not match")
+	}
+
+	if err := unregisterImage("/dev/loop0"); err != nil {
+		t.Fatalf("Failed to unregister image: %v", err)
+	}
+	if isAttachedImage("/dev/loop0", "/home/user/disc.iso") {
+		t.Error("loop0 should be forgotten")
+	}
+	if !isAttachedImage("/dev/loop1", "/home/user/firmware.img") {
+		t.Error("loop1 should still be registered")
+	}
+}
+
+func TestAttachImageSymlink(t *testing.T) {
+	oldRegistry, oldAttach := imageRegistry, attachImageDevice
+	imageRegistry = filepath.Join(t.TempDir(), "images")
+	attached := []string{}
+	attachImageDevice = func(path string, readOnly bool) (string, error) {
+		attached = append(attached, path)
+		return "/dev/loop0", nil
+	}
+	defer func() { imageRegistry, attachImageDevice = oldRegistry, oldAttach }()
+
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "images"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	image := filepath.Join(dir, "images", "disc.iso")
+	if err := os.WriteFile(image, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(dir, "images"), filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The registry has to match loop/backing_file, which has no symlinks
+	resolved, _ := filepath.EvalSymlinks(image)
+	if _, err := AttachImage(filepath.Join(dir, "link", "disc.iso")); err != nil {
+		t.Fatalf("AttachImage failed: %v", err)
+	}
+	if len(attached) != 1 || attached[0] != resolved || !isAttachedImage("/dev/loop0", resolved) {
+		t.Errorf("Attached %q, want %s", attached, resolved)
+	}
+
+	newline := filepath.Join(dir, "disc\n.iso")
+	if err := os.WriteFile(newline, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AttachImage(newline); err == nil {
+		t.Error("An image path with a newline should be refused")
+	}
+}
+
+func TestDetachIdleImage(t *testing.T) {
+	oldRegistry, oldDetach := imageRegistry, detachImageDevice
+	imageRegistry = filepath.Join(t.TempDir(), "images")
+	detached := []string{}
+	detachImageDevice = func(devPath string) error {
+		detached = append(detached, devPath)
+		return nil
+	}
+	defer func() { imageRegistry, detachImageDevice = oldRegistry, oldDetach }()
+
+	backend := NewFakeBackend(
+		Device{Name: "loop0", Path: "/dev/loop0", IsRemovable: true, BackingFile: "/home/user/sd.img"},
+		Device{Name: "loop0p1", Path: "/dev/loop0p1", Parent: "/dev/loop0", IsPartition: true, FSType: "vfat"},
+		Device{Name: "loop0p2", Path: "/dev/loop0p2", Parent: "/dev/loop0", IsPartition: true, FSType: "ext4"},
+		Device{Name: "da0p1", Path: "/dev/da0p1", IsPartition: true, FSType: "vfat"},
+	)
+	backend.SetMounted("/dev/loop0p1", "/media/boot")
+	backend.SetMounted("/dev/loop0p2", "/media/rootfs")
+	backend.SetMounted("/dev/da0p1", "/media/STICK")
+	registerImage("/dev/loop0", "/home/user/sd.img")
+
+	m := NewManagerWithBackend(backend)
+	if _, err := m.Scan(); err != nil {
+		t.Fatalf("Failed to scan: %v", err)
+	}
+
+	m.SetMounted("/dev/da0p1", "")
+	m.SetMounted("/dev/loop0p1", "")
+	for _, path := range []string{"/dev/da0p1", "/dev/loop0p1"} {
+		if err := m.DetachIdleImage(path); err != nil {
+			t.Fatalf("DetachIdleImage(%s) failed: %v", path, err)
+		}
+	}
+	if len(detached) != 0 {
+		t.Fatalf("Should keep the image while loop0p2 is mounted, detached %v", detached)
+	}
+
+	m.SetMounted("/dev/loop0p2", "")
+	if err := m.DetachIdleImage("/dev/loop0p2"); err != nil {
+		t.Fatalf("DetachIdleImage failed: %v", err)
+	}
+	if len(detached) != 1 || detached[0] != "/dev/loop0" {
+		t.Errorf("Should detach loop0 after the last unmount, detached %v", detached)
+	}
+	if isAttachedImage("/dev/loop0", "/home/user/sd.img") {
+		t.Error("Detached image should be forgotten")
+	}
+	if _, ok := m.GetDevice("/dev/loop0p1"); ok {
+		t.Error("The partitions of a detached image should be gone")
+	}
+	if err := m.DetachIdleImage("/dev/loop0p1"); err != nil || len(detached) != 1 {
+		t.Errorf("Detaching twice should do nothing, got %v and %v", err, detached)
+	}
+}
+
+func TestImageReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	for name, want := range map[string]bool{"disc.ISO": true, "sd.img": false} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got := imageReadOnly(path); got != want {
+			t.Errorf("%s: imageReadOnly() = %v, want %v", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package device
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// mountCommand runs mount(8) and umount(8) for key devices. This is a
+// variable so tests can stand in for them.
+var mountCommand = func(name string, args ...string) ([]byte, error) {
+	return exec.Command(name, args...).CombinedOutput()
+}
+
+// Time between scans while waiting for a device to be plugged in
+var waitScanInterval = 500 * time.Millisecond
+
+// ParseKeyDeviceRef splits a keyfile reference to a file on another
+// device, written as "uuid:<uuid of the key device>:/path/on/device"
+func ParseKeyDeviceRef(ref string) (uuid, path string, ok bool) {
+	rest, ok := strings.CutPrefix(ref, "uuid:")
+	if !ok {
+		return "", "", false
+	}
+	uuid, path, ok = strings.Cut(rest, ":")
+	if !ok || uuid == "" || path == "" {
+		return "", "", false
+	}
+	return uuid, path, true
+}
+
+// WaitForDevice scans until a device matching spec (see Resolve) shows up
+// and returns it, or fails once timeout has passed
+func (m *Manager) WaitForDevice(spec string, timeout time.Duration) (Device, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		if _, err := m.Scan(); err != nil {
+			return Device{}, err
+		}
+		dev, err := m.Resolve(spec)
+		if err == nil {
+			return dev, nil
+		}
+		if time.Now().After(deadline) {
+			return Device{}, err
+		}
+		time.Sleep(waitScanInterval)
+	}
+}
+
+// ReadKeyFile reads a keyfile from a key device. A device that is not
+// mounted is mounted read-only in a private temporary directory for the
+// time it takes to read the file. The caller zeroes the returned key once
+// it is done with it.
+func ReadKeyFile(keyDev *Device, path string) ([]byte, error) {
+	// Keep the path on the device
+	path = filepath.Clean("/" + path)
+
+	if keyDev.IsMounted {
+		return readKey(filepath.Join(keyDev.MountPoint, path))
+	}
+
+	dir, err := os.MkdirTemp("", "pgmount-key-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create mount point: %w", err)
+	}
+	defer os.Remove(dir)
+
+	args := []string{"-r", "-o", "nosuid,noexec"}
+	if keyDev.FSType != "" {
+		args = append(args, "-t", keyDev.MountType())
+	}
+	args = append(args, keyDev.Path, dir)
+	if output, err := mountCommand("mount", args...); err != nil {
+		return nil, fmt.Errorf("failed to mount key device %s: %w (output: %s)", keyDev.Path, err,
+			strings.TrimSpace(string(output)))
+	}
+
+	key, readErr := readKey(filepath.Join(dir, path))
+	if output, err := mountCommand("umount", dir); err != nil {
+		clear(key)
+		return nil, fmt.Errorf("failed to unmount key device %s: %w (output: %s)", keyDev.Path, err,
+			strings.TrimSpace(string(output)))
+	}
+	return key, readErr
+}
+
+// readKey reads a keyfile into a buffer of its exact size, so that no
+// partial copies are left behind when the buffer grows
+func readKey(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open keyfile: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keyfile: %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("keyfile %s is not a regular file", path)
+	}
+
+	key := make([]byte, info.Size())
+	if _, err := io.ReadFull(file, key); err != nil {
+		clear(key)
+		return nil, fmt.Errorf("failed to read keyfile: %w", err)
+	}
+	return key, nil
+}
@@ -0,0 +1,125 @@
+package device
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseKeyDeviceRef(t *testing.T) {
+	tests := []struct {
+		ref        string
+		uuid, path string
+		ok         bool
+	}{
+		{"uuid:1234-ABCD:/keys/backup.key", "1234-ABCD", "/keys/backup.key", true},
+		{"uuid:0a1b2c3d-4e5f-6071-8293-a4b5c6d7e8f9:backup.key", "0a1b2c3d-4e5f-6071-8293-a4b5c6d7e8f9", "backup.key", true},
+		{"/root/backup.key", "", "", false},
+		{"uuid:1234-ABCD", "", "", false},
+		{"uuid::/keys/backup.key", "", "", false},
+	}
+	for _, tt := range tests {
+		uuid, path, ok := ParseKeyDeviceRef(tt.ref)
+		if uuid != tt.uuid || path != tt.path || ok != tt.ok {
+			t.Errorf("ParseKeyDeviceRef(%q) = %q, %q, %v", tt.ref, uuid, path, ok)
+		}
+	}
+}
+
+// stubMount stands in for mount and umount, placing files in the mount
+// point while the key device is mounted
+func stubMount(t *testing.T, files map[string]string) *[]string {
+	runs := []string{}
+	old := mountCommand
+	mountCommand = func(name string, args ...string) ([]byte, error) {
+		dir := args[len(args)-1]
+		runs = append(runs, name+" "+strings.Join(args[:len(args)-1], " "))
+		if name == "mount" {
+			for path, content := range files {
+				os.MkdirAll(filepath.Join(dir, filepath.Dir(path)), 0755)
+				os.WriteFile(filepath.Join(dir, path), []byte(content), 0600)
+			}
+		} else {
+			entries, _ := os.ReadDir(dir)
+			for _, entry := range entries {
+				os.RemoveAll(filepath.Join(dir, entry.Name()))
+			}
+		}
+		return nil, nil
+	}
+	t.Cleanup(func() { mountCommand = old })
+	return &runs
+}
+
+func TestReadKeyFile(t *testing.T) {
+	runs := stubMount(t, map[string]string{"keys/backup.key": "0123456789abcdef"})
+	stick := &Device{Path: "/dev/sdc1", FSType: "vfat", UUID: "1234-ABCD"}
+
+	key, err := ReadKeyFile(stick, "/keys/backup.key")
+	if err != nil {
+		t.Fatalf("ReadKeyFile failed: %v", err)
+	}
+	if string(key) != "0123456789abcdef" {
+		t.Errorf("ReadKeyFile() = %q", key)
+	}
+
+	if len(*runs) != 2 || !strings.HasPrefix((*runs)[0], "mount -r -o nosuid,noexec -t ") ||
+		!strings.HasSuffix((*runs)[0], " /dev/sdc1") || (*runs)[1] != "umount " {
+		t.Errorf("Ran %q", *runs)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(os.TempDir(), "pgmount-key-*")); len(matches) != 0 {
+		t.Errorf("Temporary mount points left behind: %v", matches)
+	}
+
+	// The stick is unmounted again when the keyfile is missing, and paths
+	// cannot leave it
+	*runs = nil
+	if _, err := ReadKeyFile(stick, "../../etc/passwd"); err == nil {
+		t.Error("Reading a missing keyfile should fail")
+	}
+	if len(*runs) != 2 {
+		t.Errorf("Key device should be mounted and unmounted, ran %q", *runs)
+	}
+}
+
+func TestReadKeyFileMounted(t *testing.T) {
+	runs := stubMount(t, nil)
+	mountPoint := t.TempDir()
+	if err := os.WriteFile(filepath.Join(mountPoint, "backup.key"), []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	stick := &Device{Path: "/dev/sdc1", FSType: "vfat", IsMounted: true, MountPoint: mountPoint}
+	key, err := ReadKeyFile(stick, "backup.key")
+	if err != nil || string(key) != "secret" {
+		t.Errorf("ReadKeyFile() = %q, %v", key, err)
+	}
+	if len(*runs) != 0 {
+		t.Errorf("A mounted key device should be read in place, ran %q", *runs)
+	}
+}
+
+func TestWaitForDevice(t *testing.T) {
+	old := waitScanInterval
+	waitScanInterval = 10 * time.Millisecond
+	defer func() { waitScanInterval = old }()
+
+	backend := NewFakeBackend()
+	m := NewManagerWithBackend(backend)
+
+	if _, err := m.WaitForDevice("UUID=1234-ABCD", 30*time.Millisecond); err == nil {
+		t.Error("Waiting for an absent device should time out")
+	}
+
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		backend.Insert(Device{Name: "sdc1", Path: "/dev/sdc1", IsPartition: true, IsRemovable: true,
+			FSType: "vfat", UUID: "1234-ABCD"})
+	}()
+	dev, err := m.WaitForDevice("UUID=1234-ABCD", 5*time.Second)
+	if err != nil || dev.Path != "/dev/sdc1" {
+		t.Errorf("WaitForDevice() = %s, %v", dev.Path, err)
+	}
+}
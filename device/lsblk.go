@@ -0,0 +1,331 @@
+package device
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// LsblkBackend discovers devices on Linux by running lsblk, falling back
+// to reading /sys/block when lsblk is unavailable
+type LsblkBackend struct{}
+
+// Scan scans for devices on Linux
+func (b *LsblkBackend) Scan() ([]*Device, error) {
+	devices := []*Device{}
+
+	// Use lsblk to list block devices with sizes in bytes. There is no
+	// PATH column before util-linux 2.33, so paths are built from NAME.
+	cmd := exec.Command("lsblk", "-J", "-b", "-o",
+		"NAME,MAJ:MIN,SIZE,TYPE,MOUNTPOINT,FSTYPE,LABEL,UUID,RM,HOTPLUG,VENDOR,MODEL,SERIAL,WWN,TRAN,"+
+			"PTTYPE,PARTTYPE,PARTLABEL,PARTUUID")
+	output, err := cmd.Output()
+	if err != nil {
+		// Fallback to simpler method if lsblk JSON fails
+		return b.scanFallback()
+	}
+
+	// Parse lsblk JSON output
+	linuxDevices, err := b.parseLsblkJSON(output)
+	if err != nil {
+		return b.scanFallback()
+	}
+
+	// Filter for removable devices and their partitions
+	for _, dev := range linuxDevices {
+		if dev.IsRemovable {
+			devices = append(devices, dev)
+		}
+	}
+
+	return devices, nil
+}
+
+// scanFallback reads removable disks and partitions from /sys/block
+func (b *LsblkBackend) scanFallback() ([]*Device, error) {
+	devices := []*Device{}
+
+	// Read from /sys/block to find removable devices
+	blockDevices, err := os.ReadDir("/sys/block")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read /sys/block: %w", err)
+	}
+
+	for _, entry := range blockDevices {
+		deviceName := entry.Name()
+
+		// Check if removable
+		removablePath := filepath.Join("/sys/block", deviceName, "removable")
+		removableData, err := os.ReadFile(removablePath)
+		if err != nil {
+			continue
+		}
+
+		isRemovable := strings.TrimSpace(string(removableData)) == "1"
+		backingFile := readSysfsString(filepath.Join("/sys/block", deviceName), "loop/backing_file")
+		if !isRemovable && !isAttachedImage("/dev/"+deviceName, backingFile) {
+			continue
+		}
+
+		// Create device entry
+		dev := &Device{
+			Name:        deviceName,
+			Path:        "/dev/" + deviceName,
+			IsRemovable: true,
+			IsPartition: false,
+			BackingFile: backingFile,
+		}
+
+		// Get size
+		sizePath := filepath.Join("/sys/block", deviceName, "size")
+		if sizeData, err := os.ReadFile(sizePath); err == nil {
+			if sectors, err := strconv.ParseUint(strings.TrimSpace(string(sizeData)), 10, 64); err == nil {
+				dev.Size = sectors * 512 // Convert sectors to bytes
+			}
+		}
+		dev.MediaPresent = dev.Size > 0
+		dev.IsOptical = strings.HasPrefix(deviceName, "sr")
+
+		devices = append(devices, dev)
+
+		// Find partitions
+		partitions := b.findPartitions(deviceName)
+		for _, part := range partitions {
+			part.Parent = dev.Path
+			dev.Children = append(dev.Children, part.Path)
+		}
+		devices = append(devices, partitions...)
+	}
+	applyPartitionTables(devices)
+
+	return devices, nil
+}
+
+// findPartitions finds partitions for a Linux block device
+func (b *LsblkBackend) findPartitions(deviceName string) []*Device {
+	partitions := []*Device{}
+
+	deviceDir := filepath.Join("/sys/block", deviceName)
+	entries, err := os.ReadDir(deviceDir)
+	if err != nil {
+		return partitions
+	}
+
+	for _, entry := range entries {
+		partName := entry.Name()
+
+		// Partitions are subdirectories that start with the device name
+		if !strings.HasPrefix(partName, deviceName) {
+			continue
+		}
+
+		// Skip if it's the device itself
+		if partName == deviceName {
+			continue
+		}
+
+		// Create partition device
+		part := &Device{
+			Name:         partName,
+			Path:         "/dev/" + partName,
+			IsPartition:  true,
+			IsRemovable:  true,
+			PartitionNum: partitionNumber(partName),
+		}
+
+		// Get size
+		sizePath := filepath.Join(deviceDir, partName, "size")
+		if sizeData, err := os.ReadFile(sizePath); err == nil {
+			if sectors, err := strconv.ParseUint(strings.TrimSpace(string(sizeData)), 10, 64); err == nil {
+				part.Size = sectors * 512
+			}
+		}
+		part.MediaPresent = true
+
+		// Detect filesystem
+		b.Probe(part)
+
+		partitions = append(partitions, part)
+	}
+
+	return partitions
+}
+
+// lsblkOutput mirrors the top level of `lsblk -J` output
+type lsblkOutput struct {
+	BlockDevices []lsblkDevice `json:"blockdevices"`
+}
+
+// lsblkDevice is a single node of the lsblk device tree
+type lsblkDevice struct {
+	Name       string        `json:"name"`
+	MajMin     string        `json:"maj:min"`
+	Size       lsblkNumber   `json:"size"`
+	Type       string        `json:"type"`
+	MountPoint string        `json:"mountpoint"`
+	FSType     string        `json:"fstype"`
+	Label      string        `json:"label"`
+	UUID       string        `json:"uuid"`
+	RM         lsblkBool     `json:"rm"`
+	Hotplug    lsblkBool     `json:"hotplug"`
+	Vendor     string        `json:"vendor"`
+	Model      string        `json:"model"`
+	Serial     string        `json:"serial"`
+	WWN        string        `json:"wwn"`
+	Tran       string        `json:"tran"`
+	PTType     string        `json:"pttype"`
+	PartType   string        `json:"parttype"`
+	PartLabel  string        `json:"partlabel"`
+	PartUUID   string        `json:"partuuid"`
+	Children   []lsblkDevice `json:"children"`
+}
+
+// lsblkBool accepts both the boolean and the "0"/"1" string forms
+// that different util-linux versions emit for flag columns
+type lsblkBool bool
+
+// UnmarshalJSON implements json.Unmarshaler
+func (b *lsblkBool) UnmarshalJSON(data []byte) error {
+	switch strings.Trim(string(data), `"`) {
+	case "true", "1":
+		*b = true
+	case "false", "0", "null", "":
+		*b = false
+	default:
+		return fmt.Errorf("invalid lsblk flag value: %s", data)
+	}
+	return nil
+}
+
+// lsblkNumber accepts both numeric and string forms of byte counts,
+// since older util-linux versions quote every value
+type lsblkNumber uint64
+
+// UnmarshalJSON implements json.Unmarshaler
+func (n *lsblkNumber) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	if s == "null" || s == "" {
+		*n = 0
+		return nil
+	}
+	val, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid lsblk size value: %s", data)
+	}
+	*n = lsblkNumber(val)
+	return nil
+}
+
+// parseLsblkJSON parses `lsblk -J -b` output into a flat device list.
+// The disk -> partition -> crypt/LVM hierarchy is preserved through the
+// Parent and Children fields, and removability is inherited from the parent.
+func (b *LsblkBackend) parseLsblkJSON(output []byte) ([]*Device, error) {
+	var tree lsblkOutput
+	if err := json.Unmarshal(output, &tree); err != nil {
+		return nil, fmt.Errorf("failed to decode lsblk output: %w", err)
+	}
+
+	devices := []*Device{}
+	for i := range tree.BlockDevices {
+		devices = b.flattenLsblk(&tree.BlockDevices[i], nil, devices)
+	}
+
+	return devices, nil
+}
+
+// flattenLsblk appends node and all of its descendants to devices
+func (b *LsblkBackend) flattenLsblk(node *lsblkDevice, parent *Device, devices []*Device) []*Device {
+	dev := &Device{
+		Name:        node.Name,
+		DevNum:      node.MajMin,
+		Label:       node.Label,
+		UUID:        node.UUID,
+		FSType:      node.FSType,
+		Size:        uint64(node.Size),
+		MountPoint:  node.MountPoint,
+		IsMounted:   node.MountPoint != "",
+		IsPartition: node.Type == "part" || node.Type == "crypt" || node.Type == "lvm",
+		IsRemovable: bool(node.RM) || bool(node.Hotplug),
+		IsEncrypted: isEncryptedType(node.FSType),
+		// Empty card readers and optical drives report a size of zero
+		MediaPresent: node.Size > 0,
+		IsOptical:    node.Type == "rom",
+	}
+
+	// NAME is the device-mapper name for crypt and lvm nodes
+	if node.Type == "crypt" || node.Type == "lvm" {
+		dev.Path = "/dev/mapper/" + node.Name
+	} else {
+		dev.Path = "/dev/" + node.Name
+	}
+
+	if parent != nil {
+		dev.Parent = parent.Path
+		parent.Children = append(parent.Children, dev.Path)
+		if parent.IsRemovable {
+			dev.IsRemovable = true
+		}
+		if node.Type == "crypt" {
+			parent.IsUnlocked = true
+		}
+		dev.Hardware = parent.Hardware
+	} else {
+		// lsblk does not report USB IDs, ports or loop files, so take those from sysfs
+		dev.Hardware = readSysfsHardware(filepath.Join(sysBlockDir, node.Name))
+		dev.BackingFile = readSysfsString(filepath.Join(sysBlockDir, node.Name), "loop/backing_file")
+		if isAttachedImage(dev.Path, dev.BackingFile) {
+			dev.IsRemovable = true
+		}
+		lsblkHardware := Hardware{
+			Vendor: strings.TrimSpace(node.Vendor),
+			Model:  strings.TrimSpace(node.Model),
+			Serial: node.Serial,
+			WWN:    node.WWN,
+			Bus:    node.Tran,
+		}
+		if lsblkHardware.Bus == "ata" {
+			lsblkHardware.Bus = "sata"
+		}
+		mergeHardware(&dev.Hardware, lsblkHardware)
+	}
+
+	if node.Type == "part" {
+		dev.PartitionNum = partitionNumber(dev.Name)
+		if node.PartType != "" {
+			setPartitionEntry(dev, node.PTType, node.PartType, node.PartLabel, node.PartUUID)
+		}
+	} else {
+		// Partitions report the table of their disk in PTTYPE as well
+		dev.PartitionTable = partitionScheme(node.PTType)
+	}
+	if dev.FSType == "" && dev.IsPartition && dev.MediaPresent {
+		// Older blkid versions miss BitLocker, and none detects VeraCrypt
+		b.Probe(dev)
+	}
+
+	devices = append(devices, dev)
+	for i := range node.Children {
+		devices = b.flattenLsblk(&node.Children[i], dev, devices)
+	}
+
+	return devices
+}
+
+// Probe reads the filesystem metadata of a device
+func (b *LsblkBackend) Probe(dev *Device) error {
+	return probeDevice(dev)
+}
+
+// MountTable returns the currently mounted filesystems
+func (b *LsblkBackend) MountTable() ([]MountEntry, error) {
+	return readProcMounts()
+}
+
+// Usage returns the space statistics of a mounted filesystem
+func (b *LsblkBackend) Usage(mountPoint string) (Usage, error) {
+	return statfsUsage(mountPoint)
+}
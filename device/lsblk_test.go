@@ -0,0 +1,131 @@
+package device
+
+import (
+	"testing"
+)
+
+func TestParseLsblkJSON(t *testing.T) {
+	// Nested tree as emitted by util-linux 2.37+ with -b, including a label
+	// containing quotes and braces, null values and a LUKS volume
+	output := `{
+   "blockdevices": [
+      {"name":"sda", "size":256060514304, "type":"disk", "mountpoint":null, "fstype":null, "label":null, "uuid":null, "rm":false, "hotplug":false,
+         "children": [
+            {"name":"sda1", "size":536870912, "type":"part", "mountpoint":"/boot/efi", "fstype":"vfat", "label":null, "uuid":"ABCD-1234", "rm":false, "hotplug":false}
+         ]
+      },
+      {"name":"sdb", "size":15518924800, "type":"disk", "mountpoint":null, "fstype":null, "label":null, "uuid":null, "rm":true, "hotplug":true, "vendor":"Kingston", "model":"DataTraveler 3.0", "serial":"60A44C413A7CF3B1", "wwn":null, "tran":"usb",
+         "children": [
+            {"name":"sdb1", "size":8589934592, "type":"part", "mountpoint":"/media/My \"USB\" {1}", "fstype":"exfat", "label":"My \"USB\" {1}", "uuid":"1A2B-3C4D", "rm":false, "hotplug":false, "pttype":"dos", "parttype":"0xc", "partlabel":null, "partuuid":"1234abcd-01"},
+            {"name":"sdb2", "size":6928990208, "type":"part", "mountpoint":null, "fstype":"crypto_LUKS", "label":null, "uuid":"0f1e2d3c-4b5a-6978-8796-a5b4c3d2e1f0", "rm":false, "hotplug":false,
+               "children": [
+                  {"name":"luks-0f1e", "size":6912212992, "type":"crypt", "mountpoint":null, "fstype":"ext4", "label":"backup", "uuid":"11111111-2222-3333-4444-555555555555", "rm":false, "hotplug":false}
+               ]
+            }
+         ]
+      },
+      {"name":"sr0", "size":4697620480, "type":"rom", "mountpoint":null, "fstype":"iso9660", "label":"FREEBSD_INSTALL", "uuid":"2025-06-03-12-00-00-00", "rm":true, "hotplug":false}
+   ]
+}`
+
+	// Keep the USB IDs from the sysfs of the machine running the test out
+	oldBlock := sysBlockDir
+	sysBlockDir = t.TempDir()
+	defer func() { sysBlockDir = oldBlock }()
+
+	b := &LsblkBackend{}
+	devices, err := b.parseLsblkJSON([]byte(output))
+	if err != nil {
+		t.Fatalf("Failed to parse lsblk output: %v", err)
+	}
+
+	if len(devices) != 7 {
+		t.Fatalf("Should have 7 devices, got %d", len(devices))
+	}
+
+	byPath := make(map[string]*Device)
+	for _, dev := range devices {
+		byPath[dev.Path] = dev
+	}
+
+	if byPath["/dev/sda1"].IsRemovable {
+		t.Error("sda1 should not be removable")
+	}
+
+	sdb1 := byPath["/dev/sdb1"]
+	if !sdb1.IsRemovable {
+		t.Error("sdb1 should inherit removability from sdb")
+	}
+	if sdb1.Vendor != "Kingston" || sdb1.Serial != "60A44C413A7CF3B1" || sdb1.Bus != "usb" {
+		t.Errorf("sdb1 should inherit the hardware of sdb, got %+v", sdb1.Hardware)
+	}
+	if sdb1.Label != `My "USB" {1}` {
+		t.Errorf("Unexpected sdb1 label: %q", sdb1.Label)
+	}
+	if !sdb1.IsMounted || sdb1.MountPoint != `/media/My "USB" {1}` {
+		t.Errorf("sdb1 should be mounted, got %q", sdb1.MountPoint)
+	}
+	if sdb1.Size != 8589934592 {
+		t.Errorf("Unexpected sdb1 size: %d", sdb1.Size)
+	}
+	if sdb1.Parent != "/dev/sdb" || sdb1.PartitionNum != 1 {
+		t.Errorf("Unexpected sdb1 parent/number: %q/%d", sdb1.Parent, sdb1.PartitionNum)
+	}
+	if sdb1.PartitionScheme != "mbr" || sdb1.PartitionType != "0c" || sdb1.PartUUID != "1234abcd-01" {
+		t.Errorf("Unexpected sdb1 partition entry: %s %s %s", sdb1.PartitionScheme, sdb1.PartitionType, sdb1.PartUUID)
+	}
+
+	sdb := byPath["/dev/sdb"]
+	if len(sdb.Children) != 2 || sdb.Children[0] != "/dev/sdb1" || sdb.Children[1] != "/dev/sdb2" {
+		t.Errorf("Unexpected sdb children: %v", sdb.Children)
+	}
+
+	sdb2 := byPath["/dev/sdb2"]
+	if !sdb2.IsEncrypted || !sdb2.IsUnlocked {
+		t.Error("sdb2 should be an unlocked LUKS container")
+	}
+
+	crypt := byPath["/dev/mapper/luks-0f1e"]
+	if crypt == nil {
+		t.Fatal("Missing crypt mapping")
+	}
+	if crypt.Parent != "/dev/sdb2" || !crypt.IsRemovable || !crypt.IsPartition {
+		t.Errorf("Unexpected crypt mapping: %+v", crypt)
+	}
+	if crypt.FSType != "ext4" || crypt.Label != "backup" {
+		t.Errorf("Unexpected crypt metadata: %s %s", crypt.FSType, crypt.Label)
+	}
+
+	disc := byPath["/dev/sr0"]
+	if !disc.IsOptical || !disc.MediaPresent || !disc.IsMountable() || disc.FSType != "iso9660" {
+		t.Errorf("sr0 should be a mountable disc: %+v", disc)
+	}
+}
+
+func TestParseLsblkJSONLegacy(t *testing.T) {
+	// util-linux before 2.33 quotes every value, numbers and booleans too
+	output := `{
+   "blockdevices": [
+      {"name": "sdc", "size": "4026531840", "type": "disk", "mountpoint": null, "fstype": null, "label": null, "uuid": null, "rm": "1", "hotplug": "1",
+         "children": [
+            {"name": "sdc1", "size": "4025483264", "type": "part", "mountpoint": null, "fstype": "vfat", "label": "CAMERA", "uuid": "5E2A-91B0", "rm": "1", "hotplug": "1"}
+         ]
+      }
+   ]
+}`
+
+	b := &LsblkBackend{}
+	devices, err := b.parseLsblkJSON([]byte(output))
+	if err != nil {
+		t.Fatalf("Failed to parse lsblk output: %v", err)
+	}
+
+	if len(devices) != 2 {
+		t.Fatalf("Should have 2 devices, got %d", len(devices))
+	}
+
+	part := devices[1]
+	if part.Path != "/dev/sdc1" || part.Size != 4025483264 || !part.IsRemovable {
+		t.Errorf("Unexpected partition: %+v", part)
+	}
+}
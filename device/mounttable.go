@@ -0,0 +1,201 @@
+package device
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Location of the Linux mount table. This is a variable so tests can point
+// it at a fixture.
+var procMountinfo = "/proc/self/mountinfo"
+
+// MountEntry describes one mounted filesystem
+type MountEntry struct {
+	Device     string   // e.g., "/dev/da0p1"
+	MountPoint string   // e.g., "/media/My Stick"
+	FSType     string   // As the kernel calls it, e.g. "vfat" on Linux or "msdosfs" on FreeBSD
+	Options    []string // e.g., ["rw", "nosuid", "noexec"]
+	Root       string   // Directory of the filesystem mounted, "/" unless it is a bind mount
+	DevNum     string   // "major:minor" of the mounted device, if known
+}
+
+// IsBind reports whether the entry mounts a subdirectory of a filesystem
+// rather than its root, as bind mounts do
+func (e MountEntry) IsBind() bool {
+	return e.Root != "" && e.Root != "/"
+}
+
+// HasOption reports whether the filesystem is mounted with an option
+func (e MountEntry) HasOption(option string) bool {
+	for _, opt := range e.Options {
+		if opt == option {
+			return true
+		}
+	}
+	return false
+}
+
+// applyMountTable sets the mount state of devices from the mount table.
+// Devices are matched by device number where both sides know it, so that
+// /dev/mapper names and /dev/disk/by-* links find their device, and
+// otherwise by exact path.
+func applyMountTable(devices []*Device, mounts []MountEntry) {
+	byNum := make(map[string][]MountEntry)
+	byPath := make(map[string][]MountEntry)
+	for _, entry := range mounts {
+		if entry.DevNum != "" && !strings.HasPrefix(entry.DevNum, "0:") {
+			byNum[entry.DevNum] = append(byNum[entry.DevNum], entry)
+		}
+		byPath[entry.Device] = append(byPath[entry.Device], entry)
+		if real, err := filepath.EvalSymlinks(entry.Device); err == nil && real != entry.Device {
+			byPath[real] = append(byPath[real], entry)
+		}
+	}
+
+	for _, dev := range devices {
+		var found []MountEntry
+		if dev.DevNum != "" {
+			found = append(found, byNum[dev.DevNum]...)
+		}
+		for _, entry := range byPath[dev.Path] {
+			if !hasMountPoint(found, entry.MountPoint) {
+				found = append(found, entry)
+			}
+		}
+		dev.setMounts(found)
+	}
+}
+
+// setMounts records the mounts of a device. MountPoint is the first mount
+// of the whole filesystem, or the first bind mount if there is none.
+func (d *Device) setMounts(mounts []MountEntry) {
+	d.Mounts = mounts
+	d.MountPoint = ""
+	for _, entry := range mounts {
+		if !entry.IsBind() {
+			d.MountPoint = entry.MountPoint
+			break
+		}
+	}
+	if d.MountPoint == "" && len(mounts) > 0 {
+		d.MountPoint = mounts[0].MountPoint
+	}
+	d.IsMounted = len(mounts) > 0
+}
+
+// hasMountPoint reports whether any of the entries is mounted at mountPoint
+func hasMountPoint(mounts []MountEntry, mountPoint string) bool {
+	for _, entry := range mounts {
+		if entry.MountPoint == mountPoint {
+			return true
+		}
+	}
+	return false
+}
+
+// readProcMounts reads the Linux mount table, falling back to the older
+// /proc/self/mounts format when mountinfo is not available
+func readProcMounts() ([]MountEntry, error) {
+	data, err := os.ReadFile(procMountinfo)
+	if err == nil {
+		return parseMountinfo(data), nil
+	}
+
+	data, err = os.ReadFile("/proc/self/mounts")
+	if err != nil {
+		return nil, err
+	}
+	return parseFstabFormat(data), nil
+}
+
+// parseMountinfo parses /proc/self/mountinfo lines of the form
+//
+//	36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+//
+// where a variable number of optional fields precede the "-" separator.
+// Per-mount and superblock options are merged into Options.
+func parseMountinfo(data []byte) []MountEntry {
+	mounts := []MountEntry{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		sep := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 0 || sep+2 >= len(fields) {
+			continue
+		}
+
+		entry := MountEntry{
+			Device:     unescapeOctal(fields[sep+2]),
+			MountPoint: unescapeOctal(fields[4]),
+			FSType:     fields[sep+1],
+			Root:       unescapeOctal(fields[3]),
+			DevNum:     fields[2],
+			Options:    strings.Split(fields[5], ","),
+		}
+		if sep+3 < len(fields) {
+			for _, opt := range strings.Split(fields[sep+3], ",") {
+				if !entry.HasOption(opt) {
+					entry.Options = append(entry.Options, opt)
+				}
+			}
+		}
+		mounts = append(mounts, entry)
+	}
+
+	return mounts
+}
+
+// parseFstabFormat parses "device mountpoint fstype options ..." lines
+func parseFstabFormat(data []byte) []MountEntry {
+	mounts := []MountEntry{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		entry := MountEntry{
+			Device:     unescapeOctal(fields[0]),
+			MountPoint: unescapeOctal(fields[1]),
+			FSType:     fields[2],
+		}
+		if len(fields) > 3 {
+			entry.Options = strings.Split(fields[3], ",")
+		}
+		mounts = append(mounts, entry)
+	}
+
+	return mounts
+}
+
+// unescapeOctal decodes the \ooo escapes used for whitespace in mount tables
+func unescapeOctal(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if val, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(val))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,92 @@
+package device
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// Mount flags from <sys/mount.h>, which the syscall package does not export
+const (
+	mntNoWait = 2
+
+	mntRdonly      = 0x00000001
+	mntSynchronous = 0x00000002
+	mntNoexec      = 0x00000004
+	mntNosuid      = 0x00000008
+	mntUnion       = 0x00000020
+	mntAsync       = 0x00000040
+	mntLocal       = 0x00001000
+	mntSoftdep     = 0x00200000
+	mntNosymfollow = 0x00400000
+	mntNoatime     = 0x10000000
+)
+
+// mntOptions maps mount flags to the option names mount(8) prints
+var mntOptions = []struct {
+	flag uint64
+	name string
+}{
+	{mntSynchronous, "sync"},
+	{mntNoexec, "noexec"},
+	{mntNosuid, "nosuid"},
+	{mntUnion, "union"},
+	{mntAsync, "async"},
+	{mntLocal, "local"},
+	{mntSoftdep, "soft-updates"},
+	{mntNosymfollow, "nosymfollow"},
+	{mntNoatime, "noatime"},
+}
+
+// readFsstat reads the FreeBSD mount table with getfsstat(2)
+func readFsstat() ([]MountEntry, error) {
+	n, err := syscall.Getfsstat(nil, mntNoWait)
+	if err != nil {
+		return nil, fmt.Errorf("getfsstat failed: %w", err)
+	}
+
+	// Leave room for filesystems mounted between the two calls
+	buf := make([]syscall.Statfs_t, n+8)
+	n, err = syscall.Getfsstat(buf, mntNoWait)
+	if err != nil {
+		return nil, fmt.Errorf("getfsstat failed: %w", err)
+	}
+
+	mounts := make([]MountEntry, 0, n)
+	for _, st := range buf[:n] {
+		mounts = append(mounts, MountEntry{
+			Device:     cString(st.Mntfromname[:]),
+			MountPoint: cString(st.Mntonname[:]),
+			FSType:     cString(st.Fstypename[:]),
+			Options:    mountFlagOptions(st.Flags),
+			Root:       "/",
+		})
+	}
+
+	return mounts, nil
+}
+
+// mountFlagOptions converts statfs mount flags to option names
+func mountFlagOptions(flags uint64) []string {
+	options := []string{"rw"}
+	if flags&mntRdonly != 0 {
+		options[0] = "ro"
+	}
+	for _, opt := range mntOptions {
+		if flags&opt.flag != 0 {
+			options = append(options, opt.name)
+		}
+	}
+	return options
+}
+
+// cString converts a NUL-terminated C char array to a string
+func cString(chars []int8) string {
+	b := make([]byte, 0, len(chars))
+	for _, c := range chars {
+		if c == 0 {
+			break
+		}
+		b = append(b, byte(c))
+	}
+	return string(b)
+}
@@ -0,0 +1,10 @@
+//go:build !freebsd
+
+package device
+
+import "errors"
+
+// readFsstat is only available on FreeBSD
+func readFsstat() ([]MountEntry, error) {
+	return nil, errors.New("getfsstat is only available on FreeBSD")
+}
@@ -0,0 +1,74 @@
+package device
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMountinfo(t *testing.T) {
+	data := []byte(`22 1 8:2 / / rw,relatime shared:1 - ext4 /dev/sda2 rw
+95 22 8:17 / /media/My\040Stick rw,nosuid,nodev,relatime shared:48 - vfat /dev/sdb1 rw,fmask=0022,codepage=437
+96 22 8:17 /photos /home/user/photos rw,relatime shared:48 master:2 - vfat /dev/sdb1 rw,fmask=0022
+97 22 253:0 / /media/backup rw,relatime - ext4 /dev/mapper/luks-0f1e rw
+malformed line
+`)
+
+	mounts := parseMountinfo(data)
+	if len(mounts) != 4 {
+		t.Fatalf("Expected 4 mounts, got %d", len(mounts))
+	}
+
+	stick := mounts[1]
+	if stick.Device != "/dev/sdb1" || stick.MountPoint != "/media/My Stick" || stick.FSType != "vfat" {
+		t.Errorf("Unexpected mount: %+v", stick)
+	}
+	if stick.DevNum != "8:17" || stick.IsBind() {
+		t.Errorf("Unexpected device number or bind flag: %s %v", stick.DevNum, stick.IsBind())
+	}
+	want := []string{"rw", "nosuid", "nodev", "relatime", "fmask=0022", "codepage=437"}
+	if !reflect.DeepEqual(stick.Options, want) {
+		t.Errorf("Should merge mount and superblock options, got %v", stick.Options)
+	}
+
+	bind := mounts[2]
+	if bind.Root != "/photos" || !bind.IsBind() || bind.MountPoint != "/home/user/photos" {
+		t.Errorf("Should parse the bind mount after several optional fields, got %+v", bind)
+	}
+}
+
+func TestApplyMountTable(t *testing.T) {
+	sdb1 := &Device{Path: "/dev/sdb1", DevNum: "8:17"}
+	sdb10 := &Device{Path: "/dev/sdb10", DevNum: "8:26"}
+	crypt := &Device{Path: "/dev/mapper/luks-0f1e", DevNum: "253:0"}
+	da0p1 := &Device{Path: "/dev/da0p1"}
+
+	mounts := []MountEntry{
+		{Device: "/dev/sdb1", MountPoint: "/home/user/photos", Root: "/photos", DevNum: "8:17"},
+		{Device: "/dev/sdb1", MountPoint: "/media/STICK", Root: "/", DevNum: "8:17"},
+		{Device: "/dev/dm-0", MountPoint: "/media/backup", Root: "/", DevNum: "253:0"},
+		{Device: "/dev/da0p1", MountPoint: "/media/da0p1"},
+		{Device: "/dev/fuse", MountPoint: "/media/ntfs", DevNum: "0:52"},
+	}
+	applyMountTable([]*Device{sdb1, sdb10, crypt, da0p1}, mounts)
+
+	if !sdb1.IsMounted || len(sdb1.Mounts) != 2 {
+		t.Fatalf("sdb1 should have 2 mounts, got %+v", sdb1.Mounts)
+	}
+	if sdb1.MountPoint != "/media/STICK" {
+		t.Errorf("The main mount point should not be the bind mount, got %s", sdb1.MountPoint)
+	}
+	if sdb10.IsMounted {
+		t.Error("sdb10 should not match the mounts of sdb1")
+	}
+	if crypt.MountPoint != "/media/backup" {
+		t.Errorf("Should find the crypt mapping by device number, got %q", crypt.MountPoint)
+	}
+	if da0p1.MountPoint != "/media/da0p1" {
+		t.Errorf("Should fall back to the device path, got %q", da0p1.MountPoint)
+	}
+
+	applyMountTable([]*Device{sdb1}, nil)
+	if sdb1.IsMounted || sdb1.MountPoint != "" || sdb1.Mounts != nil {
+		t.Errorf("sdb1 should be unmounted, got %+v", sdb1.Mounts)
+	}
+}
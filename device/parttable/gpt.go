@@ -0,0 +1,122 @@
+package parttable
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	gptSignature  = "EFI PART"
+	gptEntryLimit = 1024 // Sanity limit, the usual table has 128 entries
+)
+
+// readGPT reads the primary GPT header at LBA 1, falling back to the
+// backup header at the last LBA if the primary one is damaged
+func readGPT(r io.ReaderAt, size int64, sectorSize int) *Table {
+	if table := readGPTHeader(r, size, sectorSize, int64(sectorSize)); table != nil {
+		return table
+	}
+	if size >= int64(2*sectorSize) {
+		return readGPTHeader(r, size, sectorSize, size-int64(sectorSize))
+	}
+	return nil
+}
+
+// readGPTHeader reads a GPT header at off and the entries it points to
+func readGPTHeader(r io.ReaderAt, size int64, sectorSize int, off int64) *Table {
+	hdr := readAt(r, off, 92)
+	if hdr == nil || string(hdr[0:8]) != gptSignature {
+		return nil
+	}
+
+	hdrSize := binary.LittleEndian.Uint32(hdr[12:16])
+	if hdrSize < 92 || hdrSize > uint32(sectorSize) {
+		return nil
+	}
+	full := readAt(r, off, int(hdrSize))
+	if full == nil {
+		return nil
+	}
+	check := make([]byte, len(full))
+	copy(check, full)
+	binary.LittleEndian.PutUint32(check[16:20], 0)
+	if crc32.ChecksumIEEE(check) != binary.LittleEndian.Uint32(hdr[16:20]) {
+		return nil
+	}
+
+	entriesLBA := binary.LittleEndian.Uint64(hdr[72:80])
+	count := binary.LittleEndian.Uint32(hdr[80:84])
+	entrySize := binary.LittleEndian.Uint32(hdr[84:88])
+	if count > gptEntryLimit || entrySize < 128 || entrySize > 4096 {
+		return nil
+	}
+
+	entries := readAt(r, int64(entriesLBA)*int64(sectorSize), int(count*entrySize))
+	if entries == nil || crc32.ChecksumIEEE(entries) != binary.LittleEndian.Uint32(hdr[88:92]) {
+		return nil
+	}
+
+	table := &Table{Scheme: "gpt", SectorSize: sectorSize}
+	for i := uint32(0); i < count; i++ {
+		e := entries[i*entrySize : (i+1)*entrySize]
+		typ := guidString(e[0:16])
+		if typ == "" {
+			continue
+		}
+		first := binary.LittleEndian.Uint64(e[32:40])
+		last := binary.LittleEndian.Uint64(e[40:48])
+		if last < first {
+			continue
+		}
+		attrs := binary.LittleEndian.Uint64(e[48:56])
+		table.Partitions = append(table.Partitions, Partition{
+			Index:    int(i) + 1,
+			Scheme:   "gpt",
+			Type:     typ,
+			UUID:     guidString(e[16:32]),
+			Label:    utf16Name(e[56:128]),
+			Start:    first * uint64(sectorSize),
+			Size:     (last - first + 1) * uint64(sectorSize),
+			Bootable: attrs&(1<<2) != 0, // Legacy BIOS bootable
+		})
+	}
+
+	return table
+}
+
+// guidString formats a GPT GUID, whose first three fields are little
+// endian, in the canonical lowercase form. It returns "" for the nil GUID.
+func guidString(b []byte) string {
+	zero := true
+	for _, c := range b[:16] {
+		if c != 0 {
+			zero = false
+			break
+		}
+	}
+	if zero {
+		return ""
+	}
+	return fmt.Sprintf("%08x-%04x-%04x-%x-%x",
+		binary.LittleEndian.Uint32(b[0:4]),
+		binary.LittleEndian.Uint16(b[4:6]),
+		binary.LittleEndian.Uint16(b[6:8]),
+		b[8:10], b[10:16])
+}
+
+// utf16Name decodes a NUL-terminated UTF-16LE partition name
+func utf16Name(b []byte) string {
+	units := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		u := binary.LittleEndian.Uint16(b[i:])
+		if u == 0 {
+			break
+		}
+		units = append(units, u)
+	}
+	return strings.TrimRight(string(utf16.Decode(units)), " ")
+}
@@ -0,0 +1,189 @@
+package parttable
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	mbrSectorSize = 512
+	mbrEBRLimit   = 128 // Guards against loops in a corrupt EBR chain
+
+	bsdLabelMagic  = 0x82564557
+	bsdRawPart     = 2 // "c" covers the whole slice
+	bsdMaxParts    = 26
+	bsdPartOffset  = 148
+	bsdPartEntSize = 16
+)
+
+// readMBR reads a DOS partition table, following the EBR chain of an
+// extended partition and the BSD disklabel of FreeBSD slices
+func readMBR(r io.ReaderAt, size int64) *Table {
+	sector := readAt(r, 0, mbrSectorSize)
+	if sector == nil || !validMBR(sector, size) {
+		return nil
+	}
+
+	table := &Table{Scheme: "mbr", SectorSize: mbrSectorSize}
+	var extended *Partition
+	for i := 0; i < 4; i++ {
+		p, ok := mbrEntry(sector, i, 0)
+		if !ok {
+			continue
+		}
+		p.Index = i + 1
+		if p.Type == "a5" || p.Type == "a6" || p.Type == "a9" {
+			p.Children = readBSDLabel(r, p)
+		}
+		table.Partitions = append(table.Partitions, p)
+		if isExtended(p.Type) && extended == nil {
+			extended = &p
+		}
+	}
+
+	if extended != nil {
+		table.Partitions = append(table.Partitions, readLogical(r, *extended)...)
+	}
+
+	return table
+}
+
+// validMBR checks the boot signature and that the partition entries look
+// sane, so that a FAT or NTFS boot sector is not mistaken for a table
+func validMBR(sector []byte, size int64) bool {
+	if sector[510] != 0x55 || sector[511] != 0xaa {
+		return false
+	}
+	if string(sector[3:11]) == "NTFS    " || string(sector[0x36:0x39]) == "FAT" ||
+		string(sector[0x52:0x57]) == "FAT32" {
+		return false
+	}
+
+	used := 0
+	for i := 0; i < 4; i++ {
+		e := sector[446+16*i : 446+16*(i+1)]
+		if e[0] != 0x00 && e[0] != 0x80 {
+			return false
+		}
+		if e[4] == 0 {
+			continue
+		}
+		start := uint64(binary.LittleEndian.Uint32(e[8:12]))
+		count := uint64(binary.LittleEndian.Uint32(e[12:16]))
+		if start == 0 || count == 0 {
+			return false
+		}
+		// A protective MBR may claim more than the disk holds
+		if e[4] != 0xee && size > 0 && (start+count)*mbrSectorSize > uint64(size) {
+			return false
+		}
+		used++
+	}
+	return used > 0
+}
+
+// mbrEntry decodes the i-th entry of a partition sector whose LBAs are
+// relative to base
+func mbrEntry(sector []byte, i int, base uint64) (Partition, bool) {
+	e := sector[446+16*i : 446+16*(i+1)]
+	start := uint64(binary.LittleEndian.Uint32(e[8:12]))
+	count := uint64(binary.LittleEndian.Uint32(e[12:16]))
+	if e[4] == 0 || count == 0 {
+		return Partition{}, false
+	}
+	return Partition{
+		Scheme:   "mbr",
+		Type:     fmt.Sprintf("%02x", e[4]),
+		Start:    (base + start) * mbrSectorSize,
+		Size:     count * mbrSectorSize,
+		Bootable: e[0] == 0x80,
+	}, true
+}
+
+// readLogical walks the EBR chain of an extended partition. Logical
+// partitions are numbered from 5, as on both Linux and FreeBSD.
+func readLogical(r io.ReaderAt, ext Partition) []Partition {
+	partitions := []Partition{}
+	extStart := ext.Start / mbrSectorSize
+	ebr := extStart
+
+	for n := 0; n < mbrEBRLimit; n++ {
+		sector := readAt(r, int64(ebr)*mbrSectorSize, mbrSectorSize)
+		if sector == nil || sector[510] != 0x55 || sector[511] != 0xaa {
+			break
+		}
+
+		// The first entry is relative to this EBR, the second links to the
+		// next EBR relative to the start of the extended partition
+		if p, ok := mbrEntry(sector, 0, ebr); ok {
+			p.Index = 5 + len(partitions)
+			partitions = append(partitions, p)
+		}
+		next, ok := mbrEntry(sector, 1, extStart)
+		if !ok || !isExtended(next.Type) || next.Start/mbrSectorSize <= ebr {
+			break
+		}
+		ebr = next.Start / mbrSectorSize
+	}
+
+	return partitions
+}
+
+// readBSDLabel reads the disklabel in the second sector of a BSD slice.
+// Offsets in the label are relative to the raw "c" partition, which itself
+// is not returned.
+func readBSDLabel(r io.ReaderAt, slice Partition) []Partition {
+	label := readAt(r, int64(slice.Start)+mbrSectorSize, mbrSectorSize)
+	if label == nil ||
+		binary.LittleEndian.Uint32(label[0:4]) != bsdLabelMagic ||
+		binary.LittleEndian.Uint32(label[132:136]) != bsdLabelMagic {
+		return nil
+	}
+
+	secsize := uint64(binary.LittleEndian.Uint32(label[40:44]))
+	if secsize == 0 {
+		secsize = mbrSectorSize
+	}
+	count := int(binary.LittleEndian.Uint16(label[138:140]))
+	if count > bsdMaxParts {
+		count = bsdMaxParts
+	}
+	if bsdPartOffset+count*bsdPartEntSize > len(label) {
+		count = (len(label) - bsdPartOffset) / bsdPartEntSize
+	}
+
+	entry := func(i int) []byte {
+		off := bsdPartOffset + i*bsdPartEntSize
+		return label[off : off+bsdPartEntSize]
+	}
+	rawOffset := uint64(0)
+	if count > bsdRawPart {
+		rawOffset = uint64(binary.LittleEndian.Uint32(entry(bsdRawPart)[4:8]))
+	}
+
+	partitions := []Partition{}
+	for i := 0; i < count; i++ {
+		e := entry(i)
+		size := uint64(binary.LittleEndian.Uint32(e[0:4]))
+		offset := uint64(binary.LittleEndian.Uint32(e[4:8]))
+		fstype := e[12]
+		if i == bsdRawPart || size == 0 || fstype == 0 || offset < rawOffset {
+			continue
+		}
+		partitions = append(partitions, Partition{
+			Index:  i + 1,
+			Scheme: "bsd",
+			Type:   fmt.Sprintf("%02x", fstype),
+			Start:  slice.Start + (offset-rawOffset)*secsize,
+			Size:   size * secsize,
+		})
+	}
+
+	return partitions
+}
+
+// isExtended reports whether an MBR type id is an extended partition
+func isExtended(typ string) bool {
+	return typ == "05" || typ == "0f" || typ == "85"
+}
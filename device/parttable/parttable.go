@@ -0,0 +1,83 @@
+// Package parttable reads GPT and MBR partition tables, including logical
+// partitions in extended partitions and BSD disklabels inside MBR slices,
+// without external tools.
+package parttable
+
+import (
+	"errors"
+	"io"
+
+	"github.com/pgsdf/pgmount/device/probe"
+)
+
+// Table is the partition table of a disk
+type Table struct {
+	Scheme     string // "gpt" or "mbr"
+	SectorSize int
+	Partitions []Partition
+}
+
+// Partition is one entry of a partition table
+type Partition struct {
+	Index    int    // Number the operating system gives the partition, e.g. 5 for the first logical one
+	Scheme   string // Table the entry is in: "gpt", "mbr" or "bsd"
+	Type     string // Type GUID (gpt) or two-digit hex type id (mbr, bsd), e.g. "0c"
+	Label    string // GPT partition name
+	UUID     string // GPT unique partition GUID
+	Start    uint64 // Offset from the start of the disk in bytes
+	Size     uint64 // Length in bytes
+	Bootable bool
+
+	// BSD disklabel partitions inside an MBR slice, indexed from 1 for "a"
+	Children []Partition
+}
+
+// ErrNoTable is returned when no known partition table is found
+var ErrNoTable = errors.New("no partition table found")
+
+// Read reads the partition table of the disk in r, which is size bytes long
+func Read(r io.ReaderAt, size int64) (*Table, error) {
+	// A GPT disk also carries a protective MBR, so look for GPT first
+	for _, sectorSize := range []int{512, 4096} {
+		if table := readGPT(r, size, sectorSize); table != nil {
+			return table, nil
+		}
+	}
+	if table := readMBR(r, size); table != nil {
+		return table, nil
+	}
+	return nil, ErrNoTable
+}
+
+// ReadFile reads the partition table of a block device or image file
+func ReadFile(path string) (*Table, error) {
+	file, size, err := probe.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return Read(file, size)
+}
+
+// Find returns the top-level partition with the given index
+func (t *Table) Find(index int) (Partition, bool) {
+	for _, p := range t.Partitions {
+		if p.Index == index {
+			return p, true
+		}
+	}
+	return Partition{}, false
+}
+
+// readAt reads n bytes at off, returning nil on a short read
+func readAt(r io.ReaderAt, off int64, n int) []byte {
+	if off < 0 || n <= 0 {
+		return nil
+	}
+	buf := make([]byte, n)
+	if _, err := r.ReadAt(buf, off); err != nil {
+		return nil
+	}
+	return buf
+}
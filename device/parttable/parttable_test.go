@@ -0,0 +1,304 @@
+package parttable
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+// image is an in-memory disk image used to build partition table fixtures
+type image []byte
+
+func newImage(size int) image {
+	return make(image, size)
+}
+
+func (img image) le16(off int, v uint16) { binary.LittleEndian.PutUint16(img[off:], v) }
+func (img image) le32(off int, v uint32) { binary.LittleEndian.PutUint32(img[off:], v) }
+func (img image) le64(off int, v uint64) { binary.LittleEndian.PutUint64(img[off:], v) }
+
+func (img image) read() (*Table, error) {
+	return Read(bytes.NewReader(img), int64(len(img)))
+}
+
+// guidBytes encodes a canonical GUID in the mixed-endian GPT layout
+func guidBytes(s string) []byte {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	if err != nil || len(b) != 16 {
+		panic("invalid GUID " + s)
+	}
+	b[0], b[1], b[2], b[3] = b[3], b[2], b[1], b[0]
+	b[4], b[5] = b[5], b[4]
+	b[6], b[7] = b[7], b[6]
+	return b
+}
+
+type gptEntry struct {
+	typ, uuid, name string
+	first, last     uint64
+}
+
+const (
+	efiGUID   = "c12a7328-f81f-11d2-ba4b-00a0c93ec93b"
+	basicGUID = "ebd0a0a2-b9e5-4433-87c0-68b6b72699c7"
+	partGUID  = "0f1e2d3c-4b5a-6978-8796-a5b4c3d2e1f0"
+)
+
+// gptImage builds a disk with a primary and backup GPT holding entries
+func gptImage(sectorSize, sectors int, entries ...gptEntry) image {
+	img := newImage(sectorSize * sectors)
+	const count, entrySize = 128, 128
+
+	table := make([]byte, count*entrySize)
+	for i, e := range entries {
+		off := i * entrySize
+		copy(table[off:], guidBytes(e.typ))
+		copy(table[off+16:], guidBytes(e.uuid))
+		binary.LittleEndian.PutUint64(table[off+32:], e.first)
+		binary.LittleEndian.PutUint64(table[off+40:], e.last)
+		for j, u := range utf16.Encode([]rune(e.name)) {
+			binary.LittleEndian.PutUint16(table[off+56+2*j:], u)
+		}
+	}
+	tableSectors := len(table) / sectorSize
+	if tableSectors == 0 {
+		tableSectors = 1
+	}
+
+	header := func(lba, entriesLBA int) {
+		off := lba * sectorSize
+		copy(img[off:], gptSignature)
+		img.le32(off+8, 0x00010000)
+		img.le32(off+12, 92)
+		img.le64(off+24, uint64(lba))
+		img.le64(off+72, uint64(entriesLBA))
+		img.le32(off+80, count)
+		img.le32(off+84, entrySize)
+		img.le32(off+88, crc32.ChecksumIEEE(table))
+		img.le32(off+16, crc32.ChecksumIEEE(img[off:off+92]))
+		copy(img[entriesLBA*sectorSize:], table)
+	}
+	header(1, 2)
+	header(sectors-1, sectors-1-tableSectors)
+
+	// Protective MBR
+	img[446+4] = 0xee
+	img.le32(446+8, 1)
+	img.le32(446+12, uint32(sectors-1))
+	img[510], img[511] = 0x55, 0xaa
+
+	return img
+}
+
+type mbrEntryDef struct {
+	typ         byte
+	start, size uint32
+	boot        bool
+}
+
+// putMBR writes a partition sector at lba
+func (img image) putMBR(lba int, entries ...mbrEntryDef) {
+	off := lba * 512
+	for i, e := range entries {
+		p := off + 446 + 16*i
+		if e.boot {
+			img[p] = 0x80
+		}
+		img[p+4] = e.typ
+		img.le32(p+8, e.start)
+		img.le32(p+12, e.size)
+	}
+	img[off+510], img[off+511] = 0x55, 0xaa
+}
+
+func TestReadGPT(t *testing.T) {
+	for _, sectorSize := range []int{512, 4096} {
+		img := gptImage(sectorSize, 2048,
+			gptEntry{efiGUID, partGUID, "EFI system partition", 34, 133},
+			gptEntry{basicGUID, partGUID, "backup", 134, 2000},
+		)
+
+		table, err := img.read()
+		if err != nil {
+			t.Fatalf("%d: Read failed: %v", sectorSize, err)
+		}
+		if table.Scheme != "gpt" || table.SectorSize != sectorSize {
+			t.Errorf("%d: Should detect GPT, got %s/%d", sectorSize, table.Scheme, table.SectorSize)
+		}
+		if len(table.Partitions) != 2 {
+			t.Fatalf("%d: Expected 2 partitions, got %d", sectorSize, len(table.Partitions))
+		}
+
+		efi := table.Partitions[0]
+		if efi.Index != 1 || efi.Type != efiGUID || efi.UUID != partGUID {
+			t.Errorf("%d: Unexpected EFI partition: %+v", sectorSize, efi)
+		}
+		if efi.Label != "EFI system partition" || efi.TypeName() != "efi" {
+			t.Errorf("%d: Unexpected EFI label or type name: %q %q", sectorSize, efi.Label, efi.TypeName())
+		}
+		if efi.Start != uint64(34*sectorSize) || efi.Size != uint64(100*sectorSize) {
+			t.Errorf("%d: Unexpected EFI extent: %d+%d", sectorSize, efi.Start, efi.Size)
+		}
+
+		data, ok := table.Find(2)
+		if !ok || data.Label != "backup" || data.TypeName() != "ms-basic-data" {
+			t.Errorf("%d: Unexpected data partition: %+v", sectorSize, data)
+		}
+	}
+}
+
+func TestReadGPTBackupHeader(t *testing.T) {
+	img := gptImage(512, 2048, gptEntry{basicGUID, partGUID, "data", 34, 2000})
+	img[512+20] ^= 0xff // Break the primary header checksum
+
+	table, err := img.read()
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if table.Scheme != "gpt" || len(table.Partitions) != 1 {
+		t.Errorf("Should fall back to the backup GPT header, got %+v", table)
+	}
+}
+
+func TestReadMBRLogical(t *testing.T) {
+	img := newImage(512 * 4096)
+	img.putMBR(0,
+		mbrEntryDef{typ: 0x0c, start: 63, size: 1000, boot: true},
+		mbrEntryDef{typ: 0x0f, start: 2048, size: 2048},
+	)
+	// Two logical partitions: linux-data then swap
+	img.putMBR(2048,
+		mbrEntryDef{typ: 0x83, start: 63, size: 500},
+		mbrEntryDef{typ: 0x05, start: 1024, size: 1024},
+	)
+	img.putMBR(2048+1024,
+		mbrEntryDef{typ: 0x82, start: 63, size: 900},
+	)
+
+	table, err := img.read()
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if table.Scheme != "mbr" {
+		t.Errorf("Should detect MBR, got %s", table.Scheme)
+	}
+
+	want := []struct {
+		index int
+		typ   string
+		start uint64
+	}{
+		{1, "0c", 63 * 512},
+		{2, "0f", 2048 * 512},
+		{5, "83", (2048 + 63) * 512},
+		{6, "82", (2048 + 1024 + 63) * 512},
+	}
+	if len(table.Partitions) != len(want) {
+		t.Fatalf("Expected %d partitions, got %+v", len(want), table.Partitions)
+	}
+	for i, w := range want {
+		p := table.Partitions[i]
+		if p.Index != w.index || p.Type != w.typ || p.Start != w.start {
+			t.Errorf("Partition %d: expected %+v, got %+v", i, w, p)
+		}
+	}
+	if !table.Partitions[0].Bootable {
+		t.Error("Should mark the first partition as bootable")
+	}
+	if !IsSystem("mbr", "82") || IsSystem("mbr", "83") {
+		t.Error("Should treat swap, but not Linux data, as a system partition")
+	}
+}
+
+func TestReadBSDLabel(t *testing.T) {
+	img := newImage(512 * 4096)
+	img.putMBR(0, mbrEntryDef{typ: 0xa5, start: 63, size: 4000})
+
+	// Disklabel in the second sector of the slice, with offsets relative
+	// to the raw partition that starts at the slice
+	label := (63 + 1) * 512
+	img.le32(label, bsdLabelMagic)
+	img.le32(label+40, 512)
+	img.le32(label+132, bsdLabelMagic)
+	img.le16(label+138, 4)
+	part := func(i int, size, offset uint32, fstype byte) {
+		off := label + bsdPartOffset + i*bsdPartEntSize
+		img.le32(off, size)
+		img.le32(off+4, offset)
+		img[off+12] = fstype
+	}
+	part(0, 3000, 63+16, 7)  // a: freebsd-ufs
+	part(1, 900, 63+3016, 1) // b: freebsd-swap
+	part(2, 4000, 63, 0)     // c: raw
+
+	table, err := img.read()
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	slice, ok := table.Find(1)
+	if !ok || slice.TypeName() != "freebsd" {
+		t.Fatalf("Expected a FreeBSD slice, got %+v", table.Partitions)
+	}
+	if len(slice.Children) != 2 {
+		t.Fatalf("Expected 2 BSD partitions, got %+v", slice.Children)
+	}
+
+	ufs := slice.Children[0]
+	if ufs.Index != 1 || ufs.Scheme != "bsd" || ufs.TypeName() != "freebsd-ufs" {
+		t.Errorf("Unexpected BSD partition a: %+v", ufs)
+	}
+	if ufs.Start != (63+16)*512 || ufs.Size != 3000*512 {
+		t.Errorf("Unexpected extent of BSD partition a: %d+%d", ufs.Start, ufs.Size)
+	}
+	if swap := slice.Children[1]; swap.Index != 2 || !IsSystem(swap.Scheme, swap.Type) {
+		t.Errorf("Should find swap as BSD partition b, got %+v", swap)
+	}
+}
+
+func TestReadNoTable(t *testing.T) {
+	// A superfloppy: a FAT boot sector directly on the disk
+	fat := newImage(512 * 64)
+	fat[0], fat[1], fat[2] = 0xeb, 0x3c, 0x90
+	copy(fat[3:], "MSDOS5.0")
+	copy(fat[0x36:], "FAT16   ")
+	fat[510], fat[511] = 0x55, 0xaa
+
+	for name, img := range map[string]image{
+		"empty":       newImage(512 * 64),
+		"superfloppy": fat,
+	} {
+		if _, err := img.read(); err != ErrNoTable {
+			t.Errorf("%s: Should report no partition table, got %v", name, err)
+		}
+	}
+}
+
+func TestTypeName(t *testing.T) {
+	tests := []struct {
+		scheme, typ, name string
+		system            bool
+	}{
+		{"gpt", efiGUID, "efi", true},
+		{"gpt", strings.ToUpper(basicGUID), "ms-basic-data", false},
+		{"gpt", "e3c9e316-0b5c-4db8-817d-f92df00215ae", "ms-reserved", true},
+		{"gpt", "de94bba4-06d1-4d40-a16a-bfd50179d6ac", "ms-recovery", true},
+		{"gpt", "0657fd6d-a4ab-43c4-84e5-0933c84b4f4f", "linux-swap", true},
+		{"mbr", "0c", "fat32lba", false},
+		{"mbr", "27", "ms-recovery", true},
+		{"bsd", "1b", "freebsd-zfs", false},
+		{"mbr", "99", "", false},
+	}
+
+	for _, tt := range tests {
+		if got := TypeName(tt.scheme, tt.typ); got != tt.name {
+			t.Errorf("TypeName(%s, %s) = %q, expected %q", tt.scheme, tt.typ, got, tt.name)
+		}
+		if got := IsSystem(tt.scheme, tt.typ); got != tt.system {
+			t.Errorf("IsSystem(%s, %s) = %v, expected %v", tt.scheme, tt.typ, got, tt.system)
+		}
+	}
+}
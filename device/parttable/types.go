@@ -0,0 +1,112 @@
+package parttable
+
+import "strings"
+
+// partType describes a well-known partition type
+type partType struct {
+	name   string // Friendly name, following gpart(8) where it has one
+	system bool   // Firmware, swap, recovery or reserved space, never user data
+}
+
+// gptTypes maps GPT partition type GUIDs to their descriptions
+var gptTypes = map[string]partType{
+	"c12a7328-f81f-11d2-ba4b-00a0c93ec93b": {"efi", true},
+	"21686148-6449-6e6f-744e-656564454649": {"bios-boot", true},
+	"024dee41-33e7-11d3-9d69-0008c781f39f": {"mbr", true},
+	"e3c9e316-0b5c-4db8-817d-f92df00215ae": {"ms-reserved", true},
+	"de94bba4-06d1-4d40-a16a-bfd50179d6ac": {"ms-recovery", true},
+	"ebd0a0a2-b9e5-4433-87c0-68b6b72699c7": {"ms-basic-data", false},
+	"5808c8aa-7e8f-42e0-85d2-e1e90434cfb3": {"ms-ldm-metadata", true},
+	"af9b60a0-1431-4f62-bc68-3311714a69ad": {"ms-ldm-data", false},
+	"0fc63daf-8483-4772-8e79-3d69d8477de4": {"linux-data", false},
+	"933ac7e1-2eb4-4f13-b844-0e14e2aef915": {"linux-home", false},
+	"0657fd6d-a4ab-43c4-84e5-0933c84b4f4f": {"linux-swap", true},
+	"e6d6d379-f507-44c2-a23c-238f2a3df928": {"linux-lvm", false},
+	"a19d880f-05fc-4d3b-a006-743f0f84911e": {"linux-raid", false},
+	"ca7d7ccb-63ed-4c53-861c-1742536059cc": {"linux-luks", false},
+	"bc13c2ff-59e6-4262-a352-b275fd6f7172": {"linux-xbootldr", true},
+	"83bd6b9d-7f41-11dc-be0b-001560b84f0f": {"freebsd-boot", true},
+	"516e7cb4-6ecf-11d6-8ff8-00022d09712b": {"freebsd", false},
+	"516e7cb5-6ecf-11d6-8ff8-00022d09712b": {"freebsd-swap", true},
+	"516e7cb6-6ecf-11d6-8ff8-00022d09712b": {"freebsd-ufs", false},
+	"516e7cb8-6ecf-11d6-8ff8-00022d09712b": {"freebsd-vinum", false},
+	"516e7cba-6ecf-11d6-8ff8-00022d09712b": {"freebsd-zfs", false},
+	"824cc7a0-36a8-11e3-890a-952519ad3f61": {"openbsd-data", false},
+	"48465300-0000-11aa-aa11-00306543ecac": {"apple-hfs", false},
+	"7c3457ef-0000-11aa-aa11-00306543ecac": {"apple-apfs", false},
+	"55465300-0000-11aa-aa11-00306543ecac": {"apple-ufs", false},
+	"6a898cc3-1dd2-11b2-99a6-080020736631": {"apple-zfs", false},
+	"426f6f74-0000-11aa-aa11-00306543ecac": {"apple-boot", true},
+}
+
+// mbrTypes maps MBR partition type ids to their descriptions
+var mbrTypes = map[string]partType{
+	"01": {"fat12", false},
+	"04": {"fat16", false},
+	"05": {"ebr", true},
+	"06": {"fat16", false},
+	"07": {"ntfs", false},
+	"0b": {"fat32", false},
+	"0c": {"fat32lba", false},
+	"0e": {"fat16lba", false},
+	"0f": {"ebr", true},
+	"12": {"compaq-diag", true},
+	"27": {"ms-recovery", true},
+	"82": {"linux-swap", true},
+	"83": {"linux-data", false},
+	"84": {"hibernation", true},
+	"85": {"ebr", true},
+	"8e": {"linux-lvm", false},
+	"a5": {"freebsd", false},
+	"a6": {"openbsd", false},
+	"a9": {"netbsd", false},
+	"af": {"apple-hfs", false},
+	"de": {"dell-utility", true},
+	"ee": {"gpt", true},
+	"ef": {"efi", true},
+	"fd": {"linux-raid", false},
+}
+
+// bsdTypes maps BSD disklabel fstype ids to their descriptions
+var bsdTypes = map[string]partType{
+	"01": {"freebsd-swap", true},
+	"07": {"freebsd-ufs", false},
+	"0e": {"freebsd-vinum", false},
+	"1b": {"freebsd-zfs", false},
+}
+
+// lookup returns the description of a partition type in a scheme
+func lookup(scheme, typ string) (partType, bool) {
+	typ = strings.ToLower(typ)
+	switch scheme {
+	case "gpt":
+		t, ok := gptTypes[typ]
+		return t, ok
+	case "mbr":
+		t, ok := mbrTypes[typ]
+		return t, ok
+	case "bsd":
+		t, ok := bsdTypes[typ]
+		return t, ok
+	}
+	return partType{}, false
+}
+
+// TypeName returns the friendly name of a partition type, e.g. "efi" or
+// "ms-basic-data", or "" if the type is not known
+func TypeName(scheme, typ string) string {
+	t, _ := lookup(scheme, typ)
+	return t.name
+}
+
+// IsSystem reports whether a partition type holds firmware, swap, recovery
+// or reserved space rather than user data
+func IsSystem(scheme, typ string) bool {
+	t, _ := lookup(scheme, typ)
+	return t.system
+}
+
+// TypeName returns the friendly name of the partition's type
+func (p Partition) TypeName() string {
+	return TypeName(p.Scheme, p.Type)
+}
@@ -0,0 +1,110 @@
+package probe
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	hfsPlusSignature = 0x482B // "H+"
+	hfsXSignature    = 0x4858 // "HX"
+	hfsLeafNodeKind  = 0xFF
+	apfsFeatureV2    = 0x2
+)
+
+// hfsUUIDNamespace is the namespace macOS uses to derive volume UUIDs
+// from the 64-bit identifier stored in the Finder info
+var hfsUUIDNamespace = []byte{
+	0xB3, 0xE2, 0x0F, 0x39, 0xF2, 0x92, 0x11, 0xD6,
+	0x97, 0xA4, 0x00, 0x30, 0x65, 0x43, 0xEC, 0xAC,
+}
+
+// probeHFSPlus detects HFS+ and HFSX and reads the volume name from
+// the root folder record in the catalog B-tree
+func probeHFSPlus(r io.ReaderAt, size int64) *Result {
+	vh := readAt(r, 1024, 512)
+	if vh == nil {
+		return nil
+	}
+
+	res := &Result{Type: "hfsplus"}
+	switch binary.BigEndian.Uint16(vh) {
+	case hfsPlusSignature, hfsXSignature:
+	default:
+		return nil
+	}
+	res.Version = fmt.Sprintf("%d", binary.BigEndian.Uint16(vh[2:]))
+	res.UUID = hfsVolumeUUID(vh[104:112])
+
+	blockSize := int64(binary.BigEndian.Uint32(vh[40:]))
+	catStart := int64(binary.BigEndian.Uint32(vh[288:])) * blockSize
+	catLength := int64(binary.BigEndian.Uint32(vh[292:])) * blockSize
+	if blockSize == 0 || catLength == 0 {
+		return res
+	}
+
+	header := readAt(r, catStart, 512)
+	if header == nil {
+		return res
+	}
+	firstLeaf := int64(binary.BigEndian.Uint32(header[24:]))
+	nodeSize := int64(binary.BigEndian.Uint16(header[32:]))
+	if nodeSize < 512 || firstLeaf == 0 || (firstLeaf+1)*nodeSize > catLength {
+		return res
+	}
+
+	node := readAt(r, catStart+firstLeaf*nodeSize, int(nodeSize))
+	if node == nil || node[8] != hfsLeafNodeKind {
+		return res
+	}
+
+	// The offset of record 0 is stored in the last two bytes of the node
+	rec := int(binary.BigEndian.Uint16(node[nodeSize-2:]))
+	if rec+8 > len(node) {
+		return res
+	}
+	nameLen := int(binary.BigEndian.Uint16(node[rec+6:]))
+	if end := rec + 8 + nameLen*2; end <= len(node) {
+		res.Label = utf16String(node[rec+8:end], binary.BigEndian)
+	}
+
+	return res
+}
+
+// hfsVolumeUUID converts the 64-bit HFS+ volume identifier into the
+// name-based UUID shown by macOS
+func hfsVolumeUUID(id []byte) string {
+	if isZero(id) {
+		return ""
+	}
+
+	h := md5.New()
+	h.Write(hfsUUIDNamespace)
+	h.Write(id)
+	sum := h.Sum(nil)
+	sum[6] = 0x30 | (sum[6] & 0x0f)
+	sum[8] = 0x80 | (sum[8] & 0x3f)
+
+	return uuidString(sum)
+}
+
+// probeAPFS detects an APFS container superblock
+func probeAPFS(r io.ReaderAt, size int64) *Result {
+	sb := readAt(r, 0, 128)
+	if sb == nil || string(sb[32:36]) != "NXSB" {
+		return nil
+	}
+
+	res := &Result{
+		Type:    "apfs",
+		UUID:    uuidString(sb[72:88]),
+		Version: "1",
+	}
+	if binary.LittleEndian.Uint64(sb[64:])&apfsFeatureV2 != 0 {
+		res.Version = "2"
+	}
+
+	return res
+}
@@ -0,0 +1,133 @@
+package probe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// luksMagic starts both LUKS1 and LUKS2 primary headers
+const luksMagic = "LUKS\xba\xbe"
+
+// geliMagic starts the GELI metadata block in the last sector
+const geliMagic = "GEOM::ELI"
+
+const (
+	// bdeSignature replaces the OEM name of the boot sector of BitLocker
+	// volumes and starts each FVE metadata block
+	bdeSignature = "-FVE-FS-"
+	// bdeToGoSignature is the OEM name of BitLocker To Go volumes, which
+	// keep a FAT boot sector so that older Windows can run the reader
+	bdeToGoSignature = "MSWIN4.1"
+
+	// Smallest volume a VeraCrypt or TrueCrypt header fits on: a 64 KiB
+	// header and hidden volume header at either end
+	veraCryptMinSize = 256 * 1024
+)
+
+// bdeGUID identifies BitLocker boot sectors from Windows 7 on
+var bdeGUID = []byte{0x3b, 0xd6, 0x67, 0x49, 0x29, 0x2e, 0xd8, 0x4a, 0x83, 0x99, 0xf6, 0xa3, 0x39, 0xe3, 0xd0, 0x01}
+
+// probeLUKS detects LUKS1 and LUKS2 headers
+func probeLUKS(r io.ReaderAt, size int64) *Result {
+	hdr := readAt(r, 0, 512)
+	if hdr == nil || string(hdr[0:6]) != luksMagic {
+		return nil
+	}
+
+	version := binary.BigEndian.Uint16(hdr[6:])
+	res := &Result{
+		Type:    "crypto_LUKS",
+		UUID:    cString(hdr[168:208]),
+		Version: fmt.Sprintf("%d", version),
+	}
+	if version == 2 {
+		res.Label = cString(hdr[24:72])
+	}
+
+	return res
+}
+
+// probeBitLocker detects BitLocker volumes, including BitLocker To Go,
+// and reads the volume GUID from the first FVE metadata block
+func probeBitLocker(r io.ReaderAt, size int64) *Result {
+	bs := readAt(r, 0, 512)
+	if bs == nil {
+		return nil
+	}
+
+	var metadata int64
+	switch {
+	case string(bs[3:11]) == bdeSignature:
+		if bytes.Equal(bs[160:176], bdeGUID) {
+			metadata = int64(binary.LittleEndian.Uint64(bs[176:]))
+		}
+	case string(bs[3:11]) == bdeToGoSignature && bytes.Equal(bs[424:440], bdeGUID):
+		metadata = int64(binary.LittleEndian.Uint64(bs[440:]))
+	default:
+		return nil
+	}
+
+	res := &Result{Type: "BitLocker"}
+
+	// Windows Vista volumes locate their metadata through the NTFS fields
+	// and are only recognised
+	if metadata == 0 {
+		return res
+	}
+	block := readAt(r, metadata, 64+32)
+	if block == nil || string(block[0:8]) != bdeSignature {
+		return res
+	}
+	res.Version = fmt.Sprintf("%d", binary.LittleEndian.Uint16(block[10:]))
+	res.UUID = guidString(block[64+16:])
+
+	return res
+}
+
+// IsVeraCryptCandidate reports whether a device without a known signature
+// could be a VeraCrypt or TrueCrypt volume. Their headers carry no magic
+// number: the first sector is a random salt followed by encrypted data, so
+// all that can be checked is that it looks random.
+func IsVeraCryptCandidate(r io.ReaderAt, size int64) bool {
+	if size < veraCryptMinSize {
+		return false
+	}
+	hdr := readAt(r, 0, 512)
+	if hdr == nil {
+		return false
+	}
+
+	// 512 random bytes take about 220 distinct values, while text, code
+	// and zero-filled structures take far fewer
+	var seen [256]bool
+	distinct := 0
+	for _, b := range hdr {
+		if !seen[b] {
+			seen[b] = true
+			distinct++
+		}
+	}
+	return distinct >= 180
+}
+
+// probeGELI detects GELI metadata, which FreeBSD stores at the start of
+// the provider's last sector
+func probeGELI(r io.ReaderAt, size int64) *Result {
+	for _, sectorSize := range []int64{512, 4096} {
+		if size < 2*sectorSize {
+			continue
+		}
+		md := readAt(r, size-sectorSize, 20)
+		if md == nil || cString(md[0:16]) != geliMagic {
+			continue
+		}
+		return &Result{
+			Type:    "geli",
+			Version: fmt.Sprintf("%d", binary.LittleEndian.Uint32(md[16:])),
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,54 @@
+package probe
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	extMagic = 0xEF53
+
+	extCompatHasJournal   = 0x0004
+	extIncompatJournalDev = 0x0008
+
+	// Feature flags understood by the ext2/ext3 drivers; anything else
+	// (extents, 64bit, flex_bg, metadata_csum, ...) requires ext4
+	extIncompatExt3 = 0x0002 | 0x0004 | 0x0010 // filetype, recover, meta_bg
+	extROCompatExt3 = 0x0001 | 0x0002 | 0x0004 // sparse_super, large_file, btree_dir
+)
+
+// probeExt detects ext2, ext3 and ext4 from the feature flags
+func probeExt(r io.ReaderAt, size int64) *Result {
+	sb := readAt(r, 1024, 1024)
+	if sb == nil || binary.LittleEndian.Uint16(sb[56:]) != extMagic {
+		return nil
+	}
+
+	compat := binary.LittleEndian.Uint32(sb[92:])
+	incompat := binary.LittleEndian.Uint32(sb[96:])
+	roCompat := binary.LittleEndian.Uint32(sb[100:])
+
+	// External journal devices carry the same magic but hold no files
+	if incompat&extIncompatJournalDev != 0 {
+		return nil
+	}
+
+	res := &Result{
+		Label: cString(sb[120:136]),
+		UUID:  uuidString(sb[104:120]),
+		Version: fmt.Sprintf("%d.%d",
+			binary.LittleEndian.Uint32(sb[76:]), binary.LittleEndian.Uint16(sb[62:])),
+	}
+
+	switch {
+	case incompat&^extIncompatExt3 != 0 || roCompat&^extROCompatExt3 != 0:
+		res.Type = "ext4"
+	case compat&extCompatHasJournal != 0:
+		res.Type = "ext3"
+	default:
+		res.Type = "ext2"
+	}
+
+	return res
+}
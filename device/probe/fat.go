@@ -0,0 +1,127 @@
+package probe
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// probeFAT detects FAT12, FAT16 and FAT32 from the BIOS parameter block
+func probeFAT(r io.ReaderAt, size int64) *Result {
+	bs := readAt(r, 0, 512)
+	if bs == nil || (bs[0] != 0xEB && bs[0] != 0xE9) {
+		return nil
+	}
+
+	bytesPerSector := binary.LittleEndian.Uint16(bs[11:])
+	sectorsPerCluster := uint32(bs[13])
+	reserved := uint32(binary.LittleEndian.Uint16(bs[14:]))
+	numFATs := uint32(bs[16])
+	rootEntries := uint32(binary.LittleEndian.Uint16(bs[17:]))
+
+	switch bytesPerSector {
+	case 512, 1024, 2048, 4096:
+	default:
+		return nil
+	}
+	if sectorsPerCluster == 0 || sectorsPerCluster&(sectorsPerCluster-1) != 0 {
+		return nil
+	}
+	if reserved == 0 || numFATs == 0 || numFATs > 2 {
+		return nil
+	}
+
+	totalSectors := uint32(binary.LittleEndian.Uint16(bs[19:]))
+	if totalSectors == 0 {
+		totalSectors = binary.LittleEndian.Uint32(bs[32:])
+	}
+	fatSize := uint32(binary.LittleEndian.Uint16(bs[22:]))
+	fat32 := fatSize == 0
+	if fat32 {
+		fatSize = binary.LittleEndian.Uint32(bs[36:])
+	}
+
+	rootSectors := (rootEntries*32 + uint32(bytesPerSector) - 1) / uint32(bytesPerSector)
+	metaSectors := reserved + numFATs*fatSize + rootSectors
+	if totalSectors <= metaSectors {
+		return nil
+	}
+	clusters := (totalSectors - metaSectors) / sectorsPerCluster
+
+	res := &Result{Type: "vfat"}
+	var ebpb []byte
+	switch {
+	case fat32:
+		res.Version = "FAT32"
+		ebpb = bs[64:]
+	case clusters < 4085:
+		res.Version = "FAT12"
+		ebpb = bs[36:]
+	default:
+		res.Version = "FAT16"
+		ebpb = bs[36:]
+	}
+
+	// Extended boot signature: serial number and volume label follow
+	if ebpb[2] == 0x29 || ebpb[2] == 0x28 {
+		res.UUID = serialString(binary.LittleEndian.Uint32(ebpb[3:]))
+		if ebpb[2] == 0x29 {
+			if label := cString(ebpb[7:18]); label != "NO NAME" {
+				res.Label = label
+			}
+		}
+	}
+
+	return res
+}
+
+// probeExFAT detects exFAT and reads the label from the root directory
+func probeExFAT(r io.ReaderAt, size int64) *Result {
+	bs := readAt(r, 0, 512)
+	if bs == nil || string(bs[3:11]) != "EXFAT   " {
+		return nil
+	}
+
+	revision := binary.LittleEndian.Uint16(bs[104:])
+	res := &Result{
+		Type:    "exfat",
+		UUID:    serialString(binary.LittleEndian.Uint32(bs[100:])),
+		Version: fmt.Sprintf("%d.%d", revision>>8, revision&0xff),
+	}
+
+	sectorShift := uint(bs[108])
+	clusterShift := uint(bs[109])
+	if sectorShift < 9 || sectorShift > 12 || sectorShift+clusterShift > 25 {
+		return res
+	}
+	heapOffset := int64(binary.LittleEndian.Uint32(bs[88:]))
+	rootCluster := int64(binary.LittleEndian.Uint32(bs[96:]))
+	if rootCluster < 2 {
+		return res
+	}
+
+	// Only the first cluster of the root directory is scanned; the volume
+	// label entry is always created at the start of it
+	clusterSize := 1 << (sectorShift + clusterShift)
+	if clusterSize > 64*1024 {
+		clusterSize = 64 * 1024
+	}
+	offset := (heapOffset << sectorShift) + ((rootCluster - 2) << (sectorShift + clusterShift))
+	dir := readAt(r, offset, clusterSize)
+	for i := 0; dir != nil && i+32 <= len(dir); i += 32 {
+		entryType := dir[i]
+		if entryType == 0x00 {
+			break
+		}
+		if entryType == 0x83 {
+			count := int(dir[i+1])
+			if count > 11 {
+				count = 11
+			}
+			res.Label = utf16String(dir[i+2:i+2+count*2], binary.LittleEndian)
+			break
+		}
+	}
+
+	return res
+}
@@ -0,0 +1,57 @@
+package probe
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	btrfsSuperblockOffset = 64 * 1024
+	f2fsMagic             = 0xF2F52010
+)
+
+// probeXFS detects XFS from its big-endian superblock
+func probeXFS(r io.ReaderAt, size int64) *Result {
+	sb := readAt(r, 0, 512)
+	if sb == nil || string(sb[0:4]) != "XFSB" {
+		return nil
+	}
+
+	return &Result{
+		Type:    "xfs",
+		Label:   cString(sb[108:120]),
+		UUID:    uuidString(sb[32:48]),
+		Version: fmt.Sprintf("%d", binary.BigEndian.Uint16(sb[100:])&0x000f),
+	}
+}
+
+// probeBtrfs detects btrfs from the primary superblock
+func probeBtrfs(r io.ReaderAt, size int64) *Result {
+	sb := readAt(r, btrfsSuperblockOffset, 1024)
+	if sb == nil || string(sb[64:72]) != "_BHRfS_M" {
+		return nil
+	}
+
+	return &Result{
+		Type:  "btrfs",
+		Label: cString(sb[299:555]),
+		UUID:  uuidString(sb[32:48]),
+	}
+}
+
+// probeF2FS detects F2FS from the superblock at 1 KiB
+func probeF2FS(r io.ReaderAt, size int64) *Result {
+	sb := readAt(r, 1024, 1024)
+	if sb == nil || binary.LittleEndian.Uint32(sb) != f2fsMagic {
+		return nil
+	}
+
+	return &Result{
+		Type:  "f2fs",
+		Label: utf16String(sb[124:1024], binary.LittleEndian),
+		UUID:  uuidString(sb[108:124]),
+		Version: fmt.Sprintf("%d.%d",
+			binary.LittleEndian.Uint16(sb[4:]), binary.LittleEndian.Uint16(sb[6:])),
+	}
+}
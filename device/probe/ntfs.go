@@ -0,0 +1,107 @@
+package probe
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	ntfsVolumeRecord     = 3    // MFT record number of $Volume
+	ntfsAttrVolumeName   = 0x60 // $VOLUME_NAME attribute type
+	ntfsAttrVolumeInfo   = 0x70 // $VOLUME_INFORMATION attribute type
+	ntfsAttrEnd          = 0xffffffff
+	ntfsMaxRecordSize    = 64 * 1024
+	ntfsFixupSectorBytes = 512
+)
+
+// probeNTFS detects NTFS and reads the label and version from $Volume
+func probeNTFS(r io.ReaderAt, size int64) *Result {
+	bs := readAt(r, 0, 512)
+	if bs == nil || string(bs[3:11]) != "NTFS    " {
+		return nil
+	}
+
+	res := &Result{
+		Type: "ntfs",
+		UUID: fmt.Sprintf("%016X", binary.LittleEndian.Uint64(bs[72:])),
+	}
+
+	bytesPerSector := int64(binary.LittleEndian.Uint16(bs[11:]))
+	sectorsPerCluster := int64(bs[13])
+	if sectorsPerCluster > 0x80 {
+		// Large clusters are stored as a negative power of two
+		sectorsPerCluster = 1 << (256 - sectorsPerCluster)
+	}
+	clusterSize := bytesPerSector * sectorsPerCluster
+	mftCluster := int64(binary.LittleEndian.Uint64(bs[48:]))
+
+	recordSize := int64(int8(bs[64]))
+	if recordSize < 0 {
+		recordSize = 1 << uint(-recordSize)
+	} else {
+		recordSize *= clusterSize
+	}
+	if clusterSize == 0 || recordSize < ntfsFixupSectorBytes || recordSize > ntfsMaxRecordSize {
+		return res
+	}
+
+	record := readAt(r, mftCluster*clusterSize+ntfsVolumeRecord*recordSize, int(recordSize))
+	if record == nil || string(record[0:4]) != "FILE" || !ntfsApplyFixups(record) {
+		return res
+	}
+
+	offset := int(binary.LittleEndian.Uint16(record[20:]))
+	for offset+24 <= len(record) {
+		attrType := binary.LittleEndian.Uint32(record[offset:])
+		attrLen := int(binary.LittleEndian.Uint32(record[offset+4:]))
+		if attrType == ntfsAttrEnd || attrLen <= 0 || offset+attrLen > len(record) {
+			break
+		}
+
+		// Both attributes of interest are always resident
+		if record[offset+8] == 0 {
+			valueLen := int(binary.LittleEndian.Uint32(record[offset+16:]))
+			valueOff := offset + int(binary.LittleEndian.Uint16(record[offset+20:]))
+			if valueOff+valueLen <= offset+attrLen {
+				value := record[valueOff : valueOff+valueLen]
+				switch attrType {
+				case ntfsAttrVolumeName:
+					res.Label = utf16String(value, binary.LittleEndian)
+				case ntfsAttrVolumeInfo:
+					if len(value) >= 10 {
+						res.Version = fmt.Sprintf("%d.%d", value[8], value[9])
+					}
+				}
+			}
+		}
+
+		offset += attrLen
+	}
+
+	return res
+}
+
+// ntfsApplyFixups restores the sector trailers replaced by the update
+// sequence array, returning false if the record is torn
+func ntfsApplyFixups(record []byte) bool {
+	usaOffset := int(binary.LittleEndian.Uint16(record[4:]))
+	usaCount := int(binary.LittleEndian.Uint16(record[6:]))
+	if usaCount == 0 || usaOffset+usaCount*2 > len(record) {
+		return false
+	}
+
+	check := record[usaOffset : usaOffset+2]
+	for i := 1; i < usaCount; i++ {
+		end := i * ntfsFixupSectorBytes
+		if end > len(record) {
+			return false
+		}
+		if record[end-2] != check[0] || record[end-1] != check[1] {
+			return false
+		}
+		copy(record[end-2:end], record[usaOffset+i*2:usaOffset+i*2+2])
+	}
+
+	return true
+}
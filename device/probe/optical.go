@@ -0,0 +1,166 @@
+package probe
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	isoSectorSize     = 2048
+	isoDescriptorBase = 16 * isoSectorSize
+	isoMaxDescriptors = 64
+
+	isoTypePrimary       = 1
+	isoTypeSupplementary = 2
+	isoTypeTerminator    = 255
+
+	udfAnchorSector     = 256
+	udfTagPrimaryVolume = 1
+	udfTagAnchor        = 2
+	udfTagLogicalVolume = 6
+	udfTagTerminating   = 8
+)
+
+// probeISO9660 detects ISO9660, preferring the Joliet volume name
+func probeISO9660(r io.ReaderAt, size int64) *Result {
+	var res *Result
+
+	for i := int64(0); i < isoMaxDescriptors; i++ {
+		vd := readAt(r, isoDescriptorBase+i*isoSectorSize, isoSectorSize)
+		if vd == nil || string(vd[1:6]) != "CD001" {
+			break
+		}
+
+		switch vd[0] {
+		case isoTypePrimary:
+			res = &Result{
+				Type:    "iso9660",
+				Label:   cString(vd[40:72]),
+				UUID:    isoDate(vd[813:830]),
+				Version: "1",
+			}
+		case isoTypeSupplementary:
+			// Joliet is flagged by a UCS-2 escape sequence
+			if res != nil && vd[88] == '%' && vd[89] == '/' &&
+				(vd[90] == '@' || vd[90] == 'C' || vd[90] == 'E') {
+				if label := utf16String(vd[40:72], binary.BigEndian); label != "" {
+					res.Label = label
+				}
+				res.Version = "Joliet"
+			}
+		case isoTypeTerminator:
+			return res
+		}
+	}
+
+	return res
+}
+
+// isoDate formats a volume creation timestamp the way blkid reports
+// it as the UUID of an ISO9660 filesystem
+func isoDate(d []byte) string {
+	if isZero(d[:16]) || string(d[:16]) == "0000000000000000" {
+		return ""
+	}
+	return fmt.Sprintf("%s-%s-%s-%s-%s-%s-%s",
+		d[0:4], d[4:6], d[6:8], d[8:10], d[10:12], d[12:14], d[14:16])
+}
+
+// probeUDF detects UDF via the volume recognition sequence and the anchor
+func probeUDF(r io.ReaderAt, size int64) *Result {
+	nsr := ""
+	for i := int64(0); i < isoMaxDescriptors; i++ {
+		vd := readAt(r, isoDescriptorBase+i*isoSectorSize, 6)
+		if vd == nil {
+			break
+		}
+		id := string(vd[1:6])
+		if id == "NSR02" || id == "NSR03" {
+			nsr = id
+			break
+		}
+		if id != "BEA01" && id != "CD001" && id != "CDW02" && id != "BOOT2" && id != "TEA01" {
+			break
+		}
+	}
+	if nsr == "" {
+		return nil
+	}
+
+	res := &Result{Type: "udf"}
+	for _, blockSize := range []int64{2048, 512, 1024, 4096} {
+		anchor := readAt(r, udfAnchorSector*blockSize, 512)
+		if anchor == nil || binary.LittleEndian.Uint16(anchor) != udfTagAnchor {
+			continue
+		}
+
+		// Main volume descriptor sequence extent
+		length := int64(binary.LittleEndian.Uint32(anchor[16:]))
+		location := int64(binary.LittleEndian.Uint32(anchor[20:]))
+		for i := int64(0); i < length/blockSize && i < isoMaxDescriptors; i++ {
+			desc := readAt(r, (location+i)*blockSize, 512)
+			if desc == nil {
+				break
+			}
+			switch binary.LittleEndian.Uint16(desc) {
+			case udfTagPrimaryVolume:
+				if res.Label == "" {
+					res.Label = udfDString(desc[24:56])
+				}
+				res.UUID = udfVolumeSetUUID(desc[72:200])
+			case udfTagLogicalVolume:
+				if label := udfDString(desc[84:212]); label != "" {
+					res.Label = label
+				}
+				if rev := binary.LittleEndian.Uint16(desc[240:]); rev != 0 {
+					res.Version = fmt.Sprintf("%x.%02x", rev>>8, rev&0xff)
+				}
+			case udfTagTerminating:
+				return res
+			}
+		}
+		return res
+	}
+
+	return res
+}
+
+// udfDString decodes an OSTA compressed unicode dstring, whose last byte
+// holds the used length
+func udfDString(b []byte) string {
+	n := int(b[len(b)-1])
+	if n == 0 || n >= len(b) {
+		return ""
+	}
+	return udfCSString(b[:n])
+}
+
+// udfCSString decodes OSTA compressed unicode without a length trailer
+func udfCSString(b []byte) string {
+	if len(b) < 2 {
+		return ""
+	}
+	switch b[0] {
+	case 8:
+		return cString(b[1:])
+	case 16:
+		return utf16String(b[1:], binary.BigEndian)
+	}
+	return ""
+}
+
+// udfVolumeSetUUID derives the UUID from the first 16 hex digits of the
+// volume set identifier, as recommended by the UDF specification
+func udfVolumeSetUUID(b []byte) string {
+	id := udfDString(b)
+	if len(id) < 16 {
+		return ""
+	}
+	for _, c := range id[:16] {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F') {
+			return fmt.Sprintf("%x", id[:8])
+		}
+	}
+	return id[:16]
+}
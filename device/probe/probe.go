@@ -0,0 +1,168 @@
+// Package probe identifies filesystems and encrypted containers by reading
+// their on-disk superblocks directly, without external tools.
+package probe
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf16"
+)
+
+// Result describes a filesystem or container found on a device.
+// Type names follow the blkid conventions used by udev (e.g. "vfat",
+// "ext4", "crypto_LUKS") so that results are the same on every platform.
+type Result struct {
+	Type    string
+	Label   string
+	UUID    string
+	Version string
+}
+
+// ErrUnknown is returned when no known signature is found
+var ErrUnknown = errors.New("no known filesystem signature")
+
+// prober checks for one format and returns nil if it does not match
+type prober func(r io.ReaderAt, size int64) *Result
+
+// probers are tried in order; formats with a signature in the first
+// sector are checked before FAT, whose boot sector check is the loosest.
+// UDF comes before ISO9660, since UDF bridge discs carry an ISO9660 volume
+// descriptor as well.
+var probers = []prober{
+	probeLUKS,
+	probeGELI,
+	probeBitLocker,
+	probeExFAT,
+	probeNTFS,
+	probeXFS,
+	probeAPFS,
+	probeFAT,
+	probeExt,
+	probeF2FS,
+	probeHFSPlus,
+	probeBtrfs,
+	probeUFS,
+	probeUDF,
+	probeISO9660,
+	probeZFS,
+}
+
+// Probe identifies the filesystem in r, which is size bytes long
+func Probe(r io.ReaderAt, size int64) (*Result, error) {
+	for _, p := range probers {
+		if res := p(r, size); res != nil {
+			return res, nil
+		}
+	}
+	return nil, ErrUnknown
+}
+
+// Open opens a block device or image file for reading and returns its size
+func Open(path string) (*os.File, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+
+	// Block devices report a zero size from Stat, so seek to the end instead
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		file.Close()
+		return nil, 0, fmt.Errorf("failed to determine size of %s: %w", path, err)
+	}
+	return file, size, nil
+}
+
+// ProbeFile identifies the filesystem on a block device or image file
+func ProbeFile(path string) (*Result, error) {
+	file, size, err := Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return Probe(file, size)
+}
+
+// IsVeraCryptCandidateFile reports whether the block device or image file
+// at path could be a VeraCrypt or TrueCrypt volume
+func IsVeraCryptCandidateFile(path string) bool {
+	file, size, err := Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	return IsVeraCryptCandidate(file, size)
+}
+
+// readAt reads n bytes at off, returning nil on a short read
+func readAt(r io.ReaderAt, off int64, n int) []byte {
+	if off < 0 {
+		return nil
+	}
+	buf := make([]byte, n)
+	if _, err := r.ReadAt(buf, off); err != nil {
+		return nil
+	}
+	return buf
+}
+
+// cString returns b up to the first NUL with trailing spaces removed
+func cString(b []byte) string {
+	if i := strings.IndexByte(string(b), 0); i >= 0 {
+		b = b[:i]
+	}
+	return strings.TrimRight(string(b), " ")
+}
+
+// utf16String decodes a UTF-16 string, stopping at the first NUL
+func utf16String(b []byte, order binary.ByteOrder) string {
+	units := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		u := order.Uint16(b[i:])
+		if u == 0 {
+			break
+		}
+		units = append(units, u)
+	}
+	return strings.TrimRight(string(utf16.Decode(units)), " ")
+}
+
+// uuidString formats 16 bytes in the canonical 8-4-4-4-12 form
+func uuidString(b []byte) string {
+	if len(b) < 16 || isZero(b[:16]) {
+		return ""
+	}
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// guidString formats a Microsoft GUID, whose first three fields are little
+// endian, in the canonical lowercase form
+func guidString(b []byte) string {
+	if len(b) < 16 || isZero(b[:16]) {
+		return ""
+	}
+	return fmt.Sprintf("%08x-%04x-%04x-%x-%x",
+		binary.LittleEndian.Uint32(b[0:4]), binary.LittleEndian.Uint16(b[4:6]),
+		binary.LittleEndian.Uint16(b[6:8]), b[8:10], b[10:16])
+}
+
+// serialString formats a 32-bit volume serial as XXXX-XXXX like blkid
+func serialString(serial uint32) string {
+	return fmt.Sprintf("%04X-%04X", serial>>16, serial&0xffff)
+}
+
+// isZero reports whether every byte of b is zero
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
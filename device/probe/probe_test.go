@@ -0,0 +1,539 @@
+package probe
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"unicode/utf16"
+)
+
+// image is a sparse in-memory disk image used to build superblock fixtures
+type image []byte
+
+func newImage(size int) image {
+	return make(image, size)
+}
+
+func (img image) put(off int, b []byte) {
+	copy(img[off:], b)
+}
+
+func (img image) str(off int, s string) {
+	copy(img[off:], s)
+}
+
+func (img image) le16(off int, v uint16) { binary.LittleEndian.PutUint16(img[off:], v) }
+func (img image) le32(off int, v uint32) { binary.LittleEndian.PutUint32(img[off:], v) }
+func (img image) le64(off int, v uint64) { binary.LittleEndian.PutUint64(img[off:], v) }
+func (img image) be16(off int, v uint16) { binary.BigEndian.PutUint16(img[off:], v) }
+func (img image) be32(off int, v uint32) { binary.BigEndian.PutUint32(img[off:], v) }
+
+func utf16LE(s string) []byte {
+	var b []byte
+	for _, u := range utf16.Encode([]rune(s)) {
+		b = binary.LittleEndian.AppendUint16(b, u)
+	}
+	return b
+}
+
+func utf16BE(s string) []byte {
+	var b []byte
+	for _, u := range utf16.Encode([]rune(s)) {
+		b = binary.BigEndian.AppendUint16(b, u)
+	}
+	return b
+}
+
+// padded returns s padded with spaces to n bytes
+func padded(s string, n int) string {
+	for len(s) < n {
+		s += " "
+	}
+	return s
+}
+
+var testUUID = []byte{
+	0x0f, 0x1e, 0x2d, 0x3c, 0x4b, 0x5a, 0x69, 0x78,
+	0x87, 0x96, 0xa5, 0xb4, 0xc3, 0xd2, 0xe1, 0xf0,
+}
+
+const testUUIDString = "0f1e2d3c-4b5a-6978-8796-a5b4c3d2e1f0"
+
+func extImage(compat, incompat uint32) image {
+	img := newImage(8192)
+	img.le16(1024+56, 0xEF53)
+	img.le32(1024+76, 1)
+	img.le32(1024+92, compat)
+	img.le32(1024+96, incompat)
+	img.put(1024+104, testUUID)
+	img.str(1024+120, "rootfs")
+	return img
+}
+
+func fat16Image() image {
+	img := newImage(4096)
+	img.put(0, []byte{0xEB, 0x3C, 0x90})
+	img.str(3, "MSDOS5.0")
+	img.le16(11, 512)
+	img[13] = 4
+	img.le16(14, 1)
+	img[16] = 2
+	img.le16(17, 512)
+	img.le16(22, 40)
+	img.le32(32, 40000)
+	img[38] = 0x29
+	img.le32(39, 0x1A2B3C4D)
+	img.str(43, padded("STICK", 11))
+	img.str(54, "FAT16   ")
+	img.le16(510, 0xAA55)
+	return img
+}
+
+func fat12Image() image {
+	img := newImage(4096)
+	img.put(0, []byte{0xEB, 0x3C, 0x90})
+	img.le16(11, 512)
+	img[13] = 1
+	img.le16(14, 1)
+	img[16] = 2
+	img.le16(17, 224)
+	img.le16(19, 2880)
+	img.le16(22, 9)
+	img[38] = 0x29
+	img.le32(39, 0xDEADBEEF)
+	img.str(43, padded("NO NAME", 11))
+	return img
+}
+
+func fat32Image() image {
+	img := newImage(4096)
+	img.put(0, []byte{0xEB, 0x58, 0x90})
+	img.le16(11, 512)
+	img[13] = 8
+	img.le16(14, 32)
+	img[16] = 2
+	img.le32(32, 1000000)
+	img.le32(36, 1000)
+	img[66] = 0x29
+	img.le32(67, 0x5E2A91B0)
+	img.str(71, padded("CAMERA", 11))
+	img.str(82, "FAT32   ")
+	return img
+}
+
+func exfatImage() image {
+	img := newImage(128 * 1024)
+	img.put(0, []byte{0xEB, 0x76, 0x90})
+	img.str(3, "EXFAT   ")
+	img.le32(88, 128)
+	img.le32(96, 4)
+	img.le32(100, 0x12345678)
+	img.le16(104, 0x0100)
+	img[108] = 9
+	img[109] = 3
+
+	// Root directory: allocation bitmap entry followed by the label
+	root := 128*512 + 2*4096
+	img[root] = 0x81
+	img[root+32] = 0x83
+	img[root+33] = 5
+	img.put(root+34, utf16LE("MYKEY"))
+	return img
+}
+
+func ntfsImage() image {
+	img := newImage(32 * 1024)
+	img.put(0, []byte{0xEB, 0x52, 0x90})
+	img.str(3, "NTFS    ")
+	img.le16(11, 512)
+	img[13] = 8
+	img.le64(48, 4)
+	img[64] = 0xF6 // 2^10 byte records
+	img.le64(72, 0x0123456789ABCDEF)
+
+	rec := 4*4096 + 3*1024
+	img.str(rec, "FILE")
+	img.le16(rec+4, 48)
+	img.le16(rec+6, 3)
+	img.le16(rec+20, 56)
+
+	// Update sequence: the check value replaces the last two bytes of
+	// each sector and the originals are kept in the array
+	img.le16(rec+48, 0x0007)
+	img.le16(rec+510, 0x0007)
+	img.le16(rec+1022, 0x0007)
+
+	name := utf16LE("Data")
+	attr := rec + 56
+	img.le32(attr, 0x60)
+	img.le32(attr+4, 32)
+	img.le32(attr+16, uint32(len(name)))
+	img.le16(attr+20, 24)
+	img.put(attr+24, name)
+
+	attr += 32
+	img.le32(attr, 0x70)
+	img.le32(attr+4, 40)
+	img.le32(attr+16, 12)
+	img.le16(attr+20, 24)
+	img[attr+24+8] = 3
+	img[attr+24+9] = 1
+
+	img.le32(attr+40, 0xFFFFFFFF)
+	return img
+}
+
+func ufs2Image() image {
+	img := newImage(65536 + 2048)
+	sb := 65536
+	img.le32(sb+144, 0x5f3a1b2c)
+	img.le32(sb+148, 0x0badf00d)
+	img.str(sb+680, "ufsroot")
+	img.le32(sb+1372, 0x19540119)
+	return img
+}
+
+// xdrPair encodes one nvlist pair of the given type and XDR value
+func xdrPair(name string, dataType uint32, value []byte) []byte {
+	var body []byte
+	body = binary.BigEndian.AppendUint32(body, uint32(len(name)))
+	body = append(body, name...)
+	for len(body)%4 != 0 {
+		body = append(body, 0)
+	}
+	body = binary.BigEndian.AppendUint32(body, dataType)
+	body = binary.BigEndian.AppendUint32(body, 1)
+	body = append(body, value...)
+
+	var pair []byte
+	pair = binary.BigEndian.AppendUint32(pair, uint32(len(body)+8))
+	pair = binary.BigEndian.AppendUint32(pair, uint32(len(body)+8))
+	return append(pair, body...)
+}
+
+func zfsImage() image {
+	img := newImage(256 * 1024)
+
+	nvl := []byte{1, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}
+	nvl = append(nvl, xdrPair("version", 8, binary.BigEndian.AppendUint64(nil, 5000))...)
+	name := binary.BigEndian.AppendUint32(nil, 4)
+	name = append(name, "tank"...)
+	nvl = append(nvl, xdrPair("name", 9, name)...)
+	nvl = append(nvl, xdrPair("pool_guid", 8, binary.BigEndian.AppendUint64(nil, 1234567890))...)
+	nvl = append(nvl, 0, 0, 0, 0, 0, 0, 0, 0)
+
+	img.put(16*1024, nvl)
+	img.le64(128*1024, 0x00bab10c)
+	return img
+}
+
+func isoImage() image {
+	img := newImage(40 * 1024)
+
+	pvd := 16 * 2048
+	img[pvd] = 1
+	img.str(pvd+1, "CD001")
+	img[pvd+6] = 1
+	img.str(pvd+40, padded("MY_DISC", 32))
+	img.str(pvd+813, "2024010212304500")
+
+	svd := pvd + 2048
+	img[svd] = 2
+	img.str(svd+1, "CD001")
+	img[svd+6] = 1
+	img.put(svd+40, utf16BE("My Disc"))
+	img.str(svd+88, "%/E")
+
+	term := svd + 2048
+	img[term] = 255
+	img.str(term+1, "CD001")
+	return img
+}
+
+// udfDStringBytes encodes an 8-bit OSTA dstring of length n
+func udfDStringBytes(s string, n int) []byte {
+	b := make([]byte, n)
+	b[0] = 8
+	copy(b[1:], s)
+	b[n-1] = byte(len(s) + 1)
+	return b
+}
+
+func udfImage() image {
+	img := newImage(303 * 2048)
+	img.str(16*2048+1, "BEA01")
+	img.str(17*2048+1, "NSR02")
+	img.str(18*2048+1, "TEA01")
+
+	anchor := 256 * 2048
+	img.le16(anchor, 2)
+	img.le32(anchor+16, 4*2048)
+	img.le32(anchor+20, 299)
+
+	pvd := 299 * 2048
+	img.le16(pvd, 1)
+	img.put(pvd+24, udfDStringBytes("UDFDISC", 32))
+	img.put(pvd+72, udfDStringBytes("4f3c2a1b0e9d8c7bVOLSET", 128))
+
+	lvd := 300 * 2048
+	img.le16(lvd, 6)
+	img.put(lvd+84, udfDStringBytes("Backup DVD", 128))
+	img.le16(lvd+240, 0x0250)
+
+	img.le16(301*2048, 8)
+	return img
+}
+
+// udfBridgeImage is a UDF disc with ISO9660 descriptors ahead of the
+// volume recognition sequence, as on most DVDs
+func udfBridgeImage() image {
+	img := udfImage()
+	copy(img[16*2048:19*2048], isoImage()[16*2048:19*2048])
+	img.str(19*2048+1, "BEA01")
+	img.str(20*2048+1, "NSR02")
+	img.str(21*2048+1, "TEA01")
+	return img
+}
+
+func xfsImage() image {
+	img := newImage(4096)
+	img.str(0, "XFSB")
+	img.put(32, testUUID)
+	img.be16(100, 0xB4A5)
+	img.str(108, "xfsvol")
+	return img
+}
+
+func btrfsImage() image {
+	img := newImage(68 * 1024)
+	sb := 64 * 1024
+	img.put(sb+32, testUUID)
+	img.str(sb+64, "_BHRfS_M")
+	img.str(sb+299, "pool")
+	return img
+}
+
+func f2fsImage() image {
+	img := newImage(4096)
+	img.le32(1024, 0xF2F52010)
+	img.le16(1024+4, 1)
+	img.le16(1024+6, 15)
+	img.put(1024+108, testUUID)
+	img.put(1024+124, utf16LE("android"))
+	return img
+}
+
+func hfsPlusImage() image {
+	img := newImage(24 * 1024)
+	vh := 1024
+	img.be16(vh, 0x482B)
+	img.be16(vh+2, 4)
+	img.put(vh+104, []byte{1, 2, 3, 4, 5, 6, 7, 8})
+	img.be32(vh+40, 4096)
+	img.be32(vh+288, 2)
+	img.be32(vh+292, 4)
+
+	catalog := 2 * 4096
+	img.be32(catalog+24, 1)
+	img.be16(catalog+32, 4096)
+
+	leaf := catalog + 4096
+	img[leaf+8] = 0xFF
+	name := utf16BE("Macintosh HD")
+	img.be16(leaf+14, uint16(6+len(name)))
+	img.be32(leaf+16, 1)
+	img.be16(leaf+20, uint16(len(name)/2))
+	img.put(leaf+22, name)
+	img.be16(leaf+4096-2, 14)
+	return img
+}
+
+func apfsImage() image {
+	img := newImage(4096)
+	img.str(32, "NXSB")
+	img.le32(36, 4096)
+	img.le64(64, 0x2)
+	img.put(72, testUUID)
+	return img
+}
+
+func luksImage(version uint16) image {
+	img := newImage(4096)
+	img.str(0, "LUKS\xba\xbe")
+	img.be16(6, version)
+	img.str(168, testUUIDString)
+	if version == 2 {
+		img.str(24, "secrets")
+	}
+	return img
+}
+
+func geliImage() image {
+	img := newImage(64 * 1024)
+	md := len(img) - 512
+	img.str(md, "GEOM::ELI")
+	img.le32(md+16, 7)
+	return img
+}
+
+// bitlockerImage builds a BitLocker volume from Windows 7 on, or a
+// BitLocker To Go volume with its FAT-compatible boot sector
+func bitlockerImage(toGo bool) image {
+	img := newImage(64 * 1024)
+	img.put(0, []byte{0xEB, 0x58, 0x90})
+	guid, offset := 160, 176
+	if toGo {
+		img.str(3, "MSWIN4.1")
+		guid, offset = 424, 440
+	} else {
+		img.str(3, "-FVE-FS-")
+	}
+	img.put(guid, []byte{0x3b, 0xd6, 0x67, 0x49, 0x29, 0x2e, 0xd8, 0x4a, 0x83, 0x99, 0xf6, 0xa3, 0x39, 0xe3, 0xd0, 0x01})
+	img.le64(offset, 0x2000)
+
+	img.str(0x2000, "-FVE-FS-")
+	img.le16(0x2000+10, 2)
+	img.put(0x2000+64+16, []byte{0x78, 0x56, 0x34, 0x12, 0x34, 0x12, 0x78, 0x56, 0x9a, 0xbc, 0xde, 0xf0, 0x12, 0x34, 0x56, 0x78})
+	return img
+}
+
+func TestProbe(t *testing.T) {
+	tests := []struct {
+		name  string
+		image image
+		want  Result
+	}{
+		{"ext2", extImage(0, 0x2), Result{"ext2", "rootfs", testUUIDString, "1.0"}},
+		{"ext3", extImage(0x4, 0x2), Result{"ext3", "rootfs", testUUIDString, "1.0"}},
+		{"ext4", extImage(0x4, 0x2|0x40|0x200), Result{"ext4", "rootfs", testUUIDString, "1.0"}},
+		{"fat12", fat12Image(), Result{"vfat", "", "DEAD-BEEF", "FAT12"}},
+		{"fat16", fat16Image(), Result{"vfat", "STICK", "1A2B-3C4D", "FAT16"}},
+		{"fat32", fat32Image(), Result{"vfat", "CAMERA", "5E2A-91B0", "FAT32"}},
+		{"exfat", exfatImage(), Result{"exfat", "MYKEY", "1234-5678", "1.0"}},
+		{"ntfs", ntfsImage(), Result{"ntfs", "Data", "0123456789ABCDEF", "3.1"}},
+		{"ufs2", ufs2Image(), Result{"ufs", "ufsroot", "5f3a1b2c0badf00d", "2"}},
+		{"zfs", zfsImage(), Result{"zfs_member", "tank", "1234567890", "5000"}},
+		{"iso9660", isoImage(), Result{"iso9660", "My Disc", "2024-01-02-12-30-45-00", "Joliet"}},
+		{"udf", udfImage(), Result{"udf", "Backup DVD", "4f3c2a1b0e9d8c7b", "2.50"}},
+		{"udf-bridge", udfBridgeImage(), Result{"udf", "Backup DVD", "4f3c2a1b0e9d8c7b", "2.50"}},
+		{"xfs", xfsImage(), Result{"xfs", "xfsvol", testUUIDString, "5"}},
+		{"btrfs", btrfsImage(), Result{"btrfs", "pool", testUUIDString, ""}},
+		{"f2fs", f2fsImage(), Result{"f2fs", "android", testUUIDString, "1.15"}},
+		{"hfsplus", hfsPlusImage(), Result{"hfsplus", "Macintosh HD", "6095e009-5132-3fc5-87c2-d5a01745283e", "4"}},
+		{"apfs", apfsImage(), Result{"apfs", "", testUUIDString, "2"}},
+		{"luks1", luksImage(1), Result{"crypto_LUKS", "", testUUIDString, "1"}},
+		{"luks2", luksImage(2), Result{"crypto_LUKS", "secrets", testUUIDString, "2"}},
+		{"geli", geliImage(), Result{"geli", "", "", "7"}},
+		{"bitlocker", bitlockerImage(false), Result{"BitLocker", "", "12345678-1234-5678-9abc-def012345678", "2"}},
+		{"bitlocker-togo", bitlockerImage(true), Result{"BitLocker", "", "12345678-1234-5678-9abc-def012345678", "2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := Probe(bytes.NewReader(tt.image), int64(len(tt.image)))
+			if err != nil {
+				t.Fatalf("Probe failed: %v", err)
+			}
+			if *res != tt.want {
+				t.Errorf("Got %+v, want %+v", *res, tt.want)
+			}
+		})
+	}
+}
+
+// TestProbeImages probes the start of images made by the real tools, see
+// testdata/README
+func TestProbeImages(t *testing.T) {
+	tests := []struct {
+		file string
+		want Result
+	}{
+		{"ext2.img.gz", Result{"ext2", "STICK-ext2", testUUIDString, "1.0"}},
+		{"ext3.img.gz", Result{"ext3", "STICK-ext3", testUUIDString, "1.0"}},
+		{"ext4.img.gz", Result{"ext4", "STICK-ext4", testUUIDString, "1.0"}},
+		{"iso9660.img.gz", Result{"iso9660", "my-vol-id", "2023-08-20-13-37-54-00", "1"}},
+		{"xfs.img.gz", Result{"xfs", "", "a1dc5a3d-1c20-4ce3-a050-d4bbde0cf5a6", "5"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			img := readImage(t, filepath.Join("testdata", tt.file))
+			res, err := Probe(bytes.NewReader(img), int64(len(img)))
+			if err != nil {
+				t.Fatalf("Probe failed: %v", err)
+			}
+			if *res != tt.want {
+				t.Errorf("Got %+v, want %+v", *res, tt.want)
+			}
+		})
+	}
+}
+
+// readImage reads a gzipped image fixture
+func readImage(t *testing.T, path string) []byte {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	zr, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func TestProbeUnknown(t *testing.T) {
+	img := newImage(128 * 1024)
+	if _, err := Probe(bytes.NewReader(img), int64(len(img))); err != ErrUnknown {
+		t.Errorf("Should not detect a filesystem on an empty image, got %v", err)
+	}
+
+	// A bare MBR partition table is not a FAT boot sector
+	img.le16(510, 0xAA55)
+	img[446+4] = 0x0C
+	if _, err := Probe(bytes.NewReader(img), int64(len(img))); err != ErrUnknown {
+		t.Errorf("Should not detect a filesystem on an MBR, got %v", err)
+	}
+}
+
+func TestIsVeraCryptCandidate(t *testing.T) {
+	random := newImage(512 * 1024)
+	rand.New(rand.NewSource(1)).Read(random)
+	if !IsVeraCryptCandidate(bytes.NewReader(random), int64(len(random))) {
+		t.Error("A random header should be a VeraCrypt candidate")
+	}
+	if IsVeraCryptCandidate(bytes.NewReader(random), 128*1024) {
+		t.Error("A device too small for a VeraCrypt header should not be a candidate")
+	}
+
+	for name, img := range map[string]image{"empty": newImage(512 * 1024), "ntfs": ntfsImage()} {
+		if IsVeraCryptCandidate(bytes.NewReader(img), 512*1024) {
+			t.Errorf("%s should not be a VeraCrypt candidate", name)
+		}
+	}
+}
+
+func TestProbeFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stick.img")
+	if err := os.WriteFile(path, fat32Image(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := ProbeFile(path)
+	if err != nil {
+		t.Fatalf("ProbeFile failed: %v", err)
+	}
+	if res.Type != "vfat" || res.Label != "CAMERA" {
+		t.Errorf("Unexpected result: %+v", res)
+	}
+}
@@ -0,0 +1,48 @@
+package probe
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	ufs1Magic = 0x00011954
+	ufs2Magic = 0x19540119
+)
+
+// ufsSuperblockOffsets are the locations searched by the FreeBSD kernel
+var ufsSuperblockOffsets = []int64{65536, 8192, 0, 262144}
+
+// probeUFS detects UFS1 and UFS2 in either byte order
+func probeUFS(r io.ReaderAt, size int64) *Result {
+	for _, off := range ufsSuperblockOffsets {
+		sb := readAt(r, off, 1376)
+		if sb == nil {
+			continue
+		}
+
+		for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+			res := &Result{Type: "ufs"}
+			switch order.Uint32(sb[1372:]) {
+			case ufs1Magic:
+				res.Version = "1"
+			case ufs2Magic:
+				res.Version = "2"
+			default:
+				continue
+			}
+
+			// fs_id is a pair of 32-bit words set by newfs
+			if id0, id1 := order.Uint32(sb[144:]), order.Uint32(sb[148:]); id0 != 0 || id1 != 0 {
+				res.UUID = fmt.Sprintf("%08x%08x", id0, id1)
+			}
+			if res.Version == "2" {
+				res.Label = cString(sb[680:712])
+			}
+			return res
+		}
+	}
+
+	return nil
+}
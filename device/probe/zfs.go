@@ -0,0 +1,107 @@
+package probe
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	zfsLabelSize       = 256 * 1024
+	zfsNVListOffset    = 16 * 1024
+	zfsNVListSize      = 112 * 1024
+	zfsUberblockOffset = 128 * 1024
+	zfsUberblockMagic  = 0x00bab10c
+
+	nvEncodingXDR = 1
+	nvTypeUint64  = 8
+	nvTypeString  = 9
+)
+
+// probeZFS detects a ZFS pool member from any of its four vdev labels
+func probeZFS(r io.ReaderAt, size int64) *Result {
+	offsets := []int64{0, zfsLabelSize}
+	if size >= 4*zfsLabelSize {
+		aligned := size &^ (zfsLabelSize - 1)
+		offsets = append(offsets, aligned-2*zfsLabelSize, aligned-zfsLabelSize)
+	}
+
+	for _, off := range offsets {
+		ub := readAt(r, off+zfsUberblockOffset, 8)
+		if ub == nil {
+			continue
+		}
+		if binary.LittleEndian.Uint64(ub) != zfsUberblockMagic &&
+			binary.BigEndian.Uint64(ub) != zfsUberblockMagic {
+			continue
+		}
+
+		res := &Result{Type: "zfs_member"}
+		if nvl := readAt(r, off+zfsNVListOffset, zfsNVListSize); nvl != nil {
+			pairs := parseXDRNVList(nvl)
+			if name, ok := pairs["name"].(string); ok {
+				res.Label = name
+			}
+			if guid, ok := pairs["pool_guid"].(uint64); ok {
+				res.UUID = fmt.Sprintf("%d", guid)
+			}
+			if version, ok := pairs["version"].(uint64); ok {
+				res.Version = fmt.Sprintf("%d", version)
+			}
+		}
+		return res
+	}
+
+	return nil
+}
+
+// parseXDRNVList decodes the top-level uint64 and string pairs of an
+// XDR-encoded nvlist, skipping every other value type
+func parseXDRNVList(buf []byte) map[string]interface{} {
+	pairs := make(map[string]interface{})
+
+	// 4-byte nvs header (encoding, endianness, reserved) then the
+	// nvlist version and flags
+	if len(buf) < 12 || buf[0] != nvEncodingXDR {
+		return pairs
+	}
+
+	pos := 12
+	for pos+8 <= len(buf) {
+		encodedSize := int(binary.BigEndian.Uint32(buf[pos:]))
+		if encodedSize == 0 || pos+encodedSize > len(buf) {
+			break
+		}
+		pair := buf[pos : pos+encodedSize]
+		pos += encodedSize
+
+		// encoded size, decoded size, name, type, element count, value
+		if len(pair) < 12 {
+			break
+		}
+		nameLen := int(binary.BigEndian.Uint32(pair[8:]))
+		p := 12 + (nameLen+3)&^3
+		if p+8 > len(pair) {
+			continue
+		}
+		name := string(pair[12 : 12+nameLen])
+		dataType := binary.BigEndian.Uint32(pair[p:])
+		p += 8
+
+		switch dataType {
+		case nvTypeUint64:
+			if p+8 <= len(pair) {
+				pairs[name] = binary.BigEndian.Uint64(pair[p:])
+			}
+		case nvTypeString:
+			if p+4 <= len(pair) {
+				strLen := int(binary.BigEndian.Uint32(pair[p:]))
+				if p+4+strLen <= len(pair) {
+					pairs[name] = string(pair[p+4 : p+4+strLen])
+				}
+			}
+		}
+	}
+
+	return pairs
+}
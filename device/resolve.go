@@ -0,0 +1,173 @@
+package device
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// ErrNotFound is returned when no device matches a specifier
+var ErrNotFound = errors.New("device not found")
+
+// AmbiguousError is returned when a specifier matches more than one device
+type AmbiguousError struct {
+	Spec  string
+	Paths []string
+}
+
+// Error implements error
+func (e *AmbiguousError) Error() string {
+	return fmt.Sprintf("%s matches several devices: %s", e.Spec, strings.Join(e.Paths, ", "))
+}
+
+// specTags maps the directories of udev and GEOM label symlinks to the tag
+// they stand for, e.g. /dev/disk/by-uuid/X is UUID=X
+var specTags = map[string]string{
+	"/dev/disk/by-uuid":      "UUID",
+	"/dev/disk/by-label":     "LABEL",
+	"/dev/disk/by-partuuid":  "PARTUUID",
+	"/dev/disk/by-partlabel": "PARTLABEL",
+	"/dev/gpt":               "PARTLABEL",
+	"/dev/gptid":             "PARTUUID",
+	"/dev/diskid":            "SERIAL",
+	"/dev/label":             "LABEL",
+	"/dev/msdosfs":           "LABEL",
+	"/dev/ufs":               "LABEL",
+	"/dev/ext2fs":            "LABEL",
+	"/dev/ntfs":              "LABEL",
+	"/dev/iso9660":           "LABEL",
+}
+
+// Resolve returns the device a specifier refers to among the devices of the
+// last Scan. A specifier is one of
+//
+//   - a device path or name, e.g. "/dev/da0p1" or "sdb1"
+//   - a tag: UUID=, LABEL=, PARTUUID=, PARTLABEL= or SERIAL=
+//   - a symlink or label node, e.g. /dev/disk/by-id/..., /dev/gpt/backup
+//     or /dev/label/STICK
+//   - a mount point of the device
+//
+// SERIAL= names the physical disk, so it resolves to the filesystem on that
+// disk when there is exactly one. A specifier that matches several devices
+// returns an *AmbiguousError.
+func (m *Manager) Resolve(spec string) (Device, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	matches := m.match(spec)
+	switch len(matches) {
+	case 0:
+		return Device{}, fmt.Errorf("%w: %s", ErrNotFound, spec)
+	case 1:
+		return matches[0].clone(), nil
+	}
+
+	paths := make([]string, 0, len(matches))
+	for _, dev := range matches {
+		paths = append(paths, dev.Path)
+	}
+	return Device{}, &AmbiguousError{Spec: spec, Paths: paths}
+}
+
+// match returns the devices a specifier matches. The caller must hold m.mu.
+func (m *Manager) match(spec string) []*Device {
+	if key, value, ok := strings.Cut(spec, "="); ok && !strings.HasPrefix(spec, "/") {
+		return m.matchTag(strings.ToUpper(key), value)
+	}
+
+	// Names and paths the scanner knows about
+	matches := m.filter(func(dev *Device) bool {
+		if dev.Path == spec || dev.Name == spec || "/dev/"+dev.Name == spec {
+			return true
+		}
+		for _, alias := range dev.Aliases {
+			if alias == spec {
+				return true
+			}
+		}
+		return false
+	})
+	if len(matches) > 0 || !filepath.IsAbs(spec) {
+		return matches
+	}
+
+	// Symlinks such as /dev/disk/by-id/..., compared by their target
+	if real, err := filepath.EvalSymlinks(spec); err == nil {
+		matches = m.filter(func(dev *Device) bool {
+			target, err := filepath.EvalSymlinks(dev.Path)
+			return err == nil && target == real
+		})
+		if len(matches) > 0 {
+			return matches
+		}
+	}
+
+	// Label nodes that are not there, e.g. on another machine's udev
+	if tag, ok := specTags[filepath.Dir(spec)]; ok {
+		value := filepath.Base(spec)
+		if tag == "LABEL" || tag == "PARTLABEL" {
+			value = decodeUdevString(value)
+		}
+		if tag == "SERIAL" {
+			value = strings.TrimPrefix(value, "DISK-")
+		}
+		if matches = m.matchTag(tag, value); len(matches) > 0 {
+			return matches
+		}
+	}
+
+	return m.filter(func(dev *Device) bool { return dev.IsMountedAt(spec) })
+}
+
+// matchTag returns the devices whose tag has the given value. The caller
+// must hold m.mu.
+func (m *Manager) matchTag(tag, value string) []*Device {
+	if value == "" {
+		return nil
+	}
+
+	switch tag {
+	case "UUID":
+		return m.filter(func(dev *Device) bool { return strings.EqualFold(dev.UUID, value) })
+	case "LABEL":
+		return m.filter(func(dev *Device) bool { return dev.Label == value })
+	case "PARTUUID":
+		return m.filter(func(dev *Device) bool { return strings.EqualFold(dev.PartUUID, value) })
+	case "PARTLABEL":
+		return m.filter(func(dev *Device) bool { return dev.PartitionLabel == value })
+	case "SERIAL":
+		// Partitions share the serial of their disk, so prefer what can be
+		// mounted and fall back to the disk itself
+		disk := m.filter(func(dev *Device) bool { return dev.Serial == value })
+		withFS := []*Device{}
+		for _, dev := range disk {
+			if dev.FSType != "" {
+				withFS = append(withFS, dev)
+			}
+		}
+		if len(withFS) > 0 {
+			return withFS
+		}
+		whole := []*Device{}
+		for _, dev := range disk {
+			if !dev.IsPartition {
+				whole = append(whole, dev)
+			}
+		}
+		return whole
+	}
+	return nil
+}
+
+// filter returns the devices for which keep returns true in scan order.
+// The caller must hold m.mu.
+func (m *Manager) filter(keep func(dev *Device) bool) []*Device {
+	devices := []*Device{}
+	for _, path := range m.order {
+		if dev := m.devices[path]; keep(dev) {
+			devices = append(devices, dev)
+		}
+	}
+	return devices
+}
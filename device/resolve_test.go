@@ -0,0 +1,75 @@
+package device
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	stick := Hardware{Vendor: "Kingston", Serial: "60A44C413A7CF3B1", Bus: "usb"}
+	card := Hardware{Vendor: "Generic", Serial: "000000000272", Bus: "usb"}
+	backend := NewFakeBackend(
+		Device{Name: "sdb", Path: "/dev/sdb", IsRemovable: true, Hardware: stick,
+			Aliases: []string{"/dev/disk/by-id/usb-Kingston_DataTraveler_3.0_60A44C413A7CF3B1-0:0"}},
+		Device{Name: "sdb1", Path: "/dev/sdb1", Parent: "/dev/sdb", IsPartition: true, IsRemovable: true,
+			FSType: "vfat", Label: "MY STICK", UUID: "1A2B-3C4D", Hardware: stick,
+			PartitionLabel: "data", PartUUID: "0f1e2d3c-4b5a-6978-8796-a5b4c3d2e1f0",
+			Aliases: []string{"/dev/disk/by-uuid/1A2B-3C4D"}},
+		Device{Name: "sdc", Path: "/dev/sdc", IsRemovable: true, Hardware: card},
+		Device{Name: "sdc1", Path: "/dev/sdc1", Parent: "/dev/sdc", IsPartition: true, IsRemovable: true,
+			FSType: "exfat", Label: "CARD", Hardware: card},
+		Device{Name: "sdc2", Path: "/dev/sdc2", Parent: "/dev/sdc", IsPartition: true, IsRemovable: true,
+			FSType: "ext4", Label: "CARD", Hardware: card},
+	)
+	backend.SetMounted("/dev/sdc2", "/media/CARD")
+
+	m := NewManagerWithBackend(backend)
+	if _, err := m.Scan(); err != nil {
+		t.Fatalf("Failed to scan: %v", err)
+	}
+
+	tests := []struct {
+		spec, path string
+	}{
+		{"/dev/sdb1", "/dev/sdb1"},
+		{"sdb1", "/dev/sdb1"},
+		{"UUID=1a2b-3c4d", "/dev/sdb1"},
+		{"LABEL=MY STICK", "/dev/sdb1"},
+		{"PARTUUID=0F1E2D3C-4B5A-6978-8796-A5B4C3D2E1F0", "/dev/sdb1"},
+		{"partlabel=data", "/dev/sdb1"},
+		{"SERIAL=60A44C413A7CF3B1", "/dev/sdb1"},
+		{"/dev/disk/by-uuid/1A2B-3C4D", "/dev/sdb1"},
+		{"/dev/disk/by-id/usb-Kingston_DataTraveler_3.0_60A44C413A7CF3B1-0:0", "/dev/sdb"},
+		{"/dev/disk/by-label/MY\\x20STICK", "/dev/sdb1"},
+		{"/dev/gpt/data", "/dev/sdb1"},
+		{"/dev/msdosfs/CARD", ""},
+		{"/media/CARD", "/dev/sdc2"},
+	}
+
+	for _, tt := range tests {
+		dev, err := m.Resolve(tt.spec)
+		if tt.path == "" {
+			var ambiguous *AmbiguousError
+			if !errors.As(err, &ambiguous) || len(ambiguous.Paths) != 2 {
+				t.Errorf("%s: Expected an ambiguous match, got %v", tt.spec, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: Resolve failed: %v", tt.spec, err)
+			continue
+		}
+		if dev.Path != tt.path {
+			t.Errorf("%s: Expected %s, got %s", tt.spec, tt.path, dev.Path)
+		}
+	}
+
+	if _, err := m.Resolve("SERIAL=000000000272"); err == nil {
+		t.Error("A disk with two filesystems should be ambiguous by serial")
+	}
+	for _, spec := range []string{"UUID=FFFF-FFFF", "sdd", "COLOR=red", "LABEL="} {
+		if _, err := m.Resolve(spec); !errors.Is(err, ErrNotFound) {
+			t.Errorf("%s: Expected ErrNotFound, got %v", spec, err)
+		}
+	}
+}
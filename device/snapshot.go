@@ -0,0 +1,163 @@
+package device
+
+import (
+	"strconv"
+)
+
+// Snapshot is an immutable view of the devices seen by one scan
+type Snapshot struct {
+	order   []string
+	devices map[string]Device
+}
+
+// NewSnapshot creates a snapshot holding copies of the given devices
+func NewSnapshot(devices []*Device) *Snapshot {
+	s := &Snapshot{
+		order:   make([]string, 0, len(devices)),
+		devices: make(map[string]Device, len(devices)),
+	}
+	for _, dev := range devices {
+		if _, ok := s.devices[dev.Path]; ok {
+			continue
+		}
+		s.order = append(s.order, dev.Path)
+		s.devices[dev.Path] = dev.clone()
+	}
+	return s
+}
+
+// Len returns the number of devices in the snapshot
+func (s *Snapshot) Len() int {
+	if s == nil {
+		return 0
+	}
+	return len(s.order)
+}
+
+// Get returns a copy of the device with the given path
+func (s *Snapshot) Get(path string) (Device, bool) {
+	if s == nil {
+		return Device{}, false
+	}
+	dev, ok := s.devices[path]
+	if !ok {
+		return Device{}, false
+	}
+	return dev.clone(), true
+}
+
+// Devices returns copies of all devices in scan order
+func (s *Snapshot) Devices() []Device {
+	if s == nil {
+		return nil
+	}
+	devices := make([]Device, 0, len(s.order))
+	for _, path := range s.order {
+		dev, _ := s.Get(path)
+		devices = append(devices, dev)
+	}
+	return devices
+}
+
+// EventType identifies the kind of change between two snapshots
+type EventType int
+
+const (
+	// EventAdded means the device appeared
+	EventAdded EventType = iota
+	// EventRemoved means the device disappeared
+	EventRemoved
+	// EventChanged means the device is still present but its media,
+	// filesystem or mount state changed
+	EventChanged
+)
+
+// String returns the name of the event type
+func (t EventType) String() string {
+	switch t {
+	case EventAdded:
+		return "added"
+	case EventRemoved:
+		return "removed"
+	case EventChanged:
+		return "changed"
+	}
+	return "unknown"
+}
+
+// Change describes one field that differs between two snapshots
+type Change struct {
+	Field string // "fstype", "label", "uuid", "size", "media" or "mount_point"
+	Old   string
+	New   string
+}
+
+// Event describes a device that was added, removed or changed. Device is
+// the new state, or the last known state for removed devices.
+type Event struct {
+	Type    EventType
+	Device  Device
+	Changes []Change // Only set for EventChanged
+}
+
+// HasChange reports whether the event includes a change to field
+func (e Event) HasChange(field string) bool {
+	for _, c := range e.Changes {
+		if c.Field == field {
+			return true
+		}
+	}
+	return false
+}
+
+// Diff compares two snapshots. Removed events come first, children before
+// their parents, followed by added and changed events in scan order so
+// that a disk is always reported before its partitions.
+func Diff(old, next *Snapshot) []Event {
+	events := []Event{}
+
+	if old != nil {
+		for i := len(old.order) - 1; i >= 0; i-- {
+			path := old.order[i]
+			if _, ok := next.Get(path); !ok {
+				dev, _ := old.Get(path)
+				events = append(events, Event{Type: EventRemoved, Device: dev})
+			}
+		}
+	}
+
+	if next != nil {
+		for _, path := range next.order {
+			dev, _ := next.Get(path)
+			prev, ok := old.Get(path)
+			if !ok {
+				events = append(events, Event{Type: EventAdded, Device: dev})
+				continue
+			}
+			if changes := diffDevice(prev, dev); len(changes) > 0 {
+				events = append(events, Event{Type: EventChanged, Device: dev, Changes: changes})
+			}
+		}
+	}
+
+	return events
+}
+
+// diffDevice lists the fields that differ between two states of a device
+func diffDevice(old, next Device) []Change {
+	changes := []Change{}
+	add := func(field, o, n string) {
+		if o != n {
+			changes = append(changes, Change{Field: field, Old: o, New: n})
+		}
+	}
+
+	add("fstype", old.FSType, next.FSType)
+	add("label", old.Label, next.Label)
+	add("uuid", old.UUID, next.UUID)
+	add("size", strconv.FormatUint(old.Size, 10), strconv.FormatUint(next.Size, 10))
+	add("media", strconv.FormatBool(old.MediaPresent), strconv.FormatBool(next.MediaPresent))
+	add("mount_point", old.MountPoint, next.MountPoint)
+
+	return changes
+}
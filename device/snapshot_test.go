@@ -0,0 +1,84 @@
+package device
+
+import (
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	old := NewSnapshot([]*Device{
+		{Name: "da0", Path: "/dev/da0", Children: []string{"/dev/da0p1"}},
+		{Name: "da0p1", Path: "/dev/da0p1", Parent: "/dev/da0", FSType: "vfat", Label: "STICK", UUID: "5E2A-91B0"},
+		{Name: "da1", Path: "/dev/da1", Children: []string{"/dev/da1s1"}},
+		{Name: "da1s1", Path: "/dev/da1s1", Parent: "/dev/da1", FSType: "vfat", Label: "CARD"},
+	})
+	next := NewSnapshot([]*Device{
+		{Name: "da0", Path: "/dev/da0", Children: []string{"/dev/da0p1"}},
+		{Name: "da0p1", Path: "/dev/da0p1", Parent: "/dev/da0", FSType: "exfat", Label: "BACKUP", UUID: "1A2B-3C4D",
+			IsMounted: true, MountPoint: "/media/BACKUP"},
+		{Name: "da2", Path: "/dev/da2"},
+	})
+
+	events := Diff(old, next)
+	if len(events) != 4 {
+		t.Fatalf("Should have 4 events, got %d: %+v", len(events), events)
+	}
+
+	// Children are removed before their parents
+	if events[0].Type != EventRemoved || events[0].Device.Path != "/dev/da1s1" {
+		t.Errorf("First event should remove da1s1, got %s %s", events[0].Type, events[0].Device.Path)
+	}
+	if events[1].Type != EventRemoved || events[1].Device.Path != "/dev/da1" {
+		t.Errorf("Second event should remove da1, got %s %s", events[1].Type, events[1].Device.Path)
+	}
+	if events[1].Device.Label != "" || events[0].Device.Label != "CARD" {
+		t.Error("Removed events should carry the last known device state")
+	}
+
+	changed := events[2]
+	if changed.Type != EventChanged || changed.Device.Path != "/dev/da0p1" {
+		t.Fatalf("Third event should change da0p1, got %s %s", changed.Type, changed.Device.Path)
+	}
+	for _, field := range []string{"fstype", "label", "uuid", "mount_point"} {
+		if !changed.HasChange(field) {
+			t.Errorf("Should report a %s change", field)
+		}
+	}
+	if changed.HasChange("size") {
+		t.Error("Size did not change")
+	}
+	if c := changed.Changes[1]; c.Field != "label" || c.Old != "STICK" || c.New != "BACKUP" {
+		t.Errorf("Unexpected label change: %+v", c)
+	}
+
+	if events[3].Type != EventAdded || events[3].Device.Path != "/dev/da2" {
+		t.Errorf("Last event should add da2, got %s %s", events[3].Type, events[3].Device.Path)
+	}
+
+	if events := Diff(next, next); len(events) != 0 {
+		t.Errorf("Identical snapshots should have no events, got %+v", events)
+	}
+	if events := Diff(nil, next); len(events) != 3 {
+		t.Errorf("Everything should be added against a nil snapshot, got %d events", len(events))
+	}
+}
+
+func TestSnapshotIsImmutable(t *testing.T) {
+	dev := &Device{Name: "da0", Path: "/dev/da0", Children: []string{"/dev/da0p1"}}
+	snap := NewSnapshot([]*Device{dev})
+
+	dev.Label = "CHANGED"
+	dev.Children[0] = "/dev/da0p2"
+
+	got, ok := snap.Get("/dev/da0")
+	if !ok {
+		t.Fatal("Should find da0")
+	}
+	if got.Label != "" || got.Children[0] != "/dev/da0p1" {
+		t.Errorf("Snapshot should not see later changes: %+v", got)
+	}
+
+	got.Children[0] = "/dev/da0p3"
+	if again, _ := snap.Get("/dev/da0"); again.Children[0] != "/dev/da0p1" {
+		t.Error("Changing a returned device should not change the snapshot")
+	}
+}
@@ -0,0 +1,395 @@
+package device
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Locations of the kernel block device tree and the udev property database.
+// These are variables so tests can point them at a fixture tree.
+var (
+	sysBlockDir = "/sys/class/block"
+	udevDataDir = "/run/udev/data"
+)
+
+// probeSysfsDevice is a variable so tests can stub out reading superblocks
+var probeSysfsDevice = probeDevice
+
+// errNoUdevData is returned when the udev database is not available
+var errNoUdevData = errors.New("udev database not available")
+
+// SysfsBackend discovers devices on Linux by walking sysfs and reading the
+// udev database directly, without spawning any processes
+type SysfsBackend struct {
+	// Fallback is used when the udev database is not available
+	Fallback Backend
+}
+
+// Scan scans for devices, deferring to the fallback backend without udev
+func (b *SysfsBackend) Scan() ([]*Device, error) {
+	devices, err := b.scanSysfs()
+	if err == errNoUdevData && b.Fallback != nil {
+		return b.Fallback.Scan()
+	}
+	return devices, err
+}
+
+// Probe reads the filesystem metadata of a device
+func (b *SysfsBackend) Probe(dev *Device) error {
+	return probeSysfsDevice(dev)
+}
+
+// MountTable returns the currently mounted filesystems
+func (b *SysfsBackend) MountTable() ([]MountEntry, error) {
+	return readProcMounts()
+}
+
+// Usage returns the space statistics of a mounted filesystem
+func (b *SysfsBackend) Usage(mountPoint string) (Usage, error) {
+	return statfsUsage(mountPoint)
+}
+
+// scanSysfs walks /sys/class/block and the udev database
+func (b *SysfsBackend) scanSysfs() ([]*Device, error) {
+	if _, err := os.Stat(udevDataDir); err != nil {
+		return nil, errNoUdevData
+	}
+
+	entries, err := os.ReadDir(sysBlockDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", sysBlockDir, err)
+	}
+
+	nodes := make(map[string]*Device)
+	parents := make(map[string]string)
+	children := make(map[string][]string)
+	unprobed := make(map[*Device]bool)
+	names := []string{}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		dev, parent, needsProbe := b.readSysfsDevice(name)
+		if dev == nil {
+			continue
+		}
+		nodes[name] = dev
+		parents[name] = parent
+		unprobed[dev] = needsProbe
+		names = append(names, name)
+	}
+
+	for _, name := range names {
+		if parent := parents[name]; parent != "" && nodes[parent] != nil {
+			children[parent] = append(children[parent], name)
+		}
+	}
+
+	// Walk the tree from the whole disks down so removability is inherited
+	all := []*Device{}
+	var visit func(name string, parent *Device)
+	visit = func(name string, parent *Device) {
+		dev := nodes[name]
+		if parent != nil {
+			dev.Parent = parent.Path
+			parent.Children = append(parent.Children, dev.Path)
+			if parent.IsRemovable {
+				dev.IsRemovable = true
+			}
+			if dev.Hardware == (Hardware{}) {
+				dev.Hardware = parent.Hardware
+			}
+		}
+		all = append(all, dev)
+		for _, child := range children[name] {
+			visit(child, dev)
+		}
+	}
+	for _, name := range names {
+		if parent := parents[name]; parent == "" || nodes[parent] == nil {
+			visit(name, nil)
+		}
+	}
+
+	// Only read the superblocks of the devices that are kept, reading those of
+	// internal disks would spin them up on every scan
+	devices := []*Device{}
+	byPath := make(map[string]*Device)
+	for _, dev := range all {
+		if dev.IsRemovable {
+			if unprobed[dev] {
+				b.Probe(dev)
+			}
+			devices = append(devices, dev)
+			byPath[dev.Path] = dev
+		}
+	}
+	for _, dev := range devices {
+		if parent := byPath[dev.Parent]; parent != nil &&
+			strings.HasPrefix(dev.Path, "/dev/mapper/") && parent.IsEncrypted {
+			parent.IsUnlocked = true
+		}
+	}
+	applyPartitionTables(devices)
+
+	return devices, nil
+}
+
+// readSysfsDevice builds a device from its sysfs directory and udev record.
+// It returns the sysfs name of the parent device, if any, and whether the
+// superblock has to be read to complete the udev record.
+func (b *SysfsBackend) readSysfsDevice(name string) (*Device, string, bool) {
+	dir := filepath.Join(sysBlockDir, name)
+
+	devnum := readSysfsString(dir, "dev")
+	if devnum == "" {
+		return nil, "", false
+	}
+
+	dev := &Device{
+		Name:   name,
+		Path:   "/dev/" + name,
+		DevNum: devnum,
+		Size:   readSysfsUint(dir, "size") * 512, // Convert sectors to bytes
+	}
+	// Empty card readers and optical drives report a size of zero
+	dev.MediaPresent = dev.Size > 0
+	dev.IsOptical = strings.HasPrefix(name, "sr")
+
+	parent := ""
+	if _, err := os.Stat(filepath.Join(dir, "partition")); err == nil {
+		// Partitions live inside the directory of their disk
+		dev.IsPartition = true
+		dev.PartitionNum = int(readSysfsUint(dir, "partition"))
+		if real, err := filepath.EvalSymlinks(dir); err == nil {
+			parent = filepath.Base(filepath.Dir(real))
+		}
+	} else if slaves, err := os.ReadDir(filepath.Join(dir, "slaves")); err == nil && len(slaves) > 0 {
+		// Device-mapper targets (crypt, LVM) list their backing devices as slaves
+		parent = slaves[0].Name()
+		if mapperName := readSysfsString(dir, "dm/name"); mapperName != "" {
+			dev.Name = mapperName
+			dev.Path = "/dev/mapper/" + mapperName
+		}
+		dmUUID := readSysfsString(dir, "dm/uuid")
+		dev.IsPartition = strings.HasPrefix(dmUUID, "CRYPT-") || strings.HasPrefix(dmUUID, "LVM-")
+	} else {
+		dev.BackingFile = readSysfsString(dir, "loop/backing_file")
+		dev.IsRemovable = readSysfsString(dir, "removable") == "1" || isHotplugDevice(dir) ||
+			readSysfsString(dir, "device/type") == "SD" || // cards in built-in readers
+			isAttachedImage(dev.Path, dev.BackingFile)
+		dev.Hardware = readSysfsHardware(dir)
+	}
+
+	props, links, err := readUdevRecord(filepath.Join(udevDataDir, "b"+devnum))
+	if err != nil {
+		// No udev record for this device yet, read the superblock instead
+		return dev, parent, dev.MediaPresent
+	}
+
+	for _, link := range links {
+		dev.Aliases = append(dev.Aliases, "/dev/"+link)
+	}
+	dev.FSType = props["ID_FS_TYPE"]
+	dev.UUID = props["ID_FS_UUID"]
+	if label, ok := props["ID_FS_LABEL_ENC"]; ok {
+		dev.Label = decodeUdevString(label)
+	} else {
+		dev.Label = props["ID_FS_LABEL"]
+	}
+	if num, err := strconv.Atoi(props["ID_PART_ENTRY_NUMBER"]); err == nil {
+		dev.PartitionNum = num
+	}
+	if dev.IsPartition && props["ID_PART_ENTRY_TYPE"] != "" {
+		setPartitionEntry(dev, props["ID_PART_ENTRY_SCHEME"], props["ID_PART_ENTRY_TYPE"],
+			decodeUdevString(props["ID_PART_ENTRY_NAME"]), props["ID_PART_ENTRY_UUID"])
+	}
+	if props["ID_BUS"] == "usb" {
+		dev.IsRemovable = true
+	}
+	dev.IsEncrypted = isEncryptedType(dev.FSType)
+	// Older blkid versions miss BitLocker, and none detects VeraCrypt
+	needsProbe := dev.FSType == "" && dev.IsPartition && dev.MediaPresent
+	dev.PartitionTable = partitionScheme(props["ID_PART_TABLE_TYPE"])
+	if !dev.IsPartition && parent == "" {
+		// e.g. the serial numbers of ATA disks, which sysfs does not expose
+		mergeHardware(&dev.Hardware, udevHardware(props))
+	}
+
+	return dev, parent, needsProbe
+}
+
+// readSysfsHardware reads the identity of the physical device behind a
+// whole disk by walking up its sysfs device tree
+func readSysfsHardware(dir string) Hardware {
+	hw := Hardware{}
+
+	devDir := filepath.Join(dir, "device")
+	real, err := filepath.EvalSymlinks(devDir)
+	if err != nil {
+		return hw
+	}
+
+	// SCSI, NVMe and MMC devices describe themselves
+	hw.Vendor = readSysfsString(devDir, "vendor")
+	hw.Model = readSysfsString(devDir, "model")
+	if hw.Model == "" {
+		hw.Model = readSysfsString(devDir, "name") // MMC cards
+	}
+	hw.Serial = readSysfsString(devDir, "serial")
+	hw.WWN = parseWWID(readSysfsString(dir, "wwid")) // NVMe namespaces
+	if hw.WWN == "" {
+		hw.WWN = parseWWID(readSysfsString(devDir, "wwid"))
+	}
+
+	for p := real; p != filepath.Dir(p); p = filepath.Dir(p) {
+		if readSysfsString(p, "idVendor") == "" {
+			continue
+		}
+		// The closest USB device rather than a hub further up
+		hw.Bus = "usb"
+		hw.VendorID = readSysfsString(p, "idVendor")
+		hw.ProductID = readSysfsString(p, "idProduct")
+		hw.PortPath = filepath.Base(p)
+		if serial := readSysfsString(p, "serial"); serial != "" {
+			hw.Serial = serial
+		}
+		if hw.Vendor == "" {
+			hw.Vendor = readSysfsString(p, "manufacturer")
+		}
+		if hw.Model == "" {
+			hw.Model = readSysfsString(p, "product")
+		}
+		return hw
+	}
+
+	switch {
+	case strings.Contains(real, "/nvme/"):
+		hw.Bus = "nvme"
+	case strings.Contains(real, "/mmc_host/"):
+		hw.Bus = "mmc"
+	case strings.Contains(real, "/ata"):
+		hw.Bus = "sata"
+	}
+
+	// PCIe devices behind a hotplug port are tunnelled over Thunderbolt/USB4
+	if hw.Bus != "" && hw.Bus != "sata" && isHotplugDevice(dir) {
+		hw.Bus = "thunderbolt"
+	}
+
+	return hw
+}
+
+// udevHardware reads the identity of a disk from its udev properties
+func udevHardware(props map[string]string) Hardware {
+	hw := Hardware{
+		Vendor: strings.TrimSpace(decodeUdevString(props["ID_VENDOR_ENC"])),
+		Model:  strings.TrimSpace(decodeUdevString(props["ID_MODEL_ENC"])),
+		Serial: props["ID_SERIAL_SHORT"],
+		WWN:    props["ID_WWN"],
+	}
+
+	switch props["ID_BUS"] {
+	case "usb":
+		hw.Bus = "usb"
+		hw.VendorID = props["ID_VENDOR_ID"]
+		hw.ProductID = props["ID_MODEL_ID"]
+	case "ata":
+		hw.Bus = "sata"
+	}
+
+	return hw
+}
+
+// parseWWID converts a "naa." or "eui." sysfs wwid into a 0x-prefixed WWN.
+// Vendor-specific t10 identifiers are not world wide names and are ignored.
+func parseWWID(wwid string) string {
+	for _, prefix := range []string{"naa.", "eui."} {
+		if strings.HasPrefix(wwid, prefix) {
+			return "0x" + strings.ToLower(wwid[len(prefix):])
+		}
+	}
+	return ""
+}
+
+// isHotplugDevice reports whether any ancestor of a block device in the
+// sysfs device tree is marked as removable, e.g. a USB port
+func isHotplugDevice(dir string) bool {
+	real, err := filepath.EvalSymlinks(filepath.Join(dir, "device"))
+	if err != nil {
+		return false
+	}
+
+	for p := real; p != filepath.Dir(p); p = filepath.Dir(p) {
+		if readSysfsString(p, "removable") == "removable" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// readUdevRecord reads the E: property lines and the S: symlink lines, e.g.
+// "disk/by-uuid/1A2B-3C4D", of a udev database record
+func readUdevRecord(path string) (map[string]string, []string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	props := make(map[string]string)
+	links := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "E:"):
+			if key, value, ok := strings.Cut(line[2:], "="); ok {
+				props[key] = value
+			}
+		case strings.HasPrefix(line, "S:"):
+			links = append(links, line[2:])
+		}
+	}
+
+	return props, links, scanner.Err()
+}
+
+// decodeUdevString decodes the \xNN escapes udev uses in *_ENC properties
+func decodeUdevString(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) && s[i+1] == 'x' {
+			if val, err := strconv.ParseUint(s[i+2:i+4], 16, 8); err == nil {
+				b.WriteByte(byte(val))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// readSysfsString reads a sysfs attribute with surrounding whitespace removed
+func readSysfsString(dir, attr string) string {
+	data, err := os.ReadFile(filepath.Join(dir, attr))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// readSysfsUint reads a numeric sysfs attribute, returning 0 on error
+func readSysfsUint(dir, attr string) uint64 {
+	val, err := strconv.ParseUint(readSysfsString(dir, attr), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return val
+}
@@ -0,0 +1,169 @@
+package device
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeFixture creates a file with the given content under root
+func writeFixture(t *testing.T, root, path, content string) {
+	t.Helper()
+	full := filepath.Join(root, path)
+	if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(full, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScanSysfs(t *testing.T) {
+	root := t.TempDir()
+
+	// A fixed SATA disk and a USB stick whose port is marked removable
+	writeFixture(t, root, "devices/pci0/ata1/host0/block/sda/dev", "8:0\n")
+	writeFixture(t, root, "devices/pci0/ata1/host0/block/sda/size", "500118192\n")
+	writeFixture(t, root, "devices/pci0/ata1/host0/block/sda/removable", "0\n")
+	writeFixture(t, root, "devices/pci0/ata1/host0/block/sda/sda1/dev", "8:1\n")
+	writeFixture(t, root, "devices/pci0/ata1/host0/block/sda/sda1/partition", "1\n")
+	writeFixture(t, root, "devices/pci0/usb1/1-2/removable", "removable\n")
+	writeFixture(t, root, "devices/pci0/usb1/1-2/idVendor", "0951\n")
+	writeFixture(t, root, "devices/pci0/usb1/1-2/idProduct", "1666\n")
+	writeFixture(t, root, "devices/pci0/usb1/1-2/serial", "60A44C413A7CF3B1\n")
+	writeFixture(t, root, "devices/pci0/usb1/1-2/manufacturer", "Kingston\n")
+	writeFixture(t, root, "devices/pci0/usb1/1-2/host6/target/lun0/vendor", "Kingston\n")
+	writeFixture(t, root, "devices/pci0/usb1/1-2/host6/target/lun0/model", "DataTraveler 3.0\n")
+	writeFixture(t, root, "devices/pci0/usb1/1-2/host6/target/lun0/block/sdb/dev", "8:16\n")
+	writeFixture(t, root, "devices/pci0/usb1/1-2/host6/target/lun0/block/sdb/size", "30310400\n")
+	writeFixture(t, root, "devices/pci0/usb1/1-2/host6/target/lun0/block/sdb/removable", "0\n")
+	writeFixture(t, root, "devices/pci0/usb1/1-2/host6/target/lun0/block/sdb/sdb1/dev", "8:17\n")
+	writeFixture(t, root, "devices/pci0/usb1/1-2/host6/target/lun0/block/sdb/sdb1/size", "30308352\n")
+	writeFixture(t, root, "devices/pci0/usb1/1-2/host6/target/lun0/block/sdb/sdb1/partition", "1\n")
+	// An empty DVD drive
+	writeFixture(t, root, "devices/pci0/ata2/host1/block/sr0/dev", "11:0\n")
+	writeFixture(t, root, "devices/pci0/ata2/host1/block/sr0/size", "0\n")
+	writeFixture(t, root, "devices/pci0/ata2/host1/block/sr0/removable", "1\n")
+
+	classDir := filepath.Join(root, "class/block")
+	if err := os.MkdirAll(classDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		"sda":  "devices/pci0/ata1/host0/block/sda",
+		"sda1": "devices/pci0/ata1/host0/block/sda/sda1",
+		"sdb":  "devices/pci0/usb1/1-2/host6/target/lun0/block/sdb",
+		"sdb1": "devices/pci0/usb1/1-2/host6/target/lun0/block/sdb/sdb1",
+		"sr0":  "devices/pci0/ata2/host1/block/sr0",
+	}
+	for name, target := range links {
+		if err := os.Symlink(filepath.Join(root, target), filepath.Join(classDir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(root, "devices/pci0/usb1/1-2/host6/target/lun0"),
+		filepath.Join(root, "devices/pci0/usb1/1-2/host6/target/lun0/block/sdb/device")); err != nil {
+		t.Fatal(err)
+	}
+
+	writeFixture(t, root, "udev/b8:16", "I:123\nE:ID_BUS=usb\nE:ID_PART_TABLE_TYPE=gpt\n")
+	writeFixture(t, root, "udev/b8:17", "I:124\nE:ID_FS_TYPE=exfat\nE:ID_FS_LABEL=My_Stick\n"+
+		"E:ID_FS_LABEL_ENC=My\\x20Stick\nE:ID_FS_UUID=1A2B-3C4D\nE:ID_PART_ENTRY_NUMBER=1\n"+
+		"E:ID_PART_ENTRY_SCHEME=gpt\nE:ID_PART_ENTRY_NAME=Basic\\x20data\n"+
+		"E:ID_PART_ENTRY_TYPE=EBD0A0A2-B9E5-4433-87C0-68B6B72699C7\n"+
+		"E:ID_PART_ENTRY_UUID=0f1e2d3c-4b5a-6978-8796-a5b4c3d2e1f0\n"+
+		"S:disk/by-uuid/1A2B-3C4D\nS:disk/by-label/My\\x20Stick\n")
+
+	oldBlock, oldUdev, oldProbe := sysBlockDir, udevDataDir, probeSysfsDevice
+	sysBlockDir, udevDataDir = classDir, filepath.Join(root, "udev")
+	probed := []string{}
+	probeSysfsDevice = func(dev *Device) error {
+		probed = append(probed, dev.Path)
+		return nil
+	}
+	defer func() { sysBlockDir, udevDataDir, probeSysfsDevice = oldBlock, oldUdev, oldProbe }()
+
+	b := &SysfsBackend{}
+	devices, err := b.scanSysfs()
+	if err != nil {
+		t.Fatalf("Failed to scan sysfs: %v", err)
+	}
+	// sda has no udev record, but it is not removable
+	if len(probed) != 0 {
+		t.Errorf("Internal disks should not be probed, probed %v", probed)
+	}
+
+	if len(devices) != 3 {
+		t.Fatalf("Should find 3 removable devices, got %d", len(devices))
+	}
+
+	disk, part, drive := devices[0], devices[1], devices[2]
+	if disk.Path != "/dev/sdb" || disk.IsPartition || disk.Size != 30310400*512 || !disk.MediaPresent ||
+		disk.PartitionTable != "gpt" || disk.IsMountable() {
+		t.Errorf("Unexpected disk: %+v", disk)
+	}
+	if drive.Path != "/dev/sr0" || !drive.IsOptical || drive.MediaPresent || drive.IsMountable() {
+		t.Errorf("sr0 should be an empty optical drive: %+v", drive)
+	}
+	if len(disk.Children) != 1 || disk.Children[0] != "/dev/sdb1" {
+		t.Errorf("Unexpected disk children: %v", disk.Children)
+	}
+	if part.Path != "/dev/sdb1" || !part.IsPartition || part.Parent != "/dev/sdb" {
+		t.Errorf("Unexpected partition: %+v", part)
+	}
+	if part.FSType != "exfat" || part.Label != "My Stick" || part.UUID != "1A2B-3C4D" {
+		t.Errorf("Unexpected partition metadata: %s %q %s", part.FSType, part.Label, part.UUID)
+	}
+	if len(part.Aliases) != 2 || part.Aliases[0] != "/dev/disk/by-uuid/1A2B-3C4D" {
+		t.Errorf("Unexpected partition aliases: %v", part.Aliases)
+	}
+	if part.PartitionScheme != "gpt" || part.PartitionType != "ebd0a0a2-b9e5-4433-87c0-68b6b72699c7" ||
+		part.PartitionLabel != "Basic data" || part.PartUUID != "0f1e2d3c-4b5a-6978-8796-a5b4c3d2e1f0" {
+		t.Errorf("Unexpected partition entry: %s %s %q %s",
+			part.PartitionScheme, part.PartitionType, part.PartitionLabel, part.PartUUID)
+	}
+
+	want := Hardware{
+		Vendor:    "Kingston",
+		Model:     "DataTraveler 3.0",
+		Serial:    "60A44C413A7CF3B1",
+		Bus:       "usb",
+		VendorID:  "0951",
+		ProductID: "1666",
+		PortPath:  "1-2",
+	}
+	if disk.Hardware != want {
+		t.Errorf("Unexpected disk hardware: %+v", disk.Hardware)
+	}
+	if part.Hardware != want {
+		t.Errorf("Partition should inherit the disk hardware, got %+v", part.Hardware)
+	}
+	if disk.USBID() != "0951:1666" {
+		t.Errorf("Unexpected USB ID: %s", disk.USBID())
+	}
+}
+
+func TestScanSysfsWithoutUdev(t *testing.T) {
+	oldUdev := udevDataDir
+	udevDataDir = filepath.Join(t.TempDir(), "missing")
+	defer func() { udevDataDir = oldUdev }()
+
+	b := &SysfsBackend{}
+	if _, err := b.scanSysfs(); err != errNoUdevData {
+		t.Errorf("Should report missing udev data, got %v", err)
+	}
+}
+
+func TestParseWWID(t *testing.T) {
+	tests := map[string]string{
+		"naa.5000C500A1B2C3D4":    "0x5000c500a1b2c3d4",
+		"eui.0025385b71b0a1b2":    "0x0025385b71b0a1b2",
+		"t10.ATA     Samsung SSD": "",
+		"":                        "",
+	}
+	for wwid, want := range tests {
+		if got := parseWWID(wwid); got != want {
+			t.Errorf("parseWWID(%q) = %q, want %q", wwid, got, want)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package device
+
+// Usage holds the space statistics of a mounted filesystem
+type Usage struct {
+	Total      uint64 // Size of the filesystem in bytes
+	Free       uint64 // Bytes available to unprivileged users
+	Used       uint64 // Bytes in use
+	Inodes     uint64 // Total number of inodes (files)
+	InodesFree uint64
+}
+
+// FreePercent returns the share of the filesystem that is free, from 0 to
+// 100, or -1 if the usage is not known
+func (u Usage) FreePercent() float64 {
+	if u.Total == 0 {
+		return -1
+	}
+	return float64(u.Free) * 100 / float64(u.Total)
+}
+
+// applyUsage fills in the space statistics of mounted devices
+func applyUsage(backend Backend, devices []*Device) {
+	for _, dev := range devices {
+		dev.Usage = Usage{}
+		if !dev.IsMounted || dev.MountPoint == "" {
+			continue
+		}
+		if usage, err := backend.Usage(dev.MountPoint); err == nil {
+			dev.Usage = usage
+		}
+	}
+}
+
+// newUsage converts statfs block and inode counts into a Usage
+func newUsage(blockSize, blocks, free, avail, files, filesFree uint64) Usage {
+	return Usage{
+		Total:      blocks * blockSize,
+		Free:       avail * blockSize,
+		Used:       (blocks - min(free, blocks)) * blockSize,
+		Inodes:     files,
+		InodesFree: filesFree,
+	}
+}
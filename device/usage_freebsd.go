@@ -0,0 +1,18 @@
+package device
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// statfsUsage reads the space statistics of the filesystem at path
+func statfsUsage(path string) (Usage, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return Usage{}, fmt.Errorf("statfs %s failed: %w", path, err)
+	}
+
+	// Available blocks and free inodes go negative when the reserve is in use
+	return newUsage(st.Bsize, st.Blocks, st.Bfree, uint64(max(st.Bavail, 0)),
+		st.Files, uint64(max(st.Ffree, 0))), nil
+}
@@ -0,0 +1,22 @@
+package device
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// statfsUsage reads the space statistics of the filesystem at path
+func statfsUsage(path string) (Usage, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return Usage{}, fmt.Errorf("statfs %s failed: %w", path, err)
+	}
+
+	// Block counts are in fragments, which are the block size on most filesystems
+	blockSize := uint64(st.Frsize)
+	if blockSize == 0 {
+		blockSize = uint64(st.Bsize)
+	}
+	return newUsage(blockSize, uint64(st.Blocks), uint64(st.Bfree), uint64(st.Bavail),
+		uint64(st.Files), uint64(st.Ffree)), nil
+}
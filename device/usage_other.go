@@ -0,0 +1,10 @@
+//go:build !linux && !freebsd
+
+package device
+
+import "errors"
+
+// statfsUsage is only available on Linux and FreeBSD
+func statfsUsage(path string) (Usage, error) {
+	return Usage{}, errors.New("statfs is not supported on this platform")
+}
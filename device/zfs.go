@@ -0,0 +1,217 @@
+package device
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// zfsCommand runs zpool(8) or zfs(8). This is a variable so tests can
+// stand in for them.
+var zfsCommand = func(name string, args ...string) ([]byte, error) {
+	return exec.Command(name, args...).CombinedOutput()
+}
+
+// ErrPoolNameInUse is returned when a pool has the same name as an
+// imported one and renaming was not allowed
+var ErrPoolNameInUse = errors.New("a pool with the same name is already imported")
+
+// PoolImportOptions controls how ImportPool imports a pool
+type PoolImportOptions struct {
+	MountBase string // The pool is imported with an altroot of MountBase/<pool>
+	ReadOnly  bool
+	NoMount   bool // Import without mounting any dataset
+	Rename    bool // Import under a temporary name if the name is taken
+}
+
+// IsPoolMember reports whether the device is a vdev of a ZFS pool. Its
+// Label is the pool name and its UUID the pool GUID.
+func (d *Device) IsPoolMember() bool {
+	return d.FSType == "zfs_member" || d.FSType == "zfs"
+}
+
+// ImportPool imports the ZFS pool a device belongs to and returns the name
+// it was imported under and the directory its datasets are mounted under.
+// A pool whose name is taken by an imported pool, e.g. a "zroot" disk from
+// another machine, is imported under a temporary name if opts.Rename is
+// set, or refused with ErrPoolNameInUse. A pool that is already imported,
+// e.g. through another of its vdevs, is left as it is.
+func ImportPool(dev *Device, opts PoolImportOptions) (string, string, error) {
+	if !dev.IsPoolMember() || dev.UUID == "" {
+		return "", "", fmt.Errorf("%s is not part of a ZFS pool", dev.Path)
+	}
+
+	imported, err := importedPools()
+	if err != nil {
+		return "", "", err
+	}
+	if name, ok := imported[dev.UUID]; ok {
+		return name, poolMountPoint(name, importedAltroot(name)), nil
+	}
+
+	name := dev.Label
+	if poolNameTaken(imported, name) {
+		if !opts.Rename {
+			return "", "", fmt.Errorf("%w: %s", ErrPoolNameInUse, name)
+		}
+		name = temporaryPoolName(imported, dev.Label, dev.UUID)
+	}
+
+	altroot := poolAltroot(opts.MountBase, name)
+	args := []string{"import", "-R", altroot}
+	if opts.NoMount {
+		args = append(args, "-N")
+	}
+	if opts.ReadOnly {
+		args = append(args, "-o", "readonly=on")
+	}
+	// Import by GUID, since another pool may share the name. Options go
+	// before it, as getopt stops at the first operand.
+	if name != dev.Label {
+		args = append(args, "-t", dev.UUID, name)
+	} else {
+		args = append(args, dev.UUID)
+	}
+
+	if output, err := zfsCommand("zpool", args...); err != nil {
+		return "", "", fmt.Errorf("zpool import failed: %w (output: %s)", err, strings.TrimSpace(string(output)))
+	}
+
+	return name, poolMountPoint(name, altroot), nil
+}
+
+// ExportPool exports an imported pool, unmounting all of its datasets, and
+// removes its altroot directory if it is empty
+func ExportPool(name string) error {
+	altroot := importedAltroot(name)
+
+	if output, err := zfsCommand("zpool", "export", name); err != nil {
+		return fmt.Errorf("zpool export failed: %w (output: %s)", err, strings.TrimSpace(string(output)))
+	}
+
+	if altroot != "" {
+		os.Remove(altroot)
+	}
+	return nil
+}
+
+// importedAltroot returns the altroot of an imported pool, or "" if it has
+// none
+func importedAltroot(name string) string {
+	output, err := zfsCommand("zpool", "get", "-H", "-o", "value", "altroot", name)
+	if err != nil {
+		return ""
+	}
+	if altroot := strings.TrimSpace(string(output)); altroot != "-" {
+		return altroot
+	}
+	return ""
+}
+
+// applyPools marks the vdevs of imported pools with the pool name and the
+// mounts of its datasets, which the mount table lists by dataset rather
+// than by device
+func applyPools(devices []*Device, mounts []MountEntry) {
+	members := []*Device{}
+	for _, dev := range devices {
+		if dev.IsPoolMember() && dev.UUID != "" {
+			members = append(members, dev)
+		}
+	}
+	if len(members) == 0 {
+		// Spare the zpool call on systems without removable pools
+		return
+	}
+
+	imported, err := importedPools()
+	if err != nil {
+		return
+	}
+
+	for _, dev := range members {
+		name, ok := imported[dev.UUID]
+		if !ok {
+			continue
+		}
+
+		dev.Pool = name
+		dev.IsMounted = true
+		dev.Mounts = nil
+		for _, entry := range mounts {
+			if entry.FSType == "zfs" && (entry.Device == name || strings.HasPrefix(entry.Device, name+"/")) {
+				dev.Mounts = append(dev.Mounts, entry)
+			}
+		}
+		if len(dev.Mounts) > 0 {
+			dev.MountPoint = dev.Mounts[0].MountPoint
+		}
+	}
+}
+
+// importedPools returns the names of the imported pools by GUID
+func importedPools() (map[string]string, error) {
+	output, err := zfsCommand("zpool", "list", "-H", "-o", "name,guid")
+	if err != nil {
+		return nil, fmt.Errorf("zpool list failed: %w (output: %s)", err, strings.TrimSpace(string(output)))
+	}
+
+	pools := make(map[string]string)
+	scanner := bufio.NewScanner(strings.NewReader(string(output)))
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) == 2 {
+			pools[fields[1]] = fields[0]
+		}
+	}
+	return pools, nil
+}
+
+// poolNameTaken reports whether an imported pool is called name
+func poolNameTaken(imported map[string]string, name string) bool {
+	for _, n := range imported {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// temporaryPoolName returns a free name for a pool whose name is taken,
+// made from its name and the end of its GUID, e.g. "zroot-483921"
+func temporaryPoolName(imported map[string]string, name, guid string) string {
+	suffix := guid
+	if len(suffix) > 6 {
+		suffix = suffix[len(suffix)-6:]
+	}
+
+	candidate := name + "-" + suffix
+	for i := 2; poolNameTaken(imported, candidate); i++ {
+		candidate = fmt.Sprintf("%s-%s-%d", name, suffix, i)
+	}
+	return candidate
+}
+
+// poolAltroot returns the altroot for a pool under mountBase
+func poolAltroot(mountBase, name string) string {
+	dev := Device{Label: name}
+	return dev.GetMountDirectory(mountBase)
+}
+
+// poolMountPoint returns where the root dataset of a pool is mounted, or
+// its altroot if the dataset is not mounted
+func poolMountPoint(name, altroot string) string {
+	output, err := zfsCommand("zfs", "get", "-H", "-o", "value", "mounted,mountpoint", name)
+	if err != nil {
+		return altroot
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	if len(lines) == 2 && lines[0] == "yes" && filepath.IsAbs(lines[1]) {
+		return lines[1]
+	}
+	return altroot
+}
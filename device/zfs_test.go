@@ -0,0 +1,191 @@
+package device
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeZpool stands in for zpool(8) and zfs(8) with a set of imported pools
+// and one of pools that can be imported by GUID, recording every command it
+// runs
+type fakeZpool struct {
+	pools    map[string]string
+	exported map[string]string
+	commands []string
+}
+
+func (f *fakeZpool) run(name string, args ...string) ([]byte, error) {
+	cmd := name + " " + strings.Join(args, " ")
+	f.commands = append(f.commands, cmd)
+
+	switch {
+	case strings.HasPrefix(cmd, "zpool list"):
+		var b strings.Builder
+		for guid, pool := range f.pools {
+			fmt.Fprintf(&b, "%s\t%s\n", pool, guid)
+		}
+		return []byte(b.String()), nil
+	case strings.HasPrefix(cmd, "zpool import"):
+		guid, name := args[len(args)-1], ""
+		if args[len(args)-3] == "-t" {
+			guid, name = args[len(args)-2], args[len(args)-1]
+		}
+		if _, ok := f.exported[guid]; !ok {
+			return nil, nil
+		}
+		if name == "" {
+			name = f.exported[guid]
+		}
+		if _, ok := f.pools[guid]; ok {
+			return []byte("cannot import: a pool with that guid is already imported"), errors.New("exit status 1")
+		}
+		f.pools[guid] = name
+		return nil, nil
+	case strings.HasPrefix(cmd, "zpool get"):
+		return []byte("/media/backup\n"), nil
+	case strings.HasPrefix(cmd, "zfs get"):
+		return []byte("yes\n/media/backup\n"), nil
+	case strings.HasPrefix(cmd, "zpool export"):
+		for guid, pool := range f.pools {
+			if pool == args[len(args)-1] {
+				delete(f.pools, guid)
+				return nil, nil
+			}
+		}
+		return []byte("cannot open pool"), errors.New("exit status 1")
+	}
+	return nil, nil
+}
+
+func stubZpool(t *testing.T, pools map[string]string) *fakeZpool {
+	fake := &fakeZpool{pools: pools}
+	old := zfsCommand
+	zfsCommand = fake.run
+	t.Cleanup(func() { zfsCommand = old })
+	return fake
+}
+
+func TestImportPool(t *testing.T) {
+	fake := stubZpool(t, map[string]string{"111": "zroot"})
+
+	dev := &Device{Path: "/dev/da0p1", FSType: "zfs_member", Label: "backup", UUID: "2468013579"}
+	name, mountPoint, err := ImportPool(dev, PoolImportOptions{MountBase: "/media", ReadOnly: true})
+	if err != nil {
+		t.Fatalf("ImportPool failed: %v", err)
+	}
+	if name != "backup" || mountPoint != "/media/backup" {
+		t.Errorf("Imported %q at %q, want backup at /media/backup", name, mountPoint)
+	}
+	want := "zpool import -R /media/backup -o readonly=on 2468013579"
+	if !contains(fake.commands, want) {
+		t.Errorf("Expected %q, ran %v", want, fake.commands)
+	}
+
+}
+
+func TestImportPoolMembers(t *testing.T) {
+	fake := stubZpool(t, map[string]string{"111": "zroot"})
+	fake.exported = map[string]string{"2468013579": "backup"}
+
+	// Both vdevs of a mirror carry the GUID of the pool
+	for _, path := range []string{"/dev/da0p1", "/dev/da1p1"} {
+		dev := &Device{Path: path, FSType: "zfs_member", Label: "backup", UUID: "2468013579"}
+		name, mountPoint, err := ImportPool(dev, PoolImportOptions{MountBase: "/media"})
+		if err != nil {
+			t.Fatalf("ImportPool of %s failed: %v", path, err)
+		}
+		if name != "backup" || mountPoint != "/media/backup" {
+			t.Errorf("Imported %s as %q at %q, want backup at /media/backup", path, name, mountPoint)
+		}
+	}
+
+	imports := 0
+	for _, cmd := range fake.commands {
+		if strings.HasPrefix(cmd, "zpool import") {
+			imports++
+		}
+	}
+	if imports != 1 {
+		t.Errorf("The pool should be imported once, ran %v", fake.commands)
+	}
+}
+
+func TestImportPoolNameInUse(t *testing.T) {
+	fake := stubZpool(t, map[string]string{"111": "zroot", "222": "zroot-483921"})
+
+	dev := &Device{Path: "/dev/da0p4", FSType: "zfs_member", Label: "zroot", UUID: "9876483921"}
+	if _, _, err := ImportPool(dev, PoolImportOptions{MountBase: "/media"}); !errors.Is(err, ErrPoolNameInUse) {
+		t.Errorf("Expected ErrPoolNameInUse, got %v", err)
+	}
+
+	name, _, err := ImportPool(dev, PoolImportOptions{MountBase: "/media", NoMount: true, Rename: true})
+	if err != nil {
+		t.Fatalf("ImportPool failed: %v", err)
+	}
+	if name != "zroot-483921-2" {
+		t.Errorf("Expected temporary name zroot-483921-2, got %s", name)
+	}
+	want := "zpool import -R /media/zroot-483921-2 -N -t 9876483921 zroot-483921-2"
+	if !contains(fake.commands, want) {
+		t.Errorf("Expected %q, ran %v", want, fake.commands)
+	}
+}
+
+func TestExportPool(t *testing.T) {
+	fake := stubZpool(t, map[string]string{"2468013579": "backup"})
+
+	if err := ExportPool("backup"); err != nil {
+		t.Fatalf("ExportPool failed: %v", err)
+	}
+	if len(fake.pools) != 0 {
+		t.Errorf("Pool should be exported, still have %v", fake.pools)
+	}
+	if err := ExportPool("backup"); err == nil {
+		t.Error("Exporting a pool that is not imported should fail")
+	}
+}
+
+func TestApplyPools(t *testing.T) {
+	stubZpool(t, map[string]string{"2468013579": "backup"})
+
+	devices := []*Device{
+		{Path: "/dev/da0p1", FSType: "zfs_member", Label: "backup", UUID: "2468013579"},
+		{Path: "/dev/da1p1", FSType: "zfs_member", Label: "tank", UUID: "1357924680"},
+		{Path: "/dev/da2s1", FSType: "msdosfs"},
+	}
+	mounts := []MountEntry{
+		{Device: "zroot/ROOT/default", MountPoint: "/", FSType: "zfs"},
+		{Device: "backup", MountPoint: "/media/backup", FSType: "zfs"},
+		{Device: "backup/home", MountPoint: "/media/backup/home", FSType: "zfs"},
+		{Device: "backups", MountPoint: "/media/backups", FSType: "zfs"},
+	}
+	applyPools(devices, mounts)
+
+	backup := devices[0]
+	if backup.Pool != "backup" || !backup.IsMounted || backup.MountPoint != "/media/backup" {
+		t.Errorf("Unexpected pool state: pool=%q mounted=%v at %q", backup.Pool, backup.IsMounted, backup.MountPoint)
+	}
+	var got []string
+	for _, entry := range backup.Mounts {
+		got = append(got, entry.MountPoint)
+	}
+	if want := []string{"/media/backup", "/media/backup/home"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Mounts = %v, want %v", got, want)
+	}
+
+	if devices[1].Pool != "" || devices[1].IsMounted {
+		t.Error("A pool that is not imported should not be mounted")
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
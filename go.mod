@@ -4,11 +4,9 @@ go 1.21
 
 require (
 	fyne.io/systray v1.11.0
+	github.com/godbus/dbus/v5 v5.1.0
+	github.com/kballard/go-shellquote v0.0.0-20180428030007-95032a82bc51
 	gopkg.in/yaml.v3 v3.0.1
 )
 
-require (
-	github.com/godbus/dbus/v5 v5.1.0 // indirect
-	github.com/kballard/go-shellquote v0.0.0-20180428030007-95032a82bc51 // indirect
-	golang.org/x/sys v0.15.0 // indirect
-)
+require golang.org/x/sys v0.15.0 // indirect
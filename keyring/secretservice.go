@@ -0,0 +1,207 @@
+package keyring
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	serviceName         = "org.freedesktop.secrets"
+	servicePath         = dbus.ObjectPath("/org/freedesktop/secrets")
+	defaultCollection   = dbus.ObjectPath("/org/freedesktop/secrets/aliases/default")
+	serviceInterface    = "org.freedesktop.Secret.Service"
+	collectionInterface = "org.freedesktop.Secret.Collection"
+	itemInterface       = "org.freedesktop.Secret.Item"
+	sessionInterface    = "org.freedesktop.Secret.Session"
+	promptInterface     = "org.freedesktop.Secret.Prompt"
+
+	// Items are stored like GVfs stores LUKS passphrases, so that one
+	// remembered by a file manager is found as well
+	schema        = "org.gnome.GVfs.Luks.Password"
+	uuidAttribute = "gvfs-luks-uuid"
+
+	// Devices without a UUID, such as GELI providers, are stored by the
+	// partition GUID or disk serial that stands in for it, which the GVfs
+	// schema does not cover
+	deviceIDSchema    = "org.pgsdf.pgmount.Password"
+	deviceIDAttribute = "pgmount-device-id"
+)
+
+// ErrDismissed is returned when the user dismisses a prompt of the
+// keyring, e.g. the one that unlocks it
+var ErrDismissed = errors.New("keyring prompt dismissed")
+
+// secret is the Secret struct of the Secret Service API
+type secret struct {
+	Session     dbus.ObjectPath
+	Parameters  []byte
+	Value       []byte
+	ContentType string
+}
+
+// SecretService stores passphrases of encrypted devices by their
+// device.Device.StableID with the
+// freedesktop Secret Service, as provided by gnome-keyring, KWallet or
+// KeePassXC
+type SecretService struct {
+	conn    *dbus.Conn
+	session dbus.ObjectPath
+}
+
+// Open connects to the Secret Service on the session bus
+func Open() (*SecretService, error) {
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the session bus: %w", err)
+	}
+
+	s, err := NewSecretService(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewSecretService opens a session with the Secret Service on conn.
+// Secrets are transferred unencrypted, which is what the "plain" algorithm
+// offers over a local bus.
+func NewSecretService(conn *dbus.Conn) (*SecretService, error) {
+	var output dbus.Variant
+	var session dbus.ObjectPath
+	call := conn.Object(serviceName, servicePath).Call(serviceInterface+".OpenSession", 0, "plain", dbus.MakeVariant(""))
+	if err := call.Store(&output, &session); err != nil {
+		return nil, fmt.Errorf("failed to open a Secret Service session: %w", err)
+	}
+	return &SecretService{conn: conn, session: session}, nil
+}
+
+// Close ends the session and closes the connection
+func (s *SecretService) Close() error {
+	s.conn.Object(serviceName, s.session).Call(sessionInterface+".Close", 0)
+	return s.conn.Close()
+}
+
+// Lookup returns the passphrase stored for the device with the given ID,
+// or nil if there is none. Unlocking a locked keyring may prompt the user.
+func (s *SecretService) Lookup(id string) ([]byte, error) {
+	var unlocked, locked []dbus.ObjectPath
+	call := s.conn.Object(serviceName, servicePath).Call(serviceInterface+".SearchItems", 0, attributes(id))
+	if err := call.Store(&unlocked, &locked); err != nil {
+		return nil, fmt.Errorf("failed to search the keyring: %w", err)
+	}
+	if len(unlocked) == 0 && len(locked) > 0 {
+		var err error
+		if unlocked, err = s.unlock(locked); err != nil {
+			return nil, err
+		}
+	}
+	if len(unlocked) == 0 {
+		return nil, nil
+	}
+
+	var sec secret
+	if err := s.conn.Object(serviceName, unlocked[0]).Call(itemInterface+".GetSecret", 0, s.session).Store(&sec); err != nil {
+		return nil, fmt.Errorf("failed to read the passphrase from the keyring: %w", err)
+	}
+	return sec.Value, nil
+}
+
+// Store saves the passphrase of the device with the given ID in the
+// default collection, replacing one stored before
+func (s *SecretService) Store(id, label string, passphrase []byte) error {
+	if _, err := s.unlock([]dbus.ObjectPath{defaultCollection}); err != nil {
+		return err
+	}
+
+	properties := map[string]dbus.Variant{
+		itemInterface + ".Label":      dbus.MakeVariant(label),
+		itemInterface + ".Attributes": dbus.MakeVariant(attributes(id)),
+	}
+	sec := secret{Session: s.session, Parameters: []byte{}, Value: passphrase, ContentType: "text/plain"}
+
+	var item, prompt dbus.ObjectPath
+	call := s.conn.Object(serviceName, defaultCollection).Call(collectionInterface+".CreateItem", 0, properties, sec, true)
+	if err := call.Store(&item, &prompt); err != nil {
+		return fmt.Errorf("failed to store the passphrase in the keyring: %w", err)
+	}
+	if prompt != "/" {
+		if _, err := s.prompt(prompt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unlock unlocks items or collections and returns the ones that are
+// unlocked now
+func (s *SecretService) unlock(objects []dbus.ObjectPath) ([]dbus.ObjectPath, error) {
+	var unlocked []dbus.ObjectPath
+	var prompt dbus.ObjectPath
+	if err := s.conn.Object(serviceName, servicePath).Call(serviceInterface+".Unlock", 0, objects).Store(&unlocked, &prompt); err != nil {
+		return nil, fmt.Errorf("failed to unlock the keyring: %w", err)
+	}
+	if prompt == "/" {
+		return unlocked, nil
+	}
+
+	result, err := s.prompt(prompt)
+	if err != nil {
+		return nil, err
+	}
+	if paths, ok := result.Value().([]dbus.ObjectPath); ok {
+		unlocked = append(unlocked, paths...)
+	}
+	return unlocked, nil
+}
+
+// prompt shows a prompt of the service, e.g. for the keyring password, and
+// waits for the user to complete it
+func (s *SecretService) prompt(path dbus.ObjectPath) (dbus.Variant, error) {
+	match := []dbus.MatchOption{
+		dbus.WithMatchObjectPath(path),
+		dbus.WithMatchInterface(promptInterface),
+		dbus.WithMatchMember("Completed"),
+	}
+	if err := s.conn.AddMatchSignal(match...); err != nil {
+		return dbus.Variant{}, fmt.Errorf("failed to watch the keyring prompt: %w", err)
+	}
+	defer s.conn.RemoveMatchSignal(match...)
+
+	signals := make(chan *dbus.Signal, 1)
+	s.conn.Signal(signals)
+	defer s.conn.RemoveSignal(signals)
+
+	if err := s.conn.Object(serviceName, path).Call(promptInterface+".Prompt", 0, "").Err; err != nil {
+		return dbus.Variant{}, fmt.Errorf("failed to show the keyring prompt: %w", err)
+	}
+
+	for sig := range signals {
+		if sig.Path != path || sig.Name != promptInterface+".Completed" || len(sig.Body) != 2 {
+			continue
+		}
+		if dismissed, _ := sig.Body[0].(bool); dismissed {
+			return dbus.Variant{}, ErrDismissed
+		}
+		result, _ := sig.Body[1].(dbus.Variant)
+		return result, nil
+	}
+	return dbus.Variant{}, errors.New("connection to the keyring closed")
+}
+
+// attributes identify the item of a device
+func attributes(id string) map[string]string {
+	if strings.HasPrefix(id, "partuuid:") || strings.HasPrefix(id, "serial:") {
+		return map[string]string{
+			"xdg:schema":      deviceIDSchema,
+			deviceIDAttribute: id,
+		}
+	}
+	return map[string]string{
+		"xdg:schema":  schema,
+		uuidAttribute: id,
+	}
+}
@@ -0,0 +1,243 @@
+package keyring
+
+import (
+	"bufio"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// privateBus starts a dbus-daemon of its own and returns its address
+func privateBus(t *testing.T) string {
+	daemon, err := exec.LookPath("dbus-daemon")
+	if err != nil {
+		t.Skip("dbus-daemon not found")
+	}
+
+	// A bus of its own, with the configuration of a session bus
+	cmd := exec.Command(daemon, "--session", "--nofork", "--print-address")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start dbus-daemon: %v", err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	address, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatalf("Failed to read the bus address: %v", err)
+	}
+	return strings.TrimSpace(address)
+}
+
+// fakeSecretService implements the parts of the Secret Service API that
+// SecretService uses, with a keyring that can be locked
+type fakeSecretService struct {
+	conn   *dbus.Conn
+	mu     sync.Mutex
+	locked bool
+	items  []*fakeItem
+}
+
+type fakeItem struct {
+	label      string
+	attributes map[string]string
+	value      []byte
+}
+
+func (f *fakeSecretService) OpenSession(algorithm string, input dbus.Variant) (dbus.Variant, dbus.ObjectPath, *dbus.Error) {
+	if algorithm != "plain" {
+		return dbus.Variant{}, "", dbus.NewError("org.freedesktop.DBus.Error.NotSupported", nil)
+	}
+	return dbus.MakeVariant(""), "/org/freedesktop/secrets/session/1", nil
+}
+
+func (f *fakeSecretService) SearchItems(attributes map[string]string) ([]dbus.ObjectPath, []dbus.ObjectPath, *dbus.Error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	found := []dbus.ObjectPath{}
+	for i, item := range f.items {
+		if fmt.Sprint(item.attributes) == fmt.Sprint(attributes) {
+			found = append(found, itemPath(i))
+		}
+	}
+	if f.locked {
+		return []dbus.ObjectPath{}, found, nil
+	}
+	return found, []dbus.ObjectPath{}, nil
+}
+
+func (f *fakeSecretService) Unlock(objects []dbus.ObjectPath) ([]dbus.ObjectPath, dbus.ObjectPath, *dbus.Error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.locked {
+		return []dbus.ObjectPath{}, "/org/freedesktop/secrets/prompt/1", nil
+	}
+	return objects, "/", nil
+}
+
+// Prompt stands in for the user typing the keyring password
+func (f *fakeSecretService) Prompt(windowID string) *dbus.Error {
+	f.mu.Lock()
+	f.locked = false
+	unlocked := []dbus.ObjectPath{}
+	for i := range f.items {
+		unlocked = append(unlocked, itemPath(i))
+	}
+	f.mu.Unlock()
+
+	f.conn.Emit("/org/freedesktop/secrets/prompt/1", promptInterface+".Completed", false, dbus.MakeVariant(unlocked))
+	return nil
+}
+
+func (f *fakeSecretService) CreateItem(properties map[string]dbus.Variant, sec secret, replace bool) (dbus.ObjectPath, dbus.ObjectPath, *dbus.Error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	item := &fakeItem{
+		label:      properties[itemInterface+".Label"].Value().(string),
+		attributes: properties[itemInterface+".Attributes"].Value().(map[string]string),
+		value:      sec.Value,
+	}
+	for i, old := range f.items {
+		if replace && fmt.Sprint(old.attributes) == fmt.Sprint(item.attributes) {
+			old.label, old.value = item.label, item.value
+			return itemPath(i), "/", nil
+		}
+	}
+	f.items = append(f.items, item)
+	path := itemPath(len(f.items) - 1)
+	f.conn.ExportMethodTable(map[string]interface{}{
+		"GetSecret": func(session dbus.ObjectPath) (secret, *dbus.Error) {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			return secret{Session: session, Parameters: []byte{}, Value: item.value, ContentType: "text/plain"}, nil
+		},
+	}, path, itemInterface)
+	return path, "/", nil
+}
+
+// stored returns the items in the keyring
+func (f *fakeSecretService) stored() []fakeItem {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	items := []fakeItem{}
+	for _, item := range f.items {
+		items = append(items, *item)
+	}
+	return items
+}
+
+func (f *fakeSecretService) setLocked(locked bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.locked = locked
+}
+
+func (f *fakeSecretService) isLocked() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.locked
+}
+
+func itemPath(i int) dbus.ObjectPath {
+	return dbus.ObjectPath(fmt.Sprintf("/org/freedesktop/secrets/collection/login/%d", i+1))
+}
+
+// startFakeSecretService claims the Secret Service name on the bus at
+// address
+func startFakeSecretService(t *testing.T, address string) *fakeSecretService {
+	conn, err := dbus.Connect(address)
+	if err != nil {
+		t.Fatalf("Failed to connect to the bus: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	fake := &fakeSecretService{conn: conn}
+	conn.ExportMethodTable(map[string]interface{}{
+		"OpenSession": fake.OpenSession,
+		"SearchItems": fake.SearchItems,
+		"Unlock":      fake.Unlock,
+	}, servicePath, serviceInterface)
+	conn.ExportMethodTable(map[string]interface{}{"CreateItem": fake.CreateItem}, defaultCollection, collectionInterface)
+	conn.ExportMethodTable(map[string]interface{}{"Prompt": fake.Prompt}, "/org/freedesktop/secrets/prompt/1", promptInterface)
+
+	if reply, err := conn.RequestName(serviceName, dbus.NameFlagDoNotQueue); err != nil || reply != dbus.RequestNameReplyPrimaryOwner {
+		t.Fatalf("Failed to own %s: %v", serviceName, err)
+	}
+	return fake
+}
+
+func TestSecretService(t *testing.T) {
+	address := privateBus(t)
+	fake := startFakeSecretService(t, address)
+
+	conn, err := dbus.Connect(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSecretService(conn)
+	if err != nil {
+		t.Fatalf("NewSecretService failed: %v", err)
+	}
+	defer s.Close()
+
+	if pass, err := s.Lookup("0a1b2c3d"); err != nil || pass != nil {
+		t.Fatalf("Lookup() of a new device = %q, %v", pass, err)
+	}
+
+	if err := s.Store("0a1b2c3d", "Encryption passphrase for BACKUP", []byte("secret")); err != nil {
+		t.Fatalf("Store failed: %v", err)
+	}
+	items := fake.stored()
+	if len(items) != 1 || items[0].label != "Encryption passphrase for BACKUP" ||
+		items[0].attributes[uuidAttribute] != "0a1b2c3d" || items[0].attributes["xdg:schema"] != schema {
+		t.Fatalf("Unexpected keyring items %+v", items)
+	}
+
+	if err := s.Store("0a1b2c3d", "Encryption passphrase for BACKUP", []byte("changed")); err != nil {
+		t.Fatalf("Store failed: %v", err)
+	}
+	if items := fake.stored(); len(items) != 1 {
+		t.Errorf("Storing again should replace the item, have %d", len(items))
+	}
+
+	// A locked keyring is unlocked through a prompt of the service
+	fake.setLocked(true)
+	pass, err := s.Lookup("0a1b2c3d")
+	if err != nil || string(pass) != "changed" {
+		t.Errorf("Lookup() = %q, %v", pass, err)
+	}
+	if fake.isLocked() {
+		t.Error("The keyring should have been unlocked")
+	}
+
+	if pass, err := s.Lookup("4e5f6071"); err != nil || pass != nil {
+		t.Errorf("Lookup() of another device = %q, %v", pass, err)
+	}
+
+	// GELI providers go by partition GUID, under an attribute of our own
+	if err := s.Store("partuuid:5e2a91b0", "Encryption passphrase for da0p1", []byte("geli")); err != nil {
+		t.Fatalf("Store failed: %v", err)
+	}
+	items = fake.stored()
+	if len(items) != 2 || items[1].attributes[deviceIDAttribute] != "partuuid:5e2a91b0" ||
+		items[1].attributes["xdg:schema"] != deviceIDSchema || items[1].attributes[uuidAttribute] != "" {
+		t.Errorf("Unexpected keyring items %+v", items)
+	}
+	if pass, err := s.Lookup("partuuid:5e2a91b0"); err != nil || string(pass) != "geli" {
+		t.Errorf("Lookup() of a GELI provider = %q, %v", pass, err)
+	}
+}
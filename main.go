@@ -12,6 +12,7 @@ import (
 	"github.com/pgsdf/pgmount/config"
 	"github.com/pgsdf/pgmount/daemon"
 	"github.com/pgsdf/pgmount/device"
+	"github.com/pgsdf/pgmount/keyring"
 	"github.com/pgsdf/pgmount/notify"
 	"github.com/pgsdf/pgmount/tray"
 )
@@ -75,6 +76,16 @@ func main() {
 		log.Fatalf("Failed to initialize daemon: %v", err)
 	}
 
+	// Look up stored passwords in the Secret Service keyring if enabled
+	if cfg.Encryption.Enabled && cfg.Encryption.Keyring {
+		if secrets, err := keyring.Open(); err != nil {
+			log.Printf("Warning: Failed to open the keyring: %v", err)
+		} else {
+			d.SetKeyring(secrets)
+			defer secrets.Close()
+		}
+	}
+
 	// Mount all devices if requested
 	if *mountAll {
 		if err := d.MountAll(); err != nil {
@@ -95,12 +106,16 @@ func main() {
 			cfg.Tray.Enabled = false
 		} else {
 			// Set up callbacks for mount/unmount operations
-			trayIcon.SetMountCallback(func(dev *device.Device) error {
+			trayIcon.SetMountCallback(func(dev device.Device) error {
 				return d.MountDevice(dev)
 			})
-			trayIcon.SetUnmountCallback(func(dev *device.Device) error {
+			trayIcon.SetUnmountCallback(func(dev device.Device) error {
 				return d.UnmountDevice(dev)
 			})
+			trayIcon.SetLockCallback(func(dev device.Device) error {
+				return d.LockDevice(dev)
+			})
+			trayIcon.SetForgetPasswordsCallback(d.ForgetPasswords)
 
 			// Set up device changed callback to immediately update tray
 			d.SetDeviceChangedCallback(func() {
@@ -147,12 +162,14 @@ func main() {
 
 	// Setup signal handling
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1)
 
 	log.Println("pgmountd daemon started. Press Ctrl+C to stop.")
 
-	// Wait for signals
-	<-sigChan
+	// Wait for signals, SIGUSR1 is sent by pgumount --forget-passwords
+	for sig := <-sigChan; sig == syscall.SIGUSR1; sig = <-sigChan {
+		d.ForgetPasswords()
+	}
 
 	log.Println("Shutting down...")
 
@@ -0,0 +1,212 @@
+package prompt
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Error codes pinentry reports when the user cancels the dialog or answers
+// no to CONFIRM (GPG_ERR_CANCELED and GPG_ERR_NOT_CONFIRMED, without the
+// error source in the upper bits)
+const (
+	assuanCanceled     = 99
+	assuanNotConfirmed = 114
+)
+
+// Pinentry prompts through a pinentry(1) program, which speaks the Assuan
+// protocol on its standard input and output
+type Pinentry struct {
+	Program string
+}
+
+// GetPassphrase shows a pinentry dialog and returns what the user entered
+func (p *Pinentry) GetPassphrase(req Request) ([]byte, error) {
+	var pin []byte
+	err := p.run(req, func(conn *assuanConn) error {
+		var err error
+		pin, err = conn.transact("GETPIN")
+		return err
+	})
+	if err != nil {
+		clear(pin)
+		return nil, err
+	}
+	return pin, nil
+}
+
+// Confirm shows a pinentry message with OK and cancel buttons and reports
+// whether OK was chosen
+func (p *Pinentry) Confirm(req Request) (bool, error) {
+	err := p.run(req, func(conn *assuanConn) error {
+		_, err := conn.transact("CONFIRM")
+		return err
+	})
+	var assuanErr *assuanError
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.Is(err, ErrCanceled):
+		return false, nil
+	case errors.As(err, &assuanErr) && assuanErr.code&0xffff == assuanNotConfirmed:
+		return false, nil
+	}
+	return false, err
+}
+
+// run starts pinentry, sets up the dialog for req and runs command
+func (p *Pinentry) run(req Request, command func(conn *assuanConn) error) error {
+	cmd := exec.Command(p.Program)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start %s: %w", p.Program, err)
+	}
+	defer cmd.Wait()
+	defer stdin.Close()
+
+	conn := &assuanConn{w: stdin, r: bufio.NewReader(stdout)}
+	if _, err := conn.response(); err != nil {
+		return fmt.Errorf("pinentry did not greet: %w", err)
+	}
+
+	settings := []struct{ command, value string }{
+		{"SETTITLE", req.Title},
+		{"SETDESC", req.Description},
+		{"SETPROMPT", req.Prompt},
+		{"SETERROR", req.Error},
+		{"SETOK", req.OK},
+		{"SETCANCEL", req.Cancel},
+	}
+	for _, s := range settings {
+		if s.value == "" {
+			continue
+		}
+		if _, err := conn.transact(s.command + " " + assuanEscape(s.value)); err != nil {
+			return fmt.Errorf("pinentry %s failed: %w", s.command, err)
+		}
+	}
+
+	if err := command(conn); err != nil {
+		return err
+	}
+	conn.transact("BYE")
+	return nil
+}
+
+// assuanConn is the client side of an Assuan connection
+type assuanConn struct {
+	w io.Writer
+	r *bufio.Reader
+}
+
+// assuanError is an ERR response
+type assuanError struct {
+	code    int
+	message string
+}
+
+func (e *assuanError) Error() string {
+	return fmt.Sprintf("%s (code %d)", e.message, e.code)
+}
+
+// transact sends a command and returns the data it responded with
+func (c *assuanConn) transact(command string) ([]byte, error) {
+	if _, err := io.WriteString(c.w, command+"\n"); err != nil {
+		return nil, err
+	}
+	return c.response()
+}
+
+// response reads lines up to the OK or ERR that ends a response and
+// returns the decoded data lines. Status and comment lines are skipped.
+func (c *assuanConn) response() ([]byte, error) {
+	var data []byte
+	for {
+		line, err := c.r.ReadSlice('\n')
+		if err != nil {
+			clear(line)
+			return data, fmt.Errorf("failed to read response: %w", err)
+		}
+		line = bytes.TrimRight(line, "\r\n")
+
+		switch {
+		case bytes.Equal(line, []byte("OK")) || bytes.HasPrefix(line, []byte("OK ")):
+			return data, nil
+		case bytes.HasPrefix(line, []byte("ERR ")):
+			return data, parseAssuanError(string(line[4:]))
+		case bytes.HasPrefix(line, []byte("D ")):
+			data = assuanUnescape(data, line[2:])
+			clear(line)
+		}
+	}
+}
+
+// parseAssuanError turns the text after ERR into an error, ErrCanceled
+// when the user closed the dialog
+func parseAssuanError(text string) error {
+	codeText, message, _ := strings.Cut(text, " ")
+	code, _ := strconv.Atoi(codeText)
+	if code&0xffff == assuanCanceled {
+		return ErrCanceled
+	}
+	return &assuanError{code: code, message: message}
+}
+
+// assuanEscape percent-escapes the characters that cannot appear in a
+// command line. Newlines come out as %0A, which pinentry shows as line
+// breaks.
+func assuanEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '%', '\r', '\n':
+			fmt.Fprintf(&b, "%%%02X", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// assuanUnescape appends the percent-decoded data line to dst. It does not
+// use strconv or strings so that no copies of the passphrase are left
+// behind.
+func assuanUnescape(dst, line []byte) []byte {
+	for i := 0; i < len(line); i++ {
+		if line[i] == '%' && i+2 < len(line) {
+			if hi, ok := unhex(line[i+1]); ok {
+				if lo, ok := unhex(line[i+2]); ok {
+					dst = append(dst, hi<<4|lo)
+					i += 2
+					continue
+				}
+			}
+		}
+		dst = append(dst, line[i])
+	}
+	return dst
+}
+
+func unhex(c byte) (byte, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0', true
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10, true
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
@@ -0,0 +1,125 @@
+package prompt
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakePinentry writes a pinentry stand-in that logs every command it gets
+// and answers GETPIN and CONFIRM with the given response lines
+func fakePinentry(t *testing.T, reply string) (*Pinentry, func() string) {
+	dir := t.TempDir()
+	logFile := filepath.Join(dir, "commands.log")
+	script := `#!/bin/sh
+echo "OK Pleased to meet you"
+while read -r line; do
+	echo "$line" >> ` + logFile + `
+	case "$line" in
+	GETPIN|CONFIRM)
+		printf '` + reply + `'
+		;;
+	BYE)
+		echo "OK closing connection"
+		exit 0
+		;;
+	*)
+		echo "OK"
+		;;
+	esac
+done
+`
+	program := filepath.Join(dir, "pinentry")
+	if err := os.WriteFile(program, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	readLog := func() string {
+		data, _ := os.ReadFile(logFile)
+		return string(data)
+	}
+	return &Pinentry{Program: program}, readLog
+}
+
+func TestPinentry(t *testing.T) {
+	p, readLog := fakePinentry(t, `S PASSWORD_FROM_CACHE\n# typed\nD s3cr%%25t %%0Apart\nOK\n`)
+
+	pin, err := p.GetPassphrase(Request{
+		Title:       "Unlock BACKUP",
+		Description: "BACKUP (/dev/da0p1, 14.91 GB)\n100% encrypted",
+		Prompt:      "Password:",
+	})
+	if err != nil {
+		t.Fatalf("GetPassphrase failed: %v", err)
+	}
+	if string(pin) != "s3cr%t \npart" {
+		t.Errorf("GetPassphrase() = %q", pin)
+	}
+
+	want := "SETTITLE Unlock BACKUP\n" +
+		"SETDESC BACKUP (/dev/da0p1, 14.91 GB)%0A100%25 encrypted\n" +
+		"SETPROMPT Password:\n" +
+		"GETPIN\n" +
+		"BYE\n"
+	if got := readLog(); got != want {
+		t.Errorf("Sent %q, want %q", got, want)
+	}
+}
+
+func TestPinentryRetry(t *testing.T) {
+	p, readLog := fakePinentry(t, `D secret\nOK\n`)
+
+	if _, err := p.GetPassphrase(Request{Description: "BACKUP", Error: "Wrong password, try again"}); err != nil {
+		t.Fatalf("GetPassphrase failed: %v", err)
+	}
+	if got := readLog(); !strings.Contains(got, "SETERROR Wrong password, try again\nGETPIN\n") {
+		t.Errorf("Error text should be set before GETPIN, sent %q", got)
+	}
+}
+
+func TestPinentryCancel(t *testing.T) {
+	p, _ := fakePinentry(t, `ERR 83886179 Operation cancelled <Pinentry>\n`)
+
+	if _, err := p.GetPassphrase(Request{Description: "BACKUP"}); !errors.Is(err, ErrCanceled) {
+		t.Errorf("Expected ErrCanceled, got %v", err)
+	}
+
+	p, _ = fakePinentry(t, `ERR 83886142 Timeout <Pinentry>\n`)
+	if _, err := p.GetPassphrase(Request{Description: "BACKUP"}); err == nil || errors.Is(err, ErrCanceled) {
+		t.Errorf("A timeout is an error other than cancel, got %v", err)
+	}
+}
+
+func TestIsTerminal(t *testing.T) {
+	devNull, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devNull.Close()
+
+	if IsTerminal(devNull) {
+		t.Error("/dev/null is not a terminal")
+	}
+}
+
+func TestPinentryConfirm(t *testing.T) {
+	p, readLog := fakePinentry(t, `OK\n`)
+
+	req := Request{Description: "Remember the password of BACKUP?", OK: "Remember", Cancel: "Not Now"}
+	if yes, err := p.Confirm(req); err != nil || !yes {
+		t.Errorf("Confirm() = %v, %v", yes, err)
+	}
+	want := "SETDESC Remember the password of BACKUP?\nSETOK Remember\nSETCANCEL Not Now\nCONFIRM\nBYE\n"
+	if got := readLog(); got != want {
+		t.Errorf("Sent %q, want %q", got, want)
+	}
+
+	for _, reply := range []string{`ERR 83886194 Not confirmed <Pinentry>\n`, `ERR 83886179 Operation cancelled <Pinentry>\n`} {
+		p, _ := fakePinentry(t, reply)
+		if yes, err := p.Confirm(req); err != nil || yes {
+			t.Errorf("Confirm() = %v, %v after %q", yes, err, reply)
+		}
+	}
+}
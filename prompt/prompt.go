@@ -0,0 +1,79 @@
+package prompt
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// ErrCanceled is returned when the user dismisses the prompt
+var ErrCanceled = errors.New("prompt canceled")
+
+// Request describes a passphrase prompt
+type Request struct {
+	Title       string // Window title
+	Description string // What the passphrase unlocks, e.g. device label and size
+	Prompt      string // Label of the entry field
+	Error       string // Why the previous attempt failed, empty on the first one
+	OK          string // Label of the OK button, if not the default
+	Cancel      string // Label of the cancel button, if not the default
+}
+
+// Prompter asks the user for a passphrase. The caller zeroes the returned
+// passphrase once it is done with it.
+type Prompter interface {
+	GetPassphrase(req Request) ([]byte, error)
+	// Confirm asks a yes or no question, e.g. whether to remember a passphrase
+	Confirm(req Request) (bool, error)
+}
+
+// New returns a prompter using the given pinentry program, the one
+// configured for gpg-agent, or "pinentry" from PATH. Without any of them it
+// falls back to prompting on the terminal, if there is one.
+func New(program string) (Prompter, error) {
+	if program == "" {
+		program = gpgAgentPinentry()
+	}
+	if program == "" {
+		program = "pinentry"
+	}
+	if path, err := exec.LookPath(program); err == nil {
+		return &Pinentry{Program: path}, nil
+	}
+
+	if IsTerminal(os.Stdin) {
+		return &TTY{In: os.Stdin, Out: os.Stderr}, nil
+	}
+	return nil, fmt.Errorf("%s not found and not attached to a terminal (install pinentry or set password_cmd)", program)
+}
+
+// gpgAgentPinentry returns the pinentry-program set in gpg-agent.conf
+func gpgAgentPinentry() string {
+	home := os.Getenv("GNUPGHOME")
+	if home == "" {
+		userHome, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		home = filepath.Join(userHome, ".gnupg")
+	}
+
+	file, err := os.Open(filepath.Join(home, "gpg-agent.conf"))
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "pinentry-program" {
+			return fields[1]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,12 @@
+//go:build !linux && !freebsd
+
+package prompt
+
+import "os"
+
+// IsTerminal reports whether f is a character device, which is as close
+// to a terminal check as is portable
+func IsTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,75 @@
+package prompt
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// TTY prompts on a terminal, with echo turned off while the passphrase is
+// typed
+type TTY struct {
+	In  *os.File
+	Out io.Writer
+}
+
+// GetPassphrase prints the request and reads one line
+func (t *TTY) GetPassphrase(req Request) ([]byte, error) {
+	if req.Error != "" {
+		fmt.Fprintln(t.Out, req.Error)
+	}
+	if req.Description != "" {
+		fmt.Fprintln(t.Out, req.Description)
+	}
+	prompt := req.Prompt
+	if prompt == "" {
+		prompt = "Password:"
+	}
+	fmt.Fprintf(t.Out, "%s ", prompt)
+
+	if t.stty("-echo") == nil {
+		defer func() {
+			t.stty("echo")
+			fmt.Fprintln(t.Out)
+		}()
+	}
+
+	line, err := bufio.NewReader(t.In).ReadSlice('\n')
+	if err != nil && !(err == io.EOF && len(line) > 0) {
+		clear(line)
+		if err == io.EOF {
+			return nil, ErrCanceled
+		}
+		return nil, err
+	}
+	passphrase := append([]byte(nil), bytes.TrimRight(line, "\r\n")...)
+	clear(line)
+	return passphrase, nil
+}
+
+// Confirm prints the request and reads a yes or no answer
+func (t *TTY) Confirm(req Request) (bool, error) {
+	if req.Description != "" {
+		fmt.Fprintln(t.Out, req.Description)
+	}
+	fmt.Fprint(t.Out, "[y/N] ")
+
+	answer, err := bufio.NewReader(t.In).ReadString('\n')
+	if err != nil && answer == "" {
+		return false, err
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes", nil
+}
+
+// stty changes the mode of the terminal, there is no termios wrapper in
+// the standard library
+func (t *TTY) stty(mode string) error {
+	cmd := exec.Command("stty", mode)
+	cmd.Stdin = t.In
+	return cmd.Run()
+}
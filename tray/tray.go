@@ -6,6 +6,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
@@ -26,8 +27,11 @@ type Icon struct {
 	readyChan     chan struct{}
 	menuMutex     sync.Mutex
 	menuCloseChan chan struct{}
-	onMountFunc   func(dev *device.Device) error
-	onUnmountFunc func(dev *device.Device) error
+	snapshot      *device.Snapshot // Devices shown in the current menu
+	onMountFunc   func(dev device.Device) error
+	onUnmountFunc func(dev device.Device) error
+	onLockFunc    func(dev device.Device) error
+	onForgetFunc  func()
 	onQuitFunc    func()
 }
 
@@ -89,44 +93,57 @@ func (i *Icon) handleUpdates() {
 		case <-i.updateChan:
 			i.rebuildMenu()
 		case <-ticker.C:
-			i.rebuildMenu()
+			// Only rebuild when a device was added, removed or changed
+			i.refreshMenu(false)
 		}
 	}
 }
 
 // rebuildMenu rebuilds the entire menu
 func (i *Icon) rebuildMenu() {
+	i.refreshMenu(true)
+}
+
+// refreshMenu rescans devices and rebuilds the menu, unless force is false
+// and nothing changed since the last rebuild
+func (i *Icon) refreshMenu(force bool) {
 	// Lock to prevent concurrent menu modifications
 	i.menuMutex.Lock()
 	defer i.menuMutex.Unlock()
 
 	// Get current devices
-	devices, err := i.deviceMgr.Scan()
+	snap, err := i.deviceMgr.Snapshot()
 	if err != nil {
 		log.Printf("Failed to scan devices: %v", err)
 		return
 	}
+	if !force && len(device.Diff(i.snapshot, snap)) == 0 {
+		return
+	}
+	i.snapshot = snap
+
+	devices := snap.Devices()
 
 	// Filter for partitions, but also include whole disks if they have no partitions
-	displayDevices := []*device.Device{}
+	displayDevices := []device.Device{}
 	diskHasPartitions := make(map[string]bool)
 
-	// First pass: collect all partitions and track which disks have partitions
+	// First pass: collect all partitions and discs, and track which disks
+	// have partitions
 	for _, dev := range devices {
-		if dev.IsPartition && dev.IsRemovable {
+		if dev.IsMountable() && dev.IsRemovable {
 			displayDevices = append(displayDevices, dev)
-			// Extract parent disk name (e.g., "da0" from "da0p1")
-			parentDisk := getParentDiskName(dev.Name)
-			if parentDisk != "" {
-				diskHasPartitions[parentDisk] = true
+			if dev.Parent != "" {
+				diskHasPartitions[dev.Parent] = true
 			}
 		}
 	}
 
-	// Second pass: add whole disks that don't have partitions
+	// Second pass: add whole disks that don't have partitions, including
+	// empty card readers and optical drives
 	for _, dev := range devices {
-		if !dev.IsPartition && dev.IsRemovable {
-			if !diskHasPartitions[dev.Name] {
+		if !dev.IsMountable() && dev.IsRemovable {
+			if !diskHasPartitions[dev.Path] {
 				displayDevices = append(displayDevices, dev)
 				log.Printf("Adding unpartitioned disk to tray: %s", dev.Name)
 			}
@@ -167,6 +184,16 @@ func (i *Icon) rebuildMenu() {
 	mUnmountAll := systray.AddMenuItem("Unmount All", "Unmount all mounted devices")
 	go i.handleMenuItem(mUnmountAll, menuCloseChan, func() { i.onUnmountAll() })
 
+	// Add "Mount Image..."
+	mMountImage := systray.AddMenuItem("Mount Image…", "Mount a disk image or ISO file")
+	go i.handleMenuItem(mMountImage, menuCloseChan, func() { i.onMountImage() })
+
+	// Add "Forget Passwords" when passwords are cached
+	if i.config.Encryption.CacheTimeout > 0 {
+		mForget := systray.AddMenuItem("Forget Passwords", "Forget cached passwords of encrypted devices")
+		go i.handleMenuItem(mForget, menuCloseChan, func() { i.onForgetPasswords() })
+	}
+
 	systray.AddSeparator()
 
 	// Add "Refresh"
@@ -190,7 +217,7 @@ func (i *Icon) rebuildMenu() {
 }
 
 // addDeviceMenuItems adds device-specific menu items
-func (i *Icon) addDeviceMenuItems(devices []*device.Device, menuCloseChan chan struct{}) {
+func (i *Icon) addDeviceMenuItems(devices []device.Device, menuCloseChan chan struct{}) {
 	for _, dev := range devices {
 		// Create a copy for the closure
 		device := dev
@@ -201,21 +228,36 @@ func (i *Icon) addDeviceMenuItems(devices []*device.Device, menuCloseChan chan s
 			displayName += " ●"
 		}
 
-		// Mark whole disks (unpartitioned) with a special indicator
-		if !device.IsPartition {
+		// Mark empty drives and whole disks (unpartitioned) with a special indicator
+		if !device.MediaPresent {
+			displayName += " [No Media]"
+		} else if !device.IsMountable() {
 			displayName += " [Raw Disk]"
 		}
 
 		mDevice := systray.AddMenuItem(displayName, device.Path)
 
-		// Handle whole disk vs partition differently
-		if !device.IsPartition {
-			// Whole disk (no partitions) - can't be mounted directly
-			mInfo := mDevice.AddSubMenuItem("No partitions found", "This disk has no partition table")
+		// Handle empty drives, whole disks and partitions differently
+		if !device.MediaPresent {
+			// Card reader or optical drive waiting for media
+			mDevice.AddSubMenuItem("No media inserted", "Insert a disc or card").Disable()
+			if device.IsOptical {
+				mEject := mDevice.AddSubMenuItem("Open Tray", "Open the drive tray")
+				go i.handleMenuItem(mEject, menuCloseChan, func() { i.onEjectDevice(device) })
+			}
+		} else if !device.IsMountable() {
+			// Whole disk with neither partitions nor a filesystem of its own
+			mInfo := mDevice.AddSubMenuItem("No filesystem found", "This disk has no partitions or filesystem")
 			mInfo.Disable()
 			mDevice.AddSubMenuItem("Format/partition this disk using Disk Utility", "Use gpart or other tools").Disable()
 		} else if device.IsMounted {
 			// Mounted partition
+			// Show how full the filesystem is
+			if device.Total > 0 {
+				mDevice.AddSubMenuItem(fmt.Sprintf("%s free of %s", formatSize(device.Free), formatSize(device.Total)),
+					"Free space").Disable()
+			}
+
 			// Add "Open" option
 			mOpen := mDevice.AddSubMenuItem("Open in File Manager", "Open device in file manager")
 			go i.handleMenuItem(mOpen, menuCloseChan, func() { i.onOpenDevice(device) })
@@ -230,10 +272,29 @@ func (i *Icon) addDeviceMenuItems(devices []*device.Device, menuCloseChan chan s
 				go i.handleMenuItem(mEject, menuCloseChan, func() { i.onEjectDevice(device) })
 			}
 		} else {
-			// Unmounted partition
+			// Unmounted partition or disc
 			// Add "Mount" option
-			mMount := mDevice.AddSubMenuItem("Mount", "Mount device")
+			title, tooltip := "Mount", "Mount device"
+			if device.MaybeVeraCrypt && !device.IsUnlocked {
+				// No signature to go by, so only the user knows
+				title, tooltip = "Unlock as VeraCrypt Volume", "Unlock as a VeraCrypt or TrueCrypt volume and mount it"
+			} else if device.IsEncrypted && !device.IsUnlocked {
+				title, tooltip = "Unlock and Mount", "Unlock the encrypted device and mount it"
+			}
+			mMount := mDevice.AddSubMenuItem(title, tooltip)
 			go i.handleMenuItem(mMount, menuCloseChan, func() { i.onMountDevice(device) })
+
+			// Unlocked devices can be locked again
+			if device.IsEncrypted && device.IsUnlocked {
+				mLock := mDevice.AddSubMenuItem("Lock", "Unmount and lock the encrypted device")
+				go i.handleMenuItem(mLock, menuCloseChan, func() { i.onLockDevice(device) })
+			}
+
+			// Discs can be ejected without mounting them first
+			if device.IsOptical {
+				mEject := mDevice.AddSubMenuItem("Eject", "Eject disc")
+				go i.handleMenuItem(mEject, menuCloseChan, func() { i.onEjectDevice(device) })
+			}
 		}
 
 		// Add device info
@@ -296,15 +357,25 @@ func (i *Icon) Close() {
 }
 
 // SetMountCallback sets the callback for mounting devices
-func (i *Icon) SetMountCallback(fn func(dev *device.Device) error) {
+func (i *Icon) SetMountCallback(fn func(dev device.Device) error) {
 	i.onMountFunc = fn
 }
 
 // SetUnmountCallback sets the callback for unmounting devices
-func (i *Icon) SetUnmountCallback(fn func(dev *device.Device) error) {
+func (i *Icon) SetUnmountCallback(fn func(dev device.Device) error) {
 	i.onUnmountFunc = fn
 }
 
+// SetLockCallback sets the callback for locking encrypted devices
+func (i *Icon) SetLockCallback(fn func(dev device.Device) error) {
+	i.onLockFunc = fn
+}
+
+// SetForgetPasswordsCallback sets the callback for forgetting cached passwords
+func (i *Icon) SetForgetPasswordsCallback(fn func()) {
+	i.onForgetFunc = fn
+}
+
 // SetQuitCallback sets the callback for quit action
 func (i *Icon) SetQuitCallback(fn func()) {
 	i.onQuitFunc = fn
@@ -312,7 +383,7 @@ func (i *Icon) SetQuitCallback(fn func()) {
 
 // Menu action handlers
 
-func (i *Icon) onMountDevice(dev *device.Device) {
+func (i *Icon) onMountDevice(dev device.Device) {
 	log.Printf("Tray: Mount device %s", dev.Path)
 
 	if i.onMountFunc != nil {
@@ -336,7 +407,7 @@ func (i *Icon) onMountDevice(dev *device.Device) {
 	}
 }
 
-func (i *Icon) onUnmountDevice(dev *device.Device) {
+func (i *Icon) onUnmountDevice(dev device.Device) {
 	log.Printf("Tray: Unmount device %s", dev.Path)
 
 	if i.onUnmountFunc != nil {
@@ -360,11 +431,38 @@ func (i *Icon) onUnmountDevice(dev *device.Device) {
 	}
 }
 
-func (i *Icon) onEjectDevice(dev *device.Device) {
+func (i *Icon) onLockDevice(dev device.Device) {
+	log.Printf("Tray: Lock device %s", dev.Path)
+
+	// The daemon announces the lock itself, pgumount does not
+	var err error
+	announce := false
+	if i.onLockFunc != nil {
+		err = i.onLockFunc(dev)
+	} else {
+		// Fallback: call pgumount command
+		err = exec.Command("pgumount", "--lock", dev.Path).Run()
+		announce = true
+	}
+
+	if err != nil {
+		log.Printf("Failed to lock %s: %v", dev.GetDisplayName(), err)
+		i.showNotification("Lock Failed", fmt.Sprintf("Failed to lock %s: %v", dev.GetDisplayName(), err))
+	} else {
+		if announce {
+			i.showNotification("Device Locked", fmt.Sprintf("%s locked", dev.GetDisplayName()))
+		}
+		i.UpdateDevices()
+	}
+}
+
+func (i *Icon) onEjectDevice(dev device.Device) {
 	log.Printf("Tray: Eject device %s", dev.Path)
 
-	// First unmount
-	i.onUnmountDevice(dev)
+	// First unmount, discs can be ejected without being mounted
+	if dev.IsMounted {
+		i.onUnmountDevice(dev)
+	}
 
 	// Then eject
 	cmd := exec.Command("pgumount", "--detach", dev.Path)
@@ -377,7 +475,7 @@ func (i *Icon) onEjectDevice(dev *device.Device) {
 	}
 }
 
-func (i *Icon) onOpenDevice(dev *device.Device) {
+func (i *Icon) onOpenDevice(dev device.Device) {
 	log.Printf("Tray: Open device %s", dev.Path)
 
 	if dev.MountPoint == "" {
@@ -435,7 +533,7 @@ func (i *Icon) onMountAll() {
 
 	mounted := 0
 	for _, dev := range devices {
-		if dev.IsPartition && !dev.IsMounted && dev.IsRemovable {
+		if dev.IsMountable() && !dev.IsMounted && dev.IsRemovable {
 			if i.onMountFunc != nil {
 				if err := i.onMountFunc(dev); err != nil {
 					log.Printf("Failed to mount %s: %v", dev.Path, err)
@@ -464,7 +562,7 @@ func (i *Icon) onUnmountAll() {
 
 	unmounted := 0
 	for _, dev := range devices {
-		if dev.IsPartition && dev.IsMounted && dev.IsRemovable {
+		if dev.IsMountable() && dev.IsMounted && dev.IsRemovable {
 			if i.onUnmountFunc != nil {
 				if err := i.onUnmountFunc(dev); err != nil {
 					log.Printf("Failed to unmount %s: %v", dev.Path, err)
@@ -482,6 +580,51 @@ func (i *Icon) onUnmountAll() {
 	}
 }
 
+func (i *Icon) onMountImage() {
+	log.Println("Tray: Mount Image clicked")
+
+	path, err := chooseImageFile()
+	if err != nil {
+		log.Printf("Failed to choose image: %v", err)
+		i.showNotification("Mount Failed", fmt.Sprintf("Failed to choose image: %v", err))
+		return
+	}
+	if path == "" {
+		// Dialog was cancelled
+		return
+	}
+
+	output, err := exec.Command("pgmount", "--image", path).CombinedOutput()
+	if err != nil {
+		log.Printf("Failed to mount image %s: %v (output: %s)", path, err, output)
+		i.showNotification("Mount Failed", fmt.Sprintf("Failed to mount %s: %s", filepath.Base(path),
+			strings.TrimSpace(string(output))))
+		return
+	}
+
+	i.showNotification("Image Mounted", fmt.Sprintf("%s mounted successfully", filepath.Base(path)))
+	i.UpdateDevices()
+}
+
+func (i *Icon) onForgetPasswords() {
+	log.Println("Tray: Forget Passwords clicked")
+
+	var err error
+	if i.onForgetFunc != nil {
+		i.onForgetFunc()
+	} else {
+		// Fallback: ask pgmountd through pgumount
+		err = exec.Command("pgumount", "--forget-passwords").Run()
+	}
+
+	if err != nil {
+		log.Printf("Failed to forget passwords: %v", err)
+		i.showNotification("Forget Passwords Failed", fmt.Sprintf("Failed to forget passwords: %v", err))
+	} else {
+		i.showNotification("Passwords Forgotten", "Cached passwords were cleared")
+	}
+}
+
 func (i *Icon) onRefresh() {
 	log.Println("Tray: Refresh clicked")
 	i.UpdateDevices()
@@ -512,6 +655,33 @@ func (i *Icon) showNotification(title, message string) {
 	}
 }
 
+// chooseImageFile asks for an image file with zenity or kdialog and returns
+// "" if the dialog was cancelled
+func chooseImageFile() (string, error) {
+	dialogs := [][]string{
+		{"zenity", "--file-selection", "--title=Mount Image",
+			"--file-filter=Disk images | *.iso *.img *.raw *.udf", "--file-filter=All files | *"},
+		{"kdialog", "--title", "Mount Image", "--getopenfilename", ".", "*.iso *.img *.raw *.udf"},
+	}
+
+	for _, dialog := range dialogs {
+		if _, err := exec.LookPath(dialog[0]); err != nil {
+			continue
+		}
+		output, err := exec.Command(dialog[0], dialog[1:]...).Output()
+		if err != nil {
+			// Both exit with status 1 when cancelled
+			if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+				return "", nil
+			}
+			return "", err
+		}
+		return strings.TrimSpace(string(output)), nil
+	}
+
+	return "", fmt.Errorf("no file dialog available, install zenity or kdialog")
+}
+
 func formatSize(bytes uint64) string {
 	const (
 		KB = 1024
@@ -534,28 +704,6 @@ func formatSize(bytes uint64) string {
 	}
 }
 
-// getParentDiskName extracts the parent disk name from a partition name
-// For example: "da0p1" -> "da0", "ada0s1" -> "ada0"
-func getParentDiskName(partitionName string) string {
-	// Handle common FreeBSD partition naming schemes:
-	// - da0p1, da0p2 (GPT partitions)
-	// - da0s1, da0s2 (MBR slices)
-	// - ada0p1, ada0p2
-	// - mmcsd0s1, etc.
-
-	// Find the first occurrence of 'p' or 's' followed by a digit
-	for i := 0; i < len(partitionName); i++ {
-		if (partitionName[i] == 'p' || partitionName[i] == 's') && i > 0 {
-			// Check if next character is a digit
-			if i+1 < len(partitionName) && partitionName[i+1] >= '0' && partitionName[i+1] <= '9' {
-				return partitionName[:i]
-			}
-		}
-	}
-
-	return ""
-}
-
 // getIcon returns the icon data for the tray
 func getIcon() []byte {
 	// Simple drive icon as PNG (embedded as base64 or bytes)